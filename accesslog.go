@@ -0,0 +1,96 @@
+package styx
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogRequests returns a Handler that passes each request to handler,
+// and writes a line to logger once it is answered, in the form
+//
+//	user="glenda" aname="" type=Topen path="/lib/profile" result=ok latency=1.2ms
+//
+// The result is "ok", or the error sent to the client. A request
+// that is flushed, times out or is otherwise cancelled before it is
+// answered is logged with the error of its context, such as
+// "context canceled".
+// Each Twalk and Twstat is logged as the requests it is split into,
+// with the latency of the whole message.
+func LogRequests(handler Handler, logger Logger) Handler {
+	return Stack(requestLogger{logger}, handler)
+}
+
+type requestLogger struct {
+	logger Logger
+}
+
+// accessKey is the context key for the *accessRecord of a request
+// whose result is being watched, by LogRequests or Quota.
+type accessKey struct{}
+
+type accessRecord struct {
+	mu       sync.Mutex
+	err      error
+	answered bool
+	outer    *accessRecord // of a handler further up the stack
+}
+
+// watchResult returns a context for a request, and a record that
+// holds whether it was answered, and the error it is answered with,
+// if any, once the context is done.
+func watchResult(ctx context.Context) (context.Context, *accessRecord) {
+	rec := new(accessRecord)
+	rec.outer, _ = ctx.Value(accessKey{}).(*accessRecord)
+	return context.WithValue(ctx, accessKey{}, rec), rec
+}
+
+// recordResult notes that the request with ctx was answered, with
+// err as its result, if it is being watched. It must be called before
+// the tag of the request is cleared.
+func recordResult(ctx context.Context, err error) {
+	rec, _ := ctx.Value(accessKey{}).(*accessRecord)
+	for ; rec != nil; rec = rec.outer {
+		rec.mu.Lock()
+		if rec.err == nil {
+			rec.err = err
+		}
+		rec.answered = true
+		rec.mu.Unlock()
+	}
+}
+
+// result reports whether the request was answered, rather than
+// flushed or cancelled, and the error it was answered with.
+func (rec *accessRecord) result() (answered bool, err error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.answered, rec.err
+}
+
+func (l requestLogger) Serve9P(s *Session) {
+	for s.Next() {
+		req := s.Request()
+		ctx, rec := watchResult(req.Context())
+		s.UpdateRequest(req.WithContext(ctx))
+
+		start := time.Now()
+		user, aname := s.User, s.Access
+		reqType := strings.TrimPrefix(fmt.Sprintf("%T", req), "styx.")
+		go func() {
+			// The context of a request is cancelled once its
+			// response is sent.
+			<-ctx.Done()
+			result := "ok"
+			if answered, err := rec.result(); !answered {
+				result = fmt.Sprintf("%q", ctx.Err().Error())
+			} else if err != nil {
+				result = fmt.Sprintf("%q", err.Error())
+			}
+			l.logger.Printf("user=%q aname=%q type=%s path=%q result=%s latency=%s",
+				user, aname, reqType, req.Path(), result, time.Since(start))
+		}()
+	}
+}
@@ -1,7 +1,9 @@
 package styx
 
 import (
+	"crypto/tls"
 	"io"
+	"net"
 
 	"context"
 )
@@ -10,7 +12,10 @@ import (
 // channel between the client and server, along with any contextual
 // information recorded by the server. Of note is the "conn" value,
 // which returns the underlying net.Conn value for the network
-// connection.
+// connection. The RemoteAddr, LocalAddr and TLSState methods
+// describe the connection, so that authentication methods can
+// check where a client connects from, or bind credentials to the
+// transport.
 type Channel struct {
 	context.Context
 	io.ReadWriteCloser
@@ -21,6 +26,27 @@ func (ch *Channel) Conn() interface{} {
 	return ch.Value("conn")
 }
 
+// RemoteAddr returns the network address of the other end of the
+// connection underlying a Channel, or nil if it does not have one.
+func (ch *Channel) RemoteAddr() net.Addr {
+	return remoteAddr(ch.Conn())
+}
+
+// LocalAddr returns the local network address of the connection
+// underlying a Channel, or nil if it does not have one.
+func (ch *Channel) LocalAddr() net.Addr {
+	return localAddr(ch.Conn())
+}
+
+// TLSState returns the state of the TLS connection underlying a
+// Channel, or nil if the connection does not use TLS. Authentication
+// methods may use it to bind credentials to the TLS session, with
+// the connection state's ExportKeyingMaterial method or its
+// TLSUnique field.
+func (ch *Channel) TLSState() *tls.ConnectionState {
+	return tlsState(ch.Conn())
+}
+
 // An AuthFunc is used to authenticate a user to a 9P server. The
 // authentication protocol itself is tunnelled over 9P via read and
 // write operations to a special file, and is outside the scope of the
@@ -35,6 +61,10 @@ func (ch *Channel) Conn() interface{} {
 // to authenticate based on TLS certificates, unix uid values (on a
 // unix socket), etc.
 //
+// A client may also attach without making a Tauth request. In that
+// case the AuthFunc is called with a Channel whose reads and writes
+// fail, and must decide based on the connection alone.
+//
 // An AuthFunc must return a non-nil error if authentication fails.
 // The error may be sent to the client and should not contain any
 // sensitive information. If authentication succeeds, an AuthFunc
@@ -42,3 +72,11 @@ func (ch *Channel) Conn() interface{} {
 //
 // Existing AuthFunc implementations can be found in the styxauth package.
 type AuthFunc func(rwc *Channel, user, access string) error
+
+// A noAuthFile stands in for the auth file of a Channel when a
+// client attaches without one. It cannot be read or written.
+type noAuthFile struct{}
+
+func (noAuthFile) Read([]byte) (int, error)  { return 0, errNoAuthFile }
+func (noAuthFile) Write([]byte) (int, error) { return 0, errNoAuthFile }
+func (noAuthFile) Close() error              { return nil }
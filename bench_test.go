@@ -0,0 +1,138 @@
+package styx
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"aqwari.net/net/styx/internal/netutil"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A benchClient drives a single 9P connection to a Server over
+// an in-memory pipe, one request at a time, so that benchmarks
+// measure the server's per-request overhead rather than the
+// client's.
+type benchClient struct {
+	b    *testing.B
+	conn net.Conn
+	enc  *styxproto.Encoder
+	dec  *styxproto.Decoder
+}
+
+func newBenchClient(b *testing.B, handler Handler) *benchClient {
+	var ln netutil.PipeListener
+	srv := Server{Handler: handler}
+	go srv.Serve(&ln)
+
+	conn, err := ln.Dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := &benchClient{
+		b:    b,
+		conn: conn,
+		enc:  styxproto.NewEncoder(conn),
+		dec:  styxproto.NewDecoder(conn),
+	}
+	c.enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+	c.expect("Tversion", c.next())
+	c.enc.Tattach(0, 0, styxproto.NoFid, "", "")
+	c.expect("Tattach", c.next())
+	return c
+}
+
+// next flushes any pending requests and waits for a response.
+func (c *benchClient) next() styxproto.Msg {
+	if err := c.enc.Flush(); err != nil {
+		c.b.Fatal(err)
+	}
+	if !c.dec.Next() {
+		c.b.Fatalf("connection closed: %v", c.dec.Err())
+	}
+	return c.dec.Msg()
+}
+
+func (c *benchClient) expect(req string, rsp styxproto.Msg) {
+	if r, ok := rsp.(styxproto.Rerror); ok {
+		c.b.Fatalf("%s failed: %s", req, r.Ename())
+	}
+}
+
+func (c *benchClient) close() {
+	c.conn.Close()
+}
+
+// benchFS serves a single file, "file", whose contents are data,
+// beneath an otherwise empty root directory.
+type benchFS struct {
+	data []byte
+}
+
+func (fs benchFS) Serve9P(s *Session) {
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Twalk:
+			req.Rwalk(emptyStatFile("file"), nil)
+		case Topen:
+			req.Ropen(bytes.NewReader(fs.data), nil)
+		case Tstat:
+			if req.Path() == "/" {
+				req.Rstat(emptyStatDir("/"), nil)
+			} else {
+				req.Rstat(emptyStatFile("file"), nil)
+			}
+		}
+	}
+}
+
+func BenchmarkServeSmallStats(b *testing.B) {
+	c := newBenchClient(b, benchFS{})
+	defer c.close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.enc.Tstat(1, 0)
+		c.expect("Tstat", c.next())
+	}
+}
+
+func BenchmarkServeLargeReads(b *testing.B) {
+	const readSize = 64 << 10
+	c := newBenchClient(b, benchFS{data: make([]byte, readSize)})
+	defer c.close()
+
+	c.enc.Twalk(1, 0, 1, "file")
+	c.expect("Twalk", c.next())
+	c.enc.Topen(1, 1, styxproto.OREAD)
+	c.expect("Topen", c.next())
+
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.enc.Tread(1, 1, 0, readSize)
+		rsp := c.next()
+		c.expect("Tread", rsp)
+		if r, ok := rsp.(io.Reader); ok {
+			io.Copy(ioutil.Discard, r)
+		}
+	}
+}
+
+func BenchmarkManyFids(b *testing.B) {
+	c := newBenchClient(b, benchFS{})
+	defer c.close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Walks accumulate fids in the connection and session
+		// maps without clunking them.
+		c.enc.Twalk(1, 0, uint32(i+1), "file")
+		c.expect("Twalk", c.next())
+	}
+}
@@ -0,0 +1,274 @@
+package styx
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Cache is a Handler that remembers the responses its Handler gives
+// to Tstat and Tread requests, and answers the same requests from
+// memory, so that files whose contents or metadata are expensive to
+// compute are not computed again for every client. Tread requests
+// only reach a Cache if the HandleReads option of the Server is set,
+// and only reads answered with Rread are cached.
+//
+// Responses are remembered by the file tree (the Access field of the
+// Session) and the path of the file, and reads also by their offset
+// and count. Requests that modify a file through the Cache, such as
+// Twstat or Tremove, forget the responses for that file, as do
+// writes to a file opened through the Cache, and truncating it;
+// renaming a directory forgets the files beneath it. A Handler can
+// call the SetQid method of a Session to bump the version of a file
+// that has changed by other means, so that it is no longer answered
+// from the cache on any connection.
+//
+// A Cache is shared by all of the sessions it serves, and answers
+// them regardless of their user; handlers that check permissions
+// should be placed in front of it.
+type Cache struct {
+	// Handler answers the requests that are not in the cache.
+	Handler Handler
+
+	// TTL is how long a response is remembered. Zero means
+	// responses are remembered until they are evicted.
+	TTL time.Duration
+
+	// MaxBytes is the number of bytes of file data the cache
+	// may hold. Zero means no limit.
+	MaxBytes int64
+
+	// MaxEntries is the number of responses the cache may hold.
+	// Zero means no limit.
+	MaxEntries int
+
+	mu      sync.Mutex
+	size    int64
+	lru     list.List // of *cacheEntry, least recently used last
+	entries map[cacheFile]map[cacheKey]*list.Element
+	gen     map[cacheFile]uint64 // bumped each time a file is forgotten
+}
+
+// A cacheFile identifies a file in one of the trees a Cache serves.
+type cacheFile struct {
+	access, path string
+}
+
+type cacheKey struct {
+	cacheFile
+	gen    uint64
+	offset int64 // -1 for Tstat
+	count  int
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{} // os.FileInfo, styxproto.Stat or []byte
+	added time.Time
+}
+
+func (c *Cache) Serve9P(s *Session) {
+	Stack(cacheLookup{c}, c.Handler).Serve9P(s)
+}
+
+// key returns the key for the responses to requests for the file at
+// path in the tree access.
+func (c *Cache) key(access, path string) cacheKey {
+	f := cacheFile{access, path}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheKey{cacheFile: f, gen: c.gen[f], offset: -1}
+}
+
+func (c *Cache) get(key cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key.cacheFile][key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.TTL > 0 && time.Since(e.added) > c.TTL {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache) put(key cacheKey, value interface{}) {
+	size := cacheSize(value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.MaxBytes > 0 && size > c.MaxBytes {
+		return
+	}
+	if key.gen != c.gen[key.cacheFile] {
+		// The file was forgotten while the response was made.
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[cacheFile]map[cacheKey]*list.Element)
+	}
+	file := c.entries[key.cacheFile]
+	if file == nil {
+		file = make(map[cacheKey]*list.Element)
+		c.entries[key.cacheFile] = file
+	}
+	if el, ok := file[key]; ok {
+		c.remove(el)
+	}
+	file[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, added: time.Now()})
+	c.size += size
+	for (c.MaxBytes > 0 && c.size > c.MaxBytes) || (c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// forget removes the responses for the file at path in the tree
+// access, and any responses to requests for it still in progress.
+func (c *Cache) forget(access, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgetFile(cacheFile{access, path})
+}
+
+// forgetTree is forget for the directory at path and every file
+// beneath it.
+func (c *Cache) forgetTree(access, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var under []cacheFile
+	for f := range c.entries {
+		if f.access == access && strings.HasPrefix(f.path, prefix) {
+			under = append(under, f)
+		}
+	}
+	for f := range c.gen {
+		if f.access == access && strings.HasPrefix(f.path, prefix) {
+			under = append(under, f)
+		}
+	}
+	c.forgetFile(cacheFile{access, path})
+	for _, f := range under {
+		c.forgetFile(f)
+	}
+}
+
+// forgetFile is forget, for callers holding c.mu.
+func (c *Cache) forgetFile(f cacheFile) {
+	if c.gen == nil {
+		c.gen = make(map[cacheFile]uint64)
+	}
+	c.gen[f]++
+	for _, el := range c.entries[f] {
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	file := c.entries[e.key.cacheFile]
+	delete(file, e.key)
+	if len(file) == 0 {
+		delete(c.entries, e.key.cacheFile)
+	}
+	c.size -= cacheSize(e.value)
+}
+
+// cacheSize returns the number of bytes of file data in a response.
+func cacheSize(value interface{}) int64 {
+	if p, ok := value.([]byte); ok {
+		return int64(len(p))
+	}
+	return 0
+}
+
+// forgetWrites returns a context for a Topen or Tcreate request, such
+// that the responses for the file at path are forgotten once it is
+// opened, in case the handler truncated it, and after each write.
+func (c *Cache) forgetWrites(ctx context.Context, access, path string) context.Context {
+	return wrapOpen(ctx, func(f styxfile.Interface) styxfile.Interface {
+		c.forget(access, path)
+		return styxfile.OnWrite(f, func() { c.forget(access, path) })
+	})
+}
+
+// fill returns a context for a request whose response should be
+// kept in the cache under key.
+func (c *Cache) fill(ctx context.Context, key cacheKey) context.Context {
+	return context.WithValue(ctx, fillKey{}, func(value interface{}) {
+		c.put(key, value)
+	})
+}
+
+// fillKey is the context key for a function that receives the
+// response to a Tstat or Tread request.
+type fillKey struct{}
+
+// fillCache passes the response to a request to the function attached
+// to ctx with fillKey, if any.
+func fillCache(ctx context.Context, value interface{}) {
+	if fn, ok := ctx.Value(fillKey{}).(func(interface{})); ok {
+		fn(value)
+	}
+}
+
+// cacheLookup answers the requests that are in the cache of a Cache,
+// leaving the rest for the next handler in a stack.
+type cacheLookup struct {
+	*Cache
+}
+
+func (c cacheLookup) Serve9P(s *Session) {
+	s.conn.watchQids(c.Cache)
+	for s.Next() {
+		req := s.Request()
+		key := c.key(s.Access, req.Path())
+		switch req := req.(type) {
+		case Tstat:
+			switch v, _ := c.get(key); v := v.(type) {
+			case os.FileInfo:
+				req.Rstat(v, nil)
+				continue
+			case styxproto.Stat:
+				req.RstatRaw(v, nil)
+				continue
+			}
+		case Tread:
+			key.offset, key.count = req.Offset, req.Count
+			if v, ok := c.get(key); ok {
+				req.Rread(v.([]byte))
+				continue
+			}
+		case Topen:
+			if modifies(req) {
+				c.forget(s.Access, key.path)
+				s.UpdateRequest(req.WithContext(c.forgetWrites(req.Context(), s.Access, key.path)))
+			}
+			continue
+		case Tcreate:
+			c.forget(s.Access, key.path)
+			s.UpdateRequest(req.WithContext(c.forgetWrites(req.Context(), s.Access, req.NewPath())))
+			continue
+		case Trename:
+			// Renaming a directory moves the files beneath it.
+			c.forgetTree(s.Access, req.OldPath)
+			c.forgetTree(s.Access, req.NewPath)
+			continue
+		default:
+			if modifies(req) {
+				c.forget(s.Access, key.path)
+			}
+			continue
+		}
+		s.UpdateRequest(req.WithContext(c.fill(req.Context(), key)))
+	}
+}
@@ -0,0 +1,417 @@
+package styx
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Client is a 9P client, used to make remote requests to a 9P server.
+// The zero value of a Client is a usable 9P client that uses default
+// settings chosen by the styx package.
+type Client struct {
+	// The maximum size of a single 9P message. When working with
+	// very large files, a larger MaxSize can reduce protocol overhead.
+	// The server may choose a smaller size during version negotiation.
+	// If zero, styxproto.DefaultMaxSize is used.
+	MaxSize int64
+
+	// The Client will use the Auth function to authenticate its
+	// sessions. The Channel passed to Auth reads and writes the
+	// authentication file established by a Tauth request, and its
+	// Conn method returns the network connection. If Auth is nil,
+	// no authentication is performed.
+	Auth AuthFunc
+
+	// Timeout specifies the amount of time to wait for a response
+	// from the server. Note that Timeout does not apply to Read
+	// requests, to avoid interfering with long-poll or message
+	// queue-like interfaces, where a client issues a Read request
+	// for data that has not arrived yet. When a request times out,
+	// it is flushed, and the error returned satisfies os.IsTimeout
+	// and errors.Is(err, os.ErrDeadlineExceeded). If zero, the Client
+	// waits indefinitely.
+	Timeout time.Duration
+
+	// TLSConfig is used when connecting to a 9P server over TLS.
+	TLSConfig *tls.Config
+
+	// Dialer, if not nil, is used to open network connections to
+	// 9P servers, in place of a net.Dialer. For tls URLs, the TLS
+	// handshake is run over the connection returned by Dialer. The
+	// network is "tcp" or "unix", but Dialer is free to interpret
+	// the address in any way, for instance to tunnel the connection
+	// through a proxy.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// If Reconnect is true, a File survives the loss of its
+	// connection to the server. The Client dials the server again,
+	// with exponential backoff, and opens the File again once
+	// connected. Requests made while the connection is down fail
+	// with an error whose Temporary method returns true, and may
+	// be retried.
+	Reconnect bool
+
+	// Requests to the same server, as the same user, share a
+	// connection for as long as any Files are open or any requests
+	// are in progress.
+	conns connCache
+}
+
+// DefaultClient is the Client used by the top-level Open function.
+var DefaultClient = &Client{}
+
+// Open opens a file on a remote 9P server for reading, using
+// DefaultClient. See the Open method of Client for the format of uri.
+func Open(uri string) (*File, error) {
+	return DefaultClient.Open(uri)
+}
+
+// Open opens a file on a remote 9P server for reading. The uri must be
+// of the form
+//
+//	tcp://[user@]host[:port]/path/to/file
+//	tls://[user@]host[:port]/path/to/file
+//
+// If no port is given, the standard 9P port, 564, is used. If no user
+// is given, the name of the current user is sent to the server.
+//
+// The uri may also be a Plan 9 dial string, optionally followed by
+// the path of the file, or the path of a unix socket, to open the
+// root of the server's file tree:
+//
+//	tcp!host!port!/path/to/file
+//	unix!/path/to/socket!/path/to/file
+//	/path/to/socket
+func (c *Client) Open(uri string) (*File, error) {
+	return c.OpenFile(uri, os.O_RDONLY)
+}
+
+// OpenFile is like Open, but opens the file with the access mode in
+// flag, which is one of os.O_RDONLY, os.O_WRONLY or os.O_RDWR, optionally
+// combined with os.O_TRUNC.
+func (c *Client) OpenFile(uri string, flag int) (*File, error) {
+	return c.OpenFileContext(context.Background(), uri, flag)
+}
+
+// OpenContext is like Open, but connecting to the server and opening
+// the file is abandoned if ctx is cancelled. Once the File is open,
+// ctx has no effect on it.
+func (c *Client) OpenContext(ctx context.Context, uri string) (*File, error) {
+	return c.OpenFileContext(ctx, uri, os.O_RDONLY)
+}
+
+// OpenFileContext is like OpenFile, but connecting to the server and
+// opening the file is abandoned if ctx is cancelled.
+func (c *Client) OpenFileContext(ctx context.Context, uri string, flag int) (*File, error) {
+	cc, name, err := c.connect(ctx, uri, "open")
+	if err != nil {
+		return nil, err
+	}
+	defer cc.release()
+	return cc.open(ctx, name, flag)
+}
+
+// Create creates the file at uri, with mode 0666, and opens it for
+// reading and writing. If the file already exists, it is truncated.
+func (c *Client) Create(uri string) (*File, error) {
+	ctx := context.Background()
+	cc, name, err := c.connect(ctx, uri, "create")
+	if err != nil {
+		return nil, err
+	}
+	defer cc.release()
+	return cc.createFile(ctx, name)
+}
+
+// Mkdir creates a new directory at uri, with the permission bits
+// in perm.
+func (c *Client) Mkdir(uri string, perm os.FileMode) error {
+	ctx := context.Background()
+	cc, name, err := c.connect(ctx, uri, "mkdir")
+	if err != nil {
+		return err
+	}
+	defer cc.release()
+	return cc.mkdir(ctx, name, perm)
+}
+
+// Remove removes the file or empty directory at uri.
+func (c *Client) Remove(uri string) error {
+	ctx := context.Background()
+	cc, name, err := c.connect(ctx, uri, "remove")
+	if err != nil {
+		return err
+	}
+	defer cc.release()
+	return cc.remove(ctx, name)
+}
+
+// Rename renames the file at uri to newpath. If newpath is not an
+// absolute path, it is relative to the directory containing the file.
+// 9P can only rename a file within its directory, so newpath must be
+// in the same directory as the file.
+func (c *Client) Rename(uri, newpath string) error {
+	ctx := context.Background()
+	cc, name, err := c.connect(ctx, uri, "rename")
+	if err != nil {
+		return err
+	}
+	defer cc.release()
+	return cc.rename(ctx, name, newpath)
+}
+
+// DialContext establishes a new session with the server named in uri,
+// which has the same form as the uri given to the Open method, except
+// that its path is ignored. The session is not shared with other
+// requests made by the Client. Files opened through the returned
+// ClientConn keep the session open until they are closed.
+func (c *Client) DialContext(ctx context.Context, uri string) (*ClientConn, error) {
+	addr, _, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: addr.scheme, Err: err}
+	}
+	cc.IncRef()
+	return &ClientConn{cc: cc}, nil
+}
+
+// NewClientConn establishes a session over rwc, which must be
+// connected to a 9P server, using the settings of the Client. It can
+// be used to connect to servers over transports that cannot be named
+// by a URL, such as pipes or ssh channels. The session is made as
+// the named user, or as the current user if user is empty. Because
+// the Client cannot connect to the server again, the session ends
+// once rwc fails, even if Reconnect is true.
+func (c *Client) NewClientConn(rwc io.ReadWriteCloser, user string) (*ClientConn, error) {
+	ctx := context.Background()
+	t, err := newTransport(rwc, c.maxSize())
+	if err != nil {
+		return nil, err
+	}
+	cc := newClientConn(t, c.Timeout)
+	cc.uname, cc.auth = clientUser(user), c.Auth
+	if err := cc.attachRoot(ctx, t); err != nil {
+		cc.close()
+		return nil, err
+	}
+	cc.IncRef()
+	return &ClientConn{cc: cc}, nil
+}
+
+// A ClientConn is a session with a 9P server, created by the
+// DialContext or NewClientConn methods of a Client. Paths given to
+// its methods are relative to the root of the server's file tree.
+// A ClientConn is safe for concurrent use.
+type ClientConn struct {
+	cc   *clientConn
+	once sync.Once
+}
+
+// Open opens the named file for reading.
+func (c *ClientConn) Open(name string) (*File, error) {
+	return c.OpenFileContext(context.Background(), name, os.O_RDONLY)
+}
+
+// OpenFile opens the named file with the access mode in flag. See
+// the OpenFile method of Client.
+func (c *ClientConn) OpenFile(name string, flag int) (*File, error) {
+	return c.OpenFileContext(context.Background(), name, flag)
+}
+
+// OpenFileContext is like OpenFile, but opening the file is
+// abandoned if ctx is cancelled.
+func (c *ClientConn) OpenFileContext(ctx context.Context, name string, flag int) (*File, error) {
+	return c.cc.open(ctx, path.Clean("/"+name), flag)
+}
+
+// Create creates the named file with mode 0666, and opens it for
+// reading and writing. If the file already exists, it is truncated.
+func (c *ClientConn) Create(name string) (*File, error) {
+	return c.cc.createFile(context.Background(), path.Clean("/"+name))
+}
+
+// Mkdir creates a new directory with the permission bits in perm.
+func (c *ClientConn) Mkdir(name string, perm os.FileMode) error {
+	return c.cc.mkdir(context.Background(), path.Clean("/"+name), perm)
+}
+
+// Remove removes the named file or empty directory.
+func (c *ClientConn) Remove(name string) error {
+	return c.cc.remove(context.Background(), path.Clean("/"+name))
+}
+
+// Rename renames a file. See the Rename method of Client.
+func (c *ClientConn) Rename(oldpath, newpath string) error {
+	return c.cc.rename(context.Background(), path.Clean("/"+oldpath), newpath)
+}
+
+// Stat returns information about the named file, without opening it.
+func (c *ClientConn) Stat(name string) (os.FileInfo, error) {
+	return c.cc.stat(context.Background(), path.Clean("/"+name))
+}
+
+// Close ends the session once all Files opened through it are
+// closed. It does not close open Files.
+func (c *ClientConn) Close() error {
+	c.once.Do(c.cc.release)
+	return nil
+}
+
+// connect returns a session with the server named in uri, reusing
+// an existing session if there is one, and the absolute path of the
+// file in uri. The caller must release the session when it is done.
+// Errors are reported as an *os.PathError for op.
+func (c *Client) connect(ctx context.Context, uri, op string) (*clientConn, string, error) {
+	addr, name, err := parseURI(uri)
+	if err != nil {
+		return nil, "", &os.PathError{Op: op, Path: uri, Err: err}
+	}
+	key := addr.key()
+	if cc := c.conns.get(key); cc != nil {
+		return cc, name, nil
+	}
+	cc, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, "", &os.PathError{Op: op, Path: uri, Err: err}
+	}
+	c.conns.put(key, cc)
+	return cc, name, nil
+}
+
+// dial establishes a new session with the server at addr.
+func (c *Client) dial(ctx context.Context, addr serverAddr) (*clientConn, error) {
+	t, err := c.dialTransport(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	cc := newClientConn(t, c.Timeout)
+	cc.uname, cc.auth = clientUser(addr.user), c.Auth
+	if err := cc.attachRoot(ctx, t); err != nil {
+		cc.close()
+		return nil, err
+	}
+	if c.Reconnect {
+		cc.redial = func(ctx context.Context) (*transport, error) {
+			return c.dialTransport(ctx, addr)
+		}
+		go cc.watch(t)
+	}
+	return cc, nil
+}
+
+// dialTransport connects to the server at addr, and negotiates
+// the protocol version.
+func (c *Client) dialTransport(ctx context.Context, addr serverAddr) (*transport, error) {
+	dial := c.Dialer
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	var tlsConfig *tls.Config
+	switch addr.scheme {
+	case "tcp", "unix":
+	case "tls":
+		tlsConfig = c.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = addr.hostname()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", addr.scheme)
+	}
+	conn, err := dial(ctx, addr.network(), addr.addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if conn, err = tlsHandshake(ctx, conn, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	return newTransport(conn, c.maxSize())
+}
+
+// tlsHandshake runs the client side of a TLS handshake over conn,
+// abandoning it if ctx is cancelled.
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tc := tls.Client(conn, config)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (c *Client) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return styxproto.DefaultMaxSize
+	}
+	return c.MaxSize
+}
+
+// clientUser returns the user name to send to the server, given the
+// user name requested, which may be empty.
+func clientUser(name string) string {
+	if name != "" {
+		return name
+	}
+	if cur, err := user.Current(); err == nil {
+		return cur.Username
+	}
+	return "none"
+}
+
+// openMode converts os package flags to a 9P open mode.
+func openMode(flag int) uint8 {
+	var mode uint8
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		mode = styxproto.OWRITE
+	case os.O_RDWR:
+		mode = styxproto.ORDWR
+	default:
+		mode = styxproto.OREAD
+	}
+	if flag&os.O_TRUNC != 0 {
+		mode |= styxproto.OTRUNC
+	}
+	return mode
+}
+
+// splitPath splits an absolute path into its elements, suitable
+// for a Twalk request.
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
@@ -0,0 +1,714 @@
+package styx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// osFS serves the files under a directory on the host.
+type osFS string
+
+func (root osFS) Serve9P(s *Session) {
+	for s.Next() {
+		root.serve(s.Request())
+	}
+}
+
+func (root osFS) serve(r Request) {
+	name := string(root) + r.Path()
+	switch req := r.(type) {
+	case Twalk:
+		req.Rwalk(os.Stat(name))
+	case Tstat:
+		req.Rstat(os.Stat(name))
+	case Topen:
+		req.Ropen(os.OpenFile(name, req.Flag, 0))
+	case Tcreate:
+		name = string(root) + req.NewPath()
+		if req.Mode.IsDir() {
+			if err := os.Mkdir(name, req.Mode.Perm()); err != nil {
+				req.Rcreate(nil, err)
+			} else {
+				req.Rcreate(os.Open(name))
+			}
+		} else {
+			req.Rcreate(os.OpenFile(name, req.Flag|os.O_CREATE|os.O_EXCL, req.Mode.Perm()))
+		}
+	case Tremove:
+		req.Rremove(os.Remove(name))
+	case Trename:
+		req.Rrename(os.Rename(string(root)+req.OldPath, string(root)+req.NewPath))
+	}
+}
+
+// testClientServer starts a Server on a local port, and returns
+// the URL of the root of its file tree.
+func testClientServer(t *testing.T, handler Handler) string {
+	return testClientServerAuth(t, handler, nil)
+}
+
+func testClientServerAuth(t *testing.T, handler Handler, auth AuthFunc) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	srv := Server{Handler: handler, Auth: auth}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestClientReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := ioutil.WriteFile(dir+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := testClientServer(t, osFS(dir))
+	client := Client{MaxSize: 8192}
+
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.Read(got); err == nil {
+		t.Error("read from closed file succeeded")
+	}
+
+	f, err = client.OpenFile(uri+"/file", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("hello, world\n", 2000)
+	if n, err := f.Write([]byte(msg)); err != nil || n != len(msg) {
+		t.Errorf("wrote %d bytes: %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+	if got, _ := ioutil.ReadFile(dir + "/file"); string(got) != msg {
+		t.Errorf("file contains %d bytes after write, want %d", len(got), len(msg))
+	}
+
+	if _, err := client.Open(uri + "/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("opening missing file returned %v", err)
+	}
+}
+
+func TestClientReaddir(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("file%03d", i)
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	uri := testClientServer(t, osFS(dir))
+	client := Client{MaxSize: 5000}
+
+	f, err := client.Open(uri + "/file007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "file007" || info.Size() != 7 || info.IsDir() {
+		t.Errorf("stat file007: got name=%q size=%d dir=%t", info.Name(), info.Size(), info.IsDir())
+	}
+	f.Close()
+
+	d, err := client.Open(uri + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if info, err := d.Stat(); err != nil {
+		t.Error(err)
+	} else if !info.IsDir() {
+		t.Errorf("stat / returned mode %v", info.Mode())
+	}
+
+	var got []string
+	for {
+		infos, err := d.Readdir(30)
+		for _, fi := range infos {
+			got = append(got, fi.Name())
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) == 0 || len(infos) > 30 {
+			t.Fatalf("Readdir(30) returned %d entries", len(infos))
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Readdir returned %d entries, want %d", len(got), len(want))
+	}
+}
+
+func TestClientMutate(t *testing.T) {
+	dir := t.TempDir()
+	uri := testClientServer(t, osFS(dir))
+	var client Client
+
+	if err := client.Mkdir(uri+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir + "/sub"); err != nil {
+		t.Fatal(err)
+	} else if !info.IsDir() {
+		t.Fatalf("Mkdir created %v", info.Mode())
+	}
+
+	f, err := client.Create(uri + "/sub/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello, world")); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+
+	// Create truncates existing files.
+	f, err = client.Create(uri + "/sub/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hi")); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+	if data, err := ioutil.ReadFile(dir + "/sub/a"); err != nil || string(data) != "hi" {
+		t.Errorf("after Create, file contains %q, %v", data, err)
+	}
+
+	if err := client.Rename(uri+"/sub/a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/sub/b"); err != nil {
+		t.Error(err)
+	}
+	if err := client.Rename(uri+"/sub/b", "/c"); err == nil {
+		t.Error("rename to another directory succeeded")
+	}
+
+	if err := client.Remove(uri + "/sub/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove(uri + "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/sub"); !os.IsNotExist(err) {
+		t.Errorf("directory still present after Remove: %v", err)
+	}
+	if err := client.Remove(uri + "/sub"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removing missing file returned %v", err)
+	}
+}
+
+func TestClientFS(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b/c", "b/d/e"} {
+		name = dir + "/" + name
+		if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uri := testClientServer(t, osFS(dir))
+	var client Client
+
+	if err := fstest.TestFS(client.FS(uri), "a", "b/c", "b/d/e"); err != nil {
+		t.Error(err)
+	}
+	if err := fstest.TestFS(client.FS(uri+"/b"), "c", "d/e"); err != nil {
+		t.Error(err)
+	}
+}
+
+// slowFS serves a single file whose reads block until the
+// file is closed.
+type slowFS struct {
+	file *slowFile
+}
+
+func (fsys slowFS) Serve9P(s *Session) {
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Twalk:
+			req.Rwalk(fsys.file, nil)
+		case Tstat:
+			req.Rstat(fsys.file, nil)
+		case Topen:
+			req.Ropen(fsys.file, nil)
+		}
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	file := &slowFile{
+		blockme: make(chan struct{}),
+		closeme: make(chan struct{}),
+		name:    "slow",
+	}
+	uri := testClientServer(t, slowFS{file})
+	var client Client
+
+	f, err := client.Open(uri + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	buf := make([]byte, 10)
+	if _, err := f.ReadContext(ctx, buf); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled read returned %v", err)
+	}
+	if _, err := f.ReadContext(ctx, buf); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read with expired context returned %v", err)
+	}
+
+	// The connection remains usable after a flush. The server
+	// closes the file to interrupt the read, so it is not.
+	if _, err := f.Stat(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword := func(rwc *Channel, user, access string) error {
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(rwc, buf); err != nil {
+			return err
+		}
+		if string(buf) != "secret" {
+			return errors.New("wrong password")
+		}
+		return nil
+	}
+	sendPassword := func(password string) AuthFunc {
+		return func(rwc *Channel, user, access string) error {
+			if rwc.Conn() == nil {
+				t.Error("Conn returned nil")
+			}
+			_, err := io.WriteString(rwc, password)
+			return err
+		}
+	}
+	uri := testClientServerAuth(t, osFS(dir), checkPassword)
+
+	client := Client{Auth: sendPassword("secret")}
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	f.Close()
+
+	client = Client{Auth: sendPassword("hunter")}
+	if _, err := client.Open(uri + "/file"); err == nil {
+		t.Error("open succeeded with wrong password")
+	}
+	client = Client{}
+	if _, err := client.Open(uri + "/file"); err == nil {
+		t.Error("open succeeded without authentication")
+	}
+}
+
+// stuckFS serves a slow file, and never answers Tstat requests
+// unless they are flushed.
+type stuckFS struct {
+	slowFS
+}
+
+func (fsys stuckFS) Serve9P(s *Session) {
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Twalk:
+			req.Rwalk(fsys.file, nil)
+		case Topen:
+			req.Ropen(fsys.file, nil)
+		case Tstat:
+			<-req.Context().Done()
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	file := &slowFile{
+		blockme: make(chan struct{}),
+		closeme: make(chan struct{}),
+		name:    "slow",
+	}
+	uri := testClientServer(t, stuckFS{slowFS{file}})
+	client := Client{Timeout: 20 * time.Millisecond}
+
+	f, err := client.Open(uri + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The server answers Tstat requests for open files itself.
+	if _, err := fs.Stat(client.FS(uri), "slow"); !os.IsTimeout(err) {
+		t.Errorf("stat returned %v, want timeout", err)
+	}
+
+	// Reads are exempt from the Timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := f.ReadContext(ctx, make([]byte, 10)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// A dropListener records the connections it accepts, so that
+// they can be severed.
+type dropListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *dropListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *dropListener) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func TestClientReconnect(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	dl := &dropListener{Listener: ln}
+	srv := Server{Handler: osFS(dir)}
+	go srv.Serve(dl)
+	defer ln.Close()
+
+	client := Client{Reconnect: true}
+	f, err := client.Open("tcp://" + ln.Addr().String() + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "01234" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	dl.drop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := f.Read(buf)
+		if err == nil {
+			if got := string(buf[:n]); got != "56789" {
+				t.Errorf("read %q after reconnecting, want %q", got, "56789")
+			}
+			break
+		}
+		if e, ok := errors.Unwrap(err).(interface{ Temporary() bool }); !ok || !e.Temporary() {
+			t.Fatalf("read failed with a permanent error: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("did not reconnect:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientWalkCache(t *testing.T) {
+	dir := t.TempDir()
+	deep := dir + "/a/b/c/d"
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("%s/file%d", deep, i)
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var walks int32
+	uri := testClientServer(t, HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if _, ok := s.Request().(Twalk); ok {
+				atomic.AddInt32(&walks, 1)
+			}
+			osFS(dir).serve(s.Request())
+		}
+	}))
+	var client Client
+
+	open := func(name string) *File {
+		f, err := client.Open(uri + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	keep := open("/a/b/c/d/file0")
+	defer keep.Close()
+
+	atomic.StoreInt32(&walks, 0)
+	for i := 1; i < 10; i++ {
+		f := open(fmt.Sprintf("/a/b/c/d/file%d", i))
+		buf := make([]byte, 64)
+		n, _ := f.Read(buf)
+		if want := fmt.Sprintf("%s/file%d", deep, i); string(buf[:n]) != want {
+			t.Errorf("read %q, want %q", buf[:n], want)
+		}
+		f.Close()
+	}
+	if n := atomic.LoadInt32(&walks); n != 9 {
+		t.Errorf("opening 9 sibling files took %d walks, want 9", n)
+	}
+
+	if err := client.Rename(uri+"/a/b", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(deep+"/file1", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&walks, 0)
+	open("/a/b/c/d/file1").Close()
+	// The walk starts from /a, which was cached by Rename.
+	if n := atomic.LoadInt32(&walks); n != 4 {
+		t.Errorf("opening file in renamed directory took %d walks, want 4", n)
+	}
+	open("/a/x/c/d/file1").Close()
+}
+
+func TestClientReadAtSeek(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	if err := ioutil.WriteFile(dir+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := testClientServer(t, osFS(dir))
+	client := Client{MaxSize: 5000}
+
+	f, err := client.OpenFile(uri+"/file", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 12000)
+			n, err := f.ReadAt(buf, off)
+			if err != nil || !bytes.Equal(buf[:n], data[off:off+12000]) {
+				t.Errorf("ReadAt(%d): read %d bytes, %v", off, n, err)
+			}
+		}(int64(i) * 1234)
+	}
+	wg.Wait()
+
+	sr := io.NewSectionReader(f, 19995, 100)
+	if got, err := ioutil.ReadAll(sr); err != nil || string(got) != "56789" {
+		t.Errorf("read %q from section, %v", got, err)
+	}
+	if n, err := f.ReadAt(make([]byte, 10), 19995); n != 5 || err != io.EOF {
+		t.Errorf("ReadAt past end of file returned %d, %v", n, err)
+	}
+
+	if _, err := f.WriteAt([]byte("abc"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if off, err := f.Seek(-3, io.SeekEnd); err != nil || off != int64(len(data))-3 {
+		t.Fatalf("Seek to end returned %d, %v", off, err)
+	}
+	if off, err := f.Seek(-(int64(len(data)) - 13), io.SeekCurrent); err != nil || off != 10 {
+		t.Fatalf("Seek from current offset returned %d, %v", off, err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "abc34" {
+		t.Errorf("read %q after seeking, %v", buf, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seek to negative offset succeeded")
+	}
+}
+
+func TestClientDialer(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sock := dir + "/sock"
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("cannot listen on unix socket:", err)
+	}
+	defer ln.Close()
+	go (&Server{Handler: osFS(dir)}).Serve(ln)
+
+	client := Client{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}
+	f, err := client.Open("tcp://styx.example/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello" {
+		t.Errorf("read %q, %v", got, err)
+	}
+	f.Close()
+
+	rwc, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.NewClientConn(rwc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Rename("file", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = conn.Open("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello" {
+		t.Errorf("read %q after closing ClientConn, %v", got, err)
+	}
+	f.Close()
+	if _, err := conn.Stat("renamed"); err == nil {
+		t.Error("stat succeeded after closing ClientConn and its files")
+	}
+}
+
+func TestClientDialString(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sock := dir + "/sock"
+	srv := &Server{Addr: "unix!" + sock, Handler: osFS(dir)}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	defer func() {
+		srv.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("ListenAndServe returned %v", err)
+		}
+	}()
+	for i := 0; ; i++ {
+		c, err := net.Dial("unix", sock)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 100 {
+			t.Skip("cannot listen on unix socket:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&Server{Handler: osFS(dir)}).Serve(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var client Client
+	for _, uri := range []string{
+		"unix!" + sock + "!/file",
+		"unix!" + sock + "!file",
+		"tcp!" + host + "!" + port + "!/file",
+	} {
+		f, err := client.Open(uri)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello" {
+			t.Errorf("%s: read %q, %v", uri, got, err)
+		}
+		f.Close()
+	}
+	if _, err := client.Open("unix!" + sock + "!/a!b"); err == nil {
+		t.Error("opened malformed dial string")
+	}
+
+	for _, root := range []string{sock, "unix!" + sock, "tcp!" + host + "!" + port} {
+		got, err := fs.ReadFile(client.FS(root), "file")
+		if err != nil || string(got) != "hello" {
+			t.Errorf("%s: read %q, %v", root, got, err)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package styx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/internal/pool"
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/internal/util"
+	"aqwari.net/net/styx/styxproto"
+	"aqwari.net/retry"
+)
+
+var (
+	errTooManyRequests = errors.New("too many outstanding requests")
+	errTooManyFids     = errors.New("too many open files")
+	errConnClosed      = errors.New("connection closed")
+	errCrossDir        = errors.New("cannot rename a file to another directory")
+	errNegativeOffset  = errors.New("negative offset")
+	errWhence          = errors.New("invalid whence")
+)
+
+type errUnexpectedMsg struct {
+	msg styxproto.Msg
+}
+
+func (e errUnexpectedMsg) Error() string {
+	return fmt.Sprintf("unexpected %T response", e.msg)
+}
+
+// A resetError is returned for requests made while the connection
+// to the server is down, when the client is reconnecting. The
+// request may be retried once the connection is restored.
+type resetError struct {
+	err error
+}
+
+func (e resetError) Error() string   { return "connection reset: " + e.err.Error() }
+func (e resetError) Unwrap() error   { return e.err }
+func (e resetError) Temporary() bool { return true }
+
+// A clientConn is a 9P session with a server, carried over a
+// transport. If the clientConn is configured to reconnect, the
+// transport is replaced when it fails, and the fids of open Files
+// are established again on the new transport.
+type clientConn struct {
+	mu sync.Mutex
+	t  *transport // protected by mu
+
+	// How long to wait for responses, other than to Tread
+	// requests. Zero means no limit.
+	timeout time.Duration
+
+	fids pool.FidPool
+
+	// The fid for the root of the file tree, from Tattach.
+	root uint32
+
+	// Fids for recently used directories.
+	dirs dirCache
+
+	// Parameters of the session, needed to attach again.
+	uname, aname string
+	auth         AuthFunc
+
+	// Creates a new transport to the server. If nil, the
+	// clientConn does not reconnect.
+	redial func(context.Context) (*transport, error)
+
+	// Open files, by fid. Protected by mu.
+	files map[uint32]*File
+
+	// Cancelled when the clientConn is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// One reference for each open File, and for each user of the
+	// connection while a request is in progress.
+	util.RefCount
+
+	// If the clientConn is shared, the cache it is stored in.
+	cache *connCache
+}
+
+func newClientConn(t *transport, timeout time.Duration) *clientConn {
+	c := &clientConn{
+		t:       t,
+		timeout: timeout,
+		files:   make(map[uint32]*File),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.root, _ = c.fids.Get()
+	c.dirs.root = &dirEntry{fid: c.root}
+	return c
+}
+
+// current returns the transport that requests should be sent on.
+func (c *clientConn) current() *transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// rpc sends a request over t, applying the timeout of the
+// clientConn. See the roundTrip method of transport.
+func (c *clientConn) rpc(ctx context.Context, t *transport, send func(enc *styxproto.Encoder, tag uint16) error, fn func(styxproto.Msg) error) error {
+	return c.roundTrip(ctx, t, c.timeout, send, fn)
+}
+
+func (c *clientConn) roundTrip(ctx context.Context, t *transport, timeout time.Duration, send func(enc *styxproto.Encoder, tag uint16) error, fn func(styxproto.Msg) error) error {
+	err := t.roundTrip(ctx, timeout, send, fn)
+	if err != nil && c.redial != nil && c.ctx.Err() == nil && t.Err() != nil {
+		return resetError{err}
+	}
+	return err
+}
+
+// Errors from the server are returned as an Error, with an error
+// number guessed from the message, so that they can be matched
+// using errors.Is.
+func serverError(m styxproto.Rerror) error {
+	msg := string(m.Ename())
+	return Error{Msg: msg, Errno: errno("%s", []interface{}{msg})}
+}
+
+// attachRoot authenticates, if the clientConn has an AuthFunc, and
+// attaches the root fid to the file tree over t.
+func (c *clientConn) attachRoot(ctx context.Context, t *transport) error {
+	afid := uint32(styxproto.NoFid)
+	if c.auth != nil {
+		var err error
+		if afid, err = c.authenticate(ctx, t); err != nil {
+			return err
+		}
+		defer c.clunk(t, afid)
+	}
+	return c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tattach(tag, c.root, afid, c.uname, c.aname)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		if _, ok := msg.(styxproto.Rattach); !ok {
+			return errUnexpectedMsg{msg}
+		}
+		return nil
+	})
+}
+
+// authenticate runs the authentication protocol implemented by
+// the AuthFunc of the clientConn over a new afid, and returns the
+// afid for use in a Tattach request. The caller must clunk the
+// afid once it is no longer needed.
+func (c *clientConn) authenticate(ctx context.Context, t *transport) (uint32, error) {
+	afid, ok := c.fids.Get()
+	if !ok {
+		return 0, errTooManyFids
+	}
+	err := c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tauth(tag, afid, c.uname, c.aname)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		if _, ok := msg.(styxproto.Rauth); !ok {
+			return errUnexpectedMsg{msg}
+		}
+		return nil
+	})
+	if err != nil {
+		c.fids.Free(afid)
+		return 0, err
+	}
+	ch := &Channel{
+		Context: context.WithValue(ctx, "conn", t.rwc),
+		ReadWriteCloser: &authFile{
+			File: &File{name: "auth", fid: afid, conn: c},
+			ctx:  ctx,
+			t:    t,
+		},
+	}
+	if err := c.auth(ch, c.uname, c.aname); err != nil {
+		c.clunk(t, afid)
+		return 0, err
+	}
+	return afid, nil
+}
+
+// An authFile reads and writes an afid over the transport being
+// authenticated, which may not be in use by the clientConn yet. The
+// afid must outlive the AuthFunc, so closing it is left to the
+// clientConn.
+type authFile struct {
+	*File
+	ctx    context.Context
+	t      *transport
+	offset int64
+}
+
+func (f *authFile) Read(p []byte) (int, error) {
+	n, err := f.read(f.ctx, f.t, p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *authFile) Write(p []byte) (int, error) {
+	n, err := f.write(f.ctx, f.t, p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *authFile) Close() error { return nil }
+
+// clunk releases fid on the server and in the fid pool.
+func (c *clientConn) clunk(t *transport, fid uint32) error {
+	defer c.fids.Free(fid)
+	return c.tclunk(t, fid)
+}
+
+// tclunk releases fid on the server.
+func (c *clientConn) tclunk(t *transport, fid uint32) error {
+	return c.rpc(context.Background(), t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tclunk(tag, fid)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		if _, ok := msg.(styxproto.Rclunk); !ok {
+			return errUnexpectedMsg{msg}
+		}
+		return nil
+	})
+}
+
+// open walks to the file at the absolute path name and opens it.
+// The returned File holds a reference to the connection.
+func (c *clientConn) open(ctx context.Context, name string, flag int) (*File, error) {
+	t := c.current()
+	fid, err := c.walkTo(ctx, t, name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := &File{name: name, fid: fid, flag: flag, conn: c}
+	err = c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Topen(tag, fid, openMode(flag))
+		return nil
+	}, func(msg styxproto.Msg) error {
+		m, ok := msg.(styxproto.Ropen)
+		if !ok {
+			return errUnexpectedMsg{msg}
+		}
+		f.qid = append(styxproto.Qid(nil), m.Qid()...)
+		f.iounit = m.IOunit()
+		return nil
+	})
+	if err != nil {
+		c.clunk(t, fid)
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	c.track(f)
+	return f, nil
+}
+
+// create creates the file at the absolute path name, with the
+// 9P permissions in perm, and opens it. The returned File holds a
+// reference to the connection.
+func (c *clientConn) create(ctx context.Context, name string, perm uint32, flag int) (*File, error) {
+	t := c.current()
+	fid, err := c.walkTo(ctx, t, path.Dir(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	f := &File{name: name, fid: fid, flag: flag, conn: c}
+	err = c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tcreate(tag, fid, path.Base(name), perm, openMode(flag))
+		return nil
+	}, func(msg styxproto.Msg) error {
+		m, ok := msg.(styxproto.Rcreate)
+		if !ok {
+			return errUnexpectedMsg{msg}
+		}
+		f.qid = append(styxproto.Qid(nil), m.Qid()...)
+		f.iounit = m.IOunit()
+		return nil
+	})
+	if err != nil {
+		c.clunk(t, fid)
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	c.track(f)
+	return f, nil
+}
+
+// track records an open File, so that it can be opened again if
+// the connection is restored, and takes a reference to the
+// connection on its behalf.
+func (c *clientConn) track(f *File) {
+	c.mu.Lock()
+	c.files[f.fid] = f
+	c.mu.Unlock()
+	c.IncRef()
+}
+
+// closeFile clunks the fid of f, and drops the reference taken
+// by track.
+func (c *clientConn) closeFile(f *File) error {
+	c.mu.Lock()
+	delete(c.files, f.fid)
+	c.mu.Unlock()
+	err := c.clunk(c.current(), f.fid)
+	c.release()
+	return err
+}
+
+// createFile opens the file at the absolute path name for reading
+// and writing, truncating it, or creates it with mode 0666 if it
+// does not exist.
+func (c *clientConn) createFile(ctx context.Context, name string) (*File, error) {
+	f, err := c.open(ctx, name, os.O_RDWR|os.O_TRUNC)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = c.create(ctx, name, 0666, os.O_RDWR)
+	}
+	return f, err
+}
+
+// mkdir creates a directory at the absolute path name.
+func (c *clientConn) mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	f, err := c.create(ctx, name, styxfile.Mode9P(perm&os.ModePerm|os.ModeDir), os.O_RDONLY)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: unwrapPathError(err)}
+	}
+	return f.Close()
+}
+
+// rename renames the file at the absolute path name to newpath,
+// which is relative to the directory containing the file if it is
+// not absolute.
+func (c *clientConn) rename(ctx context.Context, name, newpath string) error {
+	if !path.IsAbs(newpath) {
+		newpath = path.Join(path.Dir(name), newpath)
+	}
+	newpath = path.Clean(newpath)
+	if path.Dir(newpath) != path.Dir(name) {
+		return &os.LinkError{Op: "rename", Old: name, New: newpath, Err: errCrossDir}
+	}
+	stat, err := newWstat(path.Base(newpath))
+	if err == nil {
+		err = c.wstat(ctx, name, stat)
+		c.forgetDirs(c.current(), name)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: name, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// stat returns information about the file at the absolute path
+// name, without opening it.
+func (c *clientConn) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	t := c.current()
+	fid, err := c.walkTo(ctx, t, name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer c.clunk(t, fid)
+	info, err := c.fstat(ctx, t, fid)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// fstat sends a Tstat request for fid.
+func (c *clientConn) fstat(ctx context.Context, t *transport, fid uint32) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tstat(tag, fid)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		m, ok := msg.(styxproto.Rstat)
+		if !ok {
+			return errUnexpectedMsg{msg}
+		}
+		info = newFileInfo(m.Stat())
+		return nil
+	})
+	return info, err
+}
+
+// remove removes the file at the absolute path name.
+func (c *clientConn) remove(ctx context.Context, name string) error {
+	t := c.current()
+	fid, err := c.walkTo(ctx, t, name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	// The fid is clunked by Tremove, even if the remove fails.
+	defer c.fids.Free(fid)
+	defer c.forgetDirs(t, name)
+	err = c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Tremove(tag, fid)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		if _, ok := msg.(styxproto.Rremove); !ok {
+			return errUnexpectedMsg{msg}
+		}
+		return nil
+	})
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// wstat sends a Twstat request for the file at the absolute path
+// name. Fields of stat that should not be changed must be set to
+// the "don't touch" values created by newWstat.
+func (c *clientConn) wstat(ctx context.Context, name string, stat styxproto.Stat) error {
+	t := c.current()
+	fid, err := c.walkTo(ctx, t, name)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(t, fid)
+	return c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+		enc.Twstat(tag, fid, stat)
+		return nil
+	}, func(msg styxproto.Msg) error {
+		if _, ok := msg.(styxproto.Rwstat); !ok {
+			return errUnexpectedMsg{msg}
+		}
+		return nil
+	})
+}
+
+// newWstat creates a Stat structure for a Twstat request that
+// changes nothing but, if it is not empty, the name of the file.
+func newWstat(name string) (styxproto.Stat, error) {
+	stat, _, err := styxproto.NewStat(make([]byte, styxproto.MaxStatLen), name, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	stat.SetType(math.MaxUint16)
+	stat.SetDev(math.MaxUint32)
+	qid := stat.Qid()
+	for i := range qid {
+		qid[i] = 0xff
+	}
+	stat.SetMode(math.MaxUint32)
+	stat.SetAtime(math.MaxUint32)
+	stat.SetMtime(math.MaxUint32)
+	stat.SetLength(-1)
+	return stat, nil
+}
+
+// watch waits for t to fail, and replaces it with a new transport,
+// retrying with exponential backoff until it succeeds or the
+// clientConn is closed. It runs in its own goroutine.
+func (c *clientConn) watch(t *transport) {
+	<-t.done
+	backoff := retry.Exponential(time.Millisecond * 10).Max(time.Second)
+	for try := 0; c.ctx.Err() == nil; try++ {
+		if next, err := c.restore(c.ctx); err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.ctx.Err() != nil {
+				next.close()
+				return
+			}
+			c.t = next
+			c.dirs.reset(&c.fids)
+			go c.watch(next)
+			return
+		}
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(backoff(try)):
+		}
+	}
+}
+
+// restore dials a new transport and establishes the session and the
+// fids of all open Files on it, reusing the same fid numbers. Files
+// are opened again with the flags they were opened with, except for
+// os.O_TRUNC. Files that cannot be opened again, such as files that
+// were removed in the meantime, report errors from the server on
+// later requests.
+func (c *clientConn) restore(ctx context.Context) (*transport, error) {
+	t, err := c.redial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.attachRoot(ctx, t); err != nil {
+		t.close()
+		return nil, err
+	}
+	c.mu.Lock()
+	files := make([]*File, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	c.mu.Unlock()
+
+	for _, f := range files {
+		if _, err := c.walk(ctx, t, c.root, f.fid, splitPath(f.name)...); err != nil {
+			continue
+		}
+		err := c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+			enc.Topen(tag, f.fid, openMode(f.flag&^os.O_TRUNC))
+			return nil
+		}, func(msg styxproto.Msg) error {
+			if _, ok := msg.(styxproto.Ropen); !ok {
+				return errUnexpectedMsg{msg}
+			}
+			return nil
+		})
+		if err != nil {
+			c.tclunk(t, f.fid)
+		}
+	}
+	if err := t.Err(); err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// release drops a reference to the connection, closing it once
+// there are none left.
+func (c *clientConn) release() {
+	if c.cache != nil {
+		if c.cache.release(c) {
+			c.close()
+		}
+	} else if !c.DecRef() {
+		c.close()
+	}
+}
+
+// usable reports whether requests can be made over the clientConn.
+func (c *clientConn) usable() bool {
+	return c.ctx.Err() == nil && (c.redial != nil || c.current().Err() == nil)
+}
+
+// A connCache holds the connections of a Client, so that requests
+// to the same server, as the same user, share a connection.
+type connCache struct {
+	mu    sync.Mutex
+	conns map[string]*clientConn
+}
+
+// get returns the cached connection for key, with a reference
+// taken for the caller, or nil if there is no usable connection.
+func (cache *connCache) get(key string) *clientConn {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	c, ok := cache.conns[key]
+	if !ok || !c.usable() {
+		return nil
+	}
+	c.IncRef()
+	return c
+}
+
+// put adds c to the cache under key, with a reference taken for
+// the caller. It replaces any connection already stored under key,
+// which remains open until its references are released.
+func (cache *connCache) put(key string, c *clientConn) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.conns == nil {
+		cache.conns = make(map[string]*clientConn)
+	}
+	c.cache = cache
+	c.IncRef()
+	cache.conns[key] = c
+}
+
+// release drops a reference to c, and reports whether it was the
+// last one, in which case c is removed from the cache.
+func (cache *connCache) release(c *clientConn) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if c.DecRef() {
+		return false
+	}
+	for key, cc := range cache.conns {
+		if cc == c {
+			delete(cache.conns, key)
+		}
+	}
+	return true
+}
+
+func (c *clientConn) close() error {
+	c.cancel()
+	return c.current().close()
+}
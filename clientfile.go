@@ -0,0 +1,367 @@
+package styx
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A File is an open file on a remote 9P server. A File is safe
+// for concurrent use, though concurrent calls to Read or Write
+// will consume the file offset in an unspecified order. ReadAt and
+// WriteAt do not use the file offset, and may be called concurrently
+// with each other and with any other method.
+type File struct {
+	name string // absolute path on the server
+	fid  uint32
+	qid  styxproto.Qid
+
+	// The maximum number of bytes the server will transfer in a
+	// single read or write, or 0 if the server has no preference.
+	iounit int64
+
+	// The flags the file was opened with.
+	flag int
+
+	conn *clientConn
+
+	mu     sync.Mutex // protects offset, closed and dirents
+	offset int64
+	closed bool
+
+	// Directory entries read from the server, but not yet
+	// returned by Readdir.
+	dirents []os.FileInfo
+}
+
+// Name returns the path of the file on the server.
+func (f *File) Name() string {
+	return f.name
+}
+
+// chunkSize is the largest amount of data that can be transferred
+// in a single Tread or Twrite request over t.
+func (f *File) chunkSize(t *transport) int64 {
+	n := t.msize - styxproto.IOHeaderSize
+	if f.iounit > 0 && f.iounit < n {
+		n = f.iounit
+	}
+	return n
+}
+
+// Read reads up to len(p) bytes from the File, starting at the
+// current file offset, and advances the offset by the number of
+// bytes read. At end of file, Read returns 0, io.EOF.
+func (f *File) Read(p []byte) (int, error) {
+	return f.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but if ctx is cancelled before the server
+// responds, the request is flushed and ctx.Err() is returned, wrapped
+// in an *os.PathError.
+func (f *File) ReadContext(ctx context.Context, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	n, err := f.read(ctx, f.conn.current(), p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// read issues a single Tread request over t, reading at most one
+// chunk of data into p.
+func (f *File) read(ctx context.Context, t *transport, p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if size := f.chunkSize(t); int64(len(p)) > size {
+		p = p[:size]
+	}
+	// Reads may legitimately wait for data that has not arrived
+	// yet, so Client.Timeout does not apply to them.
+	var n int
+	err := f.conn.roundTrip(ctx, t, 0, func(enc *styxproto.Encoder, tag uint16) error {
+		return enc.Tread(tag, f.fid, offset, int64(len(p)))
+	}, func(msg styxproto.Msg) error {
+		m, ok := msg.(styxproto.Rread)
+		if !ok {
+			return errUnexpectedMsg{msg}
+		}
+		if m.Count() > int64(len(p)) {
+			return errUnexpectedMsg{msg}
+		}
+		var err error
+		n, err = io.ReadFull(m, p[:m.Count()])
+		return err
+	})
+	if err != nil {
+		return n, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes from the File, starting at byte offset
+// off. It does not use or change the file offset. Data larger than
+// a single 9P message is read using multiple requests. ReadAt returns
+// a non-nil error when n < len(p); at end of file, that error is
+// io.EOF.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errNegativeOffset}
+	}
+	if f.isClosed() {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrClosed}
+	}
+	t := f.conn.current()
+	for len(p) > 0 {
+		nr, err := f.read(context.Background(), t, p, off)
+		n += nr
+		off += int64(nr)
+		if err == io.EOF {
+			return n, io.EOF
+		} else if err != nil {
+			return n, &os.PathError{Op: "readat", Path: f.name, Err: unwrapPathError(err)}
+		}
+		p = p[nr:]
+	}
+	return n, nil
+}
+
+// Write writes len(p) bytes to the File, starting at the current
+// file offset, and advances the offset by the number of bytes
+// written. Data larger than a single 9P message is split across
+// multiple requests. Write returns a non-nil error when n != len(p).
+func (f *File) Write(p []byte) (n int, err error) {
+	return f.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but stops sending requests once ctx
+// is cancelled, flushing any outstanding request. The returned count
+// includes all data the server acknowledged.
+func (f *File) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	n, err = f.write(ctx, f.conn.current(), p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the File, starting at byte offset
+// off. It does not use or change the file offset. WriteAt returns a
+// non-nil error when n != len(p).
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errNegativeOffset}
+	}
+	if f.isClosed() {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrClosed}
+	}
+	n, err = f.write(context.Background(), f.conn.current(), p, off)
+	if err != nil {
+		return n, &os.PathError{Op: "writeat", Path: f.name, Err: unwrapPathError(err)}
+	}
+	return n, nil
+}
+
+// Seek sets the file offset for the next Read or Write to offset,
+// interpreted according to whence: io.SeekStart means relative to
+// the start of the file, io.SeekCurrent relative to the current
+// offset, and io.SeekEnd relative to the end of the file, as
+// reported by the server. Seek returns the new offset. The offset
+// of a directory may only be set to the start, which rewinds it.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.conn.fstat(context.Background(), f.conn.current(), f.fid)
+		if err != nil {
+			return 0, &os.PathError{Op: "seek", Path: f.name, Err: err}
+		}
+		offset += info.Size()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errWhence}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errNegativeOffset}
+	}
+	if f.qid.Type()&styxproto.QTDIR != 0 {
+		// From read(5), reads of a directory must continue from
+		// where the previous read ended, or start again at 0.
+		if offset != 0 {
+			return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+		}
+		f.dirents = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *File) write(ctx context.Context, t *transport, p []byte, offset int64) (n int, err error) {
+	size := f.chunkSize(t)
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+		var count int
+		err = f.conn.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+			_, err := enc.Twrite(tag, f.fid, offset, chunk)
+			return err
+		}, func(msg styxproto.Msg) error {
+			m, ok := msg.(styxproto.Rwrite)
+			if !ok {
+				return errUnexpectedMsg{msg}
+			}
+			count = int(m.Count())
+			return nil
+		})
+		if err != nil {
+			return n, &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		if count > len(chunk) {
+			count = len(chunk)
+		}
+		n += count
+		offset += int64(count)
+		if count < len(chunk) {
+			return n, &os.PathError{Op: "write", Path: f.name, Err: io.ErrShortWrite}
+		}
+		p = p[count:]
+	}
+	return n, nil
+}
+
+// Close closes the File, rendering it unusable for I/O. The
+// connection to the server is closed once all Files opened over
+// it are closed.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	err := f.conn.closeFile(f)
+	if err != nil {
+		return &os.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// Stat returns the os.FileInfo describing the file. The Sys method
+// of the returned os.FileInfo returns the styxproto.Stat sent by
+// the server.
+func (f *File) Stat() (os.FileInfo, error) {
+	if f.isClosed() {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	info, err := f.conn.fstat(context.Background(), f.conn.current(), f.fid)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return info, nil
+}
+
+// Readdir reads the contents of the directory associated with the
+// File and returns a slice of up to n os.FileInfo values, in the
+// order the server sends them. Readdir follows the conventions of
+// the Readdir method of os.File: if n > 0, Readdir returns io.EOF
+// at the end of the directory, and if n <= 0, Readdir returns all
+// remaining entries, and a nil error on success.
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrClosed}
+	}
+	t := f.conn.current()
+	buf := make([]byte, f.chunkSize(t))
+	for n <= 0 || len(f.dirents) < n {
+		nr, err := f.read(context.Background(), t, buf, f.offset)
+		f.offset += int64(nr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: f.name, Err: unwrapPathError(err)}
+		}
+		stats, err := styxproto.UnpackStats(buf[:nr])
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		for _, stat := range stats {
+			f.dirents = append(f.dirents, newFileInfo(stat))
+		}
+	}
+	list := f.dirents
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	f.dirents = f.dirents[len(list):]
+	if n > 0 && len(list) == 0 {
+		return nil, io.EOF
+	}
+	return list, nil
+}
+
+// ReadDir is like Readdir, but returns fs.DirEntry values.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
+}
+
+func unwrapPathError(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
+
+// fileInfo implements os.FileInfo for a Stat received from
+// the server.
+type fileInfo struct {
+	stat styxproto.Stat
+}
+
+// newFileInfo copies stat, which may be overwritten once the
+// message containing it is processed.
+func newFileInfo(stat styxproto.Stat) fileInfo {
+	return fileInfo{append(styxproto.Stat(nil), stat...)}
+}
+
+func (fi fileInfo) Name() string       { return string(fi.stat.Name()) }
+func (fi fileInfo) Size() int64        { return fi.stat.Length() }
+func (fi fileInfo) Mode() os.FileMode  { return styxfile.ModeOS(fi.stat.Mode()) }
+func (fi fileInfo) ModTime() time.Time { return time.Unix(int64(fi.stat.Mtime()), 0) }
+func (fi fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.stat }
@@ -0,0 +1,91 @@
+package styx
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// FS returns a file system, implementing fs.FS, fs.ReadDirFS and
+// fs.StatFS, for the tree rooted at uri, which has the same form as
+// the uri given to the Open method. Names passed to the methods of the
+// returned file system are relative to the path in uri.
+func (c *Client) FS(uri string) fs.FS {
+	return clientFS{c, uri}
+}
+
+type clientFS struct {
+	client *Client
+	root   string
+}
+
+// uri returns the URI for the file at name, which must be a valid
+// path as defined by fs.ValidPath.
+func (fsys clientFS) uri(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	addr, root, err := parseURI(fsys.root)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return addr.uri(path.Join(root, name)), nil
+}
+
+func (fsys clientFS) Open(name string) (fs.File, error) {
+	uri, err := fsys.uri("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.client.Open(uri)
+	if err != nil {
+		return nil, fsPathError(err, name)
+	}
+	return f, nil
+}
+
+func (fsys clientFS) Stat(name string) (fs.FileInfo, error) {
+	ctx := context.Background()
+	uri, err := fsys.uri("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	cc, file, err := fsys.client.connect(ctx, uri, "stat")
+	if err != nil {
+		return nil, fsPathError(err, name)
+	}
+	defer cc.release()
+	info, err := cc.stat(ctx, file)
+	if err != nil {
+		return nil, fsPathError(err, name)
+	}
+	return info, nil
+}
+
+// ReadDir reads the named directory, and returns its entries
+// sorted by file name.
+func (fsys clientFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.(*File).ReadDir(-1)
+	if err != nil {
+		return nil, fsPathError(err, name)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// The fs package expects errors to report the name passed
+// to the file system, rather than the path on the server.
+func fsPathError(err error, name string) error {
+	if e, ok := err.(*fs.PathError); ok {
+		return &fs.PathError{Op: e.Op, Path: name, Err: e.Err}
+	}
+	return err
+}
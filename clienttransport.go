@@ -0,0 +1,264 @@
+package styx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/internal/pool"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A transport is a single network connection to a 9P server, with
+// a negotiated protocol version. Requests may be made concurrently;
+// responses are routed back to the caller by their tag.
+type transport struct {
+	*styxproto.Encoder
+	dec *styxproto.Decoder
+	rwc io.ReadWriteCloser
+
+	// The maximum message size negotiated with the server.
+	msize int64
+
+	tags pool.TagPool
+
+	mu      sync.Mutex
+	pending map[uint16]chan styxproto.Msg
+	err     error // set once the transport fails
+
+	// Messages from the Decoder are only valid until the next
+	// call to Next. The reading goroutine waits on ack until the
+	// recipient of a message is done with it.
+	ack chan struct{}
+
+	// closed once the reading goroutine exits.
+	done chan struct{}
+}
+
+// newTransport negotiates the protocol version on rwc, and starts
+// a goroutine reading responses from the server.
+func newTransport(rwc io.ReadWriteCloser, msize int64) (*transport, error) {
+	t := &transport{
+		Encoder: styxproto.NewEncoder(rwc),
+		dec:     styxproto.NewDecoder(rwc),
+		rwc:     rwc,
+		pending: make(map[uint16]chan styxproto.Msg),
+		ack:     make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := t.version(msize); err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *transport) version(msize int64) error {
+	t.Encoder.MaxSize = msize
+	t.dec.MaxSize = msize
+	t.Tversion(uint32(msize), styxproto.Version9P2000)
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	if !t.dec.Next() {
+		if err := t.dec.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	switch m := t.dec.Msg().(type) {
+	case styxproto.Rversion:
+		if string(m.Version()) != styxproto.Version9P2000 {
+			return fmt.Errorf("server does not support %s", styxproto.Version9P2000)
+		}
+		if m.Msize() > msize || m.Msize() < styxproto.MinBufSize {
+			return fmt.Errorf("server sent invalid msize %d", m.Msize())
+		}
+		t.msize = m.Msize()
+		t.Encoder.MaxSize = t.msize
+		t.dec.MaxSize = t.msize
+		return nil
+	case styxproto.Rerror:
+		return serverError(m)
+	default:
+		return errUnexpectedMsg{m}
+	}
+}
+
+// run reads responses from the server and hands them to the
+// waiting callers. It runs in its own goroutine.
+func (t *transport) run() {
+	defer close(t.done)
+	for t.dec.Next() {
+		msg := t.dec.Msg()
+		t.mu.Lock()
+		ch, ok := t.pending[msg.Tag()]
+		delete(t.pending, msg.Tag())
+		t.mu.Unlock()
+
+		if ok {
+			ch <- msg
+			<-t.ack
+		}
+	}
+	err := t.dec.Err()
+	if err == nil {
+		err = errConnClosed
+	}
+	t.fail(err)
+}
+
+// fail marks the transport as failed, and wakes any callers
+// waiting for responses.
+func (t *transport) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+	for tag, ch := range t.pending {
+		close(ch)
+		delete(t.pending, tag)
+	}
+}
+
+// Err returns the error that caused the transport to fail, or
+// nil if it is still usable.
+func (t *transport) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *transport) close() error {
+	t.fail(errConnClosed)
+	return t.rwc.Close()
+}
+
+// roundTrip sends a request, written by send using a free tag, and
+// waits for the server's response, which is passed to fn. The
+// response is only valid until fn returns. Rerror responses are
+// returned as errors, without calling fn.
+//
+// If ctx is cancelled before the response arrives, roundTrip sends
+// a Tflush for the request, and returns ctx.Err() once the server
+// acknowledges it. If the response wins the race with the Tflush,
+// it is processed as usual. Likewise, if timeout is non-zero and
+// elapses first, the request is flushed and os.ErrDeadlineExceeded
+// is returned.
+func (t *transport) roundTrip(ctx context.Context, timeout time.Duration, send func(enc *styxproto.Encoder, tag uint16) error, fn func(styxproto.Msg) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tag, ok := t.tags.Get()
+	if !ok {
+		return errTooManyRequests
+	}
+	defer t.tags.Free(tag)
+
+	ch, err := t.register(tag)
+	if err != nil {
+		return err
+	}
+	err = send(t.Encoder, tag)
+	if err == nil {
+		err = t.Flush()
+	}
+	if err != nil {
+		t.unregister(tag)
+		return err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg, ok := <-ch:
+		return t.receive(msg, ok, fn)
+	case <-ctx.Done():
+		return t.cancel(tag, ch, ctx.Err(), fn)
+	case <-expired:
+		return t.cancel(tag, ch, os.ErrDeadlineExceeded, fn)
+	}
+}
+
+// register creates the channel that the response to the request
+// with the given tag will be sent on.
+func (t *transport) register(tag uint16) (chan styxproto.Msg, error) {
+	ch := make(chan styxproto.Msg)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	t.pending[tag] = ch
+	return ch, nil
+}
+
+func (t *transport) unregister(tag uint16) {
+	t.mu.Lock()
+	delete(t.pending, tag)
+	t.mu.Unlock()
+}
+
+// receive processes a response taken from a channel created by
+// register; ok is false if the channel was closed.
+func (t *transport) receive(msg styxproto.Msg, ok bool, fn func(styxproto.Msg) error) error {
+	if !ok {
+		return t.Err()
+	}
+	defer func() { t.ack <- struct{}{} }()
+
+	if m, ok := msg.(styxproto.Rerror); ok {
+		return serverError(m)
+	}
+	return fn(msg)
+}
+
+// cancel sends a Tflush for the request with the given tag, whose
+// response would arrive on ch. From flush(5), the tag may not be
+// reused until the Rflush arrives, and a response to the original
+// request that arrives before the Rflush must be processed as usual.
+func (t *transport) cancel(oldtag uint16, ch chan styxproto.Msg, cause error, fn func(styxproto.Msg) error) error {
+	tag, ok := t.tags.Get()
+	if !ok {
+		// We cannot flush the request, so wait for it.
+		msg, ok := <-ch
+		return t.receive(msg, ok, fn)
+	}
+	defer t.tags.Free(tag)
+
+	flushed, err := t.register(tag)
+	if err != nil {
+		return err
+	}
+	t.Tflush(tag, oldtag)
+	if err := t.Flush(); err != nil {
+		t.unregister(tag)
+		return err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		err = t.receive(msg, ok, fn)
+		if _, ok := <-flushed; ok {
+			t.ack <- struct{}{}
+		}
+		return err
+	case _, ok := <-flushed:
+		// The server will not respond to the original request, and
+		// any response that arrives anyway is discarded.
+		t.unregister(oldtag)
+		if ok {
+			t.ack <- struct{}{}
+		}
+		return cause
+	}
+}
@@ -0,0 +1,253 @@
+package styx
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"aqwari.net/net/styx/internal/pool"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// The maximum number of directory fids a clientConn keeps open.
+const maxCachedDirs = 64
+
+// A dirCache holds fids for recently used directories, so that
+// opening files in the same directory does not need to walk from
+// the root of the file tree every time.
+//
+// Files may be removed or renamed by other clients, so a cached fid
+// can go stale. The clientConn only invalidates entries for changes
+// it makes itself.
+type dirCache struct {
+	mu      sync.Mutex
+	root    *dirEntry
+	entries map[string]*dirEntry
+}
+
+type dirEntry struct {
+	fid uint32
+
+	// The number of walks in progress from fid. An entry cannot be
+	// clunked while it is in use.
+	refs int
+
+	// Set when the entry is removed from the cache. The fid is
+	// clunked once it is no longer in use.
+	stale bool
+}
+
+// acquire returns the cached fid for the directory at the absolute
+// path name, or nil if there is none. The caller must release the
+// entry when it is done with it.
+func (dc *dirCache) acquire(name string) *dirEntry {
+	if name == "/" {
+		return dc.root
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	e := dc.entries[name]
+	if e != nil {
+		e.refs++
+	}
+	return e
+}
+
+// release marks e as no longer in use by the caller, and reports
+// whether its fid should be clunked.
+func (dc *dirCache) release(e *dirEntry) bool {
+	if e == dc.root {
+		return false
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	e.refs--
+	return e.stale && e.refs == 0
+}
+
+// add caches fid as the directory at the absolute path name. If
+// the directory is already cached, add returns false, and the caller
+// keeps ownership of fid. The fids of any entries evicted to make
+// room are returned, to be clunked by the caller.
+func (dc *dirCache) add(name string, fid uint32) (ok bool, evicted []uint32) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if _, ok := dc.entries[name]; ok {
+		return false, nil
+	}
+	if dc.entries == nil {
+		dc.entries = make(map[string]*dirEntry)
+	}
+	for k, e := range dc.entries {
+		if len(dc.entries) < maxCachedDirs {
+			break
+		}
+		delete(dc.entries, k)
+		e.stale = true
+		if e.refs == 0 {
+			evicted = append(evicted, e.fid)
+		}
+	}
+	dc.entries[name] = &dirEntry{fid: fid}
+	return true, evicted
+}
+
+// invalidate removes the entries for the file at the absolute path
+// name and everything beneath it. The fids of removed entries that
+// are not in use are returned, to be clunked by the caller.
+func (dc *dirCache) invalidate(name string) []uint32 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	var fids []uint32
+	for k, e := range dc.entries {
+		if name == "/" || k == name || strings.HasPrefix(k, name+"/") {
+			delete(dc.entries, k)
+			e.stale = true
+			if e.refs == 0 {
+				fids = append(fids, e.fid)
+			}
+		}
+	}
+	return fids
+}
+
+// reset empties the cache, after the fids it holds are lost along
+// with the connection to the server. Fids that are not in use are
+// returned to fids; the rest are released by their users.
+func (dc *dirCache) reset(fids *pool.FidPool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for k, e := range dc.entries {
+		delete(dc.entries, k)
+		e.stale = true
+		if e.refs == 0 {
+			fids.Free(e.fid)
+		}
+	}
+}
+
+// walk walks newfid to the file reached by following names from
+// fid, and returns the qid of that file. If the walk fails, newfid
+// is not bound to a file on the server. A walk with no names clones
+// fid, and returns a nil qid.
+func (c *clientConn) walk(ctx context.Context, t *transport, fid, newfid uint32, names ...string) (styxproto.Qid, error) {
+	var qid styxproto.Qid
+	from := fid
+	for first := true; first || len(names) > 0; first = false {
+		elem := names
+		if len(elem) > styxproto.MaxWElem {
+			elem = elem[:styxproto.MaxWElem]
+		}
+		names = names[len(elem):]
+		err := c.rpc(ctx, t, func(enc *styxproto.Encoder, tag uint16) error {
+			return enc.Twalk(tag, from, newfid, elem...)
+		}, func(msg styxproto.Msg) error {
+			m, ok := msg.(styxproto.Rwalk)
+			if !ok {
+				return errUnexpectedMsg{msg}
+			}
+			if m.Nwqid() < len(elem) {
+				return os.ErrNotExist
+			}
+			if len(elem) > 0 {
+				qid = append(styxproto.Qid(nil), m.Wqid(len(elem)-1)...)
+			}
+			return nil
+		})
+		if err != nil {
+			if from == newfid {
+				c.tclunk(t, newfid)
+			}
+			return nil, err
+		}
+		from = newfid
+	}
+	return qid, nil
+}
+
+// walkTo allocates a new fid, and walks it to the file at the
+// absolute path name, starting from the fid of its parent directory,
+// which is cached for later walks.
+func (c *clientConn) walkTo(ctx context.Context, t *transport, name string) (uint32, error) {
+	fid, ok := c.fids.Get()
+	if !ok {
+		return 0, errTooManyFids
+	}
+	name = path.Clean(name)
+	dir, err := c.dir(ctx, t, path.Dir(name))
+	if err != nil {
+		c.fids.Free(fid)
+		return 0, err
+	}
+	var elem []string
+	if name != "/" {
+		elem = []string{path.Base(name)}
+	}
+	_, err = c.walk(ctx, t, dir.fid, fid, elem...)
+	c.releaseDir(t, dir)
+	if err != nil {
+		c.fids.Free(fid)
+		return 0, err
+	}
+	return fid, nil
+}
+
+// dir returns a cache entry for the directory at the absolute path
+// name, walking to it from its closest cached ancestor if it is not
+// cached itself. The caller must release the entry with releaseDir.
+func (c *clientConn) dir(ctx context.Context, t *transport, name string) (*dirEntry, error) {
+	if e := c.dirs.acquire(name); e != nil {
+		return e, nil
+	}
+	var (
+		rel  []string
+		anc  = name
+		from *dirEntry
+	)
+	for from == nil {
+		rel = append([]string{path.Base(anc)}, rel...)
+		anc = path.Dir(anc)
+		from = c.dirs.acquire(anc)
+	}
+	fid, ok := c.fids.Get()
+	if !ok {
+		c.releaseDir(t, from)
+		return nil, errTooManyFids
+	}
+	qid, err := c.walk(ctx, t, from.fid, fid, rel...)
+	c.releaseDir(t, from)
+	if err != nil {
+		c.fids.Free(fid)
+		return nil, err
+	}
+	if qid.Type()&styxproto.QTDIR == 0 {
+		c.clunk(t, fid)
+		return nil, Error{Msg: "not a directory", Errno: styxproto.ENOTDIR}
+	}
+	added, evicted := c.dirs.add(name, fid)
+	for _, fid := range evicted {
+		c.clunk(t, fid)
+	}
+	if !added {
+		// Another walk cached the directory first.
+		c.clunk(t, fid)
+		return c.dir(ctx, t, name)
+	}
+	return c.dirs.acquire(name), nil
+}
+
+func (c *clientConn) releaseDir(t *transport, e *dirEntry) {
+	if c.dirs.release(e) {
+		c.clunk(t, e.fid)
+	}
+}
+
+// forgetDirs invalidates the cached fids for the file at the
+// absolute path name, and anything beneath it.
+func (c *clientConn) forgetDirs(t *transport, name string) {
+	for _, fid := range c.dirs.invalidate(name) {
+		c.clunk(t, fid)
+	}
+}
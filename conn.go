@@ -1,17 +1,21 @@
 package styx
 
 import (
-	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"aqwari.net/net/styx/internal/qidpool"
 	"aqwari.net/net/styx/internal/styxfile"
 	"aqwari.net/net/styx/internal/threadsafe"
-	"aqwari.net/net/styx/internal/tracing"
+	"aqwari.net/net/styx/qidpool"
 	"aqwari.net/net/styx/styxproto"
+	"aqwari.net/net/styx/styxtrace"
 
 	"context"
 )
@@ -21,6 +25,9 @@ var (
 	errTagInUse     = errors.New("tag in use")
 	errNoFid        = errors.New("no such fid")
 	errNotSupported = errors.New("not supported")
+	errAuthRate     = errors.New("too many auth requests")
+	errClosed       = errors.New("session closed")
+	errNoAuthFile   = errors.New("no auth file")
 )
 
 type fcall interface {
@@ -56,14 +63,19 @@ type conn struct {
 	rwc io.ReadWriteCloser
 
 	// This serves as the parent context for the context attached to all
-	// requests.
-	ctx context.Context
+	// requests. It is cancelled when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// While srv.MaxSize holds the *desired* 9P protocol message
 	// size, msize will contain the actual maximum negotiated with
 	// the client, through a Tversion/Rversion exchange.
 	msize int64
 
+	// The protocol version negotiated with the client; one
+	// of the Version constants in the styxproto package.
+	version string
+
 	// There is no "session id" in 9P. However, because all fids
 	// for a connection must be derived from the fid established
 	// in a Tattach call, any message that contains a fid can be
@@ -73,21 +85,142 @@ type conn struct {
 	// Qids for the file tree, added on-demand.
 	qidpool *qidpool.Pool
 
+	// Caches serving sessions on this connection, told when a
+	// handler replaces a qid with Session.SetQid.
+	qidWatchMu sync.Mutex
+	qidWatch   map[*Cache]struct{}
+
+	// Counts the fids referring to each file, so that removed
+	// files keep their qids while they are still in use.
+	refs fileRefs
+
 	// used to implement request cancellation when a Tflush
 	// message is received.
 	pendingReq *threadsafe.Map
+
+	// Protects state, and serializes updates to the read deadline
+	// of rwc, which enforces the server's IdleTimeout.
+	stateMu sync.Mutex
+	state   ConnState
+
+	// Tokens for Tauth requests, refilled at the server's AuthRate.
+	// Only accessed from the serve goroutine.
+	authTokens float64
+	authTime   time.Time
+
+	// Set once a Tattach request succeeds.
+	attached int32
 }
 
-func (c *conn) remoteAddr() net.Addr {
-	type hasRemote interface {
-		RemoteAddr() net.Addr
+// A deadlineWriter sets a deadline for each write to a connection.
+// If a write fails, the connection is closed, so that the conn's
+// read loop notices a stalled client.
+type deadlineWriter struct {
+	rwc interface {
+		io.ReadWriteCloser
+		SetWriteDeadline(time.Time) error
+	}
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.rwc.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.rwc.Write(p)
+	if err != nil {
+		w.rwc.Close()
+	}
+	return n, err
+}
+
+// sessions returns the sessions established on the connection.
+func (c *conn) sessions() []*Session {
+	var sessions []*Session
+	seen := make(map[*Session]struct{})
+	c.sessionFid.Do(func(m map[interface{}]interface{}) {
+		for _, v := range m {
+			s := v.(*Session)
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				sessions = append(sessions, s)
+			}
+		}
+	})
+	return sessions
+}
+
+// watchQids arranges for cache to forget the files whose qids are
+// replaced on the connection.
+func (c *conn) watchQids(cache *Cache) {
+	c.qidWatchMu.Lock()
+	defer c.qidWatchMu.Unlock()
+	if c.qidWatch == nil {
+		c.qidWatch = make(map[*Cache]struct{})
+	}
+	c.qidWatch[cache] = struct{}{}
+}
+
+// qidChanged tells the Caches watching the connection that the qid
+// of the file at path in the tree access was replaced.
+func (c *conn) qidChanged(access, path string) {
+	c.qidWatchMu.Lock()
+	caches := make([]*Cache, 0, len(c.qidWatch))
+	for cache := range c.qidWatch {
+		caches = append(caches, cache)
 	}
-	if nc, ok := c.rwc.(hasRemote); ok {
+	c.qidWatchMu.Unlock()
+	for _, cache := range caches {
+		cache.forget(access, path)
+	}
+}
+
+func (c *conn) remoteAddr() net.Addr {
+	return remoteAddr(c.rwc)
+}
+
+// remoteAddr, localAddr and tlsState return information about
+// the network connection rwc, if it is available.
+func remoteAddr(rwc interface{}) net.Addr {
+	if nc, ok := rwc.(interface{ RemoteAddr() net.Addr }); ok {
 		return nc.RemoteAddr()
 	}
 	return nil
 }
 
+func localAddr(rwc interface{}) net.Addr {
+	if nc, ok := rwc.(interface{ LocalAddr() net.Addr }); ok {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
+func tlsState(rwc interface{}) *tls.ConnectionState {
+	if tc, ok := rwc.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// access returns the name of the file tree requested by a client
+// that sent aname in its Tauth or Tattach request. See the
+// EnableVHost option of Server.
+func (c *conn) access(aname string) string {
+	if aname != "" || !c.srv.EnableVHost {
+		return aname
+	}
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		if name := tc.ConnectionState().ServerName; name != "" {
+			return name
+		}
+	}
+	if nc, ok := c.rwc.(net.Conn); ok {
+		if host, _, err := net.SplitHostPort(nc.LocalAddr().String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
 func (c *conn) sessionByFid(fid uint32) (*Session, bool) {
 	if v, ok := c.sessionFid.Get(fid); ok {
 		return v.(*Session), true
@@ -97,6 +230,8 @@ func (c *conn) sessionByFid(fid uint32) (*Session, bool) {
 
 // Close the connection
 func (c *conn) close() error {
+	c.cancel()
+
 	// Cancel all pending requests
 	c.pendingReq.Do(func(m map[interface{}]interface{}) {
 		for tag, cancel := range m {
@@ -119,10 +254,14 @@ func (c *conn) close() error {
 		}
 	})
 
-	return c.rwc.Close()
+	err := c.rwc.Close()
+	c.setState(StateClosed)
+	return err
 }
 
-func newConn(srv *Server, rwc io.ReadWriteCloser) *conn {
+// newConn creates a conn serving rwc. The contexts of its requests
+// are derived from ctx, and carry rwc as the "conn" value.
+func newConn(ctx context.Context, srv *Server, rwc io.ReadWriteCloser) *conn {
 	var msize int64 = styxproto.DefaultMaxSize
 	if srv.MaxSize > 0 {
 		if srv.MaxSize > styxproto.MinBufSize {
@@ -131,65 +270,224 @@ func newConn(srv *Server, rwc io.ReadWriteCloser) *conn {
 			msize = styxproto.MinBufSize
 		}
 	}
-	var enc *styxproto.Encoder
-	var dec *styxproto.Decoder
-	if srv.TraceLog != nil {
-		enc = tracing.Encoder(rwc, func(m styxproto.Msg) {
-			srv.TraceLog.Printf("← %03d %s", m.Tag(), m)
-		})
-		dec = tracing.Decoder(rwc, func(m styxproto.Msg) {
-			srv.TraceLog.Printf("→ %03d %s", m.Tag(), m)
-		})
-	} else {
-		enc = styxproto.NewEncoder(rwc)
-		dec = styxproto.NewDecoder(rwc)
+	var r io.Reader = statsReader{rwc, &srv.stats}
+	var w io.Writer = rwc
+	if srv.WriteTimeout > 0 {
+		if dw, ok := rwc.(interface {
+			io.ReadWriteCloser
+			SetWriteDeadline(time.Time) error
+		}); ok {
+			w = deadlineWriter{dw, srv.WriteTimeout}
+		}
 	}
-	return &conn{
-		Decoder:    dec,
-		Encoder:    enc,
+	w = statsWriter{w, &srv.stats}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, "conn", rwc))
+	c := &conn{
 		srv:        srv,
 		rwc:        rwc,
-		ctx:        context.Background(),
+		ctx:        ctx,
+		cancel:     cancel,
 		msize:      msize,
 		sessionFid: threadsafe.NewMap(),
 		pendingReq: threadsafe.NewMap(),
-		qidpool:    qidpool.New(),
+		qidpool:    qidpool.NewFunc(srv.newQid),
+	}
+	if srv.TraceLog != nil || srv.Trace != nil || srv.Metrics != nil {
+		tr := newConnTracer(srv, c)
+		c.Encoder = styxtrace.Encoder(w, tr.sent)
+		c.Decoder = styxtrace.Decoder(r, tr.received)
+	} else {
+		c.Encoder = styxproto.NewEncoder(w)
+		c.Decoder = styxproto.NewDecoder(r)
 	}
+	return c
 }
 
 func (c *conn) qid(name string, qtype uint8) styxproto.Qid {
 	return c.qidpool.Put(name, qtype)
 }
 
-func (c *conn) getQid(name string, qtype uint8) (styxproto.Qid, bool) {
-	return c.qidpool.Get(name)
+// iounit chooses the iounit to send in response to an open or create
+// request. n is the value set by the handler; if it is not positive,
+// an IOUnit method of rwc is consulted. The result never exceeds the
+// largest read or write payload that fits in a message.
+func (c *conn) iounit(n int, rwc interface{}) uint32 {
+	if u, ok := rwc.(interface{ IOUnit() int }); ok && n <= 0 {
+		n = u.IOUnit()
+	}
+	if n <= 0 {
+		return 0
+	}
+	if max := c.msize - styxproto.IOHeaderSize; int64(n) > max {
+		return uint32(max)
+	}
+	return uint32(n)
+}
+
+// newStat creates a Stat structure in the format used by the
+// negotiated protocol version. The extension is only used by
+// 9P2000.u.
+func (c *conn) newStat(buf []byte, name, uid, gid, muid, ext string) (styxproto.Stat, []byte, error) {
+	if c.version == styxproto.Version9P2000U {
+		return styxproto.NewStatU(buf, name, uid, gid, muid, ext)
+	}
+	return styxproto.NewStat(buf, name, uid, gid, muid)
+}
+
+// newDir creates a directory file producing Stat structures in the
+// format used by the negotiated protocol version.
+func (c *conn) newDir(dir Directory, abspath string, atime styxfile.AtimeFunc) styxfile.Interface {
+	if c.version == styxproto.Version9P2000U {
+		return styxfile.NewDirU(dir, abspath, c.qidpool, atime)
+	}
+	return styxfile.NewDir(dir, abspath, c.qidpool, atime)
+}
+
+// Rerror sends an error response in the form used by the
+// negotiated protocol version. The 9P2000.u and 9P2000.L
+// extensions carry a Linux error number, which is derived from
+// the error message; see errno.go.
+func (c *conn) Rerror(tag uint16, format string, args ...interface{}) {
+	c.srv.stats.error()
+	switch c.version {
+	case styxproto.Version9P2000L:
+		c.Encoder.Rlerror(tag, errno(format, args))
+	case styxproto.Version9P2000U:
+		c.Encoder.RerrorU(tag, errno(format, args), format, args...)
+	default:
+		c.Encoder.Rerror(tag, format, args...)
+	}
 }
 
 // All request contexts must have their cancel functions
 // called, to free up resources in the context. Returns false
 // if the tag is already cancelled
 func (c *conn) clearTag(tag uint16) bool {
+	return c.answerTag(tag, nil)
+}
+
+// answerTag is clearTag for the response to a request. If the tag
+// is still pending, answered is called before the context of the
+// request is cancelled, so that anything waiting on the context can
+// tell that the request was answered, rather than flushed.
+func (c *conn) answerTag(tag uint16, answered func()) bool {
+	// The tag must be fetched and deleted atomically, so that
+	// only one of a response and a timeout is sent.
 	var cancel context.CancelFunc
-	if c.pendingReq.Fetch(tag, &cancel) {
-		cancel()
-		c.pendingReq.Del(tag)
-		return true
+	c.pendingReq.Do(func(m map[interface{}]interface{}) {
+		if v, ok := m[tag]; ok {
+			cancel = v.(context.CancelFunc)
+			delete(m, tag)
+		}
+	})
+	if cancel == nil {
+		return false
 	}
-	return false
+	if answered != nil {
+		answered()
+	}
+	cancel()
+	c.updateIdle()
+	return true
+}
+
+// updateIdle moves an active connection to StateIdle once it has
+// no requests in progress, and enforces the server's IdleTimeout.
+// While there are no requests in progress, the connection is closed
+// if the client does not send a message within IdleTimeout.
+// Otherwise, the client may be waiting for a response, and there is
+// no deadline.
+func (c *conn) updateIdle() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	idle := c.idle()
+	if idle && c.state == StateActive {
+		c.setStateLocked(StateIdle)
+	}
+	if c.srv.IdleTimeout <= 0 {
+		return
+	}
+	rd, ok := c.rwc.(interface {
+		SetReadDeadline(time.Time) error
+	})
+	if !ok {
+		return
+	}
+	if idle {
+		rd.SetReadDeadline(time.Now().Add(c.srv.IdleTimeout))
+	} else {
+		rd.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *conn) setState(state ConnState) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.setStateLocked(state)
+}
+
+// setStateLocked records the state of the connection, and reports
+// changes to the server's ConnState hook. A closed connection stays
+// closed.
+func (c *conn) setStateLocked(state ConnState) {
+	if c.state == state || c.state == StateClosed {
+		return
+	}
+	c.state = state
+	if hook := c.srv.ConnState; hook != nil {
+		if nc, ok := c.rwc.(net.Conn); ok {
+			hook(nc, state)
+		}
+	}
+}
+
+// idle reports whether the connection has no requests in progress.
+func (c *conn) idle() bool {
+	var idle bool
+	c.pendingReq.Do(func(m map[interface{}]interface{}) {
+		idle = len(m) == 0
+	})
+	return idle
 }
 
 // runs in its own goroutine, one per connection.
 func (c *conn) serve() {
+	defer c.srv.trackConn(c, false)
+	if m := c.srv.Metrics; m != nil {
+		m.ConnOpened(c.remoteAddr())
+		defer m.ConnClosed(c.remoteAddr())
+	}
 	defer c.close()
 
+	if d := c.srv.AttachTimeout; d > 0 {
+		timer := time.AfterFunc(d, func() {
+			if atomic.LoadInt32(&c.attached) == 0 {
+				c.srv.logf("%s did not attach within %s", c.remoteAddr(), d)
+				c.rwc.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+	c.updateIdle()
 	if !c.acceptTversion() {
 		return
 	}
+	if max := c.srv.MaxPending; max > 0 {
+		if max < c.msize {
+			max = c.msize
+		}
+		// Waiting for room could keep the Tflush that makes room
+		// from being read, so requests over budget are refused.
+		c.Decoder.Budget = styxproto.NewBudget(max)
+		c.Decoder.Oversize = styxproto.OversizeSkip
+	}
+	c.setState(StateIdle)
 
 	for c.Next() && c.Encoder.Err() == nil {
 		if !c.handleMessage(c.Msg()) {
 			break
 		}
+		c.updateIdle()
 	}
 	if err := c.Encoder.Err(); err != nil {
 		c.srv.logf("write error: %s", err)
@@ -198,12 +496,23 @@ func (c *conn) serve() {
 }
 
 func (c *conn) handleMessage(m styxproto.Msg) bool {
+	c.srv.stats.message(m)
 	if _, ok := c.pendingReq.Get(m.Tag()); ok {
 		c.srv.logf("fatal: client re-used existing tag %d", m.Tag())
 		return false
 	}
-	ctx, cancel := context.WithCancel(c.ctx)
+	ctx, cancel := c.requestContext(c.parentContext(m), m.Tag())
+	if n := c.Decoder.Charged(); n > 0 {
+		// The request holds its share of the budget until its
+		// tag is cleared.
+		done := cancel
+		cancel = func() {
+			done()
+			c.Decoder.Budget.Release(n)
+		}
+	}
 	c.pendingReq.Put(m.Tag(), cancel)
+	c.setState(StateActive)
 
 	switch m := m.(type) {
 	case styxproto.Tauth:
@@ -221,12 +530,49 @@ func (c *conn) handleMessage(m styxproto.Msg) bool {
 		c.Flush()
 		return true
 	default:
+		c.clearTag(m.Tag())
 		c.Rerror(m.Tag(), "unexpected %T message", m)
 		c.Flush()
 		return true
 	}
 }
 
+// parentContext returns the context that the context of m is
+// derived from. Requests made in a session are cancelled when
+// the session is closed.
+func (c *conn) parentContext(m styxproto.Msg) context.Context {
+	if m, ok := m.(fcall); ok {
+		if s, ok := c.sessionByFid(m.Fid()); ok {
+			return s.reqCtx
+		}
+	}
+	return c.ctx
+}
+
+// requestContext creates the context for the request with the given
+// tag. If the server has a RequestTimeout, the request is cancelled
+// and answered with an error once it expires.
+func (c *conn) requestContext(parent context.Context, tag uint16) (context.Context, context.CancelFunc) {
+	d := c.srv.RequestTimeout
+	if d <= 0 {
+		return context.WithCancel(parent)
+	}
+	// The context is cancelled by clearTag, rather than by a
+	// deadline, so that the handler cannot answer the request
+	// between its cancellation and the error response.
+	ctx, cancel := context.WithCancel(parent)
+	timer := time.AfterFunc(d, func() {
+		if c.clearTag(tag) {
+			c.Rerror(tag, "request timed out after %s", d)
+			c.Flush()
+		}
+	})
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
 // This is the first thing we do on a new connection. The first
 // message a client sends *must* be a Tversion message.
 func (c *conn) acceptTversion() bool {
@@ -234,6 +580,7 @@ func (c *conn) acceptTversion() bool {
 	c.Decoder.MaxSize = c.msize
 
 	for c.Next() && c.Encoder.Err() == nil {
+		c.srv.stats.message(c.Msg())
 		tver, ok := c.Msg().(styxproto.Tversion)
 		if !ok {
 			c.Rerror(tver.Tag(), "need Tversion")
@@ -249,14 +596,20 @@ func (c *conn) acceptTversion() bool {
 			c.Encoder.MaxSize = msize
 			c.Decoder.MaxSize = msize
 		}
-		if !bytes.HasPrefix(tver.Version(), []byte("9P2000")) {
+		switch version := string(tver.Version()); {
+		case version == styxproto.Version9P2000L, version == styxproto.Version9P2000U:
+			c.version = version
+		case strings.HasPrefix(version, styxproto.Version9P2000):
+			c.version = styxproto.Version9P2000
+		default:
 			c.Rversion(uint32(c.msize), "unknown")
 			c.Flush()
-		} else {
-			c.Rversion(uint32(c.msize), "9P2000")
-			c.Flush()
-			return true
+			continue
 		}
+		c.Decoder.Version = c.version
+		c.Rversion(uint32(c.msize), c.version)
+		c.Flush()
+		return true
 	}
 	c.Flush()
 	c.srv.logf("%s version negotiation failed", c.remoteAddr())
@@ -265,11 +618,10 @@ func (c *conn) acceptTversion() bool {
 
 // NOTE(droyo) consider a scenario where a malicious actor connects
 // to the server that repeatedly spams Tauth requests. It can quickly
-// use up resources on the server. Consider the following measures:
-//
-// - rate-limiting Tauth requests
-// - Setting a per-connection session limit
-// - close connections that have not established a session in N seconds
+// use up resources on the server. Server.AuthRate limits the rate of
+// Tauth requests, and Server.AttachTimeout closes connections that
+// have not established a session in time. A per-connection session
+// limit would also help.
 func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 	var (
 		f   interface{}
@@ -281,24 +633,24 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 		c.Rerror(m.Tag(), "%s", errNotSupported)
 		return true
 	}
+	if !c.allowAuth() {
+		c.clearTag(m.Tag())
+		c.Rerror(m.Tag(), "%s", errAuthRate)
+		return true
+	}
 	if _, ok := c.sessionFid.Get(m.Afid()); ok {
 		c.clearTag(m.Tag())
 		c.Rerror(m.Tag(), "fid %x in use", m.Afid())
 		return true
 	}
-	s := newSession(c, m)
-
+	var ch *Channel
 	if c.srv.OpenAuth == nil {
 		var server net.Conn
 		f, server = net.Pipe()
-		ch := &Channel{
+		ch = &Channel{
 			Context:         c.ctx,
 			ReadWriteCloser: server,
 		}
-		go func() {
-			s.authC <- c.srv.Auth(ch, s.User, s.Access)
-			close(s.authC)
-		}()
 	} else {
 		f, err = c.srv.OpenAuth()
 		if err != nil {
@@ -308,6 +660,16 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 		}
 		c.ctx = context.WithValue(c.ctx, "Auth", f)
 	}
+
+	// The session is created once c.ctx is complete, as the
+	// contexts of its requests are derived from it.
+	s := newSession(c, m)
+	if ch != nil {
+		go func() {
+			s.authC <- c.srv.Auth(ch, s.User, s.Access)
+			close(s.authC)
+		}()
+	}
 	rwc, err := styxfile.New(f)
 	if err != nil {
 		// This should never happen
@@ -321,6 +683,42 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 	return true
 }
 
+// allowAuth reports whether a Tauth request is within the server's
+// AuthRate, using a token bucket holding up to AuthRate tokens.
+func (c *conn) allowAuth() bool {
+	limit := float64(c.srv.AuthRate)
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if c.authTime.IsZero() {
+		c.authTokens = limit
+	} else {
+		c.authTokens += now.Sub(c.authTime).Seconds() * limit
+		if c.authTokens > limit {
+			c.authTokens = limit
+		}
+	}
+	c.authTime = now
+	if c.authTokens < 1 {
+		return false
+	}
+	c.authTokens--
+	return true
+}
+
+// policyCheck answers the requests refused by the Policy of a
+// Server, leaving the rest for the Handler.
+type policyCheck func(s *Session, req Request) error
+
+func (fn policyCheck) Serve9P(s *Session) {
+	for s.Next() {
+		if err := fn(s, s.Request()); err != nil {
+			s.Request().Rerror("%s", err)
+		}
+	}
+}
+
 func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 	defer c.Flush()
 	var handler Handler = HandlerFunc(func(s *Session) {
@@ -330,9 +728,25 @@ func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 	if c.srv.Handler != nil {
 		handler = c.srv.Handler
 	}
+	if c.srv.Policy != nil {
+		handler = Stack(policyCheck(c.srv.Policy), handler)
+	}
 	var s *Session
 	if c.srv.Auth == nil {
 		s = newSession(c, m)
+	} else if m.Afid() == styxproto.NoFid && c.srv.AuthNoAfid {
+		// Without an auth fid, Auth can only go by the
+		// connection itself, such as a TLS client certificate.
+		s = newSession(c, m)
+		if err := c.srv.Auth(&Channel{c.ctx, noAuthFile{}}, s.User, s.Access); err != nil {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "auth failed: %s", err)
+			return true
+		}
+	} else if m.Afid() == styxproto.NoFid && c.srv.AttachAuth != nil {
+		// Without an auth fid, the client is authenticated
+		// by AttachAuth alone, below.
+		s = newSession(c, m)
 	} else {
 		var (
 			ok  bool
@@ -347,7 +761,7 @@ func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 		}
 		// From attach(5): The same validated afid may be used for
 		// multiple attach messages with the same uname and aname.
-		if s.User != string(m.Uname()) || s.Access != string(m.Aname()) {
+		if s.User != string(m.Uname()) || s.Access != c.access(string(m.Aname())) {
 			c.clearTag(m.Tag())
 			c.Rerror(m.Tag(), "afid mismatch for %s on %s", m.Uname(), m.Aname())
 			return true
@@ -355,7 +769,7 @@ func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 		if c.srv.OpenAuth == nil {
 			err = <-s.authC
 		} else {
-			err = c.srv.Auth(&Channel{c.ctx, nil}, s.User, s.Access)
+			err = c.srv.Auth(&Channel{c.ctx, noAuthFile{}}, s.User, s.Access)
 		}
 		if err != nil {
 			c.clearTag(m.Tag())
@@ -363,13 +777,22 @@ func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 			return true
 		}
 	}
+	if c.srv.AttachAuth != nil {
+		if err := c.srv.AttachAuth(&Channel{c.ctx, noAuthFile{}}, s.User, s.Access); err != nil {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "auth failed: %s", err)
+			return true
+		}
+	}
 	go func() {
 		handler.Serve9P(s)
-		s.cleanupHandler()
+		s.CloseSession()
+		s.drain()
 	}()
 	c.sessionFid.Put(m.Fid(), s)
 	s.IncRef()
-	s.files.Put(m.Fid(), file{name: "/", rwc: nil})
+	s.putFile(m.Fid(), file{name: "/", rwc: nil})
+	atomic.StoreInt32(&c.attached, 1)
 	c.clearTag(m.Tag())
 	c.Rattach(m.Tag(), c.qid("/", styxproto.QTDIR))
 	return true
@@ -395,6 +818,20 @@ func (c *conn) handleFcall(ctx context.Context, msg fcall) bool {
 	}
 
 	file, ok := s.fetchFile(msg.Fid())
+
+	// The fids of a closed session are forgotten as the client
+	// uses them. Its files may already be gone.
+	if s.closed() {
+		c.sessionFid.Del(msg.Fid())
+		s.delFile(msg.Fid())
+		if !s.DecRef() {
+			s.endSession()
+		}
+		c.clearTag(msg.Tag())
+		c.Rerror(msg.Tag(), "%s", errClosed)
+		c.Flush()
+		return true
+	}
 	if !ok {
 		panic("bug: fid in session map, but no file associated")
 	}
@@ -439,6 +876,44 @@ func (c *conn) handleFcall(ctx context.Context, msg fcall) bool {
 		return s.handleTwstat(ctx, msg, file)
 	case styxproto.Tclunk:
 		return s.handleTclunk(ctx, msg, file)
+
+	// 9P2000.L
+	case styxproto.Tlopen:
+		return s.handleTlopen(ctx, msg, file)
+	case styxproto.Tlcreate:
+		return s.handleTlcreate(ctx, msg, file)
+	case styxproto.Tmkdir:
+		return s.handleTmkdir(ctx, msg, file)
+	case styxproto.Tgetattr:
+		return s.handleTgetattr(ctx, msg, file)
+	case styxproto.Tsetattr:
+		return s.handleTsetattr(ctx, msg, file)
+	case styxproto.Treaddir:
+		return s.handleTreaddir(ctx, msg, file)
+	case styxproto.Trename:
+		return s.handleTrename(ctx, msg, file)
+	case styxproto.Trenameat:
+		return s.handleTrenameat(ctx, msg, file)
+	case styxproto.Tunlinkat:
+		return s.handleTunlinkat(ctx, msg, file)
+	case styxproto.Tfsync:
+		return s.handleTfsync(ctx, msg, file)
+	case styxproto.Tsymlink:
+		return s.handleTsymlink(ctx, msg, file)
+	case styxproto.Treadlink:
+		return s.handleTreadlink(ctx, msg, file)
+	case styxproto.Tlink:
+		return s.handleTlink(ctx, msg, file)
+	case styxproto.Tstatfs:
+		return s.handleTstatfs(ctx, msg, file)
+	case styxproto.Tlock:
+		return s.handleTlock(ctx, msg, file)
+	case styxproto.Tgetlock:
+		return s.handleTgetlock(ctx, msg, file)
+	case styxproto.Tmknod:
+		return s.handleTmknod(ctx, msg, file)
+	case styxproto.Txattrwalk, styxproto.Txattrcreate:
+		return s.handleUnsupported(ctx, msg, file)
 	}
 	// invalid messages should have been caught
 	// in the conn.serve loop, so we should never
@@ -0,0 +1,153 @@
+package styx
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Plan 9 names network addresses with dial strings of the form
+// net!address!service, such as tcp!example.com!564 or
+// unix!/tmp/ns.glenda.:0/acme. Both the Client and the Server accept
+// them, in addition to the forms used by the net package.
+
+// A serverAddr names a 9P server that a Client connects to.
+type serverAddr struct {
+	scheme string // "tcp", "tls" or "unix"
+	addr   string // host:port, or the path of a unix socket
+	user   string // the user requested, if any
+
+	// Set if the address was given as a dial string or a socket
+	// path rather than a URL.
+	dialstr bool
+}
+
+func (a serverAddr) network() string {
+	if a.scheme == "unix" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (a serverAddr) hostname() string {
+	host, _, err := net.SplitHostPort(a.addr)
+	if err != nil {
+		return a.addr
+	}
+	return host
+}
+
+// key identifies the connections of a Client that can be shared.
+func (a serverAddr) key() string {
+	return a.scheme + "://" + clientUser(a.user) + "@" + a.addr
+}
+
+// uri returns the address of the file at name on the server, in
+// the same form the address was parsed from.
+func (a serverAddr) uri(name string) string {
+	if !a.dialstr {
+		u := url.URL{Scheme: a.scheme, Host: a.addr, Path: name}
+		if a.user != "" {
+			u.User = url.User(a.user)
+		}
+		return u.String()
+	}
+	if a.scheme == "unix" {
+		return "unix!" + a.addr + "!" + name
+	}
+	host, port, _ := net.SplitHostPort(a.addr)
+	return "tcp!" + host + "!" + port + "!" + name
+}
+
+// parseURI parses the address of a file on a 9P server, which is
+// one of
+//
+//	tcp://[user@]host[:port]/path/to/file
+//	tls://[user@]host[:port]/path/to/file
+//	tcp!host!port[!/path/to/file]
+//	unix!/path/to/socket[!/path/to/file]
+//	/path/to/socket
+//
+// and returns the server address, and the cleaned, absolute path of
+// the file on the server, which is the root of the file tree if none
+// is given.
+func parseURI(uri string) (serverAddr, string, error) {
+	if !strings.Contains(uri, "://") {
+		if strings.HasPrefix(uri, "/") {
+			return serverAddr{scheme: "unix", addr: uri, dialstr: true}, "/", nil
+		}
+		if strings.Contains(uri, "!") {
+			return parseDialString(uri)
+		}
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return serverAddr{}, "", err
+	}
+	a := serverAddr{scheme: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "tcp", "tls":
+	default:
+		return serverAddr{}, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		a.addr = net.JoinHostPort(u.Hostname(), "564")
+	}
+	if u.User != nil {
+		a.user = u.User.Username()
+	}
+	return a, path.Clean("/" + u.Path), nil
+}
+
+func parseDialString(s string) (serverAddr, string, error) {
+	a := serverAddr{dialstr: true}
+	f := strings.Split(s, "!")
+	var rest []string
+	switch f[0] {
+	case "unix":
+		if len(f) < 2 || f[1] == "" {
+			return a, "", fmt.Errorf("invalid dial string %q", s)
+		}
+		a.scheme, a.addr, rest = "unix", f[1], f[2:]
+	case "tcp", "net":
+		if len(f) < 3 || f[1] == "" || f[1] == "*" {
+			return a, "", fmt.Errorf("invalid dial string %q", s)
+		}
+		a.scheme, a.addr, rest = "tcp", net.JoinHostPort(f[1], f[2]), f[3:]
+	default:
+		return a, "", fmt.Errorf("unsupported network in dial string %q", s)
+	}
+	switch len(rest) {
+	case 0:
+		return a, "/", nil
+	case 1:
+		return a, path.Clean("/" + rest[0]), nil
+	}
+	return a, "", fmt.Errorf("invalid dial string %q", s)
+}
+
+// listenAddr converts the address a Server listens on, which may
+// be a dial string such as tcp!*!564 or unix!/path/to/socket, or
+// the path of a unix socket, to arguments for net.Listen.
+func listenAddr(addr string) (network, address string, err error) {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "./") {
+		return "unix", addr, nil
+	}
+	if !strings.Contains(addr, "!") {
+		return "tcp", addr, nil
+	}
+	f := strings.Split(addr, "!")
+	switch {
+	case f[0] == "unix" && len(f) == 2:
+		return "unix", f[1], nil
+	case (f[0] == "tcp" || f[0] == "net") && len(f) == 3:
+		host := f[1]
+		if host == "*" {
+			host = ""
+		}
+		return "tcp", net.JoinHostPort(host, f[2]), nil
+	}
+	return "", "", fmt.Errorf("invalid dial string %q", addr)
+}
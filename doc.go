@@ -25,6 +25,12 @@ Serve9P method.  The HandlerFunc type allows regular functions to be used:
 	})
 	styx.ListenAndServe(":564", fs)
 
+The handler above serves the entire file system of the host. The
+FileServer type serves a single directory, and does not let clients
+escape from it:
+
+	styx.ListenAndServe(":564", &styx.FileServer{Root: "/srv/9p"})
+
 Multiple handlers can be overlaid using the Stack function.
 
 	echo := styx.HandlerFunc(func(s *styx.Session) {
@@ -48,5 +54,22 @@ method:
 	})
 	styx.ListenAndServe(":564", styx.Stack(sessionid, echo, fs))
 
+Clients may also negotiate the 9P2000.u or 9P2000.L extensions, used by
+the Linux v9fs driver and QEMU. Where possible, the styx package translates
+their requests into the same request types used for 9P2000, so handlers
+need not be aware of the protocol version in use. Operations without a
+9P2000 equivalent, such as creating symbolic links, are provided as
+additional request types, such as Tsymlink.
+
+The Client type, and the Open function, access files on remote 9P
+servers:
+
+	f, err := styx.Open("tcp://localhost/path/to/file")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	io.Copy(os.Stdout, f)
+
 */
 package styx
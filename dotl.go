@@ -0,0 +1,381 @@
+package styx
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/internal/sys"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// The 9P2000.L extension replaces many 9P2000 messages with ones
+// modeled after Linux system calls. Most of them map cleanly onto
+// the existing request types, so that handlers can serve clients
+// regardless of the protocol version they speak. Those that do not
+// are either answered by the styx package itself, or introduce new
+// request types (see link.go).
+
+// The f_type reported by the Linux v9fs driver.
+const v9fsMagic = 0x01021997
+
+// lopenFlag converts the Linux open flags used in Tlopen and Tlcreate
+// messages to the flags of the os package.
+func lopenFlag(flags uint32) int {
+	var flag int
+	switch flags & styxproto.LACCMODE {
+	case styxproto.LWRONLY:
+		flag = os.O_WRONLY
+	case styxproto.LRDWR:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if flags&styxproto.LCREATE != 0 {
+		flag |= os.O_CREATE
+	}
+	if flags&styxproto.LEXCL != 0 {
+		flag |= os.O_EXCL
+	}
+	if flags&styxproto.LTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	if flags&styxproto.LAPPEND != 0 {
+		flag |= os.O_APPEND
+	}
+	if flags&styxproto.LSYNC != 0 {
+		flag |= os.O_SYNC
+	}
+	return flag
+}
+
+// lopenMode converts the Linux open flags used in Tlopen and Tlcreate
+// messages to the closest 9P2000 open mode.
+func lopenMode(flags uint32) uint8 {
+	var mode uint8
+	switch flags & styxproto.LACCMODE {
+	case styxproto.LWRONLY:
+		mode = styxproto.OWRITE
+	case styxproto.LRDWR:
+		mode = styxproto.ORDWR
+	default:
+		mode = styxproto.OREAD
+	}
+	if flags&styxproto.LTRUNC != 0 {
+		mode |= styxproto.OTRUNC
+	}
+	return mode
+}
+
+func (s *Session) handleTlopen(ctx context.Context, msg styxproto.Tlopen, file file) bool {
+	return s.open(ctx, msg, file, lopenFlag(msg.Flags()), lopenMode(msg.Flags()))
+}
+
+func (s *Session) handleTlcreate(ctx context.Context, msg styxproto.Tlcreate, file file) bool {
+	mode := styxfile.ModeFromUnix(msg.Mode())
+	return s.create(ctx, msg, file, string(msg.Name()), mode, lopenFlag(msg.Flags()), lopenMode(msg.Flags()))
+}
+
+func (s *Session) handleTmkdir(ctx context.Context, msg styxproto.Tmkdir, file file) bool {
+	mode := os.ModeDir | styxfile.ModeFromUnix(msg.Mode())&os.ModePerm
+	return s.create(ctx, msg, file, string(msg.Name()), mode, os.O_RDONLY, styxproto.OREAD)
+}
+
+// Unlike Tcreate, Tmkdir does not open the new directory; the fid
+// still refers to the parent directory.
+func (t Tcreate) rmkdir(rwc interface{}) {
+	if c, ok := rwc.(io.Closer); ok {
+		c.Close()
+	}
+	qid := t.session.conn.newQid(path.Join(t.path, t.Name), styxproto.QTDIR)
+	if t.respond(nil) {
+		t.session.conn.Rmkdir(t.tag, qid)
+	}
+}
+
+func (s *Session) handleTgetattr(ctx context.Context, msg styxproto.Tgetattr, file file) bool {
+	return s.stat(ctx, msg, file)
+}
+
+// attr converts an os.FileInfo to the attributes sent in an Rgetattr
+// message. If the host does not provide numeric ownership, files are
+// reported as belonging to the session's user.
+func (s *Session) attr(name string, info os.FileInfo, qid styxproto.Qid) styxproto.Attr {
+	uid, gid, ok := sys.FileOwnerID(info)
+	if !ok {
+		uid, gid = s.uid, styxproto.NoUid
+	}
+	var nlink uint64 = 1
+	if info.IsDir() {
+		nlink = 2
+	}
+	var size uint64
+	if info.Size() > 0 {
+		size = uint64(info.Size())
+	}
+	mtime := info.ModTime()
+	return styxproto.Attr{
+		Valid:   styxproto.GetattrBasic,
+		Qid:     qid,
+		Mode:    styxfile.ModeUnix(info.Mode()),
+		Uid:     uid,
+		Gid:     gid,
+		Nlink:   nlink,
+		Size:    size,
+		Blksize: uint64(s.conn.msize - styxproto.IOHeaderSize),
+		Blocks:  (size + 511) / 512,
+		Atime:   s.atime(name, info),
+		Mtime:   mtime,
+		Ctime:   mtime,
+	}
+}
+
+// A Tsetattr message is split into the same requests as a Twstat
+// message.
+func (s *Session) handleTsetattr(ctx context.Context, msg styxproto.Tsetattr, file file) bool {
+	// mode, uid+gid, size, atime+mtime
+	const numMutable = 4
+
+	var messages int
+	valid := msg.Valid()
+	status := make(chan error, numMutable)
+	info := newReqInfo(ctx, s, msg, file.name)
+	filled := make([]int32, numMutable)
+
+	if valid&styxproto.SetattrMode != 0 {
+		s.requests <- Tchmod{
+			Mode:   styxfile.ModeFromUnix(msg.Mode()),
+			twstat: twstat{status, filled, messages, info},
+		}
+		messages++
+	}
+	if valid&(styxproto.SetattrUid|styxproto.SetattrGid) != 0 {
+		req := Tchown{
+			Uid:    -1,
+			Gid:    -1,
+			twstat: twstat{status, filled, messages, info},
+		}
+		if valid&styxproto.SetattrUid != 0 {
+			req.Uid = int(msg.Uid())
+		}
+		if valid&styxproto.SetattrGid != 0 {
+			req.Gid = int(msg.Gid())
+		}
+		s.requests <- req
+		messages++
+	}
+	if valid&styxproto.SetattrSize != 0 {
+		s.requests <- Ttruncate{
+			Size:   int64(msg.Size()),
+			file:   file.rwc,
+			twstat: twstat{status, filled, messages, info},
+		}
+		messages++
+	}
+	if valid&(styxproto.SetattrAtime|styxproto.SetattrMtime) != 0 {
+		s.requests <- Tutimes{
+			Atime:  setattrTime(valid, styxproto.SetattrAtime, styxproto.SetattrAtimeSet, msg.Atime()),
+			Mtime:  setattrTime(valid, styxproto.SetattrMtime, styxproto.SetattrMtimeSet, msg.Mtime()),
+			twstat: twstat{status, filled, messages, info},
+		}
+		messages++
+	}
+	go s.collectWstat(msg, msg.Tag(), status, messages)
+	return true
+}
+
+// Unless the client provides a time, Tsetattr asks the server to
+// use the current time.
+func setattrTime(valid, change, set uint32, t time.Time) time.Time {
+	if valid&change == 0 {
+		return time.Time{}
+	} else if valid&set == 0 {
+		return time.Now()
+	}
+	return t
+}
+
+func (s *Session) handleTrename(ctx context.Context, msg styxproto.Trename, file file) bool {
+	dir, ok := s.fetchFile(msg.Dfid())
+	if !ok {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "%s", errNoFid)
+		s.conn.Flush()
+		return true
+	}
+	return s.rename(ctx, msg, file.name, path.Join(dir.name, string(msg.Name())))
+}
+
+func (s *Session) handleTrenameat(ctx context.Context, msg styxproto.Trenameat, file file) bool {
+	dir, ok := s.fetchFile(msg.Newdirfid())
+	if !ok {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "%s", errNoFid)
+		s.conn.Flush()
+		return true
+	}
+	oldpath := path.Join(file.name, string(msg.Oldname()))
+	newpath := path.Join(dir.name, string(msg.Newname()))
+	return s.rename(ctx, msg, oldpath, newpath)
+}
+
+func (s *Session) rename(ctx context.Context, msg fcall, oldpath, newpath string) bool {
+	status := make(chan error, 1)
+	s.requests <- Trename{
+		OldPath: oldpath,
+		NewPath: newpath,
+		newpath: newpath,
+		twstat:  twstat{status, make([]int32, 1), 0, newReqInfo(ctx, s, msg, oldpath)},
+	}
+	go s.collectWstat(msg, msg.Tag(), status, 1)
+	return true
+}
+
+func (s *Session) handleTfsync(ctx context.Context, msg styxproto.Tfsync, file file) bool {
+	status := make(chan error, 1)
+	s.requests <- Tsync{
+		twstat: twstat{status, make([]int32, 1), 0, newReqInfo(ctx, s, msg, file.name)},
+	}
+	go s.collectWstat(msg, msg.Tag(), status, 1)
+	return true
+}
+
+// Tunlinkat names the file to remove relative to a directory, which
+// remains open.
+func (s *Session) handleTunlinkat(ctx context.Context, msg styxproto.Tunlinkat, file file) bool {
+	s.requests <- Tremove{
+		reqInfo: newReqInfo(ctx, s, msg, path.Join(file.name, string(msg.Name()))),
+	}
+	return true
+}
+
+func (t Tremove) runlinkat(err error) {
+	if !t.respond(err) {
+		return
+	}
+	if err != nil {
+		t.session.conn.Rerror(t.tag, "%s", err)
+	} else {
+		t.session.conn.removed(t.path)
+		t.session.conn.Runlinkat(t.tag)
+	}
+}
+
+// Directories are read through the same Stat stream used for
+// 9P2000 clients, and the Stat structures converted to Dirents.
+// The offset of a Dirent is the offset of the next Stat in the
+// stream, so directories can be read sequentially without keeping
+// any additional state.
+func (s *Session) handleTreaddir(ctx context.Context, msg styxproto.Treaddir, file file) bool {
+	if file.rwc == nil {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "file %s is not open for reading", file.name)
+		s.conn.Flush()
+		return true
+	}
+	if qid, ok := s.conn.qidpool.Get(file.name); !ok || qid.Type()&styxproto.QTDIR == 0 {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "not a directory: %q", file.name)
+		s.conn.Flush()
+		return true
+	}
+
+	// Create a copy so that execution can proceed and s.conn.Next can be
+	// called without cloberring the request.
+	msgCopy := styxproto.Treaddir(make([]byte, msg.Len()))
+	copy(msgCopy, msg)
+
+	// The reply must fit in a single message. Dirents are smaller
+	// than the Stats they are made from, so reading no more than
+	// this many bytes of Stats is enough.
+	count := int64(msgCopy.Count())
+	if max := s.conn.msize - styxproto.IOHeaderSize; count > max {
+		count = max
+	}
+	go func(msg styxproto.Treaddir) {
+		buf := make([]byte, int(count))
+		n, err := file.rwc.ReadAt(buf, int64(msg.Offset()))
+
+		if !s.conn.clearTag(msg.Tag()) {
+			return
+		}
+		if n == 0 && err != nil && err != io.EOF {
+			s.conn.Rerror(msg.Tag(), "%v", err)
+		} else {
+			s.conn.Rreaddir(msg.Tag(), dirents(buf[:n], msg.Offset()))
+		}
+		s.conn.Flush()
+	}(msgCopy)
+	return true
+}
+
+// dirents converts a sequence of Stat structures, read from offset,
+// to Dirent structures. Dirents are always smaller than the Stat
+// they are made from.
+func dirents(stats []byte, offset uint64) []byte {
+	buf := make([]byte, len(stats))
+	out := buf
+	for len(stats) > 2 {
+		size := int(binary.LittleEndian.Uint16(stats)) + 2
+		if size > len(stats) {
+			break
+		}
+		stat := styxproto.Stat(stats[:size])
+		stats = stats[size:]
+		offset += uint64(size)
+
+		dtype := uint8(styxproto.DTREG)
+		if stat.Qid().Type()&styxproto.QTDIR != 0 {
+			dtype = styxproto.DTDIR
+		} else if stat.Qid().Type()&styxproto.QTSYMLINK != 0 {
+			dtype = styxproto.DTLNK
+		}
+		_, rest, err := styxproto.NewDirent(out, stat.Qid(), offset, dtype, string(stat.Name()))
+		if err != nil {
+			break
+		}
+		out = rest
+	}
+	return buf[:len(buf)-len(out)]
+}
+
+func (s *Session) handleTstatfs(ctx context.Context, msg styxproto.Tstatfs, file file) bool {
+	s.conn.clearTag(msg.Tag())
+	s.conn.Rstatfs(msg.Tag(), styxproto.Statfs{
+		Type:    v9fsMagic,
+		Bsize:   uint32(s.conn.msize - styxproto.IOHeaderSize),
+		Namelen: styxproto.MaxFilenameLen,
+	})
+	s.conn.Flush()
+	return true
+}
+
+// Advisory locks are granted unconditionally; they are only
+// meaningful between clients, which the styx package cannot
+// arbitrate without knowledge of the file tree.
+func (s *Session) handleTlock(ctx context.Context, msg styxproto.Tlock, file file) bool {
+	s.conn.clearTag(msg.Tag())
+	s.conn.Rlock(msg.Tag(), styxproto.LockSuccess)
+	s.conn.Flush()
+	return true
+}
+
+func (s *Session) handleTgetlock(ctx context.Context, msg styxproto.Tgetlock, file file) bool {
+	s.conn.clearTag(msg.Tag())
+	s.conn.Rgetlock(msg.Tag(), styxproto.LockTypeUnlck, msg.Start(), msg.Length(),
+		msg.ProcID(), string(msg.ClientID()))
+	s.conn.Flush()
+	return true
+}
+
+// Extended attributes are not supported.
+func (s *Session) handleUnsupported(ctx context.Context, msg fcall, file file) bool {
+	s.conn.clearTag(msg.Tag())
+	s.conn.Rerror(msg.Tag(), "%s", errNotSupported)
+	s.conn.Flush()
+	return true
+}
@@ -0,0 +1,119 @@
+package styx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"aqwari.net/net/styx/internal/sys"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// The 9P2000.u and 9P2000.L extensions send Linux error numbers
+// to the client, which the client's kernel hands back to the program
+// that made the system call. However, handlers respond to requests
+// with error messages, in the spirit of 9P2000. The errno function
+// makes a best effort to find the error number matching an error.
+// It first looks for an Error or another recognizable error value
+// among the arguments to an Rerror call, then falls back to matching the message against
+// the text of common error strings. If neither works, EIO is used.
+
+// An Error is an error with a Linux error number. Handlers may
+// use an Error to control the error number sent to clients using
+// the 9P2000.u or 9P2000.L extensions; clients using 9P2000 only
+// receive the message.
+type Error struct {
+	Msg   string
+	Errno uint32 // one of the E constants in the styxproto package
+}
+
+// Errorf creates an Error with the given error number and a message
+// formatted as in fmt.Sprintf.
+func Errorf(errno uint32, format string, args ...interface{}) Error {
+	return Error{Msg: fmt.Sprintf(format, args...), Errno: errno}
+}
+
+func (e Error) Error() string { return e.Msg }
+
+// Is reports whether the Error's number corresponds to target, one of
+// os.ErrNotExist, os.ErrExist or os.ErrPermission, for use with the
+// errors.Is function.
+func (e Error) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.Errno == styxproto.ENOENT
+	case os.ErrExist:
+		return e.Errno == styxproto.EEXIST
+	case os.ErrPermission:
+		return e.Errno == styxproto.EACCES || e.Errno == styxproto.EPERM
+	}
+	return false
+}
+
+// Ordered from most to least specific; the first match wins.
+var errnoStrings = []struct {
+	text  string
+	errno uint32
+}{
+	{"not a directory", styxproto.ENOTDIR},
+	{"is a directory", styxproto.EISDIR},
+	{"directory not empty", styxproto.ENOTEMPTY},
+	{"no such file", styxproto.ENOENT},
+	{"does not exist", styxproto.ENOENT},
+	{"not found", styxproto.ENOENT},
+	{"file exists", styxproto.EEXIST},
+	{"already exists", styxproto.EEXIST},
+	{"permission denied", styxproto.EACCES},
+	{"not permitted", styxproto.EPERM},
+	{"not supported", styxproto.EOPNOTSUPP},
+	{"read-only file system", styxproto.EROFS},
+	{"no space", styxproto.ENOSPC},
+	{"name too long", styxproto.ENAMETOOLONG},
+	{"invalid argument", styxproto.EINVAL},
+	{"bad message", styxproto.EINVAL},
+	{"no such fid", styxproto.EBADF},
+	{"already open", styxproto.EBADF},
+	{"not open", styxproto.EBADF},
+	{"interrupted", styxproto.EINTR},
+	{"cancelled", styxproto.EINTR},
+	{"timed out", styxproto.ETIMEDOUT},
+}
+
+func errno(format string, args []interface{}) uint32 {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			if n := errnoOf(err); n != 0 {
+				return n
+			}
+		}
+	}
+	msg := strings.ToLower(fmt.Sprintf(format, args...))
+	for _, e := range errnoStrings {
+		if strings.Contains(msg, e.text) {
+			return e.errno
+		}
+	}
+	return styxproto.EIO
+}
+
+func errnoOf(err error) uint32 {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Errno
+	}
+	if n := sys.Errno(err); n != 0 {
+		return n
+	}
+	switch {
+	case os.IsNotExist(err):
+		return styxproto.ENOENT
+	case os.IsExist(err):
+		return styxproto.EEXIST
+	case os.IsPermission(err):
+		return styxproto.EACCES
+	case os.IsTimeout(err):
+		return styxproto.ETIMEDOUT
+	}
+	return 0
+}
@@ -1,7 +1,9 @@
 package styx
 
 import (
+	"io/fs"
 	"os"
+	"time"
 
 	"aqwari.net/net/styx/internal/styxfile"
 )
@@ -31,6 +33,25 @@ type OwnerInfo interface {
 	Muid() string
 }
 
+// If an os.FileInfo value, or the value returned by its Sys method,
+// implements the AtimeInfo interface, the styx package reports the
+// time returned by Atime as the time the file was last accessed.
+// Otherwise, the access time is the time recorded by the server if it
+// tracks access times (see the TrackAtime field of Server), or the
+// modification time of the file.
+type AtimeInfo interface {
+	Atime() time.Time
+}
+
+// If the os.FileInfo of a symbolic link, or the value returned by
+// its Sys method, implements the LinkInfo interface, the target
+// returned by LinkTarget is sent to 9P2000.u clients in the extension
+// field of the link's Stat. Clients using 9P2000.L read link targets
+// with Treadlink requests instead.
+type LinkInfo interface {
+	LinkTarget() string
+}
+
 // In the 9P protocol, a directory is simply a file that returns zero or more
 // styxproto.Stat structures when read. Types that implement the Directory
 // interface can avoid marshalling styxproto.Stat methods in the Read methods.
@@ -42,3 +63,11 @@ type OwnerInfo interface {
 type Directory interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
+
+// A DirEntryReader may be used in place of a Directory. Its ReadDir
+// method, like that of os.File, lists the contents of a directory
+// as fs.DirEntry values, whose Info methods are used to describe
+// each file.
+type DirEntryReader interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+}
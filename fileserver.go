@@ -0,0 +1,285 @@
+package styx
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A FileServer is a Handler that serves the files in a directory on
+// the host, much like http.FileServer:
+//
+//	styx.ListenAndServe(":564", &styx.FileServer{Root: "/usr/share/doc"})
+//
+// Requests can never name files outside of Root. Symbolic links are
+// followed, but unless FollowSymlinks is set, links that lead outside
+// of Root are treated as if they do not exist. Files are created,
+// opened and modified with the permissions of the server process,
+// regardless of the user of a session.
+type FileServer struct {
+	// Root is the directory to serve.
+	Root string
+
+	// If ReadOnly is true, requests that would modify the tree
+	// are refused.
+	ReadOnly bool
+
+	// If FollowSymlinks is true, symbolic links are followed
+	// wherever they lead, even outside of Root.
+	FollowSymlinks bool
+}
+
+// A fileRoot is the resolved root of a FileServer.
+type fileRoot struct {
+	*FileServer
+	dir string // absolute, without symbolic links
+}
+
+func (srv *FileServer) Serve9P(s *Session) {
+	dir, err := filepath.Abs(srv.Root)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		s.conn.srv.logf("FileServer: %s", err)
+		for s.Next() {
+			s.Request().Rerror("%s", fs.ErrNotExist)
+		}
+		return
+	}
+	root := fileRoot{srv, dir}
+	for s.Next() {
+		root.serve(s.Request())
+	}
+}
+
+func (root fileRoot) serve(r Request) {
+	if root.ReadOnly && modifies(r) {
+		r.Rerror("%s", errReadOnly)
+		return
+	}
+	switch req := r.(type) {
+	case Twalk:
+		req.Rwalk(root.stat(req.Path()))
+	case Tstat:
+		req.Rstat(root.stat(req.Path()))
+	case Topen:
+		name, err := root.resolve(req.Path(), true)
+		if err != nil {
+			req.Ropen(nil, err)
+			return
+		}
+		f, err := os.OpenFile(name, req.Flag, 0)
+		req.Ropen(f, root.pathError(err, req.Path()))
+	case Tcreate:
+		req.Rcreate(root.create(req))
+	case Tremove:
+		if req.Path() == "/" {
+			req.Rremove(&os.PathError{Op: "remove", Path: "/", Err: fs.ErrPermission})
+			return
+		}
+		req.Rremove(root.apply(req.Path(), false, os.Remove))
+	case Trename:
+		req.Rrename(root.rename(req.OldPath, req.NewPath))
+	case Tchmod:
+		req.Rchmod(root.apply(req.Path(), true, func(name string) error {
+			return os.Chmod(name, req.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		}))
+	case Tutimes:
+		req.Rutimes(root.apply(req.Path(), true, func(name string) error {
+			return chtimes(name, req.Atime, req.Mtime)
+		}))
+	case Tchown:
+		req.Rchown(root.apply(req.Path(), false, func(name string) error {
+			return chown(name, req)
+		}))
+	case Ttruncate:
+		req.Rtruncate(root.apply(req.Path(), true, func(name string) error {
+			return os.Truncate(name, req.Size)
+		}))
+	case Tsync:
+		req.Rsync(root.apply(req.Path(), true, func(name string) error {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return f.Sync()
+		}))
+	case Tsymlink:
+		req.Rsymlink(root.apply(req.NewPath(), false, func(name string) error {
+			return os.Symlink(req.Target, name)
+		}))
+	case Treadlink:
+		name, err := root.resolve(req.Path(), false)
+		if err != nil {
+			req.Rreadlink("", err)
+			return
+		}
+		target, err := os.Readlink(name)
+		req.Rreadlink(target, root.pathError(err, req.Path()))
+	case Tlink:
+		req.Rlink(root.link(req.Target, req.NewPath()))
+	}
+}
+
+// resolve returns the name on the host of the file at the absolute
+// path p in the tree. If follow is false, a symbolic link at p is not
+// followed, though links in the directories leading to it are.
+func (root fileRoot) resolve(p string, follow bool) (string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return root.dir, nil
+	}
+	name := filepath.Join(root.dir, filepath.FromSlash(p))
+	if !follow {
+		dir, err := root.resolve(path.Dir(p), true)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, path.Base(p)), nil
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", root.pathError(err, p)
+	}
+	if !root.FollowSymlinks && !root.contains(resolved) {
+		return "", &os.PathError{Op: "walk", Path: p, Err: fs.ErrNotExist}
+	}
+	return resolved, nil
+}
+
+func (root fileRoot) contains(name string) bool {
+	return name == root.dir || strings.HasPrefix(name, root.dir+string(filepath.Separator))
+}
+
+// pathError replaces the host file name in err, which would reveal
+// the location of the tree on the host, with the path p in the tree.
+func (root fileRoot) pathError(err error, p string) error {
+	var pe *os.PathError
+	var le *os.LinkError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &pe):
+		return &os.PathError{Op: pe.Op, Path: p, Err: pe.Err}
+	case errors.As(err, &le):
+		return &os.PathError{Op: le.Op, Path: p, Err: le.Err}
+	}
+	return err
+}
+
+func (root fileRoot) stat(p string) (os.FileInfo, error) {
+	name, err := root.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	return info, root.pathError(err, p)
+}
+
+// apply calls fn with the host name of the file at p.
+func (root fileRoot) apply(p string, follow bool, fn func(name string) error) error {
+	name, err := root.resolve(p, follow)
+	if err != nil {
+		return err
+	}
+	return root.pathError(fn(name), p)
+}
+
+func (root fileRoot) create(req Tcreate) (interface{}, error) {
+	if req.Name == "" || req.Name == "." || req.Name == ".." || strings.ContainsAny(req.Name, "/\\") {
+		return nil, &os.PathError{Op: "create", Path: req.NewPath(), Err: fs.ErrInvalid}
+	}
+	dir, err := root.resolve(req.Path(), true)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, req.Name)
+	if req.Mode.IsDir() {
+		if err := os.Mkdir(name, req.Mode.Perm()); err != nil {
+			return nil, root.pathError(err, req.NewPath())
+		}
+		f, err := os.Open(name)
+		return f, root.pathError(err, req.NewPath())
+	}
+	f, err := os.OpenFile(name, req.Flag|os.O_CREATE|os.O_EXCL, req.Mode.Perm())
+	return f, root.pathError(err, req.NewPath())
+}
+
+func (root fileRoot) rename(oldpath, newpath string) error {
+	if oldpath == "/" || newpath == "/" {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: fs.ErrPermission}
+	}
+	from, err := root.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	to, err := root.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	return root.pathError(os.Rename(from, to), oldpath)
+}
+
+func (root fileRoot) link(target, newpath string) error {
+	from, err := root.resolve(target, false)
+	if err != nil {
+		return err
+	}
+	to, err := root.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	return root.pathError(os.Link(from, to), newpath)
+}
+
+// chtimes is like os.Chtimes, except that zero times are left
+// unchanged. The access time cannot be read portably, so a zero
+// access time is set to the modification time.
+func chtimes(name string, atime, mtime time.Time) error {
+	if atime.IsZero() || mtime.IsZero() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if mtime.IsZero() {
+			mtime = info.ModTime()
+		}
+		if atime.IsZero() {
+			atime = mtime
+		}
+	}
+	return os.Chtimes(name, atime, mtime)
+}
+
+// chown changes the owner of a file to the user and group in req,
+// looking up their ids if the client did not provide them.
+func chown(name string, req Tchown) error {
+	uid, gid := req.Uid, req.Gid
+	if uid < 0 && req.User != "" {
+		u, err := user.Lookup(req.User)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if gid < 0 && req.Group != "" {
+		g, err := user.LookupGroup(req.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Lchown(name, uid, gid)
+}
@@ -0,0 +1,133 @@
+package styx
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// FS returns a Handler that serves the files in fsys, such as an
+// embed.FS or an fstest.MapFS. Files that implement io.Seeker or
+// io.ReaderAt can be read at any offset; others can only be read
+// sequentially.
+//
+// The tree is read-only unless fsys implements some of the following
+// methods, which are called with the same names fsys.Open accepts, and
+// should behave like the functions of the os package with the same
+// names:
+//
+//	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+//	Mkdir(name string, perm fs.FileMode) error
+//	Remove(name string) error
+//	Rename(oldname, newname string) error
+//
+// OpenFile is used to open files for writing and to create files,
+// and the files it returns should implement io.Writer or io.WriterAt.
+func FS(fsys fs.FS) Handler {
+	return fsHandler{fsys}
+}
+
+type openFileFS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+type mkdirFS interface {
+	Mkdir(name string, perm fs.FileMode) error
+}
+
+type removeFS interface {
+	Remove(name string) error
+}
+
+type renameFS interface {
+	Rename(oldname, newname string) error
+}
+
+type fsHandler struct {
+	fsys fs.FS
+}
+
+// fsName converts the absolute path of a file in a session to the
+// name of the file in an fs.FS.
+func fsName(p string) string {
+	if p = strings.TrimPrefix(path.Clean("/"+p), "/"); p == "" {
+		return "."
+	}
+	return p
+}
+
+func (h fsHandler) Serve9P(s *Session) {
+	for s.Next() {
+		h.serve(s.Request())
+	}
+}
+
+func (h fsHandler) serve(r Request) {
+	switch req := r.(type) {
+	case Twalk:
+		req.Rwalk(fs.Stat(h.fsys, fsName(req.Path())))
+	case Tstat:
+		req.Rstat(fs.Stat(h.fsys, fsName(req.Path())))
+	case Topen:
+		req.Ropen(h.open(fsName(req.Path()), req.Flag))
+	case Tcreate:
+		req.Rcreate(h.create(fsName(req.NewPath()), req.Mode, req.Flag))
+	case Tremove:
+		if fsys, ok := h.fsys.(removeFS); ok {
+			req.Rremove(fsys.Remove(fsName(req.Path())))
+		} else {
+			req.Rremove(errReadOnly)
+		}
+	case Trename:
+		if fsys, ok := h.fsys.(renameFS); ok {
+			req.Rrename(fsys.Rename(fsName(req.OldPath), fsName(req.NewPath)))
+		} else {
+			req.Rrename(errReadOnly)
+		}
+	}
+}
+
+func (h fsHandler) open(name string, flag int) (interface{}, error) {
+	var (
+		file fs.File
+		err  error
+	)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) == 0 {
+		file, err = h.fsys.Open(name)
+	} else if fsys, ok := h.fsys.(openFileFS); ok {
+		file, err = fsys.OpenFile(name, flag, 0)
+	} else {
+		err = errReadOnly
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (h fsHandler) create(name string, mode os.FileMode, flag int) (interface{}, error) {
+	if mode.IsDir() {
+		fsys, ok := h.fsys.(mkdirFS)
+		if !ok {
+			return nil, errReadOnly
+		}
+		if err := fsys.Mkdir(name, mode.Perm()); err != nil {
+			return nil, err
+		}
+		file, err := h.fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	fsys, ok := h.fsys.(openFileFS)
+	if !ok {
+		return nil, errReadOnly
+	}
+	file, err := fsys.OpenFile(name, flag|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
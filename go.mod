@@ -1,5 +1,5 @@
 module aqwari.net/net/styx
 
-go 1.16
+go 1.18
 
 require aqwari.net/retry v0.0.0-20180428204214-1281ce5d8df0
@@ -0,0 +1,75 @@
+package styxfile
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// Files whose mode includes DMAPPEND are append-only; a write
+// always adds data to the end of the file, wherever the client
+// asked to write it, and the file cannot be truncated when opened.
+
+// ErrAppendTrunc is returned when a client tries to truncate an
+// append-only file while opening it.
+var ErrAppendTrunc = errors.New("cannot truncate append-only file")
+
+type appendFile struct {
+	Interface
+	end int64 // offset of the next write, if the size is unknown
+	sync.Mutex
+}
+
+// Append returns an Interface that writes to the end of file,
+// ignoring the offsets given to WriteAt. The end of the file is
+// taken from the Stat or Size method of the value file was created
+// from. If it has neither, writes are made one after the other,
+// starting from offset 0.
+func Append(file Interface) Interface {
+	return &appendFile{Interface: file}
+}
+
+// OpenAppend checks that a file with the given mode may be opened
+// with flag, and, if the mode marks the file as append-only,
+// wraps it with Append.
+func OpenAppend(file Interface, mode os.FileMode, flag int) (Interface, error) {
+	if mode&os.ModeAppend == 0 {
+		return file, nil
+	}
+	if flag&os.O_TRUNC != 0 {
+		return nil, ErrAppendTrunc
+	}
+	return Append(file), nil
+}
+
+func (f *appendFile) WriteAt(p []byte, _ int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if size, ok := fileSize(underlying(f.Interface)); ok {
+		f.end = size
+	}
+	n, err := f.Interface.WriteAt(p, f.end)
+	f.end += int64(n)
+	return n, err
+}
+
+func fileSize(file interface{}) (int64, bool) {
+	type hasStat interface {
+		Stat() (os.FileInfo, error)
+	}
+	type hasSize interface {
+		Size() int64
+	}
+	switch v := file.(type) {
+	case hasStat:
+		if info, err := v.Stat(); err == nil {
+			return info.Size(), true
+		}
+	case hasSize:
+		if size := v.Size(); size >= 0 {
+			return size, true
+		}
+	}
+	return 0, false
+}
@@ -5,10 +5,12 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"time"
 
-	"aqwari.net/net/styx/internal/qidpool"
 	"aqwari.net/net/styx/internal/sys"
+	"aqwari.net/net/styx/qidpool"
 	"aqwari.net/net/styx/styxproto"
 )
 
@@ -25,102 +27,162 @@ type Directory interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
 
+// An AtimeFunc returns the access time to report for the file
+// at the absolute path name, described by fi.
+type AtimeFunc func(name string, fi os.FileInfo) time.Time
+
 // NewDir creates a new Interface that converts the return
 // value of a Directory's Readdir method into 9P Stat structures.
-func NewDir(dir Directory, abspath string, pool *qidpool.Pool) Interface {
+// If the Sys method of an os.FileInfo returns a styxproto.Stat, it
+// is used as-is, apart from conversion between the 9P2000 and
+// 9P2000.u formats.
+// The access times of files are given by atime; if atime is nil,
+// their modification times are used.
+func NewDir(dir Directory, abspath string, pool *qidpool.Pool, atime AtimeFunc) Interface {
+	return &dirReader{
+		Directory: dir,
+		pool:      pool,
+		path:      abspath,
+		atime:     atime,
+		short:     -1,
+	}
+}
+
+// NewDirU is like NewDir, but produces Stat structures in
+// the format used by the 9P2000.u extension.
+func NewDirU(dir Directory, abspath string, pool *qidpool.Pool, atime AtimeFunc) Interface {
 	return &dirReader{
 		Directory: dir,
 		pool:      pool,
 		path:      abspath,
+		atime:     atime,
+		dotu:      true,
+		short:     -1,
 	}
 }
 
+// A dirReader keeps the Stat structures it has produced, so that
+// clients can read them again from any offset at which one begins,
+// such as 0 to rewind the directory. Entries added to the directory
+// after they were listed are not seen until it is opened again.
 type dirReader struct {
 	Directory
-	offset    int64 // current offset in the byte stream
-	nextlen   int   // if non zero, the length of next stat structure cached in next.
-	nextshort bool  // whether a short read occured on next
-	next      [styxproto.MaxStatLen]byte
 	sync.Mutex
-	pool *qidpool.Pool
-	path string
+	stats  []byte  // the Stat structures produced so far
+	starts []int64 // the offset of each Stat structure in stats
+	err    error   // error from Readdir, once it is exhausted
+	short  int64   // offset of the last short read, or -1
+	next   [styxproto.MaxStatLenU]byte
+	pool   *qidpool.Pool
+	path   string
+	atime  AtimeFunc
+	dotu   bool // produce 9P2000.u stats
 }
 
-func (d *dirReader) ReadAt(p []byte, offset int64) (written int, err error) {
+func (d *dirReader) ReadAt(p []byte, offset int64) (int, error) {
 	// see Plan 9 man read(5): read must return an integral number
 	// of stat structures.
 	d.Lock()
 	defer d.Unlock()
 
-	if offset != d.offset {
+	for int64(len(d.stats)) < offset+int64(len(p)) && d.err == nil {
+		nstats := len(p) / styxproto.MaxStatLen
+		if nstats == 0 {
+			nstats = 1
+		}
+		d.fill(nstats)
+	}
+	if offset == int64(len(d.stats)) {
+		return 0, d.err
+	}
+	i := sort.Search(len(d.starts), func(i int) bool { return d.starts[i] >= offset })
+	if i == len(d.starts) || d.starts[i] != offset {
 		return 0, ErrNoSeek
 	}
 
-	// We accept one short read
-	if d.nextlen > 0 {
-		if len(p) < d.nextlen {
-			if d.nextshort {
-				return 0, ErrSmallRead
-			} else {
-				// User buffer is too short,
-				// next read *must* be large enough
-				d.nextshort = true
-				return 0, nil
-			}
-		} else {
-			copy(p[:], d.next[:d.nextlen])
-			p = p[d.nextlen:]
-			written += d.nextlen
-			d.offset += int64(d.nextlen)
-			d.nextlen = 0
-			d.nextshort = false
+	end := offset
+	for j := i + 1; j <= len(d.starts); j++ {
+		next := int64(len(d.stats))
+		if j < len(d.starts) {
+			next = d.starts[j]
+		}
+		if next-offset > int64(len(p)) {
+			break
 		}
+		end = next
 	}
-
-	for len(p) > 0 {
-		nstats := len(p) / styxproto.MaxStatLen
-		if nstats == 0 {
-			nstats = 1
+	if end == offset {
+		// We accept one short read; the next read at the
+		// same offset *must* be large enough.
+		if d.short == offset {
+			return 0, ErrSmallRead
 		}
-		files, rerr := d.Readdir(nstats)
-		for _, fi := range files {
-			// Create 9p stat blob
-			uid, gid, muid := sys.FileOwner(fi)
-			stat, _, err := styxproto.NewStat(d.next[:], fi.Name(), uid, gid, muid)
-			if err != nil {
-				return written, err
-			}
-			mode := Mode9P(fi.Mode())
-			qtype := QidType(mode)
+		d.short = offset
+		return 0, nil
+	}
+	d.short = -1
+	return copy(p, d.stats[offset:end]), nil
+}
 
-			stat.SetMtime(uint32(fi.ModTime().Unix()))
-			stat.SetAtime(stat.Mtime())
-			stat.SetLength(fi.Size())
-			stat.SetMode(mode)
-			stat.SetQid(d.pool.Put(path.Join(d.path, fi.Name()), qtype))
-
-			if len(stat) > len(p) {
-				if nstats != 1 {
-					panic("impossible")
-				}
-				// Last entry overflows
-				d.nextlen = len(stat)
-				d.nextshort = false
-				return written, nil
+// fill adds the Stat structures for up to n more files to d.stats.
+func (d *dirReader) fill(n int) {
+	files, err := d.Readdir(n)
+	for _, fi := range files {
+		if raw, ok := fi.Sys().(styxproto.Stat); ok {
+			stat, serr := ConvertStat(d.next[:], raw, d.dotu)
+			if serr != nil {
+				d.err = serr
+				return
 			}
-
-			n := copy(p, stat)
-			p = p[n:]
-			written += n
-			d.offset += int64(n)
+			d.starts = append(d.starts, int64(len(d.stats)))
+			d.stats = append(d.stats, stat...)
+			continue
+		}
+		// Create 9p stat blob
+		uid, gid, muid := sys.FileOwner(fi)
+		stat, serr := d.newStat(fi.Name(), uid, gid, muid, Extension(fi))
+		if serr != nil {
+			d.err = serr
+			return
 		}
+		if nuid, ngid, ok := sys.FileOwnerID(fi); ok {
+			stat.SetNUid(nuid)
+			stat.SetNGid(ngid)
+		}
+		mode := Mode9P(fi.Mode())
+		qtype := QidType(mode)
 
-		if rerr != nil {
-			err = rerr
-			break
+		name := path.Join(d.path, fi.Name())
+		stat.SetMtime(uint32(fi.ModTime().Unix()))
+		if d.atime != nil {
+			stat.SetAtime(uint32(d.atime(name, fi).Unix()))
+		} else {
+			stat.SetAtime(stat.Mtime())
 		}
+		stat.SetLength(fi.Size())
+		stat.SetMode(mode)
+		stat.SetQid(d.pool.Put(name, qtype))
+
+		d.starts = append(d.starts, int64(len(d.stats)))
+		d.stats = append(d.stats, stat...)
+	}
+	if err == nil && len(files) == 0 {
+		err = io.EOF
+	}
+	d.err = err
+}
+
+func (d *dirReader) newStat(name, uid, gid, muid, ext string) (styxproto.Stat, error) {
+	var (
+		stat styxproto.Stat
+		err  error
+	)
+	if d.dotu {
+		stat, _, err = styxproto.NewStatU(d.next[:], name, uid, gid, muid, ext)
+	} else {
+		stat, _, err = styxproto.NewStat(d.next[:], name, uid, gid, muid)
 	}
-	return written, err
+	return stat, err
 }
 
 func (d *dirReader) WriteAt(p []byte, offset int64) (int, error) {
@@ -128,7 +190,7 @@ func (d *dirReader) WriteAt(p []byte, offset int64) (int, error) {
 }
 
 func (d *dirReader) Close() error {
-	if c, ok := d.Directory.(io.Closer); ok {
+	if c, ok := underlying(d).(io.Closer); ok {
 		return c.Close()
 	}
 	return nil
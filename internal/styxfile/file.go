@@ -51,7 +51,9 @@ func (nopCloser) Close() error { return nil }
 // by New; if rwc already implements Interface, it is used as-is. If
 // some methods are missing, wrapper types are used to implement
 // missing functionality. If the provided type cannot be adapted into
-// an Interface, New returns a non-nil error.
+// an Interface, New returns a non-nil error. Files opened from an
+// fs.FS can be passed to New; like an *os.File, their Stat method
+// is used to describe them.
 func New(rwc interface{}) (Interface, error) {
 	switch rwc := rwc.(type) {
 	case Interface:
@@ -71,51 +73,65 @@ func New(rwc interface{}) (Interface, error) {
 	}
 }
 
-// SetDeadline sets read/write deadlines for a file, if the type supports it.
-func SetDeadline(file Interface, t time.Time) error {
-	var real interface{}
+// underlying returns the value that was adapted into an Interface
+// by New or NewDir, so that optional methods it provides can be
+// found.
+func underlying(file Interface) interface{} {
 	switch v := file.(type) {
 	case *seekerAt:
-		real = v.rwc
+		return v.rwc
 	case *dumbPipe:
-		real = v.rwc
+		return v.rwc
 	case *dirReader:
-		real = v.Directory
-	default:
-		real = v
-	}
+		if r, ok := v.Directory.(readDirFile); ok {
+			return r.DirEntryReader
+		}
+		return v.Directory
+	case nopCloser:
+		return v.interfaceWithoutClose
+	case *appendFile:
+		return underlying(v.Interface)
+	case *limitFile:
+		return underlying(v.Interface)
+	case *notifyFile:
+		return underlying(v.Interface)
+	}
+	return file
+}
+
+// SetDeadline sets read/write deadlines for a file, if the type supports it.
+func SetDeadline(file Interface, t time.Time) error {
 	type deadline interface {
 		SetDeadline(time.Time) error
 	}
-	if v, ok := real.(deadline); ok {
+	if v, ok := underlying(file).(deadline); ok {
 		return v.SetDeadline(t)
 	}
 	return ErrNotSupported
 }
 
+// A Truncater is a file whose size can be changed, such as an
+// *os.File.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// Truncate changes the size of a file, if the type supports it.
+func Truncate(file Interface, size int64) error {
+	if v, ok := underlying(file).(Truncater); ok {
+		return v.Truncate(size)
+	}
+	return ErrNotSupported
+}
+
 // Stat produces a styxproto.Stat from an open file. If the value
 // provides a Stat method matching that of os.File, that is used.
 // Otherwise, the styxfile package determines the file's attributes
 // based on other characteristics.
 func Stat(buf []byte, file Interface, name string, qid styxproto.Qid) (styxproto.Stat, error) {
-	var (
-		fi  os.FileInfo
-		err error
-	)
-	type hasStat interface {
-		Stat() (os.FileInfo, error)
-	}
-	if v, ok := file.(hasStat); ok {
-		fi, err = v.Stat()
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		// name is an absolute path, make sure we don't pass an absolute path to statGuess,
-		// otherwise we may get back an absolute path if the file does not have a Name() method,
-		// which would be incorrect since stat names cannot contain slashes.
-		name := filepath.Base(name)
-		fi = statGuess{file, name, qid.Type()}
+	fi, err := Info(file, name, qid)
+	if err != nil {
+		return nil, err
 	}
 	uid, gid, muid := sys.FileOwner(fi)
 	stat, _, err := styxproto.NewStat(buf, fi.Name(), uid, gid, muid)
@@ -130,10 +146,38 @@ func Stat(buf []byte, file Interface, name string, qid styxproto.Qid) (styxproto
 	return stat, nil
 }
 
-// FIXME: When statGuess is used with a styxfile.Directory, none of the stat methods are found,
-// and we fall back on incorrectly using guessed values every time.
+// ConvertStat returns stat in the 9P2000.u format if dotu is true,
+// or in the 9P2000 format otherwise. If stat is already in that
+// format, it is returned as-is; otherwise the converted Stat is
+// written to buf.
+func ConvertStat(buf []byte, stat styxproto.Stat, dotu bool) (styxproto.Stat, error) {
+	b := styxproto.NewStatBuilder(stat)
+	if b.U == dotu {
+		return stat, nil
+	}
+	b.U = dotu
+	stat, _, err := b.Build(buf)
+	return stat, err
+}
+
+// Info produces an os.FileInfo describing an open file, in the
+// same manner as Stat.
+func Info(file Interface, name string, qid styxproto.Qid) (os.FileInfo, error) {
+	type hasStat interface {
+		Stat() (os.FileInfo, error)
+	}
+	real := underlying(file)
+	if v, ok := real.(hasStat); ok {
+		return v.Stat()
+	}
+	// name is an absolute path, make sure we don't pass an absolute path to statGuess,
+	// otherwise we may get back an absolute path if the file does not have a Name() method,
+	// which would be incorrect since stat names cannot contain slashes.
+	return statGuess{real, filepath.Base(name), qid.Type()}, nil
+}
+
 type statGuess struct {
-	file  Interface
+	file  interface{}
 	name  string
 	qtype uint8
 }
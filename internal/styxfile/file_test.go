@@ -3,11 +3,14 @@ package styxfile
 import (
 	"bytes"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"testing/fstest"
 
-	"aqwari.net/net/styx/internal/qidpool"
+	"aqwari.net/net/styx/qidpool"
 	"aqwari.net/net/styx/styxproto"
 )
 
@@ -90,7 +93,7 @@ func TestDirectory(t *testing.T) {
 		return
 	}
 
-	dir := NewDir(fd, dirname, qidpool.New())
+	dir := NewDir(fd, dirname, qidpool.New(), nil)
 
 	// We know that we can read a single Stat by only
 	// asking for 1 * MaxStatLen bytes. This is an implementation
@@ -112,3 +115,201 @@ func TestDirectory(t *testing.T) {
 		t.Logf("%s", stat)
 	}
 }
+
+// A statSeeker is an io.Seeker, adapted by New, that can describe
+// itself.
+type statSeeker struct {
+	*bytes.Reader
+	fi os.FileInfo
+}
+
+func (s statSeeker) Stat() (os.FileInfo, error) { return s.fi, nil }
+
+func TestStatAdapter(t *testing.T) {
+	dirname := t.TempDir()
+	if err := os.Chmod(dirname, 0750); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(dirname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := qidpool.New()
+	dir := NewDir(fd, dirname, pool, nil)
+	defer dir.Close()
+	file, err := New(statSeeker{bytes.NewReader(nil), fi})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []Interface{dir, file} {
+		qid := pool.Put("/guess", styxproto.QTDIR)
+		stat, err := Stat(make([]byte, styxproto.MaxStatLen), f, "/guess", qid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := string(stat.Name()); name != fi.Name() {
+			t.Errorf("Stat of %T has name %q, want %q", f, name, fi.Name())
+		}
+		if mode := ModeOS(stat.Mode()); mode != fi.Mode() {
+			t.Errorf("Stat of %T has mode %s, want %s", f, mode, fi.Mode())
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := OpenAppend(f, os.ModeAppend|0644, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	write(t, file, 0, "hello")
+	write(t, file, 0, ", ")
+	write(t, file, 2, "world!")
+	compare(t, file, 0, "hello, world!")
+
+	if _, err := OpenAppend(f, os.ModeAppend|0644, os.O_RDWR|os.O_TRUNC); err != ErrAppendTrunc {
+		t.Errorf("opening append-only file with O_TRUNC returned %v, want %v", err, ErrAppendTrunc)
+	}
+	if plain, err := OpenAppend(f, 0644, os.O_RDWR|os.O_TRUNC); err != nil || plain != Interface(f) {
+		t.Errorf("OpenAppend wrapped a regular file: %T, %v", plain, err)
+	}
+}
+
+func TestFSDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a": {Data: []byte("a")},
+		"dir/b": {Data: []byte("bb")},
+	}
+	fd, err := fsys.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := AsDirectory(fd)
+	if !ok {
+		t.Fatalf("%T is not a Directory", fd)
+	}
+	dir := NewDir(d, "/dir", qidpool.New(), nil)
+	defer dir.Close()
+
+	if fi, err := Info(dir, "/dir", nil); err != nil || !fi.IsDir() {
+		t.Errorf("Info = %v, %v", fi, err)
+	}
+	buf := make([]byte, 2*styxproto.MaxStatLen)
+	n, err := dir.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	stats, err := styxproto.UnpackStats(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, stat := range stats {
+		names = append(names, string(stat.Name()))
+	}
+	if strings.Join(names, " ") != "a b" {
+		t.Errorf("directory lists %q, want a and b", names)
+	}
+}
+
+func TestDirSeek(t *testing.T) {
+	fsys := fstest.MapFS{"a": {}, "b": {}, "c": {}}
+	fd, err := fsys.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := AsDirectory(fd)
+	dir := NewDir(d, "/", qidpool.New(), nil)
+	defer dir.Close()
+
+	names := func(offset int64, size int) []string {
+		buf := make([]byte, size)
+		n, err := dir.ReadAt(buf, offset)
+		if err != nil {
+			t.Fatalf("ReadAt(%d): %v", offset, err)
+		}
+		stats, err := styxproto.UnpackStats(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, stat := range stats {
+			list = append(list, string(stat.Name()))
+		}
+		return list
+	}
+	buf := make([]byte, styxproto.MaxStatLen)
+	n, err := dir.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := styxproto.UnpackStats(buf[:n])
+	if err != nil || len(stats) != 3 {
+		t.Fatalf("read %d stats, %v", len(stats), err)
+	}
+	if n, err := dir.ReadAt(buf, int64(n)); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at end = %d, %v", n, err)
+	}
+
+	if got := names(0, len(buf)); strings.Join(got, " ") != "a b c" {
+		t.Errorf("read %q after rewind", got)
+	}
+	second := int64(len(stats[0]))
+	if got := names(second, len(stats[1])); strings.Join(got, " ") != "b" {
+		t.Errorf("read %q at offset %d, want b", got, second)
+	}
+	if _, err := dir.ReadAt(buf, 1); err != ErrNoSeek {
+		t.Errorf("ReadAt within a stat = %v, want ErrNoSeek", err)
+	}
+	small := make([]byte, len(stats[0])-1)
+	if n, err := dir.ReadAt(small, 0); n != 0 || err != nil {
+		t.Errorf("first short ReadAt = %d, %v", n, err)
+	}
+	if _, err := dir.ReadAt(small, 0); err != ErrSmallRead {
+		t.Errorf("second short ReadAt = %v, want ErrSmallRead", err)
+	}
+}
+
+// entryLister implements only the ReadDir method.
+type entryLister []fs.DirEntry
+
+func (l *entryLister) ReadDir(n int) ([]fs.DirEntry, error) {
+	if len(*l) == 0 {
+		return nil, io.EOF
+	}
+	list := *l
+	*l = nil
+	return list, nil
+}
+
+func TestDirEntryReader(t *testing.T) {
+	entries, err := fs.ReadDir(fstest.MapFS{"x": {}, "y": {}}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lister := entryLister(entries)
+	d, ok := AsDirectory(&lister)
+	if !ok {
+		t.Fatal("ReadDir method not recognized")
+	}
+	dir := NewDir(d, "/", qidpool.New(), nil)
+	defer dir.Close()
+
+	buf := make([]byte, styxproto.MaxStatLen)
+	n, err := dir.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := styxproto.UnpackStats(buf[:n]); err != nil || len(stats) != 2 {
+		t.Errorf("read %d stats, %v", len(stats), err)
+	}
+}
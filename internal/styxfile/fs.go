@@ -0,0 +1,51 @@
+package styxfile
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// A DirEntryReader is a directory that lists its contents as
+// fs.DirEntry values, like an fs.ReadDirFile or an *os.File.
+type DirEntryReader interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+}
+
+// AsDirectory returns a Directory that lists the contents of v, if
+// v implements Directory or DirEntryReader. The fs.DirEntry values
+// returned by the ReadDir method of a DirEntryReader are converted
+// to os.FileInfo values with their Info method.
+func AsDirectory(v interface{}) (Directory, bool) {
+	switch v := v.(type) {
+	case Directory:
+		return v, true
+	case DirEntryReader:
+		return readDirFile{v}, true
+	}
+	return nil, false
+}
+
+// readDirFile adapts a DirEntryReader, such as a directory opened
+// from an fs.FS, to the Directory interface. Other methods, such as
+// Stat and Close, are found by underlying.
+type readDirFile struct {
+	DirEntryReader
+}
+
+func (d readDirFile) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := d.ReadDir(n)
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, ierr := entry.Info()
+		if ierr != nil {
+			// The file was removed since the directory was read.
+			continue
+		}
+		list = append(list, info)
+	}
+	if err == io.EOF && len(list) > 0 {
+		err = nil
+	}
+	return list, err
+}
@@ -0,0 +1,46 @@
+package styxfile
+
+// A limitFile passes each write through a pair of functions, so that
+// the amount of data written to it can be limited.
+type limitFile struct {
+	Interface
+	reserve func(n int64) error
+	refund  func(n int64)
+}
+
+// Limit returns an Interface that calls reserve with the size of
+// each write to file before it is made, and fails the write with
+// the error reserve returns, if any. Once the write is made, refund
+// is called with the number of bytes that were not written.
+func Limit(file Interface, reserve func(n int64) error, refund func(n int64)) Interface {
+	return &limitFile{Interface: file, reserve: reserve, refund: refund}
+}
+
+func (f *limitFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := f.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.Interface.WriteAt(p, offset)
+	if n < len(p) {
+		f.refund(int64(len(p) - n))
+	}
+	return n, err
+}
+
+// A notifyFile calls a function after each write to it.
+type notifyFile struct {
+	Interface
+	written func()
+}
+
+// OnWrite returns an Interface that calls written after each write
+// to file, whether or not it succeeds.
+func OnWrite(file Interface, written func()) Interface {
+	return &notifyFile{Interface: file, written: written}
+}
+
+func (f *notifyFile) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := f.Interface.WriteAt(p, offset)
+	f.written()
+	return n, err
+}
@@ -21,6 +21,9 @@ func ModeOS(perm uint32) os.FileMode {
 	if perm&styxproto.DMTMP != 0 {
 		mode |= os.ModeTemporary
 	}
+	if perm&styxproto.DMSYMLINK != 0 {
+		mode |= os.ModeSymlink
+	}
 	mode |= (os.FileMode(perm) & os.ModePerm)
 	return mode
 }
@@ -40,11 +43,112 @@ func Mode9P(mode os.FileMode) uint32 {
 	if mode&os.ModeTemporary != 0 {
 		perm |= styxproto.DMTMP
 	}
+	if mode&os.ModeSymlink != 0 {
+		perm |= styxproto.DMSYMLINK
+	}
 	return perm | uint32(mode&os.ModePerm)
 }
 
+// Extension returns the 9P2000.u extension field for the Stat of a
+// file: the target of a symbolic link, if fi, or the value returned
+// by its Sys method, has a LinkTarget method.
+func Extension(fi os.FileInfo) string {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+	type linkTarget interface {
+		LinkTarget() string
+	}
+	if l, ok := fi.(linkTarget); ok {
+		return l.LinkTarget()
+	}
+	if l, ok := fi.Sys().(linkTarget); ok {
+		return l.LinkTarget()
+	}
+	return ""
+}
+
 // QidType selects the first byte of a 9P mode mask,
 // and is suitable for use in a Qid's type field.
 func QidType(mode uint32) uint8 {
 	return uint8(mode >> 24)
 }
+
+// Unix file type and permission bits, as used in the mode fields
+// of the 9P2000.L extension.
+const (
+	unixTypeMask = 0170000
+	unixSocket   = 0140000
+	unixSymlink  = 0120000
+	unixRegular  = 0100000
+	unixBlock    = 0060000
+	unixDir      = 0040000
+	unixChar     = 0020000
+	unixFIFO     = 0010000
+	unixSetuid   = 04000
+	unixSetgid   = 02000
+	unixSticky   = 01000
+)
+
+// ModeUnix converts an os.FileMode to a Unix mode, including
+// the file type bits.
+func ModeUnix(mode os.FileMode) uint32 {
+	perm := uint32(mode & os.ModePerm)
+	switch {
+	case mode&os.ModeDir != 0:
+		perm |= unixDir
+	case mode&os.ModeSymlink != 0:
+		perm |= unixSymlink
+	case mode&os.ModeNamedPipe != 0:
+		perm |= unixFIFO
+	case mode&os.ModeSocket != 0:
+		perm |= unixSocket
+	case mode&os.ModeCharDevice != 0:
+		perm |= unixChar
+	case mode&os.ModeDevice != 0:
+		perm |= unixBlock
+	default:
+		perm |= unixRegular
+	}
+	if mode&os.ModeSetuid != 0 {
+		perm |= unixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unixSticky
+	}
+	return perm
+}
+
+// ModeFromUnix converts a Unix mode to an os.FileMode. If
+// mode does not contain any file type bits, the result describes
+// a regular file.
+func ModeFromUnix(mode uint32) os.FileMode {
+	perm := os.FileMode(mode) & os.ModePerm
+	switch mode & unixTypeMask {
+	case unixDir:
+		perm |= os.ModeDir
+	case unixSymlink:
+		perm |= os.ModeSymlink
+	case unixFIFO:
+		perm |= os.ModeNamedPipe
+	case unixSocket:
+		perm |= os.ModeSocket
+	case unixChar:
+		perm |= os.ModeDevice | os.ModeCharDevice
+	case unixBlock:
+		perm |= os.ModeDevice
+	}
+	if mode&unixSetuid != 0 {
+		perm |= os.ModeSetuid
+	}
+	if mode&unixSetgid != 0 {
+		perm |= os.ModeSetgid
+	}
+	if mode&unixSticky != 0 {
+		perm |= os.ModeSticky
+	}
+	return perm
+}
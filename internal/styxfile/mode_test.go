@@ -11,6 +11,7 @@ func TestFileMode(t *testing.T) {
 	var perm uint32 = styxproto.DMDIR |
 		styxproto.DMEXCL |
 		styxproto.DMTMP |
+		styxproto.DMSYMLINK |
 		0750
 	mode := ModeOS(perm)
 	if mode&os.ModeDir == 0 {
@@ -22,6 +23,9 @@ func TestFileMode(t *testing.T) {
 	if mode&os.ModeTemporary == 0 {
 		t.Error("DMTMP")
 	}
+	if mode&os.ModeSymlink == 0 {
+		t.Error("DMSYMLINK")
+	}
 	if mode&os.ModePerm != 0750 {
 		t.Errorf("perm %o != %o", mode&os.ModePerm, perm&0777)
 	}
@@ -31,6 +35,7 @@ func TestPerm(t *testing.T) {
 	var mode os.FileMode = os.ModeDir |
 		os.ModeExclusive |
 		os.ModeTemporary |
+		os.ModeSymlink |
 		0750
 	perm := Mode9P(mode)
 	if perm&styxproto.DMDIR == 0 {
@@ -42,7 +47,32 @@ func TestPerm(t *testing.T) {
 	if perm&styxproto.DMTMP == 0 {
 		t.Error("ModeTemporary")
 	}
+	if perm&styxproto.DMSYMLINK == 0 {
+		t.Error("ModeSymlink")
+	}
 	if perm&0777 != 0750 {
 		t.Error("ModePerm")
 	}
 }
+
+func TestUnixMode(t *testing.T) {
+	modes := []os.FileMode{
+		0644,
+		os.ModeDir | 0755,
+		os.ModeSymlink | 0777,
+		os.ModeNamedPipe | 0600,
+		os.ModeSocket | 0700,
+		os.ModeDevice | 0660,
+		os.ModeDevice | os.ModeCharDevice | 0620,
+		os.ModeDir | os.ModeSticky | 0777,
+		os.ModeSetuid | os.ModeSetgid | 0755,
+	}
+	for _, mode := range modes {
+		if m := ModeFromUnix(ModeUnix(mode)); m != mode {
+			t.Errorf("%s != %s", m, mode)
+		}
+	}
+	if mode := ModeUnix(os.ModeDir | 0755); mode != 040755 {
+		t.Errorf("unix mode of directory is %o", mode)
+	}
+}
@@ -0,0 +1,28 @@
+package sys
+
+import (
+	"os"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+type hasAtime interface {
+	Atime() time.Time
+}
+
+// FileAtime retrieves the time a file was last accessed, if fi or
+// fi.Sys() implements the styx.AtimeInfo interface, or fi.Sys() is
+// a styxproto.Stat. Otherwise, ok is false.
+func FileAtime(fi os.FileInfo) (atime time.Time, ok bool) {
+	if v, ok := fi.(hasAtime); ok {
+		return v.Atime(), true
+	}
+	switch v := fi.Sys().(type) {
+	case hasAtime:
+		return v.Atime(), true
+	case styxproto.Stat:
+		return time.Unix(int64(v.Atime()), 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,10 @@
+package sys
+
+// Errno returns the Linux error number corresponding to err, if err
+// is an error returned by the host operating system. The 9P2000.u
+// and 9P2000.L extensions send Linux error numbers to the client,
+// regardless of the operating system the server runs on. If no such
+// number can be found, Errno returns 0.
+func Errno(err error) uint32 {
+	return errno(err)
+}
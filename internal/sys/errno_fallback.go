@@ -0,0 +1,7 @@
+//+build !android,!darwin,!dragonfly,!freebsd,!linux,!nacl,!netbsd,!openbsd,!solaris
+
+package sys
+
+func errno(err error) uint32 {
+	return 0
+}
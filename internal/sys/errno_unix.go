@@ -0,0 +1,48 @@
+// +build android darwin dragonfly freebsd linux nacl netbsd openbsd solaris
+
+package sys
+
+import (
+	"errors"
+	"syscall"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// Error numbers differ between Unix systems; this maps the host's
+// error numbers to their Linux equivalents.
+var linuxErrno = map[syscall.Errno]uint32{
+	syscall.EPERM:        styxproto.EPERM,
+	syscall.ENOENT:       styxproto.ENOENT,
+	syscall.EINTR:        styxproto.EINTR,
+	syscall.EIO:          styxproto.EIO,
+	syscall.EBADF:        styxproto.EBADF,
+	syscall.EAGAIN:       styxproto.EAGAIN,
+	syscall.ENOMEM:       styxproto.ENOMEM,
+	syscall.EACCES:       styxproto.EACCES,
+	syscall.EBUSY:        styxproto.EBUSY,
+	syscall.EEXIST:       styxproto.EEXIST,
+	syscall.EXDEV:        styxproto.EXDEV,
+	syscall.ENOTDIR:      styxproto.ENOTDIR,
+	syscall.EISDIR:       styxproto.EISDIR,
+	syscall.EINVAL:       styxproto.EINVAL,
+	syscall.EFBIG:        styxproto.EFBIG,
+	syscall.ENOSPC:       styxproto.ENOSPC,
+	syscall.EROFS:        styxproto.EROFS,
+	syscall.EMLINK:       styxproto.EMLINK,
+	syscall.ERANGE:       styxproto.ERANGE,
+	syscall.ENAMETOOLONG: styxproto.ENAMETOOLONG,
+	syscall.ENOSYS:       styxproto.ENOSYS,
+	syscall.ENOTEMPTY:    styxproto.ENOTEMPTY,
+	syscall.ELOOP:        styxproto.ELOOP,
+	syscall.EOPNOTSUPP:   styxproto.EOPNOTSUPP,
+	syscall.ETIMEDOUT:    styxproto.ETIMEDOUT,
+}
+
+func errno(err error) uint32 {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return linuxErrno[e]
+	}
+	return 0
+}
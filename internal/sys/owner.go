@@ -64,3 +64,11 @@ func ownerInfo(v interface{}) (uid, gid, muid string, ok bool) {
 	}
 	return uid, gid, muid, meets
 }
+
+// FileOwnerID retrieves the numeric user and group ids of a file's
+// owner from the host operating system, for protocol extensions such
+// as 9P2000.u and 9P2000.L that use them. If the ids are not available,
+// ok is false.
+func FileOwnerID(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	return fileOwnerID(fi.Sys())
+}
@@ -5,3 +5,7 @@ package sys
 func fileOwner(v interface{}) (uid, gid, muid string) {
 	return DefaultUid, DefaultGid, DefaultUid
 }
+
+func fileOwnerID(v interface{}) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -18,3 +18,8 @@ func fileOwner(v interface{}) (uid, gid, muid string) {
 	// was made for 9P :D
 	return stat.Uid, stat.Gid, stat.Muid
 }
+
+// Plan 9 does not have numeric user ids.
+func fileOwnerID(v interface{}) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -32,3 +32,10 @@ func fileOwner(v interface{}) (uid, gid, muid string) {
 	}
 	return uid, gid, muid
 }
+
+func fileOwnerID(v interface{}) (uid, gid uint32, ok bool) {
+	if stat, ok := v.(*syscall.Stat_t); ok {
+		return uint32(stat.Uid), uint32(stat.Gid), true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,235 @@
+package styx
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+func (s *Session) handleTsymlink(ctx context.Context, msg styxproto.Tsymlink, file file) bool {
+	s.requests <- Tsymlink{
+		Name:    string(msg.Name()),
+		Target:  string(msg.Target()),
+		reqInfo: newReqInfo(ctx, s, msg, file.name),
+	}
+	return true
+}
+
+func (s *Session) handleTreadlink(ctx context.Context, msg styxproto.Treadlink, file file) bool {
+	s.requests <- Treadlink{
+		reqInfo: newReqInfo(ctx, s, msg, file.name),
+	}
+	return true
+}
+
+func (s *Session) handleTmknod(ctx context.Context, msg styxproto.Tmknod, file file) bool {
+	s.requests <- Tmknod{
+		Name:    string(msg.Name()),
+		Mode:    styxfile.ModeFromUnix(msg.Mode()),
+		Major:   msg.Major(),
+		Minor:   msg.Minor(),
+		Gid:     numericID(msg.Gid()),
+		reqInfo: newReqInfo(ctx, s, msg, file.name),
+	}
+	return true
+}
+
+func (s *Session) handleTlink(ctx context.Context, msg styxproto.Tlink, file file) bool {
+	dir, ok := s.fetchFile(msg.Dfid())
+	if !ok {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "%s", errNoFid)
+		s.conn.Flush()
+		return true
+	}
+	s.requests <- Tlink{
+		Name:    string(msg.Name()),
+		Target:  file.name,
+		reqInfo: newReqInfo(ctx, s, msg, dir.name),
+	}
+	return true
+}
+
+// A Tsymlink message is sent when a client wants to create a symbolic
+// link. It is sent by clients using the 9P2000.L extension, and for
+// 9P2000.u clients that create a file with the styxproto.DMSYMLINK
+// permission bit, in which case Target holds the extension field of
+// the Tcreate message. The Path method of a Tsymlink message returns the absolute path of the
+// containing directory. Use the Rsymlink method to indicate success.
+//
+// The default response to a Tsymlink message is an Rerror message
+// saying "permission denied".
+type Tsymlink struct {
+	Name   string // name of the link to create
+	Target string // contents of the link
+	reqInfo
+}
+
+func (t Tsymlink) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// NewPath returns the absolute path to the new link.
+func (t Tsymlink) NewPath() string {
+	return path.Join(t.Path(), t.Name)
+}
+
+// Path returns the absolute path to the containing directory of the
+// new link.
+func (t Tsymlink) Path() string {
+	return t.reqInfo.Path() // overrode this method for the godoc comments
+}
+
+// Rsymlink, when called with a nil error, indicates that the link
+// was created. Future stat requests for the link should report it
+// as a symbolic link.
+func (t Tsymlink) Rsymlink(err error) {
+	if err != nil {
+		t.Rerror("%s", err)
+		return
+	}
+	newpath := path.Join(t.path, t.Name)
+	qid := t.session.conn.newQid(newpath, styxproto.QTSYMLINK)
+	_, create := t.msg.(styxproto.Tcreate)
+	if create {
+		// As for any Tcreate, the fid now refers to the new file.
+		t.session.putFile(t.fid, file{name: newpath})
+	}
+	if !t.respond(nil) {
+		return
+	}
+	if create {
+		t.session.conn.Rcreate(t.tag, qid, 0)
+	} else {
+		t.session.conn.Rsymlink(t.tag, qid)
+	}
+}
+
+// A Treadlink message is sent when a client wants to read the target
+// of a symbolic link. It is only sent by clients using the 9P2000.L
+// extension. Use the Rreadlink method to respond to it.
+//
+// The default response to a Treadlink message is an Rerror message
+// saying "permission denied".
+type Treadlink struct {
+	reqInfo
+}
+
+func (t Treadlink) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// Rreadlink sends the target of a symbolic link to the client, such
+// as the result of the os.Readlink function. If err is non-nil, an
+// error is sent to the client instead.
+func (t Treadlink) Rreadlink(target string, err error) {
+	if err != nil {
+		t.Rerror("%s", err)
+		return
+	}
+	if t.respond(nil) {
+		if err := t.session.conn.Rreadlink(t.tag, target); err != nil {
+			t.session.conn.Rerror(t.tag, "%s", err)
+		}
+	}
+}
+
+// A Tlink message is sent when a client wants to create a hard link
+// to an existing file. It is only sent by clients using the 9P2000.L
+// extension. The Path method of a Tlink message returns the absolute
+// path of the directory to create the link in. Use the Rlink method
+// to indicate success.
+//
+// The default response to a Tlink message is an Rerror message
+// saying "permission denied".
+type Tlink struct {
+	Name   string // name of the link to create
+	Target string // absolute path to the existing file
+	reqInfo
+}
+
+func (t Tlink) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// NewPath returns the absolute path to the new link.
+func (t Tlink) NewPath() string {
+	return path.Join(t.Path(), t.Name)
+}
+
+// Path returns the absolute path to the containing directory of the
+// new link.
+func (t Tlink) Path() string {
+	return t.reqInfo.Path() // overrode this method for the godoc comments
+}
+
+// Rlink, when called with a nil error, indicates that the link
+// was created.
+func (t Tlink) Rlink(err error) {
+	if err != nil {
+		t.Rerror("%s", err)
+		return
+	}
+	if t.respond(nil) {
+		t.session.conn.Rlink(t.tag)
+	}
+}
+
+// A Tmknod message is sent when a client wants to create a device
+// file, named pipe or socket. It is only sent by clients using the
+// 9P2000.L extension. The Path method of a Tmknod message returns
+// the absolute path of the containing directory. Use the Rmknod
+// method to indicate success.
+//
+// The default response to a Tmknod message is an Rerror message
+// saying "permission denied".
+type Tmknod struct {
+	Name string // name of the file to create
+
+	// Mode holds the type and permissions of the new file, such
+	// as os.ModeDevice|os.ModeCharDevice|0666.
+	Mode os.FileMode
+
+	// Major and Minor are the device numbers of a device file.
+	Major, Minor uint32
+
+	// Gid is the numeric group the client asked to own the file,
+	// or -1 if it did not choose one.
+	Gid int
+	reqInfo
+}
+
+func (t Tmknod) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// NewPath returns the absolute path to the new file.
+func (t Tmknod) NewPath() string {
+	return path.Join(t.Path(), t.Name)
+}
+
+// Path returns the absolute path to the containing directory of the
+// new file.
+func (t Tmknod) Path() string {
+	return t.reqInfo.Path() // overrode this method for the godoc comments
+}
+
+// Rmknod, when called with a nil error, indicates that the file was
+// created. Future stat requests for the file should report Mode.
+func (t Tmknod) Rmknod(err error) {
+	if err != nil {
+		t.Rerror("%s", err)
+		return
+	}
+	qid := t.session.conn.newQid(path.Join(t.path, t.Name), styxfile.QidType(styxfile.Mode9P(t.Mode)))
+	if t.respond(nil) {
+		t.session.conn.Rmknod(t.tag, qid)
+	}
+}
@@ -0,0 +1,28 @@
+package styx
+
+import (
+	"net"
+	"time"
+)
+
+// Types implementing the Metrics interface receive callbacks
+// as a Server handles connections and requests, so that they can
+// be exported to a monitoring system. Methods may be called
+// concurrently from multiple goroutines, and should not block.
+//
+// Message types are named after their styxproto types, such as
+// "Twalk". A request finishes when its response is sent. The error
+// passed to RequestFinished is nil if the response was not an error
+// response, an Error if it was, and context.Canceled if the request
+// was flushed by the client.
+type Metrics interface {
+	ConnOpened(addr net.Addr)
+	ConnClosed(addr net.Addr)
+	RequestStarted(msgType string)
+	RequestFinished(msgType string, d time.Duration, err error)
+
+	// BytesIn and BytesOut count the size of each message
+	// received and sent.
+	BytesIn(n int64)
+	BytesOut(n int64)
+}
@@ -0,0 +1,203 @@
+package styx
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path"
+
+	"aqwari.net/net/styx/internal/sys"
+	"aqwari.net/net/styx/styxproto"
+)
+
+var errPermission = Errorf(styxproto.EACCES, "permission denied")
+
+// A Perm is a Handler that enforces the permission checks of a Plan 9
+// file server before passing requests on to its Handler. The owner,
+// group and permission bits of a file are taken from the os.FileInfo
+// returned by Stat, with ownership determined as described for the
+// OwnerInfo interface, and checked against the User of the session:
+//
+//   - walking to a file requires execute permission on the directory
+//     walked from, which for ".." is the directory being left
+//   - opening a file requires read, write or execute permission on
+//     the file, according to the mode it is opened with, and
+//     opening it with ORCLOSE also requires write permission on
+//     its directory
+//   - creating, removing, renaming or linking a file requires write
+//     permission on its directory
+//   - truncating a file or changing its times requires write
+//     permission on the file
+//   - changing the mode, owner or muid of a file is reserved to its
+//     owner
+//
+// As in Plan 9, a user is granted the permissions of the "other"
+// bits, the group bits if they are in the file's group, and the
+// owner bits if they own the file. Requests that fail a check are
+// answered with a "permission denied" error. Requests for files that
+// Stat cannot find are passed on, so that Handler may answer them;
+// if Stat fails for any other reason, the request is denied.
+type Perm struct {
+	// Handler answers requests that pass the checks.
+	Handler Handler
+
+	// Stat returns information about the file at the absolute
+	// path name.
+	Stat func(name string) (os.FileInfo, error)
+
+	// InGroup reports whether user is a member of group. If nil,
+	// users are only members of the group with their own name.
+	InGroup func(user, group string) bool
+}
+
+// Permission bits, in the position of the "other" bits.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+func (p *Perm) Serve9P(s *Session) {
+	Stack(permCheck{p}, p.Handler).Serve9P(s)
+}
+
+// permCheck answers requests that fail the checks of a Perm, leaving
+// the rest for the next handler in a stack.
+type permCheck struct {
+	*Perm
+}
+
+func (p permCheck) Serve9P(s *Session) {
+	for s.Next() {
+		if err := p.check(s.User, s.Request()); err != nil {
+			s.Request().Rerror("%s", err)
+		}
+	}
+}
+
+func (p *Perm) check(user string, r Request) error {
+	switch req := r.(type) {
+	case Twalk:
+		return p.allow(user, req.dir(), permExec)
+	case Topen:
+		// The file is removed when it is clunked.
+		if req.RemoveOnClose {
+			if err := p.allow(user, path.Dir(req.Path()), permWrite); err != nil {
+				return err
+			}
+		}
+		return p.allow(user, req.Path(), openPerm(req.Flag, req.Exec))
+	case Tcreate:
+		return p.allow(user, req.Path(), permWrite)
+	case Tremove:
+		return p.allow(user, path.Dir(req.Path()), permWrite)
+	case Trename:
+		if err := p.allow(user, path.Dir(req.OldPath), permWrite); err != nil {
+			return err
+		}
+		return p.allow(user, path.Dir(req.NewPath), permWrite)
+	case Tsymlink:
+		return p.allow(user, path.Dir(req.NewPath()), permWrite)
+	case Tlink:
+		return p.allow(user, path.Dir(req.NewPath()), permWrite)
+	case Tmknod:
+		return p.allow(user, path.Dir(req.NewPath()), permWrite)
+	case Ttruncate:
+		return p.allow(user, req.Path(), permWrite)
+	case Tutimes:
+		return p.allow(user, req.Path(), permWrite)
+	case Tchmod:
+		return p.owner(user, req.Path())
+	case Tchown:
+		return p.owner(user, req.Path())
+	case Tmuid:
+		return p.owner(user, req.Path())
+	case Twstat:
+		return p.checkWstat(user, req)
+	}
+	return nil
+}
+
+// checkWstat checks each change requested by a Twstat with the
+// permissions of the request it would otherwise be split into.
+func (p *Perm) checkWstat(user string, req Twstat) error {
+	stat := req.Stat
+	if name := string(stat.Name()); name != "" && name != path.Base(req.Path()) {
+		if err := p.allow(user, path.Dir(req.Path()), permWrite); err != nil {
+			return err
+		}
+	}
+	if stat.Mode() != math.MaxUint32 || len(stat.Uid()) > 0 || len(stat.Gid()) > 0 || len(stat.Muid()) > 0 {
+		if err := p.owner(user, req.Path()); err != nil {
+			return err
+		}
+	}
+	if stat.Length() != -1 || stat.Mtime() != math.MaxUint32 || stat.Atime() != math.MaxUint32 {
+		return p.allow(user, req.Path(), permWrite)
+	}
+	return nil
+}
+
+// openPerm returns the permissions needed to open a file with flag.
+func openPerm(flag int, exec bool) os.FileMode {
+	var perm os.FileMode
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		perm = permWrite
+	case os.O_RDWR:
+		perm = permRead | permWrite
+	default:
+		perm = permRead
+	}
+	if flag&os.O_TRUNC != 0 {
+		perm |= permWrite
+	}
+	if exec {
+		perm = perm&^permRead | permExec
+	}
+	return perm
+}
+
+func (p *Perm) inGroup(user, group string) bool {
+	if p.InGroup != nil {
+		return p.InGroup(user, group)
+	}
+	return user == group
+}
+
+// allow checks that user has the permissions in want on the file at
+// name.
+func (p *Perm) allow(user, name string, want os.FileMode) error {
+	info, err := p.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errPermission
+	}
+	uid, gid, _ := sys.FileOwner(info)
+	mode := info.Mode().Perm()
+	have := mode & 7
+	if p.inGroup(user, gid) {
+		have |= mode >> 3 & 7
+	}
+	if user == uid {
+		have |= mode >> 6 & 7
+	}
+	if have&want != want {
+		return errPermission
+	}
+	return nil
+}
+
+func (p *Perm) owner(user, name string) error {
+	info, err := p.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errPermission
+	}
+	if uid, _, _ := sys.FileOwner(info); uid != user {
+		return errPermission
+	}
+	return nil
+}
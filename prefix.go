@@ -0,0 +1,105 @@
+package styx
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// pathKey is the context key for the function that maps the path of
+// a request, as the client sees it, to the path its handler sees.
+type pathKey struct{}
+
+// AddPrefix returns a Handler that passes requests to handler with
+// prefix added to their paths, so that a request for /lib/profile
+// is seen by handler as one for prefix/lib/profile. Paths are only
+// rewritten for handler; the server keeps track of the files of a
+// session by the paths the client uses. This lets handlers written
+// for different places in a file tree be combined.
+func AddPrefix(prefix string, handler Handler) Handler {
+	prefix = path.Clean("/" + prefix)
+	return rewritePaths(handler, func(p string) (string, bool) {
+		return path.Join(prefix, p), true
+	})
+}
+
+// StripPrefix returns a Handler that passes requests to handler with
+// prefix removed from their paths, so that a request for
+// prefix/lib/profile is seen by handler as one for /lib/profile.
+// Requests for files outside of prefix are not passed to handler, and
+// fail with an error saying that the file does not exist.
+func StripPrefix(prefix string, handler Handler) Handler {
+	prefix = path.Clean("/" + prefix)
+	return rewritePaths(handler, func(p string) (string, bool) {
+		switch {
+		case prefix == "/":
+			return p, true
+		case p == prefix:
+			return "/", true
+		case strings.HasPrefix(p, prefix+"/"):
+			return p[len(prefix):], true
+		}
+		return "", false
+	})
+}
+
+// Chroot returns a Handler that confines clients to the directory dir
+// of the file tree served by handler, which clients see as the root
+// of their tree. Since the paths of requests never lead above the
+// root, clients cannot leave dir, though symbolic links followed by
+// handler may. Chroot is the same as AddPrefix.
+func Chroot(dir string, handler Handler) Handler {
+	return AddPrefix(dir, handler)
+}
+
+func rewritePaths(handler Handler, fn func(string) (string, bool)) Handler {
+	return Stack(pathRewriter(fn), handler)
+}
+
+// A pathRewriter changes the paths of the requests it receives for
+// the handlers after it in a stack, refusing paths that fn cannot
+// map.
+type pathRewriter func(string) (string, bool)
+
+func (fn pathRewriter) Serve9P(s *Session) {
+	for s.Next() {
+		req := s.Request()
+		paths := []string{req.Path()}
+		switch req := req.(type) {
+		case Trename:
+			paths = append(paths, req.NewPath)
+		case Tlink:
+			paths = append(paths, req.Target)
+		}
+		ok := true
+		for i := range paths {
+			if paths[i], ok = fn(paths[i]); !ok {
+				break
+			}
+		}
+		if !ok {
+			req.Rerror("%s", fs.ErrNotExist)
+			continue
+		}
+
+		outer, _ := req.Context().Value(pathKey{}).(func(string) string)
+		view := func(p string) string {
+			if outer != nil {
+				p = outer(p)
+			}
+			p, _ = fn(p)
+			return p
+		}
+		req = req.WithContext(context.WithValue(req.Context(), pathKey{}, view))
+		switch r := req.(type) {
+		case Trename:
+			r.OldPath, r.NewPath = paths[0], paths[1]
+			req = r
+		case Tlink:
+			r.Target = paths[1]
+			req = r
+		}
+		s.UpdateRequest(req)
+	}
+}
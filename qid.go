@@ -0,0 +1,45 @@
+package styx
+
+import (
+	"os"
+	"strings"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A QidSource chooses the qids that identify files to clients. By
+// default, a Server numbers the files on each connection in the order
+// they are first seen, so the same file may have a different qid on
+// every connection and after every restart. Clients that cache file
+// data use qids to tell whether a file has changed, so applications
+// that can provide stable identifiers, such as inode numbers, content
+// hashes or database keys, should supply a QidSource.
+//
+// Qid is called with the absolute path of a file and its type, the
+// first time the file is walked to, created or listed on a connection,
+// and again after the file is removed or renamed. The returned Qid may
+// be created with styxproto.NewQid; its type is replaced with the one
+// given by mode. If Qid returns nil, the server's counter is used.
+type QidSource interface {
+	Qid(path string, mode os.FileMode) styxproto.Qid
+}
+
+// newQid asks the QidSource of the server for the qid of a file, if
+// it has one.
+func (srv *Server) newQid(name string, qtype uint8) styxproto.Qid {
+	// Auth files are not part of the file tree.
+	if srv.QidSource == nil || !strings.HasPrefix(name, "/") {
+		return nil
+	}
+	mode := styxfile.ModeOS(uint32(qtype) << 24)
+	qid := srv.QidSource.Qid(name, mode)
+	if len(qid) < styxproto.QidLen {
+		return nil
+	}
+	qid, _, err := styxproto.NewQid(make([]byte, styxproto.QidLen), qtype, qid.Version(), qid.Path())
+	if err != nil {
+		panic(err) // buffer is large enough
+	}
+	return qid
+}
@@ -0,0 +1,164 @@
+// Package qidpool manages pools of 9P Qids, 13-bit unique identifiers
+// for files.
+//
+// A Pool created with NewStore saves its Qids in a Store, so that a
+// file keeps its Qid across server restarts. Such a Pool implements
+// the styx.QidSource interface:
+//
+//	store, err := qidpool.OpenFile("/var/lib/myfs/qids")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	srv := styx.Server{QidSource: qidpool.NewStore(store)}
+package qidpool
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"aqwari.net/net/styx/internal/threadsafe"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Pool maintains a pool of unique 13-bit identifiers
+// for files on a 9P file server. A Pool must be created
+// with a call to New.
+type Pool struct {
+	m    *threadsafe.Map
+	path uint64
+	fn   func(name string, qtype uint8) styxproto.Qid
+
+	store Store
+	mu    sync.Mutex
+	err   error // first error from store
+}
+
+// New returns a new, empty Pool.
+func New() *Pool {
+	return &Pool{m: threadsafe.NewMap()}
+}
+
+// NewFunc returns a new, empty Pool that calls fn to create
+// the Qid for a name that is not in the pool. If fn returns nil,
+// a unique Qid is created as for a Pool returned by New.
+func NewFunc(fn func(name string, qtype uint8) styxproto.Qid) *Pool {
+	return &Pool{m: threadsafe.NewMap(), fn: fn}
+}
+
+// NewStore returns a Pool that loads and saves its Qids in s. Qids
+// not found in s are created with paths from s.NextPath.
+func NewStore(s Store) *Pool {
+	return &Pool{m: threadsafe.NewMap(), store: s}
+}
+
+// Put creates a new, unique Qid of the given type and adds it to the
+// pool. The returned Qid should be considered read-only. Put will not
+// overwrite an existing Qid; if there is already a Qid associated with name,
+// it is returned instead.
+func (p *Pool) Put(name string, qtype uint8) styxproto.Qid {
+	if qid, ok := p.Get(name); ok {
+		return qid
+	}
+	var qid styxproto.Qid
+	if p.store != nil {
+		qid = p.load(name, qtype)
+	} else if p.fn != nil {
+		qid = p.fn(name, qtype)
+	}
+	if qid == nil {
+		var err error
+		buf := make([]byte, styxproto.QidLen)
+		path := atomic.AddUint64(&p.path, 1)
+		qid, _, err = styxproto.NewQid(buf, qtype, 0, path)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	p.m.Do(func(m map[interface{}]interface{}) {
+		if existing, ok := m[name]; ok {
+			qid = existing.(styxproto.Qid)
+		} else {
+			m[name] = qid
+		}
+	})
+
+	p.m.Put(name, qid)
+	return qid
+}
+
+// Del removes a Qid from a Pool. Once a Qid is removed from a pool, it
+// will never be used again, unless it is returned again by the function
+// given to NewFunc.
+func (p *Pool) Del(name string) {
+	p.m.Del(name)
+	if p.store != nil {
+		p.setErr(p.store.Delete(name))
+	}
+}
+
+// Do calls fn while holding the write lock for the pool
+func (p *Pool) Do(fn func(map[interface{}]interface{})) {
+	p.m.Do(fn)
+}
+
+// Get fetches the Qid currently associated with name from the pool. The
+// Qid is only valid if the second return value is true.
+func (p *Pool) Get(name string) (styxproto.Qid, bool) {
+	if v, ok := p.m.Get(name); ok {
+		return v.(styxproto.Qid), true
+	}
+	return nil, false
+}
+
+// load fetches the Qid for name from the Pool's Store, or creates
+// and saves a new one.
+func (p *Pool) load(name string, qtype uint8) styxproto.Qid {
+	qid, ok, err := p.store.Load(name)
+	if err != nil {
+		p.setErr(err)
+		return nil
+	} else if ok {
+		return qid
+	}
+	path, err := p.store.NextPath()
+	if err != nil {
+		p.setErr(err)
+		return nil
+	}
+	qid, _, err = styxproto.NewQid(make([]byte, styxproto.QidLen), qtype, 0, path)
+	if err != nil {
+		panic(err)
+	}
+	p.setErr(p.store.Save(name, qid))
+	return qid
+}
+
+func (p *Pool) setErr(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+}
+
+// Err returns the first error returned by the Store of a Pool
+// created with NewStore. Qids that could not be loaded from the
+// Store are numbered by the Pool's own counter instead, and may
+// collide with those in the Store.
+func (p *Pool) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Qid returns the Qid for the file at path, adding it to the
+// pool if necessary. It implements the styx.QidSource interface.
+func (p *Pool) Qid(path string, mode os.FileMode) styxproto.Qid {
+	var qtype uint8
+	if mode.IsDir() {
+		qtype = styxproto.QTDIR
+	}
+	return p.Put(path, qtype)
+}
@@ -0,0 +1,85 @@
+package qidpool
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+func TestQidpool(t *testing.T) {
+	pool := New()
+	pool.Put("/foo/bar", styxproto.QTDIR)
+
+	var oldpath uint64
+	var oldver uint32
+
+	if q, ok := pool.Get("/foo/bar"); !ok {
+		t.Error("could not find qid")
+	} else if q.Type() != styxproto.QTDIR {
+		t.Error("qid was not set to given type")
+	} else {
+		oldpath = q.Path()
+		oldver = q.Version()
+	}
+
+	pool.Del("/foo/bar")
+	if _, ok := pool.Get("/foo/bar"); ok {
+		t.Error("Del did not delete qid")
+	}
+
+	pool.Put("/foo/bar", styxproto.QTDIR)
+	if q, ok := pool.Get("/foo/bar"); !ok {
+		t.Error("second Put did not put qid")
+	} else if q.Version() == oldver && q.Path() == oldpath {
+		t.Error("Put on same file did not use new qid")
+	}
+
+	pool.Put("/foo/bar", styxproto.QTAUTH)
+	if q, ok := pool.Get("/foo/bar"); !ok {
+		t.Error("repeated Get of qid failed")
+	} else if q.Type() != styxproto.QTDIR {
+		t.Error("subsequent Put replaced old qid")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "qids")
+	store, err := OpenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewStore(store)
+	dir := pool.Qid("/usr/glenda", os.ModeDir)
+	file := pool.Put("/usr/glenda/lib profile", styxproto.QTFILE)
+	pool.Put("/tmp/x", styxproto.QTFILE)
+	pool.Del("/tmp/x")
+	if err := pool.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if dir.Type() != styxproto.QTDIR {
+		t.Errorf("qid of directory has type %d", dir.Type())
+	}
+	store.Close()
+
+	store, err = OpenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	pool = NewStore(store)
+	if q, ok, _ := store.Load("/usr/glenda/lib profile"); !ok || !bytes.Equal(q, file) {
+		t.Errorf("reopened store has qid %v, want %v", q, file)
+	}
+	if q := pool.Qid("/usr/glenda", os.ModeDir); !bytes.Equal(q, dir) {
+		t.Errorf("reopened pool has qid %v, want %v", q, dir)
+	}
+	if _, ok, _ := store.Load("/tmp/x"); ok {
+		t.Error("deleted qid was restored")
+	}
+	if q := pool.Put("/tmp/x", styxproto.QTFILE); q.Path() <= 3 {
+		t.Errorf("new qid reused path %d", q.Path())
+	}
+}
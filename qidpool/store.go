@@ -0,0 +1,191 @@
+package qidpool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Store holds the Qids of a Pool created with NewStore, so that
+// they outlive it. A Store must be safe for concurrent use.
+type Store interface {
+	// Load returns the Qid saved for name. The second return
+	// value is false if there is none.
+	Load(name string) (styxproto.Qid, bool, error)
+
+	// Save records the Qid for name, replacing any previous one.
+	Save(name string, qid styxproto.Qid) error
+
+	// Delete removes the Qid for name, if any.
+	Delete(name string) error
+
+	// NextPath returns a path that has not been used by any
+	// Qid in the Store, and will not be returned again.
+	NextPath() (uint64, error)
+}
+
+// A MemStore is a Store that keeps its Qids in memory. The zero
+// value is an empty MemStore ready for use.
+type MemStore struct {
+	mu   sync.Mutex
+	qids map[string]styxproto.Qid
+	path uint64
+}
+
+func (s *MemStore) Load(name string) (styxproto.Qid, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qid, ok := s.qids[name]
+	return qid, ok, nil
+}
+
+func (s *MemStore) Save(name string, qid styxproto.Qid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.qids == nil {
+		s.qids = make(map[string]styxproto.Qid)
+	}
+	s.qids[name] = append(styxproto.Qid(nil), qid...)
+	if qid.Path() > s.path {
+		s.path = qid.Path()
+	}
+	return nil
+}
+
+func (s *MemStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.qids, name)
+	return nil
+}
+
+func (s *MemStore) NextPath() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path++
+	return s.path, nil
+}
+
+// A FileStore is a Store that keeps its Qids in a file, so that
+// they survive restarts of the program. Changes are appended to the
+// file as they are made, and the whole file is read when it is
+// opened; the paths of deleted Qids are never reused.
+type FileStore struct {
+	mem  MemStore
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFile opens the FileStore in the named file, creating it if it
+// does not exist.
+func OpenFile(name string) (*FileStore, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{file: file}
+	if err := s.read(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("qidpool: %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// Each line of a FileStore is either
+//
+//	save type version path name
+//	delete name
+//
+// where name is a quoted Go string.
+func (s *FileStore) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		record := strings.SplitN(scanner.Text(), " ", 2)
+		var err error
+		switch {
+		case len(record) < 2:
+			err = fmt.Errorf("short record")
+		case record[0] == "save":
+			err = s.readSave(strings.SplitN(record[1], " ", 4))
+		case record[0] == "delete":
+			var name string
+			if name, err = strconv.Unquote(record[1]); err == nil {
+				s.mem.Delete(name)
+			}
+		default:
+			err = fmt.Errorf("unrecognized record")
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileStore) readSave(fields []string) error {
+	if len(fields) < 4 {
+		return fmt.Errorf("short save record")
+	}
+	qtype, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return err
+	}
+	path, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	name, err := strconv.Unquote(fields[3])
+	if err != nil {
+		return err
+	}
+	qid, _, err := styxproto.NewQid(make([]byte, styxproto.QidLen), uint8(qtype), uint32(version), path)
+	if err != nil {
+		return err
+	}
+	return s.mem.Save(name, qid)
+}
+
+func (s *FileStore) Load(name string) (styxproto.Qid, bool, error) {
+	return s.mem.Load(name)
+}
+
+func (s *FileStore) Save(name string, qid styxproto.Qid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.file, "save %d %d %d %q\n", qid.Type(), qid.Version(), qid.Path(), name)
+	if err != nil {
+		return err
+	}
+	return s.mem.Save(name, qid)
+}
+
+func (s *FileStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprintf(s.file, "delete %q\n", name); err != nil {
+		return err
+	}
+	return s.mem.Delete(name)
+}
+
+// NextPath returns a path one greater than any saved in the
+// FileStore. Paths returned by NextPath that are not saved may be
+// returned again after the FileStore is reopened.
+func (s *FileStore) NextPath() (uint64, error) {
+	return s.mem.NextPath()
+}
+
+// Close closes the file of a FileStore.
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,175 @@
+package styx
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+var errQuota = Errorf(styxproto.EDQUOT, "disk quota exceeded")
+
+// A Quota is a Handler that limits how much data each user may write,
+// and how many files each user may create, before passing requests on
+// to its Handler. Usage is counted by the User of a session, across
+// all of the sessions the Quota serves. Writes, and requests that
+// create files, such as Tcreate, Tsymlink, Tmknod and Tlink, beyond
+// a limit fail with a "disk quota exceeded" error.
+//
+// Files are counted when they are created and data when it is
+// written, whether or not the files are later removed or the data
+// overwritten; a Quota limits what users do, rather than the space
+// their files take up. A request to create a file that fails, or
+// that is flushed before it is answered, is not counted, and a write is counted only
+// for the bytes that reach the file.
+type Quota struct {
+	// Handler answers requests within the limits.
+	Handler Handler
+
+	// MaxBytes is the number of bytes each user may write. Zero
+	// means no limit.
+	MaxBytes int64
+
+	// MaxFiles is the number of files each user may create. Zero
+	// means no limit.
+	MaxFiles int64
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	bytes, files int64
+}
+
+func (q *Quota) Serve9P(s *Session) {
+	Stack(quotaCheck{q}, q.Handler).Serve9P(s)
+}
+
+// Usage returns the number of bytes user has written, and the number
+// of files user has created.
+func (q *Quota) Usage(user string) (bytes, files int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u, ok := q.usage[user]; ok {
+		return u.bytes, u.files
+	}
+	return 0, 0
+}
+
+// reserve adds bytes and files to the usage of user, unless that
+// would exceed a limit.
+func (q *Quota) reserve(user string, bytes, files int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		q.usage = make(map[string]*quotaUsage)
+	}
+	u, ok := q.usage[user]
+	if !ok {
+		u = new(quotaUsage)
+		q.usage[user] = u
+	}
+	if q.MaxBytes > 0 && u.bytes+bytes > q.MaxBytes {
+		return errQuota
+	}
+	if q.MaxFiles > 0 && u.files+files > q.MaxFiles {
+		return errQuota
+	}
+	u.bytes += bytes
+	u.files += files
+	return nil
+}
+
+// refund takes back a reservation that was not used.
+func (q *Quota) refund(user string, bytes, files int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[user]
+	u.bytes -= bytes
+	u.files -= files
+}
+
+// limitWrites returns a context for a Topen or Tcreate request, such
+// that writes to the file it opens count against the quota of user.
+func (q *Quota) limitWrites(ctx context.Context, user string) context.Context {
+	return wrapOpen(ctx, func(f styxfile.Interface) styxfile.Interface {
+		reserve := func(n int64) error { return q.reserve(user, n, 0) }
+		refund := func(n int64) { q.refund(user, n, 0) }
+		return styxfile.Limit(f, reserve, refund)
+	})
+}
+
+// openKey is the context key for a function that wraps the file
+// opened by a Topen or Tcreate request.
+type openKey struct{}
+
+// wrapOpen returns a context in which fn is applied to the file
+// opened by a Topen or Tcreate request, after any function already
+// attached to ctx, so that handlers in a stack may each wrap it.
+func wrapOpen(ctx context.Context, fn func(styxfile.Interface) styxfile.Interface) context.Context {
+	if prev, ok := ctx.Value(openKey{}).(func(styxfile.Interface) styxfile.Interface); ok {
+		wrap := fn
+		fn = func(f styxfile.Interface) styxfile.Interface { return wrap(prev(f)) }
+	}
+	return context.WithValue(ctx, openKey{}, fn)
+}
+
+// wrapOpened applies the function attached to ctx with openKey, if
+// any, to f.
+func wrapOpened(ctx context.Context, f styxfile.Interface) styxfile.Interface {
+	if fn, ok := ctx.Value(openKey{}).(func(styxfile.Interface) styxfile.Interface); ok {
+		return fn(f)
+	}
+	return f
+}
+
+// quotaCheck refuses the requests that would exceed the limits of
+// a Quota, and arranges for writes to be counted, leaving the
+// requests for the next handler in a stack.
+type quotaCheck struct {
+	*Quota
+}
+
+func (q quotaCheck) Serve9P(s *Session) {
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Tcreate:
+			if ctx, ok := q.reserveFile(s, req); ok {
+				s.UpdateRequest(req.WithContext(q.limitWrites(ctx, s.User)))
+			}
+		case Tsymlink, Tmknod, Tlink:
+			if ctx, ok := q.reserveFile(s, req); ok {
+				s.UpdateRequest(req.WithContext(ctx))
+			}
+		case Topen:
+			if req.Flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+				s.UpdateRequest(req.WithContext(q.limitWrites(req.Context(), s.User)))
+			}
+		}
+	}
+}
+
+// reserveFile counts the file created by req against the quota of
+// the session's user, and returns the context req should be passed
+// on with. If the quota is exceeded, req is answered with an error
+// and reserveFile returns false.
+func (q quotaCheck) reserveFile(s *Session, req Request) (context.Context, bool) {
+	if err := q.reserve(s.User, 0, 1); err != nil {
+		req.Rerror("%s", err)
+		return nil, false
+	}
+	ctx, rec := watchResult(req.Context())
+	go func(user string) {
+		<-ctx.Done()
+		// Only a file that was created counts. The request may
+		// also have been flushed or timed out before the handler
+		// answered it.
+		if answered, err := rec.result(); !answered || err != nil {
+			q.refund(user, 0, 1)
+		}
+	}(s.User)
+	return ctx, true
+}
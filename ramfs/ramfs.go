@@ -0,0 +1,448 @@
+// Package ramfs provides a styx.Handler that serves a read-write file
+// tree held in memory. It is useful for testing 9P clients, for
+// scratch space, and as an example of a complete Handler.
+package ramfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx"
+	"aqwari.net/net/styx/styxproto"
+)
+
+var (
+	errNoSpace  = styx.Errorf(styxproto.ENOSPC, "no space left on device")
+	errNotEmpty = styx.Errorf(styxproto.ENOTEMPTY, "directory not empty")
+	errNotDir   = styx.Errorf(styxproto.ENOTDIR, "not a directory")
+	errIsDir    = styx.Errorf(styxproto.EISDIR, "is a directory")
+	errInvalid  = styx.Errorf(styxproto.EINVAL, "invalid argument")
+	errRoot     = styx.Errorf(styxproto.EPERM, "operation not permitted on root")
+)
+
+// An FS is an in-memory file tree. The zero value of an FS is an
+// empty tree, ready to use. An FS may be served by several Servers,
+// and to several sessions, at once; they all share the same files.
+//
+// The FS does not check permissions; any user may read, write or
+// remove any file. Files are owned by the user that created them.
+type FS struct {
+	// MaxBytes limits the total size of the files in the tree.
+	// Writes that would exceed it fail. Zero means no limit.
+	MaxBytes int64
+
+	// MaxFiles limits the number of files and directories in the
+	// tree, not counting the root. Zero means no limit.
+	MaxFiles int
+
+	mu    sync.RWMutex
+	root  *node
+	bytes int64
+	files int
+}
+
+// A node is a file or directory in the tree.
+type node struct {
+	name          string
+	mode          os.FileMode
+	mtime         time.Time
+	uid, gid      string
+	muid          string
+	data          []byte
+	children      map[string]*node // nil for regular files
+	parent        *node            // nil for the root and removed nodes
+	removed, root bool
+}
+
+func (n *node) info() fileInfo {
+	return fileInfo{
+		name:  n.name,
+		size:  int64(len(n.data)),
+		mode:  n.mode,
+		mtime: n.mtime,
+		uid:   n.uid,
+		gid:   n.gid,
+		muid:  n.muid,
+	}
+}
+
+// Serve9P serves the tree to a session.
+func (fsys *FS) Serve9P(s *styx.Session) {
+	fsys.mu.Lock()
+	if fsys.root == nil {
+		fsys.root = &node{
+			name:     "/",
+			mode:     os.ModeDir | 0777,
+			mtime:    time.Now(),
+			uid:      s.User,
+			gid:      s.User,
+			muid:     s.User,
+			children: make(map[string]*node),
+			root:     true,
+		}
+	}
+	fsys.mu.Unlock()
+
+	for s.Next() {
+		fsys.serve(s.User, s.Request())
+	}
+}
+
+func (fsys *FS) serve(user string, r styx.Request) {
+	switch req := r.(type) {
+	case styx.Twalk:
+		req.Rwalk(fsys.stat(req.Path()))
+	case styx.Tstat:
+		req.Rstat(fsys.stat(req.Path()))
+	case styx.Topen:
+		req.Ropen(fsys.open(user, req.Path(), req.Flag))
+	case styx.Tcreate:
+		req.Rcreate(fsys.create(user, req.Path(), req.Name, req.Mode))
+	case styx.Tremove:
+		req.Rremove(fsys.remove(req.Path()))
+	case styx.Trename:
+		req.Rrename(fsys.rename(req.OldPath, req.NewPath))
+	case styx.Tchmod:
+		req.Rchmod(fsys.update(req.Path(), func(n *node) error {
+			n.mode = n.mode&os.ModeType | req.Mode&^os.ModeType
+			return nil
+		}))
+	case styx.Tchown:
+		req.Rchown(fsys.update(req.Path(), func(n *node) error {
+			if uid := ownerName(req.User, req.Uid); uid != "" {
+				n.uid = uid
+			}
+			if gid := ownerName(req.Group, req.Gid); gid != "" {
+				n.gid = gid
+			}
+			return nil
+		}))
+	case styx.Tmuid:
+		req.Rmuid(fsys.update(req.Path(), func(n *node) error {
+			n.muid = req.Muid
+			return nil
+		}))
+	case styx.Tutimes:
+		req.Rutimes(fsys.update(req.Path(), func(n *node) error {
+			if !req.Mtime.IsZero() {
+				n.mtime = req.Mtime
+			}
+			return nil
+		}))
+	case styx.Ttruncate:
+		req.Rtruncate(fsys.update(req.Path(), func(n *node) error {
+			if n.children != nil {
+				return errIsDir
+			}
+			if req.Size < 0 {
+				return errInvalid
+			}
+			if err := fsys.resize(n, req.Size); err != nil {
+				return err
+			}
+			n.mtime, n.muid = time.Now(), user
+			return nil
+		}))
+	case styx.Tsync:
+		req.Rsync(nil)
+	}
+}
+
+// ownerName returns the name of a file owner, given as a name or,
+// by clients of the 9P2000.u and 9P2000.L extensions, as a number.
+func ownerName(name string, id int) string {
+	if name == "" && id >= 0 {
+		return strconv.Itoa(id)
+	}
+	return name
+}
+
+// lookup finds the node at the absolute path p. fsys.mu must be held.
+func (fsys *FS) lookup(p string) (*node, error) {
+	n := fsys.root
+	for _, elem := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		if n.children == nil {
+			return nil, &os.PathError{Op: "walk", Path: p, Err: errNotDir}
+		}
+		if n = n.children[elem]; n == nil {
+			return nil, &os.PathError{Op: "walk", Path: p, Err: os.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+// resize changes the length of a file's contents, within the limits
+// of the FS. fsys.mu must be held for writing.
+func (fsys *FS) resize(n *node, size int64) error {
+	delta := size - int64(len(n.data))
+	if !n.removed {
+		if delta > 0 && fsys.MaxBytes > 0 && fsys.bytes+delta > fsys.MaxBytes {
+			return errNoSpace
+		}
+		fsys.bytes += delta
+	}
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return nil
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, n.data)
+	n.data = data
+	return nil
+}
+
+func (fsys *FS) stat(p string) (os.FileInfo, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+	n, err := fsys.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+func (fsys *FS) update(p string, fn func(*node) error) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup(p)
+	if err != nil {
+		return err
+	}
+	return fn(n)
+}
+
+func (fsys *FS) open(user, p string, flag int) (interface{}, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.children != nil {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+			return nil, &os.PathError{Op: "open", Path: p, Err: errIsDir}
+		}
+		return newDirHandle(n), nil
+	}
+	if flag&os.O_TRUNC != 0 {
+		fsys.resize(n, 0)
+		n.mtime, n.muid = time.Now(), user
+	}
+	return &fileHandle{fsys: fsys, n: n, user: user}, nil
+}
+
+func (fsys *FS) create(user, dir, name string, mode os.FileMode) (interface{}, error) {
+	p := path.Join(dir, name)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, &os.PathError{Op: "create", Path: p, Err: errInvalid}
+	}
+	if mode&os.ModeType&^os.ModeDir != 0 {
+		return nil, &os.PathError{Op: "create", Path: p, Err: styx.Errorf(styxproto.EOPNOTSUPP, "not supported")}
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	parent, err := fsys.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if parent.children == nil {
+		return nil, &os.PathError{Op: "create", Path: p, Err: errNotDir}
+	}
+	if _, ok := parent.children[name]; ok {
+		return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrExist}
+	}
+	if fsys.MaxFiles > 0 && fsys.files >= fsys.MaxFiles {
+		return nil, &os.PathError{Op: "create", Path: p, Err: errNoSpace}
+	}
+	n := &node{
+		name:   name,
+		mode:   mode,
+		mtime:  time.Now(),
+		uid:    user,
+		gid:    parent.gid,
+		muid:   user,
+		parent: parent,
+	}
+	parent.children[name] = n
+	parent.mtime, parent.muid = n.mtime, user
+	fsys.files++
+	if mode.IsDir() {
+		n.children = make(map[string]*node)
+		return newDirHandle(n), nil
+	}
+	return &fileHandle{fsys: fsys, n: n, user: user}, nil
+}
+
+// detach removes n from the tree. fsys.mu must be held for writing.
+func (fsys *FS) detach(n *node) {
+	delete(n.parent.children, n.name)
+	n.parent = nil
+	n.removed = true
+	fsys.files--
+	fsys.bytes -= int64(len(n.data))
+}
+
+func (fsys *FS) remove(p string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup(p)
+	if err != nil {
+		return err
+	}
+	if n.root {
+		return &os.PathError{Op: "remove", Path: p, Err: errRoot}
+	}
+	if len(n.children) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: errNotEmpty}
+	}
+	n.parent.mtime = time.Now()
+	fsys.detach(n)
+	return nil
+}
+
+func (fsys *FS) rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	n, err := fsys.lookup(oldpath)
+	if err != nil {
+		return err
+	}
+	if n.root || path.Clean(newpath) == "/" {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: errRoot}
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: errInvalid}
+	}
+	dir, name := path.Split(path.Clean(newpath))
+	parent, err := fsys.lookup(dir)
+	if err != nil {
+		return err
+	}
+	if parent.children == nil {
+		return &os.PathError{Op: "rename", Path: newpath, Err: errNotDir}
+	}
+	if old, ok := parent.children[name]; ok && old != n {
+		switch {
+		case old.children != nil && n.children == nil:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errIsDir}
+		case old.children == nil && n.children != nil:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errNotDir}
+		case len(old.children) > 0:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errNotEmpty}
+		}
+		fsys.detach(old)
+	}
+	now := time.Now()
+	delete(n.parent.children, n.name)
+	n.parent.mtime = now
+	n.name, n.parent = name, parent
+	parent.children[name] = n
+	parent.mtime = now
+	return nil
+}
+
+// A fileHandle is an open regular file.
+type fileHandle struct {
+	fsys *FS
+	n    *node
+	user string
+}
+
+func (f *fileHandle) ReadAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.RLock()
+	defer f.fsys.mu.RUnlock()
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fileHandle) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errInvalid
+	}
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.n.data)) {
+		if err := f.fsys.resize(f.n, end); err != nil {
+			return 0, err
+		}
+	}
+	copy(f.n.data[off:], p)
+	f.n.mtime, f.n.muid = time.Now(), f.user
+	return len(p), nil
+}
+
+func (f *fileHandle) Close() error { return nil }
+
+// A dirHandle is an open directory. It lists the directory's
+// contents as they were when it was opened.
+type dirHandle struct {
+	entries []os.FileInfo
+}
+
+func newDirHandle(n *node) *dirHandle {
+	d := &dirHandle{entries: make([]os.FileInfo, 0, len(n.children))}
+	for _, child := range n.children {
+		d.entries = append(d.entries, child.info())
+	}
+	sort.Slice(d.entries, func(i, j int) bool {
+		return d.entries[i].Name() < d.entries[j].Name()
+	})
+	return d
+}
+
+func (d *dirHandle) Readdir(n int) ([]os.FileInfo, error) {
+	if n <= 0 {
+		list := d.entries
+		d.entries = nil
+		return list, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	list := d.entries[:n]
+	d.entries = d.entries[n:]
+	return list, nil
+}
+
+func (d *dirHandle) Close() error { return nil }
+
+// fileInfo describes a node. It implements styx.OwnerInfo.
+type fileInfo struct {
+	name           string
+	size           int64
+	mode           os.FileMode
+	mtime          time.Time
+	uid, gid, muid string
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+func (fi fileInfo) Uid() string        { return fi.uid }
+func (fi fileInfo) Gid() string        { return fi.gid }
+func (fi fileInfo) Muid() string       { return fi.muid }
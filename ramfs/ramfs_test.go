@@ -0,0 +1,123 @@
+package ramfs
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+func dial(t *testing.T, fsys *FS) *styx.ClientConn {
+	local, remote := net.Pipe()
+	go (&styx.Server{Handler: fsys}).ServeConn(remote)
+	var client styx.Client
+	conn, err := client.NewClientConn(local, "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func writeFile(conn *styx.ClientConn, name, data string) error {
+	f, err := conn.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(data))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readFile(conn *styx.ClientConn, name string) (string, error) {
+	f, err := conn.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
+}
+
+func TestFS(t *testing.T) {
+	var fsys FS
+	conn := dial(t, &fsys)
+	if err := conn.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/b", "dir/a", "top"} {
+		if err := writeFile(conn, name, "contents of "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := readFile(conn, "dir/a"); err != nil || got != "contents of dir/a" {
+		t.Errorf("read %q, %v", got, err)
+	}
+	info, err := conn.Stat("dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("contents of dir/a")) || info.Mode().IsDir() {
+		t.Errorf("stat dir/a: size %d, mode %s", info.Size(), info.Mode())
+	}
+
+	dir, err := conn.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil || len(list) != 2 || list[0].Name() != "a" || list[1].Name() != "b" {
+		t.Errorf("readdir: %d entries, %v", len(list), err)
+	}
+
+	// A second session sees the same tree.
+	if got, err := readFile(dial(t, &fsys), "top"); err != nil || got != "contents of top" {
+		t.Errorf("second session read %q, %v", got, err)
+	}
+
+	if err := conn.Rename("dir/a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFile(conn, "dir/c"); err != nil || got != "contents of dir/a" {
+		t.Errorf("read renamed file: %q, %v", got, err)
+	}
+	if _, err := conn.Stat("dir/a"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("stat old name after rename: %v", err)
+	}
+	if err := conn.Remove("dir"); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("removing non-empty directory: %v", err)
+	}
+	for _, name := range []string{"dir/b", "dir/c", "dir"} {
+		if err := conn.Remove(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := conn.Remove("/"); err == nil {
+		t.Error("removed root")
+	}
+}
+
+func TestFSLimits(t *testing.T) {
+	fsys := FS{MaxBytes: 10, MaxFiles: 2}
+	conn := dial(t, &fsys)
+	if err := writeFile(conn, "a", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(conn, "b", "x"); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Errorf("write past MaxBytes: %v", err)
+	}
+	if err := conn.Mkdir("c", 0755); err == nil {
+		t.Error("created file past MaxFiles")
+	}
+	if err := conn.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(conn, "c", "0123456789"); err != nil {
+		t.Errorf("space was not freed by Remove: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package styx
+
+import (
+	"errors"
+	"os"
+)
+
+var errReadOnly = errors.New("read-only file system")
+
+// ReadOnly returns a Handler that refuses every request that would
+// modify the file tree before it reaches handler. Files may not be
+// created, removed, renamed or linked, their attributes may not be
+// changed, and they may not be opened for writing, truncation or
+// removal on close.
+// The refused requests are answered with a "read-only file system"
+// error, so a server built on ReadOnly cannot be changed by clients
+// even if handler would allow it.
+func ReadOnly(handler Handler) Handler {
+	return Stack(HandlerFunc(refuseWrites), handler)
+}
+
+func refuseWrites(s *Session) {
+	for s.Next() {
+		if modifies(s.Request()) {
+			s.Request().Rerror("%s", errReadOnly)
+		}
+	}
+}
+
+// modifies reports whether r would change the file tree.
+func modifies(r Request) bool {
+	switch r := r.(type) {
+	case Tcreate, Tremove, Trename, Tchmod, Tutimes, Tchown, Tmuid,
+		Ttruncate, Twstat, Tsymlink, Tlink, Tmknod:
+		return true
+	case Topen:
+		return r.RemoveOnClose || r.Flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package styx
+
+import (
+	"sync"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// Like a Unix file system, a 9P server should let clients keep using a
+// file after it is removed, through any other fids that refer to it.
+// The styx package identifies files by their path, so to keep the qid
+// of a removed file, the fids referring to each path are counted, and
+// the qid is only forgotten when the last of them is clunked. If a new
+// file is created at the same path in the meantime, it is given a new
+// qid.
+type fileRefs struct {
+	mu      sync.Mutex
+	count   map[string]int
+	removed map[string]bool
+}
+
+func (r *fileRefs) inc(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count == nil {
+		r.count = make(map[string]int)
+	}
+	r.count[name]++
+}
+
+// dec drops a reference to name, and reports whether name was removed
+// and is no longer referenced.
+func (r *fileRefs) dec(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count[name]--; r.count[name] > 0 {
+		return false
+	}
+	delete(r.count, name)
+	if r.removed[name] {
+		delete(r.removed, name)
+		return true
+	}
+	return false
+}
+
+// remove marks name as removed, and reports whether it is no
+// longer referenced.
+func (r *fileRefs) remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count[name] == 0 {
+		return true
+	}
+	if r.removed == nil {
+		r.removed = make(map[string]bool)
+	}
+	r.removed[name] = true
+	return false
+}
+
+// replace reports whether name was removed but still referenced,
+// and forgets that it was removed, as a new file has taken its place.
+func (r *fileRefs) replace(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.removed[name] {
+		delete(r.removed, name)
+		return true
+	}
+	return false
+}
+
+// move transfers a reference from oldname to newname.
+func (r *fileRefs) move(oldname, newname string) {
+	r.dec(oldname)
+	r.inc(newname)
+}
+
+// hold and release count the fids referring to a file. Auth files
+// are not part of the file tree.
+func (c *conn) hold(f file) {
+	if !f.auth {
+		c.refs.inc(f.name)
+	}
+}
+
+func (c *conn) release(f file) {
+	if !f.auth && c.refs.dec(f.name) {
+		c.qidpool.Del(f.name)
+	}
+}
+
+// removed forgets the qid of a removed file, once no fids refer to it.
+func (c *conn) removed(name string) {
+	if c.refs.remove(name) {
+		c.qidpool.Del(name)
+	}
+}
+
+// newQid returns the qid for a newly created file.
+func (c *conn) newQid(name string, qtype uint8) styxproto.Qid {
+	if c.refs.replace(name) {
+		c.qidpool.Del(name)
+	}
+	return c.qid(name, qtype)
+}
+
+// putFile associates fid with f, replacing any file it referred to.
+func (s *Session) putFile(fid uint32, f file) {
+	var old file
+	var ok bool
+	s.files.Do(func(m map[interface{}]interface{}) {
+		var v interface{}
+		if v, ok = m[fid]; ok {
+			old = v.(file)
+		}
+		m[fid] = f
+	})
+	s.conn.hold(f)
+	if ok {
+		s.conn.release(old)
+	}
+}
+
+// delFile removes fid from the session.
+func (s *Session) delFile(fid uint32) {
+	var old file
+	var ok bool
+	s.files.Do(func(m map[interface{}]interface{}) {
+		var v interface{}
+		if v, ok = m[fid]; ok {
+			old = v.(file)
+			delete(m, fid)
+		}
+	})
+	if ok {
+		s.conn.release(old)
+	}
+}
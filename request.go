@@ -6,7 +6,6 @@ import (
 	"path"
 
 	"aqwari.net/net/styx/internal/styxfile"
-	"aqwari.net/net/styx/internal/sys"
 	"aqwari.net/net/styx/styxproto"
 )
 
@@ -34,6 +33,11 @@ type Request interface {
 	// Path returns the Path of the file being operated on.
 	Path() string
 
+	// Qid returns the qid that identifies the file being operated
+	// on to the client, or nil if the server has not assigned one
+	// yet, as for the file a Twalk or Tcreate request refers to.
+	Qid() styxproto.Qid
+
 	// For the programmer's convenience, each request type has a default
 	// response. Programmers can choose to ignore requests of a given
 	// type and have the styx package send default responses to them.
@@ -41,10 +45,6 @@ type Request interface {
 	// has insufficient permissions or the file in question does not exist.
 	defaultResponse()
 	handled() bool
-
-	// Used for nested request handlers to swap a request between
-	// sub-sessions.
-	setSession(*Session)
 }
 
 // common fields among all requests. Some may be nil for
@@ -58,10 +58,6 @@ type reqInfo struct {
 	path    string
 }
 
-func (info reqInfo) setSession(new *Session) {
-	info.session = new
-}
-
 func (info reqInfo) handled() bool {
 	return !info.session.unhandled
 }
@@ -77,17 +73,46 @@ func (t reqInfo) Context() context.Context {
 
 // Path returns the absolute path of the file being operated on.
 func (t reqInfo) Path() string {
-	return t.path
+	return t.view(t.path)
+}
+
+// view maps the absolute path p, as the client sees it, to the
+// path seen by the handler the request is passed to.
+func (t reqInfo) view(p string) string {
+	if fn, ok := t.ctx.Value(pathKey{}).(func(string) string); ok {
+		return fn(p)
+	}
+	return p
+}
+
+// Qid returns the qid of the file being operated on, if the server
+// has assigned it one.
+func (t reqInfo) Qid() styxproto.Qid {
+	return t.session.Qid(t.path)
 }
 
-// Rerror sends an error to the client.
+// Rerror sends an error to the client. Clients using the 9P2000.u or
+// 9P2000.L extensions also receive an error number, which is taken from
+// any Error or os package error in args, or guessed from the message.
 func (t reqInfo) Rerror(format string, args ...interface{}) {
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
+	err := rerror(format, args)
+	if failAttempt(t.ctx, err) {
+		return
+	}
+	if t.respond(err) {
 		t.session.conn.Rerror(t.tag, format, args...)
 	}
 }
 
+// respond claims the tag of the request for its response, noting
+// err as the result of the request for the handlers watching it. It
+// reports whether the response should be sent; it should not if the
+// request was flushed or cancelled first.
+func (t reqInfo) respond(err error) bool {
+	t.session.unhandled = false
+	return t.session.conn.answerTag(t.tag, func() { recordResult(t.ctx, err) })
+}
+
 func newReqInfo(ctx context.Context, s *Session, msg fcall, filepath string) reqInfo {
 	return reqInfo{
 		session: s,
@@ -108,6 +133,27 @@ type Topen struct {
 	// The mode to open the file with. One of the flag constants
 	// in the os package, such as O_RDWR, O_APPEND etc.
 	Flag int
+
+	// OpenMode is the mode byte sent by the client, such as
+	// styxproto.OREAD|styxproto.OTRUNC. For 9P2000.L clients
+	// it is derived from the Linux open flags.
+	OpenMode uint8
+
+	// Exec is true if the client opened the file for execution
+	// (OEXEC). The file is read as usual, but a handler may
+	// check for execute permission instead of read permission.
+	Exec bool
+
+	// RemoveOnClose is true if the client asked for the file to
+	// be removed when the fid is clunked (ORCLOSE). The styx
+	// package does not remove the file; a handler can do so when
+	// the value given to Ropen is closed.
+	RemoveOnClose bool
+
+	// IOUnit, if positive, is sent to the client by Ropen as the
+	// largest number of bytes it should read or write in a single
+	// request. See the Ropen method.
+	IOUnit int
 	reqInfo
 }
 
@@ -126,11 +172,25 @@ func (t Topen) WithContext(ctx context.Context) Request {
 // the file. Types that only implement Read or Write operations will return
 // errors on writes and reads, respectively.
 //
+// If the file's mode, as reported when it was walked to, includes
+// os.ModeAppend, the file is append-only: writes are made at the end
+// of the file, regardless of the offset requested by the client, and
+// requests to truncate the file when opening it are refused.
+//
 // If rwc implements the Stat method of os.File, that will be used to
 // answer Tstat requests. Otherwise, the styx package will assemble Rstat
 // responses out of default values merged with any methods rwc provides
 // from the os.FileInfo interface.
 //
+// If the file is a directory, rwc should implement the Directory or
+// DirEntryReader interface, such as directories opened from an fs.FS.
+//
+// The iounit sent to the client is the IOUnit field of the request
+// or, if that is not set, the result of an IOUnit() int method on
+// rwc, if it has one. Clients that honor it will size their reads and
+// writes to fit. It is capped at the largest payload that fits in a
+// message on the connection; if zero, clients use the message size.
+//
 // If a file does not implement any of the Read or Write interfaces in
 // the io package, A generic error is returned to the client, and a message
 // will be written to the server's ErrorLog.
@@ -143,15 +203,21 @@ func (t Topen) Ropen(rwc interface{}, err error) {
 		t.Rerror("%s", err)
 		return
 	}
+	if captureOpen(t.ctx, rwc) {
+		return
+	}
 	// The type of the file (regular or directory) will have been
 	// established in a previous Twalk request.
-	qid := t.session.conn.qid(t.Path(), 0)
+	qid := t.session.conn.qid(t.path, 0)
 	mode := styxfile.ModeOS(uint32(qid.Type()) << 24)
 
-	if dir, ok := rwc.(Directory); ok && mode.IsDir() {
-		f = styxfile.NewDir(dir, t.Path(), t.session.conn.qidpool)
-	} else {
-		f, err = styxfile.New(rwc)
+	if dir, ok := styxfile.AsDirectory(rwc); ok && mode.IsDir() {
+		f = t.session.conn.newDir(dir, t.path, t.session.atime)
+	} else if f, err = styxfile.New(rwc); err == nil {
+		if f, err = styxfile.OpenAppend(f, mode, t.Flag); err == styxfile.ErrAppendTrunc {
+			t.Rerror("%s", err)
+			return
+		}
 	}
 
 	if err != nil {
@@ -162,12 +228,19 @@ func (t Topen) Ropen(rwc interface{}, err error) {
 		t.Rerror("open failed")
 		return
 	}
+	if !mode.IsDir() {
+		f = wrapOpened(t.ctx, f)
+	}
 	t.session.files.Update(t.fid, &file, func() {
 		file.rwc = f
 	})
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
-		t.session.conn.Ropen(t.tag, qid, 0)
+	if !t.respond(nil) {
+		return
+	}
+	if _, ok := t.msg.(styxproto.Tlopen); ok {
+		t.session.conn.Rlopen(t.tag, qid, t.session.conn.iounit(t.IOUnit, rwc))
+	} else {
+		t.session.conn.Ropen(t.tag, qid, t.session.conn.iounit(t.IOUnit, rwc))
 	}
 }
 
@@ -196,29 +269,79 @@ func (t Tstat) Rstat(info os.FileInfo, err error) {
 		t.Rerror("%s", err)
 		return
 	}
-	buf := make([]byte, styxproto.MaxStatLen)
-	uid, gid, muid := sys.FileOwner(info)
-	name := info.Name()
-	if name == "/" {
-		name = "."
+	fillCache(t.ctx, info)
+	if t.respond(nil) {
+		t.session.rstat(t.msg, t.tag, t.path, info)
 	}
-	stat, _, err := styxproto.NewStat(buf, name, uid, gid, muid)
+}
+
+// RstatRaw is like Rstat, but sends stat to the client unchanged,
+// giving the handler control of fields that cannot be derived from
+// an os.FileInfo, such as the type, dev and muid fields. It is only
+// converted to or from the 9P2000.u format to match the connection.
+// For 9P2000.L clients, stat is translated as it would be by Rstat.
+// Similarly, directory listings send the Stat returned by the Sys
+// method of an os.FileInfo as-is, if it is a styxproto.Stat.
+func (t Tstat) RstatRaw(stat styxproto.Stat, err error) {
 	if err != nil {
-		// should never happen
-		panic(err)
+		t.Rerror("%s", err)
+		return
 	}
-	mode := styxfile.Mode9P(info.Mode())
-	stat.SetLength(info.Size())
-	stat.SetMode(mode)
-	stat.SetAtime(uint32(info.ModTime().Unix())) // TODO: get atime
-	stat.SetMtime(uint32(info.ModTime().Unix()))
-	stat.SetQid(t.session.conn.qid(t.Path(), styxfile.QidType(mode)))
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
-		t.session.conn.Rstat(t.tag, stat)
+	fillCache(t.ctx, append(styxproto.Stat(nil), stat...))
+	if !t.respond(nil) {
+		return
+	}
+	if _, ok := t.msg.(styxproto.Tgetattr); ok {
+		t.session.rstat(t.msg, t.tag, t.path, newFileInfo(stat))
+		return
+	}
+	dotu := t.session.conn.version == styxproto.Version9P2000U
+	stat, err = styxfile.ConvertStat(make([]byte, styxproto.MaxStatLenU), stat, dotu)
+	if err != nil {
+		t.session.conn.Rerror(t.tag, "%s", err)
+		return
+	}
+	t.session.conn.Rstat(t.tag, stat)
+}
+
+// A Tread message is sent when a client wants to read from an open
+// file. Tread requests are only passed to handlers when the HandleReads
+// option of the Server is set, and only for regular files, so that
+// a handler can compute the data returned by each read, rather than
+// providing an io.ReaderAt to Ropen. Use the Rread method to respond.
+//
+// The default response to a Tread message is to read from the value
+// given to Ropen or Rcreate when the file was opened, as is done when
+// HandleReads is not set.
+type Tread struct {
+	Offset int64 // offset in the file to read from
+	Count  int   // maximum number of bytes to return
+	file   file
+	reqInfo
+}
+
+func (t Tread) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// Rread sends the data in p to the client, truncated to the Count of
+// the request. An empty p signals the end of the file.
+func (t Tread) Rread(p []byte) {
+	if len(p) > t.Count {
+		p = p[:t.Count]
+	}
+	fillCache(t.ctx, append([]byte(nil), p...))
+	t.session.touch(t.path)
+	if t.respond(nil) {
+		t.session.conn.Rread(t.tag, p)
 	}
 }
 
+func (t Tread) defaultResponse() {
+	t.session.read(t.ctx, t.msg.(styxproto.Tread), t.file)
+}
+
 // A Tcreate message is sent when a client wants to create a new file
 // and open it with the provided Mode. The Path method of a Tcreate
 // message returns the absolute path of the containing directory. A user
@@ -230,6 +353,24 @@ type Tcreate struct {
 	Name string      // name of the file to create
 	Mode os.FileMode // permissions and file type to create
 	Flag int         // flags to open the new file with
+
+	// Perm9P holds the permission bits sent by the client, before
+	// they are converted to Mode. It includes bits that have no
+	// equivalent in os.FileMode, such as styxproto.DMAUTH and the
+	// 9P2000.u file types. For 9P2000.L clients it is derived from
+	// Mode.
+	Perm9P uint32
+
+	// OpenMode, Exec and RemoveOnClose describe how the new
+	// file is opened, as for Topen.
+	OpenMode      uint8
+	Exec          bool
+	RemoveOnClose bool
+
+	// IOUnit, if positive, is sent to the client by Rcreate as
+	// the largest number of bytes it should read or write in a
+	// single request, as described for Topen.
+	IOUnit int
 	reqInfo
 }
 
@@ -254,7 +395,11 @@ func (t Tcreate) Path() string {
 // a file also opens the file for I/O. Once Rcreate returns, future read
 // and write requests to the file handle will pass through rwc. The value
 // rwc must meet the same criteria listed for the Ropen method of a Topen
-// request.
+// request, and the iounit sent to the client is chosen the same way.
+//
+// Clients using the 9P2000.L extension create directories without
+// opening them. For such requests, rwc may be nil, and is closed if it
+// implements io.Closer.
 func (t Tcreate) Rcreate(rwc interface{}, err error) {
 	var (
 		f styxfile.Interface
@@ -263,29 +408,40 @@ func (t Tcreate) Rcreate(rwc interface{}, err error) {
 		t.Rerror("%s", err)
 		return
 	}
+	if _, ok := t.msg.(styxproto.Tmkdir); ok {
+		t.rmkdir(rwc)
+		return
+	}
 
-	if dir, ok := rwc.(Directory); t.Mode.IsDir() && ok {
+	if dir, ok := styxfile.AsDirectory(rwc); t.Mode.IsDir() && ok {
 
-		f = styxfile.NewDir(dir, path.Join(t.Path(), t.Name), t.session.conn.qidpool)
-	} else {
-		f, err = styxfile.New(rwc)
+		f = t.session.conn.newDir(dir, path.Join(t.path, t.Name), t.session.atime)
+	} else if f, err = styxfile.New(rwc); err == nil {
+		f, err = styxfile.OpenAppend(f, t.Mode, t.Flag&^os.O_TRUNC)
+		if err == nil {
+			f = wrapOpened(t.ctx, f)
+		}
 	}
 	if err != nil {
 		t.session.conn.srv.logf("create %s failed: %s", t.Name, err)
 		t.Rerror("create failed")
 		return
 	}
-	file := file{name: path.Join(t.Path(), t.Name), rwc: f}
+	file := file{name: path.Join(t.path, t.Name), rwc: f}
 
 	// fid for parent directory is now the fid for the new file,
 	// so there is no increase in references to this session.
-	t.session.files.Put(t.fid, file)
-
 	qtype := styxfile.QidType(styxfile.Mode9P(t.Mode))
-	qid := t.session.conn.qid(file.name, qtype)
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
-		t.session.conn.Rcreate(t.tag, qid, 0)
+	qid := t.session.conn.newQid(file.name, qtype)
+	t.session.putFile(t.fid, file)
+
+	if !t.respond(nil) {
+		return
+	}
+	if _, ok := t.msg.(styxproto.Tlcreate); ok {
+		t.session.conn.Rlcreate(t.tag, qid, t.session.conn.iounit(t.IOUnit, rwc))
+	} else {
+		t.session.conn.Rcreate(t.tag, qid, t.session.conn.iounit(t.IOUnit, rwc))
 	}
 }
 
@@ -313,25 +469,30 @@ func (t Tremove) WithContext(ctx context.Context) Request {
 //
 // If err is non-nil, an Rerror message is sent to the client. Regardless, the
 // file handle is no longer valid.
+//
+// Clients using the 9P2000.L extension remove files by name, relative to
+// a directory. For such requests the file handle, which refers to the
+// directory, remains valid.
 func (t Tremove) Rremove(err error) {
+	if _, ok := t.msg.(styxproto.Tunlinkat); ok {
+		t.runlinkat(err)
+		return
+	}
 	t.session.conn.sessionFid.Del(t.fid)
-	t.session.files.Del(t.fid)
+	t.session.delFile(t.fid)
 
-	t.session.unhandled = false
-	if !t.session.conn.clearTag(t.tag) {
+	if !t.respond(err) {
 		// cancelled, do not send response
 		return
 	}
 
-	// NOTE(droyo): This is not entirely correct; if the server wants
-	// to implement unix-like semantics (the file hangs around as
-	// long as there's 1 descriptor for it), we should not delete the
-	// qid until *all* references to it are removed. We'll need to implement
-	// reference counting for that :\
+	// Other fids may still refer to the file; its qid is kept
+	// until they are clunked. See refs.go.
 	if err != nil {
 		t.session.conn.Rerror(t.tag, "%s", err)
 	} else {
-		t.session.conn.qidpool.Del(t.Path())
+		t.session.conn.removed(t.path)
+		t.session.conn.srv.atimes.Delete(t.session.atimeKey(t.path))
 		t.session.conn.Rremove(t.tag)
 	}
 
@@ -1,8 +1,12 @@
 package styx
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"aqwari.net/net/styx/internal/util"
@@ -18,6 +22,10 @@ type Logger interface {
 
 type AuthOpenFunc func() (interface{}, error)
 
+// ErrServerClosed is returned by the Serve, ServeConn and ListenAndServe
+// methods of a Server after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("styx: Server closed")
+
 // A Server defines parameters for running a 9P server. The
 // zero value of a Server is usable as a 9P server, and will
 // use the defaults set by the styx package.
@@ -26,14 +34,28 @@ type Server struct {
 	Addr string
 
 	// maximum wait before timing out write of the response.
+	// A client that does not accept a response in time is
+	// disconnected. Zero means no timeout.
 	WriteTimeout time.Duration
 
-	// maximum wait before closing an idle connection.
+	// maximum time a request may take. Requests that are not
+	// answered in time are cancelled, and the client receives
+	// an error. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// maximum wait before closing an idle connection, with no
+	// requests in progress. Zero means no timeout.
 	IdleTimeout time.Duration
 
 	// maximum size of a 9P message, DefaultMsize if unset.
 	MaxSize int64
 
+	// maximum total size of the requests a connection may have
+	// in progress at once. Requests beyond it are answered with
+	// an error. It is raised to the negotiated message size if it
+	// is smaller. Zero means no limit.
+	MaxPending int64
+
 	// optional TLS config, used by ListenAndServeTLS
 	TLSConfig *tls.Config
 
@@ -41,17 +63,177 @@ type Server struct {
 	Handler Handler
 
 	// Auth is used to authenticate user sessions. If nil,
-	// authentication is disabled.
+	// authentication is disabled. Auth is only called for
+	// clients that attach with an auth fid, unless AuthNoAfid
+	// is set.
 	Auth AuthFunc
 
-	// OpenAuth is used to open file to authentication agent
+	// If AuthNoAfid is true, Auth is also called for clients
+	// that attach without an auth fid, with a Channel that
+	// cannot be read or written, so that it may authenticate
+	// them by their connection alone, such as by a TLS client
+	// certificate. It is off by default because an AuthFunc
+	// that ignores its Channel, such as styxauth.Users, would
+	// then accept clients that never proved who they are.
+	AuthNoAfid bool
+
+	// OpenAuth is used to open file to authentication agent.
+	// When it is set, the client talks to the agent through the
+	// file, and Auth is called at Tattach with a Channel that
+	// cannot be read or written, to check the agent's verdict.
 	OpenAuth AuthOpenFunc
 
+	// Policy, if not nil, is called with each request of a session
+	// before it is passed to the Handler. If it returns an error,
+	// the request is answered with the error and the Handler never
+	// sees it. Policy can be used to disable whole classes of
+	// requests, such as Tremove or Twstat, for some or all users.
+	Policy func(s *Session, req Request) error
+
+	// If HandleReads is true, Tread requests for regular files are
+	// passed to the Handler. See the documentation for the Tread
+	// type.
+	HandleReads bool
+
+	// If RawWstat is true, Twstat requests are passed to the
+	// Handler whole, so that it can see every field of the Stat
+	// and apply the changes atomically. Otherwise, they are split
+	// into Tutimes, Tchown, Tmuid, Trename, Ttruncate, Tchmod and
+	// Tsync requests. See the documentation for the Twstat type.
+	RawWstat bool
+
+	// Normally, a Twstat request that is split into several
+	// requests succeeds if any one of them succeeds. If StrictWstat
+	// is true, it fails unless all of them succeed, as stat(5)
+	// requires. Changes that succeeded are not undone; handlers
+	// that must apply every change or none should set RawWstat.
+	StrictWstat bool
+
+	// If EnableVHost is true, sessions whose clients do not name a
+	// file tree in their Tattach request are given the name the
+	// client connected to as their Access field: the server name
+	// indicated by TLS clients, if any, or else the IP address
+	// the connection was made to. Servers can use it to serve
+	// different file trees for different host names.
+	EnableVHost bool
+
+	// If TrackAtime is true, the server records the time each
+	// file is read, and reports it as the file's access time
+	// unless the file's os.FileInfo implements AtimeInfo.
+	// Requests that only change the access time of a file are
+	// recorded and succeed, if the Handler does not answer them.
+	TrackAtime bool
+
+	// QidSource, if not nil, chooses the qids of the files in
+	// the file trees of every connection, in place of the
+	// server's counters. See the QidSource type.
+	QidSource QidSource
+
+	// AttachAuth, if not nil, is called for every Tattach request,
+	// after any authentication by Auth, and the request is rejected
+	// if it returns an error. The Channel passed to AttachAuth
+	// cannot be read or written, but its Conn method returns the
+	// network connection. Unlike Auth, it does not require the
+	// client to make a Tauth request, so it suits methods that
+	// rely on the connection alone, such as styxauth.TLSClientCert.
+	// If Auth is also set and AuthNoAfid is not, clients that
+	// attach without an auth fid are authenticated by AttachAuth
+	// alone; without AttachAuth, such clients are rejected.
+	AttachAuth AuthFunc
+
+	// AuthRate limits the number of Tauth requests a connection
+	// may make per second, with bursts of up to AuthRate requests.
+	// Requests over the limit receive an error. Zero means no limit.
+	AuthRate int
+
+	// maximum wait for a new connection to establish a session
+	// with a successful Tattach request, after which it is closed.
+	// Zero means no limit.
+	AttachTimeout time.Duration
+
 	// If not nil, ErrorLog will be used to log unexpected
 	// errors accepting or handling connections. TraceLog,
 	// if not nil, will receive detailed protocol tracing
 	// information.
 	ErrorLog, TraceLog Logger
+
+	// If not nil, Trace receives an event for every message
+	// received or sent, including the latency of responses and
+	// the session they belong to.
+	Trace TraceFunc
+
+	// If not nil, Metrics receives callbacks for connections,
+	// requests, and bytes transferred.
+	Metrics Metrics
+
+	// BaseContext optionally specifies a function that returns
+	// the base context for requests on connections accepted from
+	// the listener l. If BaseContext is nil, the base context is
+	// context.Background(). It must not return a nil context.
+	BaseContext func(l net.Listener) context.Context
+
+	// ConnContext optionally specifies a function that modifies
+	// the context used for requests on a new connection c. The
+	// provided ctx is derived from the base context, and the
+	// returned context must be derived from it. Request contexts
+	// are cancelled when their connection is closed.
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// ConnState specifies an optional callback function that is
+	// called when a client connection changes state. See the
+	// ConnState type and associated constants for details.
+	ConnState func(net.Conn, ConnState)
+
+	stats serverStats
+
+	// access times recorded when TrackAtime is set, keyed
+	// by atimeKey.
+	atimes sync.Map
+
+	mu        sync.Mutex
+	shutdown  bool
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+}
+
+// A ConnState represents the state of a client connection to a
+// server. It is used by the optional Server.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a new connection that has not yet
+	// negotiated a protocol version.
+	StateNew ConnState = iota
+
+	// StateActive represents a connection with at least one
+	// request in progress.
+	StateActive
+
+	// StateIdle represents a connection with no requests in
+	// progress. A client may keep files open on an idle
+	// connection.
+	StateIdle
+
+	// StateHijacked represents a connection that has been taken
+	// over from the Server. It is terminal. The styx package
+	// does not currently hijack connections, and the state is
+	// defined for parity with net/http.
+	StateHijacked
+
+	// StateClosed represents a closed connection. It is terminal.
+	StateClosed
+)
+
+var connStateName = map[ConnState]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+func (s ConnState) String() string {
+	return connStateName[s]
 }
 
 // Types implementing the Handler interface can receive and respond to 9P
@@ -64,7 +246,8 @@ type Server struct {
 // the session, the Session's Next method will return false. If the Serve9P
 // method exits prematurely, all open files and other resources associated
 // with that session are released, and any further requests for that session
-// will result in an error.
+// will result in an error. A handler may end a session itself with the
+// Session's CloseSession or Hangup methods.
 //
 // The Serve9P method is not required to answer every type of 9P message.
 // If an existing request is unanswered when Serve9P fetches the next
@@ -110,14 +293,34 @@ func (fn HandlerFunc) Serve9P(s *Session) {
 // Serve accepts connections on the listener l, creating a new service
 // goroutine for each. The service goroutines read requests and relays
 // them to the appropriate Handler goroutines.
+//
+// Serve always returns a non-nil error. After Shutdown or Close, the
+// returned error is ErrServerClosed.
 func (srv *Server) Serve(l net.Listener) error {
 	backoff := retry.Exponential(time.Millisecond * 10).Max(time.Second)
 	try := 0
 
+	if !srv.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+
+	base := context.Background()
+	if srv.BaseContext != nil {
+		base = srv.BaseContext(l)
+		if base == nil {
+			panic("styx: BaseContext returned a nil context")
+		}
+	}
+
 	srv.logf("listening on %s", l.Addr())
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if util.IsTempErr(err) {
 				try++
 				srv.logf("9p: Accept error: %v; retrying in %v", err, backoff(try))
@@ -130,11 +333,169 @@ func (srv *Server) Serve(l net.Listener) error {
 		}
 
 		srv.logf("accepted connection from %s", rwc.RemoteAddr())
-		conn := newConn(srv, rwc)
+		conn, ok := srv.startConn(base, rwc)
+		if !ok {
+			return ErrServerClosed
+		}
 		go conn.serve()
 	}
 }
 
+// ServeConn serves 9P requests on a single connection, which need
+// not come from a net.Listener. It can be used to serve a 9P file
+// tree over the standard input and output of a process, an ssh
+// channel, or a websocket. ServeConn blocks until the connection
+// is closed, and closes rwc before returning.
+//
+// The ConnContext and ConnState hooks are only called if rwc is a
+// net.Conn. If the Server is shut down, ServeConn returns
+// ErrServerClosed.
+func (srv *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	conn, ok := srv.startConn(context.Background(), rwc)
+	if !ok {
+		return ErrServerClosed
+	}
+	conn.serve()
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	return nil
+}
+
+// startConn prepares a new connection to be served, reporting
+// false, and closing rwc, if the Server has been shut down.
+func (srv *Server) startConn(base context.Context, rwc io.ReadWriteCloser) (*conn, bool) {
+	ctx := base
+	nc, isConn := rwc.(net.Conn)
+	if isConn && srv.ConnContext != nil {
+		ctx = srv.ConnContext(ctx, nc)
+		if ctx == nil {
+			panic("styx: ConnContext returned a nil context")
+		}
+	}
+	conn := newConn(ctx, srv, rwc)
+	if !srv.trackConn(conn, true) {
+		rwc.Close()
+		return nil, false
+	}
+	if isConn && srv.ConnState != nil {
+		srv.ConnState(nc, StateNew)
+	}
+	return conn, true
+}
+
+// shutdownPollInterval is how often Shutdown checks for connections
+// with no requests in progress.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// then closes connections as they become idle, with no requests in
+// progress, until none are left. If ctx expires first, the remaining
+// connections are closed and ctx.Err() is returned.
+//
+// Once Shutdown has been called, Serve and ListenAndServe return
+// ErrServerClosed, and the Server may not be reused.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.closeListeners()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !srv.closeConns(false) {
+		select {
+		case <-ctx.Done():
+			srv.closeConns(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Close immediately closes all listeners and connections of the
+// server. The contexts of requests in progress are cancelled. Close returns any
+// error from closing the listeners. For a graceful shutdown, use
+// Shutdown.
+func (srv *Server) Close() error {
+	err := srv.closeListeners()
+	srv.closeConns(true)
+	return err
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shutdown
+}
+
+// trackListener adds or removes l from the set of listeners closed
+// on shutdown. It reports false if l cannot be added because the
+// server is shutting down.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
+	if srv.shutdown {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn is like trackListener, for connections.
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.conns, c)
+		return true
+	}
+	if srv.shutdown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]struct{})
+	}
+	srv.conns[c] = struct{}{}
+	return true
+}
+
+// closeListeners marks the server as shutting down, and closes
+// its listeners.
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.shutdown = true
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.listeners, l)
+	}
+	return err
+}
+
+// closeConns closes the connections of the server, or only those
+// that are idle if all is false. It reports whether there are no
+// connections left.
+func (srv *Server) closeConns(all bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		if all || c.idle() {
+			c.cancel()
+			c.rwc.Close()
+			delete(srv.conns, c)
+		}
+	}
+	return len(srv.conns) == 0
+}
+
 // ListenAndServe listens on the specified TCP address, and then
 // calls Serve with handler to handle requests of incoming
 // connections.
@@ -154,13 +515,19 @@ func ListenAndServeTLS(addr string, certFile, keyFile string, handler Handler) e
 
 // ListenAndServe listens on the TCP network address srv.Addr and
 // calls Serve to handle requests on incoming connections.
-// If srv.Addr is blank, :564 is used.
+// If srv.Addr is blank, :564 is used. srv.Addr may also be
+// the path of a unix socket, or a Plan 9 dial string such as
+// tcp!*!564 or unix!/path/to/socket.
 func (srv *Server) ListenAndServe() error {
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":9pfs"
 	}
-	ln, err := net.Listen("tcp", addr)
+	network, addr, err := listenAddr(addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
@@ -168,7 +535,8 @@ func (srv *Server) ListenAndServe() error {
 }
 
 // ListenAndServeTLS listens on the TCP network address srv.Addr for
-// incoming TLS connections.
+// incoming TLS connections. srv.Addr may be given in any of the
+// forms accepted by ListenAndServe.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	addr := srv.Addr
 	if addr == "" {
@@ -187,7 +555,11 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		}
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	network, addr, err := listenAddr(addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package styx
 
 import (
+	"context"
 	"fmt"
 	"os"
 )
@@ -22,6 +23,6 @@ func (srv *Server) Post(service string) error {
 		f.Close()
 		return err
 	}
-	newConn(srv, out).serve()
+	newConn(context.Background(), srv, out).serve()
 	return nil
 }
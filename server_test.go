@@ -2,15 +2,30 @@ package styx
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
 	"path"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"aqwari.net/net/styx/internal/netutil"
@@ -37,6 +52,41 @@ type testServer struct {
 	test     *testing.T
 }
 
+// testDial connects to srv over a pipe, for tests that trade
+// hand-written messages with the server one at a time. The
+// function passed to rpc writes a message to enc; rpc sends it
+// and returns the server's response, decoded as the given
+// protocol version, or nil if the server closed the connection.
+// The connection is closed when the test ends.
+func testDial(t *testing.T, srv *Server, version string) (*styxproto.Encoder, func(func()) styxproto.Msg) {
+	var ln netutil.PipeListener
+	go srv.Serve(&ln)
+	t.Cleanup(func() { ln.Close() })
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	enc := styxproto.NewEncoder(conn)
+	dec := styxproto.NewDecoder(conn)
+	dec.Version = version
+	rpc := func(fn func()) styxproto.Msg {
+		t.Helper()
+		fn()
+		enc.Flush()
+		if !dec.Next() {
+			if err := dec.Err(); err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		}
+		t.Logf("← %03d %s", dec.Msg().Tag(), dec.Msg())
+		return dec.Msg()
+	}
+	return enc, rpc
+}
+
 func openfile(filename string) (*os.File, func()) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -61,6 +111,15 @@ func (f *slowFile) Read(p []byte) (int, error) {
 	}
 }
 
+func (f *slowFile) Write(p []byte) (int, error) {
+	select {
+	case <-f.blockme:
+		return len(p), nil
+	case <-f.closeme:
+		return 0, errors.New("closed")
+	}
+}
+
 // os.FileInfo
 func (f *slowFile) Mode() os.FileMode  { return 0 }
 func (f *slowFile) IsDir() bool        { return false }
@@ -115,6 +174,12 @@ func (s emptyStatDir) Sys() interface{}   { return nil }
 func (s emptyStatDir) Size() int64        { return 0 }
 func (s emptyStatDir) ModTime() time.Time { return time.Time{} }
 
+// linkStat describes a symbolic link to a target.
+type linkStat struct{ emptyStatFile }
+
+func (s linkStat) Mode() os.FileMode  { return 0777 | os.ModeSymlink }
+func (s linkStat) LinkTarget() string { return "target" }
+
 type emptyFile struct{ emptyStatFile }
 
 var _ styxfile.Interface = emptyFile{}
@@ -170,18 +235,11 @@ func chanServer(t *testing.T, handler Handler) (in, out chan styxproto.Msg) {
 }
 
 func copyMsg(msg styxproto.Msg) styxproto.Msg {
-	var err error
-
-	rd, wr := io.Pipe()
-	d := styxproto.NewDecoder(rd)
-	go func() {
-		_, err = styxproto.Write(wr, msg)
-		wr.CloseWithError(err)
-	}()
-	for d.Next() {
-		return d.Msg()
+	m, err := styxproto.Clone(msg)
+	if err != nil {
+		panic(fmt.Errorf("failed to copy %T message: %s", msg, err))
 	}
-	panic(fmt.Errorf("failed to copy %T message: %s", msg, d.Err()))
+	return m
 }
 
 func messagesFrom(t *testing.T, r io.Reader) chan styxproto.Msg {
@@ -510,6 +568,46 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkQids(t *testing.T) {
+	srv := testServer{test: t}
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Twalk); !ok {
+			return
+		}
+		m, ok := rsp.(styxproto.Rwalk)
+		switch req.Tag() {
+		case 1:
+			// Files the server has never seen are given new qids.
+			if !ok || m.Nwqid() != 2 {
+				t.Errorf("Twalk to new files returned %s", rsp)
+			} else if m.Wqid(0).Path() == m.Wqid(1).Path() {
+				t.Errorf("/a and /a/b were given the same qid %s", m.Wqid(0))
+			}
+		case 2:
+			// Only the qids before the first failure are
+			// returned, even if later elements were answered.
+			if !ok || m.Nwqid() != 1 {
+				t.Errorf("Twalk failing at the second element returned %s", rsp)
+			}
+		}
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Twalk); ok {
+				if path.Base(req.Path()) == "bad" {
+					req.Rwalk(nil, os.ErrNotExist)
+				} else {
+					req.Rwalk(os.Stat("."))
+				}
+			}
+		}
+	})
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a", "b")
+		enc.Twalk(2, 0, 2, "a", "bad", "c")
+	})
+}
+
 func TestTcreate(t *testing.T) {
 	srv := testServer{test: t}
 
@@ -535,7 +633,6 @@ func TestTcreate(t *testing.T) {
 				if name != expected.name {
 					t.Errorf("expected name to be %s, instead got %s", expected.name, name)
 				}
-				// FIXME: For directories, the mode does not match
 				mode := styxfile.ModeOS(rsp.Stat().Mode())
 				if mode != expected.mode {
 					t.Errorf("expected mode to be %s, instead got %s", expected.mode, mode)
@@ -652,3 +749,3008 @@ func TestRootQid(t *testing.T) {
 		t.Error("test cases did not fire")
 	}
 }
+
+// A 9P2000.L session against a handler serving a directory on
+// the host file system.
+func TestDotL(t *testing.T) {
+	root := t.TempDir()
+	srv := Server{
+		ErrorLog: testLogger{t},
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(os.Lstat(root + req.Path()))
+				case Tstat:
+					req.Rstat(os.Lstat(root + req.Path()))
+				case Topen:
+					req.Ropen(os.OpenFile(root+req.Path(), req.Flag, 0))
+				case Tcreate:
+					req.Rcreate(nil, os.Mkdir(root+req.NewPath(), req.Mode.Perm()))
+				case Tsymlink:
+					req.Rsymlink(os.Symlink(req.Target, root+req.NewPath()))
+				case Treadlink:
+					req.Rreadlink(os.Readlink(root + req.Path()))
+				case Tremove:
+					req.Rremove(os.Remove(root + req.Path()))
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, &srv, styxproto.Version9P2000L)
+
+	rsp := rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000L) })
+	if v := string(rsp.(styxproto.Rversion).Version()); v != styxproto.Version9P2000L {
+		t.Fatalf("server negotiated version %q", v)
+	}
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", 1000) })
+
+	rsp = rpc(func() { enc.Tgetattr(1, 0, styxproto.GetattrBasic) })
+	if m, ok := rsp.(styxproto.Rgetattr); !ok || m.Mode()&040000 == 0 {
+		t.Errorf("Tgetattr on root returned %s, want a directory", rsp)
+	}
+	rsp = rpc(func() { enc.Twalk(1, 0, 1, "missing") })
+	if m, ok := rsp.(styxproto.Rlerror); !ok || m.Ecode() != styxproto.ENOENT {
+		t.Errorf("Twalk to missing file returned %s, want ENOENT", rsp)
+	}
+	if _, ok := rpc(func() { enc.Tmkdir(1, 0, "sub", 0755, 0) }).(styxproto.Rmkdir); !ok {
+		t.Fatal("Tmkdir failed")
+	}
+	if _, ok := rpc(func() { enc.Tsymlink(1, 0, "link", "sub", 0) }).(styxproto.Rsymlink); !ok {
+		t.Fatal("Tsymlink failed")
+	}
+	rpc(func() { enc.Twalk(1, 0, 1, "link") })
+	rsp = rpc(func() { enc.Treadlink(1, 1) })
+	if m, ok := rsp.(styxproto.Rreadlink); !ok || string(m.Target()) != "sub" {
+		t.Errorf("Treadlink returned %s, want sub", rsp)
+	}
+
+	rpc(func() { enc.Twalk(1, 0, 2) })
+	rpc(func() { enc.Tlopen(1, 2, styxproto.LRDONLY) })
+	rsp = rpc(func() { enc.Treaddir(1, 2, 0, 4096) })
+	m, ok := rsp.(styxproto.Rreaddir)
+	if !ok {
+		t.Fatalf("Treaddir returned %s", rsp)
+	}
+	data, err := ioutil.ReadAll(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for len(data) > 0 {
+		d := styxproto.Dirent(data)
+		names = append(names, string(d.Name()))
+		if d.Name()[0] == 's' && d.Type() != styxproto.DTDIR {
+			t.Errorf("%s is not a directory", d)
+		}
+		data = data[24+len(d.Name()):]
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "link sub" {
+		t.Errorf("Treaddir returned entries %q", got)
+	}
+
+	if _, ok := rpc(func() { enc.Tunlinkat(1, 0, "link", 0) }).(styxproto.Runlinkat); !ok {
+		t.Error("Tunlinkat failed")
+	}
+	if _, err := os.Lstat(root + "/link"); !os.IsNotExist(err) {
+		t.Error("link still exists after Tunlinkat")
+	}
+}
+
+func TestDotLReaddirMsize(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%s/%03d%s", root, i, strings.Repeat("x", 60))
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(os.Lstat(root + req.Path()))
+				case Topen:
+					req.Ropen(os.OpenFile(root+req.Path(), req.Flag, 0))
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000L)
+	rpc(func() { enc.Tversion(styxproto.MinBufSize, styxproto.Version9P2000L) })
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", 1000) })
+	rpc(func() { enc.Twalk(1, 0, 1) })
+	rpc(func() { enc.Tlopen(1, 1, styxproto.LRDONLY) })
+
+	// The client asks for more than fits in a message.
+	var names []string
+	var offset uint64
+	for {
+		rsp := rpc(func() { enc.Treaddir(1, 1, offset, 1<<20) })
+		m, ok := rsp.(styxproto.Rreaddir)
+		if !ok {
+			t.Fatalf("Treaddir returned %s", rsp)
+		}
+		if m.Len() > styxproto.MinBufSize {
+			t.Errorf("Rreaddir is %d bytes, larger than msize", m.Len())
+		}
+		data, err := ioutil.ReadAll(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		for len(data) > 0 {
+			d := styxproto.Dirent(data)
+			names = append(names, string(d.Name()))
+			offset = d.Offset()
+			data = data[24+len(d.Name()):]
+		}
+	}
+	if len(names) != 100 {
+		t.Errorf("read %d entries, want 100", len(names))
+	}
+}
+
+func TestServerWstatName(t *testing.T) {
+	var renames, stats []string
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyStatDir(path.Base(req.Path())), nil)
+				case Trename:
+					renames = append(renames, req.NewPath)
+					req.Rrename(nil)
+				case Tstat:
+					stats = append(stats, req.Path())
+					req.Rstat(emptyStatDir(path.Base(req.Path())), nil)
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Tattach(1, 10, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "dir", "file") })
+	rpc(func() { enc.Twalk(1, 10, 11, "dir", "file") })
+
+	for _, name := range []string{"../x", "a/b", ".", ".."} {
+		if rsp, ok := rpc(func() { enc.Twstat(1, 1, blankStat(name, "", "")) }).(styxproto.Rerror); !ok {
+			t.Errorf("Twstat to name %q returned %s", name, rsp)
+		}
+	}
+	if len(renames) > 0 {
+		t.Errorf("handler saw renames to %q", renames)
+	}
+
+	// Fids in other sessions follow the renamed file.
+	if rsp, ok := rpc(func() { enc.Twstat(1, 1, blankStat("new", "", "")) }).(styxproto.Rwstat); !ok {
+		t.Fatalf("Twstat to name \"new\" returned %s", rsp)
+	}
+	rpc(func() { enc.Tstat(1, 11) })
+	if want := []string{"/dir/new"}; !reflect.DeepEqual(stats, want) {
+		t.Errorf("Tstat of renamed file in another session went to %q, want %q", stats, want)
+	}
+}
+
+func TestErrno(t *testing.T) {
+	tests := []struct {
+		format string
+		args   []interface{}
+		errno  uint32
+	}{
+		{"%s", []interface{}{Errorf(styxproto.EROFS, "read-only")}, styxproto.EROFS},
+		{"%s", []interface{}{fmt.Errorf("wrapped: %w", Errorf(styxproto.EXDEV, "cross-device"))}, styxproto.EXDEV},
+		{"%s", []interface{}{os.ErrNotExist}, styxproto.ENOENT},
+		{"permission denied", nil, styxproto.EACCES},
+		{"not a directory: %q", []interface{}{"/x"}, styxproto.ENOTDIR},
+		{"something odd", nil, styxproto.EIO},
+	}
+	for _, tt := range tests {
+		if n := errno(tt.format, tt.args); n != tt.errno {
+			t.Errorf("errno(%q, %v) = %d, want %d", tt.format, tt.args, n, tt.errno)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Tstat requests for /stuck never complete.
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			req := s.Request()
+			if req.Path() != "/stuck" {
+				osFS(dir).serve(req)
+			} else if walk, ok := req.(Twalk); ok {
+				walk.Rwalk(emptyStatFile("stuck"), nil)
+			} else if _, ok := req.(Tstat); ok {
+				<-req.Context().Done()
+			}
+		}
+	})
+	serve := func() (srv *Server, uri string, done chan error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip("cannot listen on loopback:", err)
+		}
+		srv = &Server{Handler: handler}
+		done = make(chan error, 1)
+		go func() { done <- srv.Serve(ln) }()
+		return srv, "tcp://" + ln.Addr().String(), done
+	}
+
+	// Idle connections are closed right away.
+	srv, uri, done := serve()
+	var client Client
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := f.Read(make([]byte, 5)); err == nil {
+		t.Error("read succeeded after Shutdown")
+	}
+	if _, err := client.Open(uri + "/file"); err == nil {
+		t.Error("open succeeded after Shutdown")
+	}
+
+	// Connections with requests in progress are closed once the
+	// context expires.
+	srv, uri, done = serve()
+	stat := make(chan error, 1)
+	go func() {
+		_, err := fs.Stat(client.FS(uri), "stuck")
+		stat <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+	if err := <-stat; err == nil {
+		t.Error("stat succeeded after Shutdown")
+	}
+	<-done
+
+	// Close does not wait.
+	srv, uri, done = serve()
+	go func() {
+		_, err := fs.Stat(client.FS(uri), "stuck")
+		stat <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+	if err := <-stat; err == nil {
+		t.Error("stat succeeded after Close")
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	// A client that does not read its responses is disconnected.
+	srv := &Server{WriteTimeout: 50 * time.Millisecond}
+	cli, rwc := net.Pipe()
+	defer cli.Close()
+	done := make(chan struct{})
+	go func() {
+		newConn(context.Background(), srv, rwc).serve()
+		close(done)
+	}()
+	enc := styxproto.NewEncoder(cli)
+	enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000)
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("stalled client was not disconnected")
+	}
+
+	// An idle client is disconnected, but not while it waits
+	// for a response.
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	defer ln.Close()
+	srv = &Server{
+		IdleTimeout: 100 * time.Millisecond,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tstat); ok {
+					time.Sleep(300 * time.Millisecond)
+					req.Rstat(os.Stat(dir + req.Path()))
+				} else {
+					osFS(dir).serve(s.Request())
+				}
+			}
+		}),
+	}
+	go srv.Serve(ln)
+
+	var client Client
+	uri := "tcp://" + ln.Addr().String()
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fs.Stat(client.FS(uri), "file"); err != nil {
+		t.Errorf("slow request failed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := f.Read(make([]byte, 5)); err == nil {
+		t.Error("idle connection was not closed")
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	type key string
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	values := make(chan []interface{}, 1)
+	cancelled := make(chan struct{})
+	srv := &Server{
+		BaseContext: func(l net.Listener) context.Context {
+			return context.WithValue(context.Background(), key("base"), l.Addr())
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, key("remote"), c.RemoteAddr())
+		},
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyStatFile("file"), nil)
+				case Tstat:
+					ctx := req.Context()
+					values <- []interface{}{ctx.Value(key("base")), ctx.Value(key("remote")), ctx.Value("conn")}
+					<-ctx.Done()
+					close(cancelled)
+				}
+			}
+		}),
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	var client Client
+	go fs.Stat(client.FS("tcp://"+ln.Addr().String()), "file")
+	v := <-values
+	if v[0] != ln.Addr() {
+		t.Errorf("request context has base value %v, want %v", v[0], ln.Addr())
+	}
+	if v[1] == nil {
+		t.Error("request context is missing value from ConnContext")
+	}
+	if _, ok := v[2].(net.Conn); !ok {
+		t.Errorf("request context has conn value %T, want net.Conn", v[2])
+	}
+	srv.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("request context was not cancelled by Close")
+	}
+	<-done
+}
+
+func TestServerConnState(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	var (
+		mu     sync.Mutex
+		states []ConnState
+		closed = make(chan struct{})
+	)
+	srv := &Server{
+		Handler: osFS(dir),
+		ConnState: func(c net.Conn, state ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+			if state == StateClosed {
+				close(closed)
+			}
+		},
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	var client Client
+	f, err := client.Open("tcp://" + ln.Addr().String() + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) < 4 || states[0] != StateNew || states[1] != StateIdle ||
+		states[len(states)-1] != StateClosed {
+		t.Fatalf("connection went through states %v", states)
+	}
+	for i, state := range states[2 : len(states)-1] {
+		if want := []ConnState{StateActive, StateIdle}[i%2]; state != want {
+			t.Errorf("connection went through states %v", states)
+			break
+		}
+	}
+}
+
+func TestServerAuthLimits(t *testing.T) {
+	srv := &Server{
+		AuthRate:      2,
+		AttachTimeout: 200 * time.Millisecond,
+		Auth: func(rwc *Channel, user, access string) error {
+			<-rwc.Done()
+			return errors.New("cancelled")
+		},
+	}
+	cli, rwc := net.Pipe()
+	defer cli.Close()
+	done := make(chan struct{})
+	go func() {
+		newConn(context.Background(), srv, rwc).serve()
+		close(done)
+	}()
+	enc := styxproto.NewEncoder(cli)
+	dec := styxproto.NewDecoder(cli)
+	enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000)
+	enc.Flush()
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+
+	var rejected int
+	for i := 0; i < 5; i++ {
+		enc.Tauth(uint16(i), uint32(i), "user", "")
+		enc.Flush()
+		if !dec.Next() {
+			t.Fatal(dec.Err())
+		}
+		if msg, ok := dec.Msg().(styxproto.Rerror); ok {
+			if !strings.Contains(string(msg.Ename()), errAuthRate.Error()) {
+				t.Errorf("Tauth failed: %s", msg.Ename())
+			}
+			rejected++
+		}
+	}
+	if rejected != 3 {
+		t.Errorf("%d of 5 Tauth requests rejected, want 3", rejected)
+	}
+
+	// The connection never attaches, so it is closed.
+	for dec.Next() {
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("connection was not closed")
+	}
+}
+
+type testMetrics struct {
+	mu               sync.Mutex
+	opened, closed   int
+	started          map[string]int
+	finished, failed map[string]int
+	in, out          int64
+}
+
+func (m *testMetrics) ConnOpened(net.Addr) { m.mu.Lock(); m.opened++; m.mu.Unlock() }
+func (m *testMetrics) ConnClosed(net.Addr) { m.mu.Lock(); m.closed++; m.mu.Unlock() }
+func (m *testMetrics) BytesIn(n int64)     { m.mu.Lock(); m.in += n; m.mu.Unlock() }
+func (m *testMetrics) BytesOut(n int64)    { m.mu.Lock(); m.out += n; m.mu.Unlock() }
+
+func (m *testMetrics) RequestStarted(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[kind]++
+}
+
+func (m *testMetrics) RequestFinished(kind string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished[kind]++
+	if err != nil {
+		m.failed[kind]++
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	metrics := &testMetrics{
+		started:  make(map[string]int),
+		finished: make(map[string]int),
+		failed:   make(map[string]int),
+	}
+	closed := make(chan struct{})
+	srv := &Server{
+		Handler: osFS(dir),
+		Metrics: metrics,
+		ConnState: func(c net.Conn, state ConnState) {
+			if state == StateClosed {
+				close(closed)
+			}
+		},
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	var client Client
+	uri := "tcp://" + ln.Addr().String()
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Open(uri + "/missing"); err == nil {
+		t.Error("opened missing file")
+	}
+	ioutil.ReadAll(f)
+	f.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	// Give the tracing goroutines a moment to catch up.
+	time.Sleep(50 * time.Millisecond)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.opened != 1 || metrics.closed != 1 {
+		t.Errorf("%d connections opened and %d closed, want 1", metrics.opened, metrics.closed)
+	}
+	for _, kind := range []string{"Tversion", "Tattach", "Twalk", "Topen", "Tread", "Tclunk"} {
+		if metrics.started[kind] == 0 || metrics.started[kind] != metrics.finished[kind] {
+			t.Errorf("%d %s requests started, %d finished", metrics.started[kind], kind, metrics.finished[kind])
+		}
+	}
+	if metrics.failed["Twalk"] != 1 {
+		t.Errorf("%d Twalk requests failed, want 1", metrics.failed["Twalk"])
+	}
+	if metrics.in == 0 || metrics.out == 0 {
+		t.Errorf("counted %d bytes in, %d bytes out", metrics.in, metrics.out)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	srv := &Server{Handler: osFS(dir)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	var client Client
+	uri := "tcp://" + ln.Addr().String()
+	f, err := client.Open(uri + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	client.Open(uri + "/missing")
+	ioutil.ReadAll(f)
+
+	stats := srv.Stats()
+	if stats.Conns != 1 {
+		t.Errorf("%d open connections, want 1", stats.Conns)
+	}
+	// The root fid and the open file.
+	if stats.Fids != 2 {
+		t.Errorf("%d fids in use, want 2", stats.Fids)
+	}
+	if stats.Messages["Topen"] != 1 || stats.Messages["Tread"] < 2 {
+		t.Errorf("counted messages %v", stats.Messages)
+	}
+	if stats.Errors != 1 {
+		t.Errorf("%d errors sent, want 1", stats.Errors)
+	}
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Errorf("counted %d bytes in, %d bytes out", stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestServerTrace(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	type event struct {
+		TraceEvent
+		kind string
+		tag  uint16
+	}
+	var (
+		mu     sync.Mutex
+		events []event
+	)
+	srv := &Server{
+		Handler: osFS(dir),
+		Trace: func(ev TraceEvent) {
+			e := event{ev, msgType(ev.Msg), ev.Msg.Tag()}
+			if ev.Bytes != ev.Msg.Len() {
+				t.Errorf("event for %s has size %d", ev.Msg, ev.Bytes)
+			}
+			e.Msg = nil
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := Client{}
+	f, err := client.Open("tcp://alice@" + ln.Addr().String() + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(f)
+	f.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n > 0 && n%2 == 0 && events[n-1].tag == events[n-2].tag {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("did not see response to last request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var sawRead bool
+	for _, ev := range events {
+		if ev.RemoteAddr == nil {
+			t.Errorf("event for %s has no remote address", ev.kind)
+		}
+		if ev.kind == "Rread" {
+			sawRead = true
+			if ev.Received || ev.Latency <= 0 || ev.User != "alice" {
+				t.Errorf("Rread event has received=%t latency=%s user=%q", ev.Received, ev.Latency, ev.User)
+			}
+		}
+		if ev.kind == "Tread" && (!ev.Received || ev.User != "alice") {
+			t.Errorf("Tread event has received=%t user=%q", ev.Received, ev.User)
+		}
+	}
+	if !sawRead {
+		t.Error("no Rread events")
+	}
+}
+
+// A pipeConn is one end of a pair of pipes; it is not a net.Conn.
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeConn) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func pipePair() (pipeConn, pipeConn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return pipeConn{r1, w2}, pipeConn{r2, w1}
+}
+
+func TestServerServeConn(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var srv Server
+	srv.Handler = osFS(dir)
+
+	serve := func() (*ClientConn, chan error) {
+		local, remote := pipePair()
+		done := make(chan error, 1)
+		go func() { done <- srv.ServeConn(remote) }()
+		var client Client
+		conn, err := client.NewClientConn(local, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, done
+	}
+
+	conn, done := serve()
+	f, err := conn.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello" {
+		t.Errorf("read %q, %v", got, err)
+	}
+	f.Close()
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn returned %v after client hung up", err)
+	}
+
+	conn, done = serve()
+	if srv.Stats().Conns != 1 {
+		t.Errorf("Stats().Conns = %d, want 1", srv.Stats().Conns)
+	}
+	srv.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ServeConn returned %v after Close, want ErrServerClosed", err)
+	}
+	conn.Close()
+
+	local, remote := pipePair()
+	defer local.Close()
+	if err := srv.ServeConn(remote); err != ErrServerClosed {
+		t.Errorf("ServeConn on closed server returned %v", err)
+	}
+}
+
+func TestServerAttachAuth(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{
+		Handler: osFS(dir),
+		AttachAuth: func(rwc *Channel, user, access string) error {
+			if _, ok := rwc.Conn().(net.Conn); !ok {
+				return errors.New("no connection")
+			}
+			if rwc.RemoteAddr() == nil || rwc.LocalAddr() == nil {
+				return errors.New("no address")
+			}
+			if rwc.TLSState() != nil {
+				return errors.New("unexpected TLS state")
+			}
+			if user != "glenda" {
+				return errors.New("not glenda")
+			}
+			return nil
+		},
+	}
+	defer srv.Close()
+	var client Client
+	for _, user := range []string{"glenda", "bootes"} {
+		local, remote := net.Pipe()
+		go srv.ServeConn(remote)
+		conn, err := client.NewClientConn(local, user)
+		if user == "glenda" && err != nil {
+			t.Errorf("attach as %s: %v", user, err)
+		} else if user != "glenda" && (err == nil || !strings.Contains(err.Error(), "not glenda")) {
+			t.Errorf("attach as %s returned %v", user, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for host.
+func testCertificate(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerVHost(t *testing.T) {
+	access := make(chan string, 1)
+	srv := &Server{
+		EnableVHost: true,
+		Handler: HandlerFunc(func(s *Session) {
+			select {
+			case access <- s.Access:
+			default:
+			}
+			for s.Next() {
+			}
+		}),
+	}
+	defer srv.Close()
+	ln := mustListen(t)
+	go srv.Serve(ln)
+	tlsLn := tls.NewListener(mustListen(t), &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "vhost.example")},
+	})
+	go srv.Serve(tlsLn)
+
+	client := Client{
+		TLSConfig: &tls.Config{
+			ServerName:         "vhost.example",
+			InsecureSkipVerify: true,
+		},
+	}
+	for uri, want := range map[string]string{
+		"tcp://" + ln.Addr().String():    "127.0.0.1",
+		"tls://" + tlsLn.Addr().String(): "vhost.example",
+	} {
+		conn, err := client.DialContext(context.Background(), uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := <-access; got != want {
+			t.Errorf("%s: Access = %q, want %q", uri, got, want)
+		}
+		conn.Close()
+	}
+}
+
+func mustListen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	return ln
+}
+
+func TestStack(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(handler Handler) *ClientConn {
+		local, remote := net.Pipe()
+		go (&Server{Handler: handler}).ServeConn(remote)
+		var client Client
+		conn, err := client.NewClientConn(local, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	readFile := func(conn *ClientConn) error {
+		f, err := conn.Open("file")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if got, err := ioutil.ReadAll(f); err != nil || string(got) != "hello" {
+			return fmt.Errorf("read %q, %v", got, err)
+		}
+		return nil
+	}
+
+	// Requests updated upstream are seen downstream, and requests
+	// answered upstream are not passed down.
+	var tagged, unseen int32
+	tag := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			req := s.Request()
+			s.UpdateRequest(req.WithContext(context.WithValue(req.Context(), "tag", true)))
+		}
+	})
+	check := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if s.Request().Context().Value("tag") == true {
+				atomic.AddInt32(&tagged, 1)
+			}
+			osFS(dir).serve(s.Request())
+		}
+	})
+	never := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			atomic.AddInt32(&unseen, 1)
+		}
+	})
+	conn := dial(Stack(tag, check, never))
+	if err := readFile(conn); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+	if atomic.LoadInt32(&tagged) == 0 {
+		t.Error("downstream handler did not see updated requests")
+	}
+	if n := atomic.LoadInt32(&unseen); n != 0 {
+		t.Errorf("%d answered requests passed downstream", n)
+	}
+
+	// Handlers that exit early are skipped, and the request they
+	// held goes to the next handler.
+	quit := HandlerFunc(func(s *Session) {})
+	hold := HandlerFunc(func(s *Session) { s.Next() })
+	conn = dial(Stack(quit, hold, osFS(dir)))
+	if err := readFile(conn); err != nil {
+		t.Errorf("after early exit: %v", err)
+	}
+	conn.Close()
+
+	// Once every handler has exited, requests get default responses.
+	conn = dial(Stack(quit, hold))
+	if _, err := conn.Stat("file"); err == nil {
+		t.Error("Stat succeeded with no handlers left")
+	}
+	if _, err := conn.Stat("file"); err == nil {
+		t.Error("Stat succeeded with no handlers left")
+	}
+	conn.Close()
+}
+
+func TestFileServer(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	for name, data := range map[string]string{
+		root + "/file":      "hello",
+		outside + "/secret": "secret",
+	} {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("file", root+"/in"); err != nil {
+		t.Skip("cannot create symlinks:", err)
+	}
+	if err := os.Symlink(outside+"/secret", root+"/out"); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(fsrv *FileServer) *ClientConn {
+		local, remote := net.Pipe()
+		go (&Server{Handler: fsrv}).ServeConn(remote)
+		var client Client
+		conn, err := client.NewClientConn(local, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	read := func(conn *ClientConn, name string) (string, error) {
+		f, err := conn.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		return string(data), err
+	}
+
+	conn := dial(&FileServer{Root: root})
+	for name, want := range map[string]string{"file": "hello", "in": "hello", "/../../file": "hello"} {
+		if got, err := read(conn, name); err != nil || got != want {
+			t.Errorf("read %s: %q, %v", name, got, err)
+		}
+	}
+	_, err := read(conn, "out")
+	if err == nil {
+		t.Error("read a symlink leading outside of Root")
+	} else if strings.Contains(err.Error(), root) || strings.Contains(err.Error(), outside) {
+		t.Errorf("error reveals host path: %v", err)
+	}
+	f, err := conn.Create("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new file"))
+	f.Close()
+	if err := conn.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Rename("new", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(root + "/renamed"); err != nil || string(data) != "new file" {
+		t.Errorf("renamed file contains %q, %v", data, err)
+	}
+	if err := conn.Remove("renamed"); err != nil {
+		t.Error(err)
+	}
+	if err := conn.Remove("in"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(root + "/file"); err != nil {
+		t.Error("removing a symlink removed its target:", err)
+	}
+
+	conn = dial(&FileServer{Root: root, ReadOnly: true})
+	if _, err := conn.Create("new"); err == nil {
+		t.Error("created file on read-only FileServer")
+	}
+	if _, err := conn.OpenFile("file", os.O_RDWR); err == nil {
+		t.Error("opened file for writing on read-only FileServer")
+	}
+	if got, err := read(conn, "file"); err != nil || got != "hello" {
+		t.Errorf("read-only: read %q, %v", got, err)
+	}
+
+	conn = dial(&FileServer{Root: root, FollowSymlinks: true})
+	if got, err := read(conn, "out"); err != nil || got != "secret" {
+		t.Errorf("FollowSymlinks: read %q, %v", got, err)
+	}
+}
+
+// writableFS is an fs.FS for a host directory that implements the
+// optional methods used by FS to modify the tree.
+type writableFS string
+
+func (dir writableFS) name(name string) string {
+	return string(dir) + "/" + name
+}
+
+func (dir writableFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(dir)).Open(name)
+}
+
+func (dir writableFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(dir.name(name), flag, perm)
+}
+
+func (dir writableFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(dir.name(name), perm)
+}
+
+func (dir writableFS) Remove(name string) error {
+	return os.Remove(dir.name(name))
+}
+
+func (dir writableFS) Rename(oldname, newname string) error {
+	return os.Rename(dir.name(oldname), dir.name(newname))
+}
+
+func TestFS(t *testing.T) {
+	dial := func(handler Handler) *ClientConn {
+		local, remote := net.Pipe()
+		go (&Server{Handler: handler}).ServeConn(remote)
+		var client Client
+		conn, err := client.NewClientConn(local, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	conn := dial(FS(fstest.MapFS{
+		"hello.txt":     {Data: []byte("hello, world")},
+		"dir/a":         {Data: []byte("a")},
+		"dir/b":         {Data: []byte("b")},
+		"dir/sub/empty": {},
+	}))
+	f, err := conn.Open("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := f.ReadAt(buf, 7); err != nil || string(buf[:n]) != "world" {
+		t.Errorf("ReadAt: %q, %v", buf[:n], err)
+	}
+	f.Close()
+	dir, err := conn.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	list, err := dir.Readdir(-1)
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	dir.Close()
+	if err != nil || strings.Join(names, " ") != "a b sub" {
+		t.Errorf("Readdir: %q, %v", names, err)
+	}
+	if _, err := conn.Create("new"); err == nil {
+		t.Error("created file in read-only fs.FS")
+	}
+	if _, err := conn.OpenFile("hello.txt", os.O_WRONLY); err == nil {
+		t.Error("opened read-only fs.FS file for writing")
+	}
+
+	root := t.TempDir()
+	conn = dial(FS(writableFS(root)))
+	if err := conn.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err = conn.Create("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("written"))
+	f.Close()
+	if err := conn.Rename("dir/file", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(root + "/dir/renamed"); err != nil || string(data) != "written" {
+		t.Errorf("renamed file contains %q, %v", data, err)
+	}
+	if err := conn.Remove("dir/renamed"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerHandleReads(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"file", "generated"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte("on disk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{
+		HandleReads: true,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				req, ok := s.Request().(Tread)
+				if !ok {
+					osFS(dir).serve(s.Request())
+				} else if req.Path() == "/generated" {
+					data := "generated"
+					if req.Offset < int64(len(data)) {
+						data = data[req.Offset:]
+					} else {
+						data = ""
+					}
+					req.Rread([]byte(data))
+				}
+			}
+		}),
+	}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	f, err := conn.Open("generated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "generated" {
+		t.Errorf("intercepted reads returned %q, %v", data, err)
+	}
+	buf := make([]byte, 3)
+	if n, err := f.ReadAt(buf, 2); err != nil || string(buf[:n]) != "ner" {
+		t.Errorf("intercepted ReadAt returned %q, %v", buf[:n], err)
+	}
+	f.Close()
+
+	f, err = conn.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "on disk" {
+		t.Errorf("read %q, %v from file whose reads were not answered", data, err)
+	}
+	f.Close()
+}
+
+type iounitFile struct {
+	*os.File
+	iounit int
+}
+
+func (f iounitFile) IOUnit() int { return f.iounit }
+
+func TestServerIOUnit(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"field", "method", "plain"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var counts = make(chan int, 100)
+	srv := &Server{
+		HandleReads: true,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Topen:
+					f, err := os.OpenFile(dir+req.Path(), req.Flag, 0)
+					switch req.Path() {
+					case "/field":
+						req.IOUnit = 4
+						req.Ropen(f, err)
+					case "/method":
+						req.Ropen(iounitFile{f, 3}, err)
+					default:
+						req.IOUnit = 1 << 30
+						req.Ropen(f, err)
+					}
+				case Tread:
+					counts <- req.Count
+				default:
+					osFS(dir).serve(req)
+				}
+			}
+		}),
+	}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for name, want := range map[string]int{
+		"field":  4,
+		"method": 3,
+		"plain":  10, // capped to the message size, larger than buf
+	} {
+		f, err := conn.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10)
+		if _, err := f.Read(buf); err != nil {
+			t.Errorf("read %s: %v", name, err)
+		}
+		if n := <-counts; n != want {
+			t.Errorf("client read %d bytes of %s at once, want %d", n, name, want)
+		}
+		f.Close()
+	}
+}
+
+type appendInfo struct {
+	os.FileInfo
+}
+
+func (info appendInfo) Mode() os.FileMode { return info.FileInfo.Mode() | os.ModeAppend }
+
+func TestServerAppendOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/log", []byte("start\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					info, err := os.Stat(dir + req.Path())
+					if err == nil && req.Path() == "/log" {
+						info = appendInfo{info}
+					}
+					req.Rwalk(info, err)
+				default:
+					osFS(dir).serve(req)
+				}
+			}
+		}),
+	}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.OpenFile("log", os.O_WRONLY|os.O_TRUNC); err == nil {
+		t.Error("opened append-only file with O_TRUNC")
+	}
+	f, err := conn.OpenFile("log", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n"} {
+		if _, err := f.WriteAt([]byte(line), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if data, err := ioutil.ReadFile(dir + "/log"); err != nil || string(data) != "start\none\ntwo\n" {
+		t.Errorf("append-only file contains %q, %v", data, err)
+	}
+}
+
+func TestServerOpenMode(t *testing.T) {
+	type opened struct {
+		flag, mode    int
+		exec, rmclose bool
+	}
+	var got []opened
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(&slowFile{}, nil)
+				case Topen:
+					got = append(got, opened{req.Flag, int(req.OpenMode), req.Exec, req.RemoveOnClose})
+					req.Rerror("not really")
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	rpc(func() { enc.Topen(1, 1, styxproto.OEXEC) })
+	rpc(func() { enc.Topen(1, 1, styxproto.OWRITE|styxproto.OTRUNC|styxproto.ORCLOSE) })
+	rpc(func() { enc.Topen(1, 1, styxproto.ORDWR) })
+
+	want := []opened{
+		{os.O_RDONLY, styxproto.OEXEC, true, false},
+		{os.O_WRONLY | os.O_TRUNC, styxproto.OWRITE | styxproto.OTRUNC | styxproto.ORCLOSE, false, true},
+		{os.O_RDWR, styxproto.ORDWR, false, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handler saw opens %v, want %v", got, want)
+	}
+}
+
+func TestServerCreatePerm(t *testing.T) {
+	var perms []uint32
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tcreate); ok {
+					perms = append(perms, req.Perm9P)
+					req.Rerror("not really")
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	want := []uint32{
+		styxproto.DMEXCL | styxproto.DMTMP | 0600,
+		styxproto.DMAUTH | 0400,
+	}
+	for _, perm := range want {
+		rpc(func() { enc.Twalk(1, 0, 1) })
+		rpc(func() { enc.Tcreate(1, 1, "file", perm, styxproto.OREAD) })
+		rpc(func() { enc.Tclunk(1, 1) })
+	}
+	if !reflect.DeepEqual(perms, want) {
+		t.Errorf("handler saw permissions %#o, want %#o", perms, want)
+	}
+}
+
+func TestServerWalkParent(t *testing.T) {
+	var walks []string
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Twalk); ok {
+					walks = append(walks, req.Name+" "+req.Path())
+					req.Rwalk(os.Stat("."))
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rsp := rpc(func() { enc.Twalk(1, 0, 1, "..", "a", "b", "..", "..", "..", "c") })
+	if m, ok := rsp.(styxproto.Rwalk); !ok || m.Nwqid() != 7 {
+		t.Fatalf("Twalk with parent elements returned %s", rsp)
+	}
+	want := []string{
+		".. /",
+		"a /a",
+		"b /a/b",
+		".. /a",
+		".. /",
+		".. /",
+		"c /c",
+	}
+	if !reflect.DeepEqual(walks, want) {
+		t.Errorf("handler saw walks %q, want %q", walks, want)
+	}
+	rsp = rpc(func() { enc.Twalk(1, 0, 2, "a/../..") })
+	if _, ok := rsp.(styxproto.Rerror); !ok {
+		t.Errorf("Twalk with slash in element returned %s, want Rerror", rsp)
+	}
+}
+
+type testQidSource map[string]uint64
+
+func (src testQidSource) Qid(path string, mode os.FileMode) styxproto.Qid {
+	if n, ok := src[path]; ok {
+		qid, _, _ := styxproto.NewQid(make([]byte, styxproto.QidLen), 0, 7, n)
+		return qid
+	}
+	return nil
+}
+
+func TestServerQidSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Handler:   osFS(dir),
+		QidSource: testQidSource{"/": 1, "/sub": 42},
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rsp := rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	if m, ok := rsp.(styxproto.Rattach); !ok || m.Qid().Path() != 1 || m.Qid().Type() != styxproto.QTDIR {
+		t.Errorf("Tattach returned %s, want qid 1 from QidSource", rsp)
+	}
+	rsp = rpc(func() { enc.Twalk(1, 0, 1, "sub") })
+	m, ok := rsp.(styxproto.Rwalk)
+	if !ok || m.Nwqid() != 1 {
+		t.Fatalf("Twalk returned %s", rsp)
+	}
+	if q := m.Wqid(0); q.Path() != 42 || q.Version() != 7 || q.Type() != styxproto.QTDIR {
+		t.Errorf("walk to /sub returned qid %s, want QidSource's qid with directory type", q)
+	}
+}
+
+func TestServerTrackAtime(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(dir+"/file", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: osFS(dir), TrackAtime: true}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	atime := func() time.Time {
+		rsp := rpc(func() { enc.Tstat(1, 1) })
+		m, ok := rsp.(styxproto.Rstat)
+		if !ok {
+			t.Fatalf("Tstat returned %s", rsp)
+		}
+		return time.Unix(int64(m.Stat().Atime()), 0)
+	}
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	if got := atime(); !got.Equal(mtime) {
+		t.Errorf("atime of unread file is %v, want mtime %v", got, mtime)
+	}
+
+	start := time.Now().Truncate(time.Second)
+	rpc(func() { enc.Topen(1, 1, styxproto.OREAD) })
+	rpc(func() { enc.Tread(1, 1, 0, 100) })
+	if got := atime(); got.Before(start) {
+		t.Errorf("atime after read is %v, want at least %v", got, start)
+	}
+
+	stat := blankStat("", "", "")
+	stat.SetAtime(1500000000)
+	if rsp, ok := rpc(func() { enc.Twstat(1, 1, stat) }).(styxproto.Rwstat); !ok {
+		t.Errorf("atime-only Twstat returned %s", rsp)
+	}
+	if got := atime(); got.Unix() != 1500000000 {
+		t.Errorf("atime after Twstat is %v, want %v", got, time.Unix(1500000000, 0))
+	}
+}
+
+func TestServerTruncateOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: osFS(dir)}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	rpc(func() { enc.Twalk(1, 0, 2, "file") })
+
+	stat := blankStat("", "", "")
+	stat.SetLength(2)
+	// The handler does not answer Ttruncate, and fid 2 is not open.
+	if rsp, ok := rpc(func() { enc.Twstat(1, 2, stat) }).(styxproto.Rerror); !ok {
+		t.Errorf("Twstat of unopened file returned %s", rsp)
+	}
+	rpc(func() { enc.Topen(1, 1, styxproto.ORDWR) })
+	if rsp, ok := rpc(func() { enc.Twstat(1, 1, stat) }).(styxproto.Rwstat); !ok {
+		t.Errorf("Twstat of open file returned %s", rsp)
+	}
+	if data, err := ioutil.ReadFile(dir + "/file"); err != nil || string(data) != "da" {
+		t.Errorf("truncated file contains %q, %v", data, err)
+	}
+}
+
+func TestRstatRaw(t *testing.T) {
+	stat, _, err := styxproto.NewStat(make([]byte, styxproto.MaxStatLen), "file", "glenda", "sys", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat.SetType('M')
+	stat.SetDev(7)
+	stat.SetLength(100)
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyStatFile("file"), nil)
+			case Tstat:
+				req.RstatRaw(stat, nil)
+			}
+		}
+	})
+	for _, version := range []string{styxproto.Version9P2000, styxproto.Version9P2000U} {
+		enc, rpc := testDial(t, &Server{Handler: handler}, version)
+		rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, version) })
+		if version == styxproto.Version9P2000U {
+			rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", styxproto.NoUid) })
+		} else {
+			rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+		}
+		rpc(func() { enc.Twalk(1, 0, 1, "file") })
+		m := rpc(func() { enc.Tstat(1, 1) })
+		rsp, ok := m.(styxproto.Rstat)
+		if !ok {
+			t.Fatalf("%s: Tstat returned %T %s", version, m, m)
+		}
+		got := rsp.Stat()
+		if got.Type() != 'M' || got.Dev() != 7 || got.Length() != 100 || string(got.Muid()) != "bob" {
+			t.Errorf("%s: got stat %s", version, got)
+		}
+		// A 9P2000.u Stat has extra fields.
+		if converted := len(got) != len(stat); converted != (version == styxproto.Version9P2000U) {
+			t.Errorf("%s: stat is in the wrong format: %s", version, got)
+		}
+	}
+}
+
+func TestServerRemoveOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: osFS(dir)}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rsp := rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	walked, ok := rsp.(styxproto.Rwalk)
+	if !ok {
+		t.Fatalf("Twalk returned %s", rsp)
+	}
+	oldpath := walked.Wqid(0).Path()
+	rpc(func() { enc.Twalk(1, 0, 2, "file") })
+	rpc(func() { enc.Topen(1, 2, styxproto.OREAD) })
+
+	if _, ok := rpc(func() { enc.Tremove(1, 1) }).(styxproto.Rremove); !ok {
+		t.Fatal("Tremove failed")
+	}
+	rsp = rpc(func() { enc.Tstat(1, 2) })
+	if m, ok := rsp.(styxproto.Rstat); !ok {
+		t.Errorf("Tstat of removed, open file returned %s", rsp)
+	} else if m.Stat().Qid().Path() != oldpath {
+		t.Errorf("removed file changed qid from %d to %d", oldpath, m.Stat().Qid().Path())
+	}
+
+	rpc(func() { enc.Twalk(1, 0, 3) })
+	rsp = rpc(func() { enc.Tcreate(1, 3, "file", 0644, styxproto.OWRITE) })
+	if m, ok := rsp.(styxproto.Rcreate); !ok {
+		t.Errorf("Tcreate returned %s", rsp)
+	} else if m.Qid().Path() == oldpath {
+		t.Error("new file took the qid of the removed file")
+	}
+	rpc(func() { enc.Tclunk(1, 2) })
+	rsp = rpc(func() { enc.Tstat(1, 3) })
+	if m, ok := rsp.(styxproto.Rstat); !ok || m.Stat().Qid().Path() == oldpath {
+		t.Errorf("Tstat of new file returned %s after removed file was clunked", rsp)
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := &Server{
+		RequestTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(os.Stat("."))
+				case Tstat:
+					<-req.Context().Done()
+					close(cancelled)
+					req.Rstat(os.Stat("."))
+				}
+			}
+		}),
+	}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Stat("slow")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Stat of blocked handler returned %v, want timeout", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("request context was not cancelled")
+	}
+}
+
+// A blockedWriter blocks writes until it is closed.
+type blockedWriter struct {
+	writing chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.closed
+	return 0, errors.New("closed")
+}
+
+func (w *blockedWriter) Close() error {
+	w.once.Do(func() { close(w.closed) })
+	return nil
+}
+
+func TestCancelWrite(t *testing.T) {
+	file := &blockedWriter{writing: make(chan struct{}), closed: make(chan struct{})}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(&slowFile{}, nil)
+				case Topen:
+					req.Ropen(file, nil)
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "somefile") })
+	rpc(func() { enc.Topen(1, 1, styxproto.OWRITE) })
+
+	enc.Twrite(1, 1, 0, []byte("hello"))
+	enc.Flush()
+	select {
+	case <-file.writing:
+	case <-time.After(time.Second):
+		t.Fatal("write did not start")
+	}
+	rsp := rpc(func() { enc.Tflush(2, 1) })
+	if _, ok := rsp.(styxproto.Rflush); !ok {
+		t.Errorf("Tflush of blocked write returned %s", rsp)
+	}
+	select {
+	case <-file.closed:
+	case <-time.After(time.Second):
+		t.Error("cancel write failed")
+	}
+}
+
+func TestServerMaxPending(t *testing.T) {
+	dir := t.TempDir()
+	blocked := &blockedWriter{writing: make(chan struct{}), closed: make(chan struct{})}
+	srv := &Server{
+		MaxPending: 1, // raised to msize
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(&slowFile{}, nil)
+				case Topen:
+					if req.Path() == "/blocked" {
+						req.Ropen(blocked, nil)
+					} else {
+						req.Ropen(os.Create(dir + req.Path()))
+					}
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.MinBufSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "blocked") })
+	rpc(func() { enc.Topen(1, 1, styxproto.OWRITE) })
+	rpc(func() { enc.Twalk(1, 0, 2, "file") })
+	rpc(func() { enc.Topen(1, 2, styxproto.OWRITE) })
+
+	// Two of these writes do not fit in one message size.
+	data := make([]byte, styxproto.MinBufSize/2)
+	enc.Twrite(1, 1, 0, data)
+	enc.Flush()
+	select {
+	case <-blocked.writing:
+	case <-time.After(time.Second):
+		t.Fatal("write did not start")
+	}
+	rsp := rpc(func() { enc.Twrite(2, 2, 0, data) })
+	if m, ok := rsp.(styxproto.Rerror); !ok || !strings.Contains(string(m.Ename()), "budget") {
+		t.Errorf("write over budget returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Tflush(3, 1) }).(styxproto.Rflush); !ok {
+		t.Fatalf("Tflush returned %s", rsp)
+	}
+	rsp = rpc(func() { enc.Twrite(2, 2, 0, data) })
+	if _, ok := rsp.(styxproto.Rwrite); !ok {
+		t.Errorf("write after the budget was released returned %s", rsp)
+	}
+}
+
+// permInfo is an os.FileInfo with an owner and group.
+type permInfo struct {
+	name       string
+	mode       os.FileMode
+	uid, group string
+}
+
+func (fi permInfo) Name() string       { return path.Base(fi.name) }
+func (fi permInfo) Size() int64        { return 0 }
+func (fi permInfo) Mode() os.FileMode  { return fi.mode }
+func (fi permInfo) ModTime() time.Time { return time.Time{} }
+func (fi permInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi permInfo) Sys() interface{}   { return nil }
+func (fi permInfo) Uid() string        { return fi.uid }
+func (fi permInfo) Gid() string        { return fi.group }
+func (fi permInfo) Muid() string       { return fi.uid }
+
+func TestPerm(t *testing.T) {
+	tree := map[string]permInfo{
+		"/":          {"/", os.ModeDir | 0755, "sys", "sys"},
+		"/private":   {"/private", os.ModeDir | 0700, "bob", "bob"},
+		"/private/f": {"/private/f", 0666, "bob", "bob"},
+		"/pub":       {"/pub", os.ModeDir | 0755, "alice", "alice"},
+		"/pub/ro":    {"/pub/ro", 0644, "bob", "bob"},
+		"/pub/grp":   {"/pub/grp", 0640, "bob", "alice"},
+		"/pub/bad":   {"/pub/bad", 0644, "alice", "alice"},
+		"/sys":       {"/sys", os.ModeDir | 0755, "sys", "sys"},
+		"/sys/lib":   {"/sys/lib", 0644, "sys", "sys"},
+	}
+	stat := func(name string) (os.FileInfo, error) {
+		if fi, ok := tree[name]; ok {
+			return fi, nil
+		}
+		return nil, os.ErrNotExist
+	}
+	app := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(stat(req.Path()))
+			case Tstat:
+				req.Rstat(stat(req.Path()))
+			case Topen:
+				req.Ropen(strings.NewReader(""), nil)
+			case Tcreate:
+				req.Rcreate(strings.NewReader(""), nil)
+			case Tremove:
+				req.Rremove(nil)
+			}
+		}
+	})
+	// Perm cannot stat /pub/bad, though the file exists.
+	permStat := func(name string) (os.FileInfo, error) {
+		if name == "/pub/bad" {
+			return nil, errors.New("i/o error")
+		}
+		return stat(name)
+	}
+	srv := &Server{Handler: &Perm{Handler: app, Stat: permStat}}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	check := func(what string, err error, allowed bool) {
+		t.Helper()
+		if allowed && err != nil {
+			t.Errorf("%s: %v", what, err)
+		} else if !allowed && (err == nil || !strings.Contains(err.Error(), "permission denied")) {
+			t.Errorf("%s returned %v, want permission denied", what, err)
+		}
+	}
+	open := func(name string, flag int) error {
+		f, err := conn.OpenFile(name, flag)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	}
+	_, err = conn.Stat("private/f")
+	check("walk through private directory", err, false)
+	check("read file", open("pub/ro", os.O_RDONLY), true)
+	check("write file", open("pub/ro", os.O_WRONLY), false)
+	check("read group file", open("pub/grp", os.O_RDONLY), true)
+	f, err := conn.Create("new")
+	check("create in root", err, false)
+	if f, err = conn.Create("pub/new"); err == nil {
+		f.Close()
+	}
+	check("create in own directory", err, true)
+	check("remove from own directory", conn.Remove("pub/ro"), true)
+	check("open file that cannot be stat'd", open("pub/bad", os.O_RDONLY), false)
+
+	// The client cannot ask for ORCLOSE.
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "alice", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "pub", "ro") })
+	rpc(func() { enc.Twalk(1, 0, 2, "sys", "lib") })
+	rpc(func() { enc.Twalk(1, 0, 3, "sys", "lib") })
+	rpc(func() { enc.Twalk(1, 0, 4, "private") })
+	if rsp, ok := rpc(func() { enc.Twalk(1, 4, 5, "..") }).(styxproto.Rerror); !ok {
+		t.Errorf("walk to parent of private directory returned %s, want permission denied", rsp)
+	}
+	rsp := rpc(func() { enc.Topen(1, 1, styxproto.OREAD|styxproto.ORCLOSE) })
+	if _, ok := rsp.(styxproto.Ropen); !ok {
+		t.Errorf("ORCLOSE in own directory returned %s", rsp)
+	}
+	rsp = rpc(func() { enc.Topen(1, 2, styxproto.OREAD) })
+	if _, ok := rsp.(styxproto.Ropen); !ok {
+		t.Errorf("read file in other directory returned %s", rsp)
+	}
+	rsp = rpc(func() { enc.Topen(1, 3, styxproto.OREAD|styxproto.ORCLOSE) })
+	if _, ok := rsp.(styxproto.Rerror); !ok {
+		t.Errorf("ORCLOSE in other directory returned %s, want permission denied", rsp)
+	}
+}
+
+func TestServerCloseSession(t *testing.T) {
+	file := &blockedWriter{writing: make(chan struct{}), closed: make(chan struct{})}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(&slowFile{}, nil)
+				case Topen:
+					req.Ropen(file, nil)
+				case Tstat:
+					s.CloseSession()
+				case Tremove:
+					s.Hangup()
+				}
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Tattach(1, 10, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "somefile") })
+	rpc(func() { enc.Topen(1, 1, styxproto.OWRITE) })
+
+	enc.Twrite(1, 1, 0, []byte("hello"))
+	enc.Flush()
+	select {
+	case <-file.writing:
+	case <-time.After(time.Second):
+		t.Fatal("write did not start")
+	}
+
+	// Both the pending write and the request that closed the
+	// session are answered with errors.
+	for _, send := range []func(){func() { enc.Tstat(2, 0) }, func() {}} {
+		rsp := rpc(send)
+		if _, ok := rsp.(styxproto.Rerror); !ok {
+			t.Errorf("got %s after closing session, want Rerror", rsp)
+		}
+	}
+	select {
+	case <-file.closed:
+	case <-time.After(time.Second):
+		t.Error("open file was not closed")
+	}
+	rsp := rpc(func() { enc.Twalk(1, 0, 2) })
+	if _, ok := rsp.(styxproto.Rerror); !ok {
+		t.Errorf("Twalk on closed session returned %s", rsp)
+	}
+	rsp = rpc(func() { enc.Twalk(1, 10, 11, "somefile") })
+	if _, ok := rsp.(styxproto.Rwalk); !ok {
+		t.Errorf("Twalk on other session returned %s", rsp)
+	}
+
+	// Hangup closes the connection.
+	if rsp := rpc(func() { enc.Tremove(1, 11) }); rsp != nil {
+		t.Errorf("got %s after Hangup, want closed connection", rsp)
+	}
+}
+
+func TestSessionTransport(t *testing.T) {
+	type transport struct {
+		local, remote net.Addr
+		tls           *tls.ConnectionState
+	}
+	sessions := make(chan transport, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			select {
+			case sessions <- transport{s.LocalAddr(), s.RemoteAddr(), s.TLSState()}:
+			default:
+			}
+			for s.Next() {
+			}
+		}),
+	}
+	defer srv.Close()
+	ln := mustListen(t)
+	go srv.Serve(ln)
+	tlsLn := tls.NewListener(mustListen(t), &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "transport.example")},
+	})
+	go srv.Serve(tlsLn)
+
+	client := Client{
+		TLSConfig: &tls.Config{
+			ServerName:         "transport.example",
+			InsecureSkipVerify: true,
+		},
+	}
+	for _, ln := range []net.Listener{ln, tlsLn} {
+		uri := "tcp://" + ln.Addr().String()
+		if ln == tlsLn {
+			uri = "tls://" + ln.Addr().String()
+		}
+		conn, err := client.DialContext(context.Background(), uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := <-sessions
+		if got.local == nil || got.local.String() != ln.Addr().String() {
+			t.Errorf("%s: LocalAddr = %v, want %s", uri, got.local, ln.Addr())
+		}
+		if got.remote == nil {
+			t.Errorf("%s: RemoteAddr is nil", uri)
+		}
+		if ln == tlsLn && (got.tls == nil || got.tls.ServerName != "transport.example") {
+			t.Errorf("%s: TLSState = %v", uri, got.tls)
+		} else if ln != tlsLn && got.tls != nil {
+			t.Errorf("%s: TLSState is not nil", uri)
+		}
+		conn.Close()
+	}
+}
+
+func TestSessionVersion(t *testing.T) {
+	type negotiated struct {
+		msize   int64
+		version string
+	}
+	sessions := make(chan negotiated, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			sessions <- negotiated{s.MaxSize(), s.Version()}
+			for s.Next() {
+			}
+		}),
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(8192, styxproto.Version9P2000U) })
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", styxproto.NoUid) })
+	want := negotiated{8192, styxproto.Version9P2000U}
+	if got := <-sessions; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestServerAuthNoAfid(t *testing.T) {
+	var authCalls int32
+	auth := func(rwc *Channel, user, access string) error {
+		atomic.AddInt32(&authCalls, 1)
+		return errors.New("password required")
+	}
+	attach := func(srv *Server, user string) error {
+		local, remote := net.Pipe()
+		go srv.ServeConn(remote)
+		var client Client
+		conn, err := client.NewClientConn(local, user)
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// With only Auth, a client must make a Tauth request.
+	srv := &Server{Handler: osFS(t.TempDir()), Auth: auth}
+	defer srv.Close()
+	if err := attach(srv, "glenda"); err == nil || !strings.Contains(err.Error(), errNoFid.Error()) {
+		t.Errorf("attach without afid returned %v", err)
+	}
+	if n := atomic.LoadInt32(&authCalls); n != 0 {
+		t.Errorf("Auth called %d times for attach without afid", n)
+	}
+
+	// With AttachAuth, such clients are authenticated by it alone.
+	srv = &Server{
+		Handler: osFS(t.TempDir()),
+		Auth:    auth,
+		AttachAuth: func(rwc *Channel, user, access string) error {
+			if _, err := rwc.Write([]byte("hello")); err == nil {
+				return errors.New("wrote to auth file")
+			}
+			if _, ok := rwc.Conn().(net.Conn); !ok {
+				return errors.New("no connection")
+			}
+			if user != "glenda" {
+				return errors.New("not glenda")
+			}
+			return nil
+		},
+	}
+	defer srv.Close()
+	for _, user := range []string{"glenda", "bootes"} {
+		err := attach(srv, user)
+		if user == "glenda" && err != nil {
+			t.Errorf("attach as %s: %v", user, err)
+		} else if user != "glenda" && (err == nil || !strings.Contains(err.Error(), "not glenda")) {
+			t.Errorf("attach as %s returned %v", user, err)
+		}
+	}
+	if n := atomic.LoadInt32(&authCalls); n != 0 {
+		t.Errorf("Auth called %d times for attach without afid", n)
+	}
+
+	// With AuthNoAfid, Auth judges them by their connection.
+	srv = &Server{
+		Handler:    osFS(t.TempDir()),
+		AuthNoAfid: true,
+		Auth: func(rwc *Channel, user, access string) error {
+			atomic.AddInt32(&authCalls, 1)
+			if _, err := rwc.Read(make([]byte, 1)); err == nil {
+				return errors.New("read from auth file")
+			}
+			if user != "glenda" {
+				return errors.New("not glenda")
+			}
+			return nil
+		},
+	}
+	defer srv.Close()
+	for _, user := range []string{"glenda", "bootes"} {
+		err := attach(srv, user)
+		if user == "glenda" && err != nil {
+			t.Errorf("attach as %s: %v", user, err)
+		} else if user != "glenda" && (err == nil || !strings.Contains(err.Error(), "not glenda")) {
+			t.Errorf("attach as %s returned %v", user, err)
+		}
+	}
+	if n := atomic.LoadInt32(&authCalls); n != 2 {
+		t.Errorf("Auth called %d times with AuthNoAfid, want 2", n)
+	}
+}
+
+func TestServerRawWstat(t *testing.T) {
+	var (
+		got  []Twstat
+		path string
+	)
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyStatFile("file"), nil)
+			case Twstat:
+				got = append(got, req)
+				req.Rwstat(nil)
+			case Tstat:
+				path = req.Path()
+				req.Rstat(emptyStatFile("new"), nil)
+			}
+		}
+	})
+	enc, rpc := testDial(t, &Server{Handler: handler, RawWstat: true}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+
+	stat := blankStat("new", "", "")
+	stat.SetLength(5)
+	if rsp, ok := rpc(func() { enc.Twstat(1, 1, stat) }).(styxproto.Rwstat); !ok {
+		t.Fatalf("Twstat returned %s", rsp)
+	}
+	if len(got) != 1 {
+		t.Fatalf("handler received %d Twstat requests, want 1", len(got))
+	}
+	if req := got[0]; req.Path() != "/file" || string(req.Stat.Name()) != "new" || req.Stat.Length() != 5 {
+		t.Errorf("handler received Twstat of %s with stat %s", req.Path(), req.Stat)
+	}
+	rpc(func() { enc.Tstat(1, 1) })
+	if path != "/new" {
+		t.Errorf("renamed fid refers to %s, want /new", path)
+	}
+}
+
+func TestServerStrictWstat(t *testing.T) {
+	var muid string
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyStatFile("file"), nil)
+			case Tmuid:
+				muid = req.Muid
+				req.Rmuid(nil)
+			case Tchmod:
+				req.Rchmod(errors.New("read-only mode"))
+			}
+		}
+	})
+	for _, strict := range []bool{false, true} {
+		enc, rpc := testDial(t, &Server{Handler: handler, StrictWstat: strict}, styxproto.Version9P2000)
+		rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+		rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+		rpc(func() { enc.Twalk(1, 0, 1, "file") })
+
+		// blankStat sets the muid to the uid, so the unanswered
+		// Tchown fails too.
+		stat := blankStat("", "bob", "")
+		stat.SetMode(0600)
+		rsp := rpc(func() { enc.Twstat(1, 1, stat) })
+		if _, ok := rsp.(styxproto.Rerror); ok != strict {
+			t.Errorf("StrictWstat=%v: partial Twstat returned %s", strict, rsp)
+		}
+		if muid != "bob" {
+			t.Errorf("StrictWstat=%v: handler received muid %q", strict, muid)
+		}
+	}
+}
+
+func TestRwalkMode(t *testing.T) {
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Twalk); ok {
+				switch req.Path() {
+				case "/dir":
+					req.RwalkMode(os.ModeDir, nil)
+				case "/dir/file":
+					req.RwalkMode(0, nil)
+				}
+			}
+		}
+	})
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rsp, ok := rpc(func() { enc.Twalk(1, 0, 1, "dir", "file") }).(styxproto.Rwalk)
+	if !ok || rsp.Nwqid() != 2 {
+		t.Fatalf("Twalk returned %s", rsp)
+	}
+	if qtype := rsp.Wqid(0).Type(); qtype != styxproto.QTDIR {
+		t.Errorf("directory has qid type %#x", qtype)
+	}
+	if qtype := rsp.Wqid(1).Type(); qtype != styxproto.QTFILE {
+		t.Errorf("file has qid type %#x", qtype)
+	}
+}
+
+func TestSessionQid(t *testing.T) {
+	var seen styxproto.Qid
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.RwalkMode(0, nil)
+			case Tstat:
+				seen = req.Qid()
+				qid, _, err := styxproto.NewQid(make([]byte, styxproto.QidLen), seen.Type(), 7, seen.Path())
+				if err != nil {
+					panic(err)
+				}
+				s.SetQid(req.Path(), qid[:styxproto.QidLen-1:styxproto.QidLen-1])
+				s.SetQid(req.Path(), qid)
+				req.Rstat(emptyStatFile("file"), nil)
+			}
+		}
+	})
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	walk, ok := rpc(func() { enc.Twalk(1, 0, 1, "file") }).(styxproto.Rwalk)
+	if !ok || walk.Nwqid() != 1 {
+		t.Fatalf("Twalk returned %s", walk)
+	}
+	walked := walk.Wqid(0).Path()
+	rsp, ok := rpc(func() { enc.Tstat(1, 1) }).(styxproto.Rstat)
+	if !ok {
+		t.Fatalf("Tstat returned %s", rsp)
+	}
+	if seen == nil || seen.Path() != walked {
+		t.Errorf("handler saw qid %v, want path %d", seen, walked)
+	}
+	if qid := rsp.Stat().Qid(); qid.Path() != walked || qid.Version() != 7 {
+		t.Errorf("Rstat has qid %v after SetQid", qid)
+	}
+}
+
+func TestServerSymlinkU(t *testing.T) {
+	var created []string
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Tsymlink:
+				created = append(created, req.NewPath()+" -> "+req.Target)
+				req.Rsymlink(nil)
+			case Tstat:
+				req.Rstat(linkStat{"link"}, nil)
+			}
+		}
+	})
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000U)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000U) })
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", styxproto.NoUid) })
+	rpc(func() { enc.Twalk(1, 0, 1) })
+	rsp, ok := rpc(func() {
+		enc.TcreateU(1, 1, "link", styxproto.DMSYMLINK|0777, styxproto.OREAD, "target")
+	}).(styxproto.Rcreate)
+	if !ok {
+		t.Fatalf("Tcreate of symlink returned %s", rsp)
+	}
+	if rsp.Qid().Type() != styxproto.QTSYMLINK {
+		t.Errorf("new link has qid type %#x", rsp.Qid().Type())
+	}
+	if len(created) != 1 || created[0] != "/link -> target" {
+		t.Errorf("handler created %q", created)
+	}
+	stat, ok := rpc(func() { enc.Tstat(1, 1) }).(styxproto.Rstat)
+	if !ok {
+		t.Fatalf("Tstat of link returned %s", stat)
+	}
+	if s := stat.Stat(); s.Mode()&styxproto.DMSYMLINK == 0 || string(s.Extension()) != "target" {
+		t.Errorf("link has stat %s", s)
+	}
+}
+
+func TestServerMknod(t *testing.T) {
+	var got []Tmknod
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tmknod); ok {
+				got = append(got, req)
+				req.Rmknod(nil)
+			}
+		}
+	})
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000L)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000L) })
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "", "", 1000) })
+	rsp := rpc(func() { enc.Tmknod(1, 0, "null", 020666, 1, 3, 5) })
+	if _, ok := rsp.(styxproto.Rmknod); !ok {
+		t.Fatalf("Tmknod returned %s", rsp)
+	}
+	if len(got) != 1 {
+		t.Fatalf("handler received %d Tmknod requests", len(got))
+	}
+	req := got[0]
+	if req.NewPath() != "/null" || req.Mode != os.ModeDevice|os.ModeCharDevice|0666 {
+		t.Errorf("Tmknod of %s with mode %s", req.NewPath(), req.Mode)
+	}
+	if req.Major != 1 || req.Minor != 3 || req.Gid != 5 {
+		t.Errorf("Tmknod of device %d,%d for group %d", req.Major, req.Minor, req.Gid)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	handler := ReadOnly(HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyStatFile("file"), nil)
+			case Topen:
+				req.Ropen(strings.NewReader("data"), nil)
+			case Tcreate:
+				req.Rcreate(strings.NewReader(""), nil)
+			case Tremove:
+				req.Rremove(nil)
+			case Tchmod:
+				req.Rchmod(nil)
+			}
+		}
+	}))
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	rpc(func() { enc.Twalk(1, 0, 2) })
+
+	stat := blankStat("", "", "")
+	stat.SetMode(0600)
+	refused := []struct {
+		name string
+		fn   func()
+	}{
+		{"Topen(OWRITE)", func() { enc.Topen(1, 1, styxproto.OWRITE) }},
+		{"Topen(OTRUNC)", func() { enc.Topen(1, 1, styxproto.OREAD|styxproto.OTRUNC) }},
+		{"Topen(ORCLOSE)", func() { enc.Topen(1, 1, styxproto.OREAD|styxproto.ORCLOSE) }},
+		{"Tcreate", func() { enc.Tcreate(1, 2, "new", 0644, styxproto.OREAD) }},
+		{"Twstat", func() { enc.Twstat(1, 1, stat) }},
+	}
+	for _, tt := range refused {
+		if rsp, ok := rpc(tt.fn).(styxproto.Rerror); !ok || string(rsp.Ename()) != errReadOnly.Error() {
+			t.Errorf("%s returned %s", tt.name, rsp)
+		}
+	}
+	if rsp, ok := rpc(func() { enc.Topen(1, 1, styxproto.OREAD) }).(styxproto.Ropen); !ok {
+		t.Errorf("Topen(OREAD) returned %s", rsp)
+	}
+}
+
+func TestServerPolicy(t *testing.T) {
+	var removed []string
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyStatFile("file"), nil)
+				case Tremove:
+					removed = append(removed, s.User)
+					req.Rremove(nil)
+				}
+			}
+		}),
+		Policy: func(s *Session, req Request) error {
+			if _, ok := req.(Tremove); ok && s.User == "guest" {
+				return errors.New("guests may not remove files")
+			}
+			return nil
+		},
+	}
+	enc, rpc := testDial(t, srv, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "guest", "") })
+	rpc(func() { enc.Tattach(1, 1, styxproto.NoFid, "owner", "") })
+	rpc(func() { enc.Twalk(1, 0, 2, "file") })
+	rpc(func() { enc.Twalk(1, 1, 3, "file") })
+
+	rsp, ok := rpc(func() { enc.Tremove(1, 2) }).(styxproto.Rerror)
+	if !ok || string(rsp.Ename()) != "guests may not remove files" {
+		t.Errorf("Tremove by guest returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Tremove(1, 3) }).(styxproto.Rremove); !ok {
+		t.Errorf("Tremove by owner returned %s", rsp)
+	}
+	if len(removed) != 1 || removed[0] != "owner" {
+		t.Errorf("handler removed files for %q", removed)
+	}
+}
+
+// lineLogger sends each line logged to a channel.
+type lineLogger chan string
+
+func (l lineLogger) Printf(format string, args ...interface{}) {
+	l <- fmt.Sprintf(format, args...)
+}
+
+func TestLogRequests(t *testing.T) {
+	lines := make(lineLogger, 10)
+	handler := LogRequests(HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyStatFile("file"), nil)
+			case Topen:
+				req.Rerror("no access")
+			case Tstat:
+				// Left for the client to flush.
+				<-req.Context().Done()
+			}
+		}
+	}), lines)
+	enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "glenda", "") })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	rpc(func() { enc.Topen(1, 1, styxproto.OREAD) })
+	enc.Tstat(2, 1)
+	if rsp, ok := rpc(func() { enc.Tflush(3, 2) }).(styxproto.Rflush); !ok {
+		t.Fatalf("Tflush returned %s", rsp)
+	}
+
+	want := []string{
+		`user="glenda" aname="" type=Twalk path="/file" result=ok latency=`,
+		`user="glenda" aname="" type=Topen path="/file" result="no access" latency=`,
+		`user="glenda" aname="" type=Tstat path="/file" result="context canceled" latency=`,
+	}
+	// Requests are logged as they finish, in no particular order.
+	var got []string
+	for range want {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("only logged %q", got)
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	for i, prefix := range want {
+		if !strings.HasPrefix(got[i], prefix) {
+			t.Errorf("logged %q, want %q...", got[i], prefix)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	quota := &Quota{Handler: osFS(t.TempDir()), MaxBytes: 6, MaxFiles: 1}
+	enc, rpc := testDial(t, &Server{Handler: quota}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "glenda", "") })
+	rpc(func() { enc.Twalk(1, 0, 1) })
+	if rsp, ok := rpc(func() { enc.Tcreate(1, 1, "a", 0644, styxproto.ORDWR) }).(styxproto.Rcreate); !ok {
+		t.Fatalf("first Tcreate returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Twrite(1, 1, 0, []byte("four")) }).(styxproto.Rwrite); !ok {
+		t.Errorf("write within quota returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Twrite(1, 1, 4, []byte("four")) }).(styxproto.Rerror); !ok {
+		t.Errorf("write beyond quota returned %s", rsp)
+	}
+	rpc(func() { enc.Twalk(1, 0, 2) })
+	if rsp, ok := rpc(func() { enc.Tcreate(1, 2, "b", 0644, styxproto.ORDWR) }).(styxproto.Rerror); !ok {
+		t.Errorf("Tcreate beyond quota returned %s", rsp)
+	}
+	if bytes, files := quota.Usage("glenda"); bytes != 4 || files != 1 {
+		t.Errorf("usage is %d bytes, %d files", bytes, files)
+	}
+}
+
+func TestQuotaDotL(t *testing.T) {
+	quota := &Quota{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyStatFile("file"), nil)
+				case Tsymlink:
+					req.Rsymlink(nil)
+				case Tmknod:
+					req.Rmknod(errors.New("no devices"))
+				case Tlink:
+					req.Rlink(nil)
+				}
+			}
+		}),
+		MaxFiles: 3,
+	}
+	enc, rpc := testDial(t, &Server{Handler: quota}, styxproto.Version9P2000L)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000L) })
+	rpc(func() { enc.TattachU(1, 0, styxproto.NoFid, "glenda", "", 1000) })
+	rpc(func() { enc.Twalk(1, 0, 1, "file") })
+	if rsp, ok := rpc(func() { enc.Tsymlink(1, 0, "link", "file", 0) }).(styxproto.Rsymlink); !ok {
+		t.Fatalf("Tsymlink returned %s", rsp)
+	}
+	rpc(func() { enc.Tmknod(1, 0, "dev", 0644, 1, 1, 0) })
+	if rsp, ok := rpc(func() { enc.Tlink(1, 0, 1, "hard") }).(styxproto.Rlink); !ok {
+		t.Fatalf("Tlink within quota returned %s", rsp)
+	}
+	// The failed Tmknod is refunded once the request is done.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, files := quota.Usage("glenda")
+		if files == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("usage is %d files, want 2", files)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rsp, ok := rpc(func() { enc.Tlink(1, 0, 1, "hard2") }).(styxproto.Rlink); !ok {
+		t.Fatalf("Tlink within quota returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Tsymlink(1, 0, "link2", "file", 0) }).(styxproto.Rlerror); !ok {
+		t.Errorf("Tsymlink beyond quota returned %s", rsp)
+	}
+}
+
+func TestQuotaFlush(t *testing.T) {
+	creating := make(chan struct{})
+	quota := &Quota{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tcreate); ok {
+					// Left for the client to flush.
+					close(creating)
+					<-req.Context().Done()
+				}
+			}
+		}),
+		MaxFiles: 1,
+	}
+	enc, rpc := testDial(t, &Server{Handler: quota}, styxproto.Version9P2000)
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "glenda", "") })
+	rpc(func() { enc.Twalk(1, 0, 1) })
+	enc.Tcreate(2, 1, "a", 0644, styxproto.ORDWR)
+	enc.Flush()
+	select {
+	case <-creating:
+	case <-time.After(time.Second):
+		t.Fatal("Tcreate did not reach the handler")
+	}
+	if rsp, ok := rpc(func() { enc.Tflush(3, 2) }).(styxproto.Rflush); !ok {
+		t.Fatalf("Tflush returned %s", rsp)
+	}
+	// The reservation is refunded once the request is done.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, files := quota.Usage("glenda")
+		if files == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flushed Tcreate counted as %d files", files)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/sub/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(handler Handler) (*styxproto.Encoder, func(fn func()) styxproto.Msg) {
+		enc, rpc := testDial(t, &Server{Handler: handler}, styxproto.Version9P2000)
+		rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+		rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+		return enc, rpc
+	}
+
+	enc, rpc := connect(Chroot("/sub", osFS(dir)))
+	if rsp, ok := rpc(func() { enc.Twalk(1, 0, 1, "file") }).(styxproto.Rwalk); !ok {
+		t.Fatalf("Twalk in chroot returned %s", rsp)
+	}
+	stat := blankStat("renamed", "", "")
+	if rsp, ok := rpc(func() { enc.Twstat(1, 1, stat) }).(styxproto.Rwstat); !ok {
+		t.Fatalf("rename in chroot returned %s", rsp)
+	}
+	if _, err := os.Stat(dir + "/sub/renamed"); err != nil {
+		t.Error(err)
+	}
+	if rsp, ok := rpc(func() { enc.Tstat(1, 1) }).(styxproto.Rstat); !ok {
+		t.Errorf("Tstat of renamed file returned %s", rsp)
+	} else if name := string(rsp.Stat().Name()); name != "renamed" {
+		t.Errorf("renamed file is called %q", name)
+	}
+
+	enc, rpc = connect(StripPrefix("/mnt", osFS(dir)))
+	if rsp, ok := rpc(func() { enc.Twalk(1, 0, 1, "mnt", "sub", "renamed") }).(styxproto.Rwalk); !ok || rsp.Nwqid() != 3 {
+		t.Errorf("Twalk under prefix returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Twalk(1, 0, 2, "sub") }).(styxproto.Rerror); !ok {
+		t.Errorf("Twalk outside of prefix returned %s", rsp)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	upper, lower := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		upper + "/common": "upper",
+		upper + "/top":    "top",
+		lower + "/common": "lower",
+		lower + "/bottom": "bottom",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc, rpc := testDial(t, &Server{Handler: Union(osFS(upper), osFS(lower))}, styxproto.Version9P2000)
+	read := func(fid uint32) []byte {
+		rsp, ok := rpc(func() { enc.Tread(1, fid, 0, 4096) }).(styxproto.Rread)
+		if !ok {
+			t.Fatalf("Tread returned %s", rsp)
+		}
+		data, err := ioutil.ReadAll(rsp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+	rpc(func() { enc.Tattach(1, 0, styxproto.NoFid, "", "") })
+
+	if rsp, ok := rpc(func() { enc.Twalk(1, 0, 1, "bottom") }).(styxproto.Rwalk); !ok {
+		t.Errorf("Twalk to file in lower layer returned %s", rsp)
+	}
+	if rsp, ok := rpc(func() { enc.Twalk(1, 0, 1, "missing") }).(styxproto.Rerror); !ok {
+		t.Errorf("Twalk to missing file returned %s", rsp)
+	}
+	rpc(func() { enc.Twalk(1, 0, 2, "common") })
+	rpc(func() { enc.Topen(1, 2, styxproto.OREAD) })
+	if data := read(2); string(data) != "upper" {
+		t.Errorf("read %q from common, want upper", data)
+	}
+
+	rpc(func() { enc.Twalk(1, 0, 3) })
+	if rsp, ok := rpc(func() { enc.Topen(1, 3, styxproto.OREAD) }).(styxproto.Ropen); !ok {
+		t.Fatalf("Topen of root returned %s", rsp)
+	}
+	var names []string
+	for data := read(3); len(data) > 0; {
+		n := int(binary.LittleEndian.Uint16(data)) + 2
+		names = append(names, string(styxproto.Stat(data[:n]).Name()))
+		data = data[n:]
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "bottom common top" {
+		t.Errorf("root directory lists %q", got)
+	}
+
+	rpc(func() { enc.Twalk(1, 0, 4) })
+	if rsp, ok := rpc(func() { enc.Tcreate(1, 4, "new", 0644, styxproto.OWRITE) }).(styxproto.Rcreate); !ok {
+		t.Fatalf("Tcreate returned %s", rsp)
+	}
+	if _, err := os.Stat(upper + "/new"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(lower + "/new"); err == nil {
+		t.Error("new file created in lower layer")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var stats, reads, version int32
+	report := []byte("expensive report")
+	cache := &Cache{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyStatFile(path.Base(req.Path())), nil)
+				case Topen:
+					qid := req.Qid()
+					v := uint32(atomic.LoadInt32(&version))
+					if qid.Version() != v {
+						qid, _, _ = styxproto.NewQid(qid, qid.Type(), v, qid.Path())
+						s.SetQid(req.Path(), qid)
+					}
+					req.Ropen(bytes.NewReader(report), nil)
+				case Tstat:
+					atomic.AddInt32(&stats, 1)
+					req.Rstat(emptyStatFile(path.Base(req.Path())), nil)
+				case Tread:
+					atomic.AddInt32(&reads, 1)
+					var p []byte
+					if req.Offset < int64(len(report)) {
+						p = report[req.Offset:]
+					}
+					req.Rread(p)
+				}
+			}
+		}),
+	}
+	local, remote := net.Pipe()
+	go (&Server{HandleReads: true, Handler: cache}).ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	readReport := func() {
+		f, err := conn.Open("report")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if data, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(data, report) {
+			t.Fatalf("read %q, %v", data, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Stat("report"); err != nil {
+			t.Fatal(err)
+		}
+		readReport()
+	}
+	if n := atomic.LoadInt32(&stats); n != 1 {
+		t.Errorf("handler answered %d Tstat requests, want 1", n)
+	}
+	cached := atomic.LoadInt32(&reads)
+	if cached == 0 {
+		t.Fatal("handler answered no Tread requests")
+	}
+
+	atomic.StoreInt32(&version, 1)
+	readReport()
+	if n := atomic.LoadInt32(&reads); n != 2*cached {
+		t.Errorf("handler answered %d Tread requests after the qid changed, want %d", n, 2*cached)
+	}
+}
+
+func TestCacheWrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("old data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The Quota checks that the files opened through the Cache
+	// are wrapped by both.
+	quota := &Quota{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(os.Stat(dir + req.Path()))
+				case Topen:
+					req.Ropen(os.OpenFile(dir+req.Path(), req.Flag, 0))
+				case Tread:
+					data, err := ioutil.ReadFile(dir + req.Path())
+					if err != nil {
+						req.Rerror("%s", err)
+					} else if req.Offset < int64(len(data)) {
+						req.Rread(data[req.Offset:])
+					} else {
+						req.Rread(nil)
+					}
+				}
+			}
+		}),
+	}
+	cache := &Cache{Handler: quota}
+	local, remote := net.Pipe()
+	go (&Server{HandleReads: true, Handler: cache}).ServeConn(remote)
+	var client Client
+	conn, err := client.NewClientConn(local, "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	readBack := func(want string) {
+		t.Helper()
+		f, err := conn.Open("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if data, err := ioutil.ReadAll(f); err != nil || string(data) != want {
+			t.Errorf("read %q, %v, want %q", data, err, want)
+		}
+	}
+	readBack("old data")
+
+	f, err := conn.OpenFile("file", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBack("old data")
+	if _, err := f.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	readBack("new data")
+	if n, _ := quota.Usage("glenda"); n != 3 {
+		t.Errorf("quota counted %d bytes written, want 3", n)
+	}
+
+	f, err = conn.OpenFile("file", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	readBack("")
+}
+
+func TestCacheShared(t *testing.T) {
+	var version, reads int32
+	cache := &Cache{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					if path.Base(req.Path()) == "dir" {
+						req.Rwalk(emptyStatDir("dir"), nil)
+					} else {
+						req.Rwalk(emptyStatFile(path.Base(req.Path())), nil)
+					}
+				case Topen:
+					req.Ropen(strings.NewReader(""), nil)
+				case Tread:
+					atomic.AddInt32(&reads, 1)
+					v := atomic.LoadInt32(&version)
+					req.Rread([]byte(fmt.Sprintf("%s:%s:%d", s.Access, req.Path(), v)))
+				case Trename:
+					atomic.AddInt32(&version, 1)
+					req.Rrename(nil)
+				case Tsync:
+					// The file changes without the Cache
+					// seeing a request that modifies it.
+					atomic.AddInt32(&version, 1)
+					qid := req.Qid()
+					qid, _, _ = styxproto.NewQid(qid, qid.Type(), qid.Version()+1, qid.Path())
+					s.SetQid(req.Path(), qid)
+					req.Rsync(nil)
+				}
+			}
+		}),
+	}
+	srv := &Server{HandleReads: true, Handler: cache}
+	encA, rpcA := testDial(t, srv, styxproto.Version9P2000)
+	encB, rpcB := testDial(t, srv, styxproto.Version9P2000)
+	open := func(enc *styxproto.Encoder, rpc func(func()) styxproto.Msg, root, fid uint32, elem ...string) {
+		t.Helper()
+		if rsp, ok := rpc(func() { enc.Twalk(1, root, fid, elem...) }).(styxproto.Rwalk); !ok {
+			t.Fatalf("Twalk returned %s", rsp)
+		}
+		if rsp, ok := rpc(func() { enc.Topen(1, fid, styxproto.OREAD) }).(styxproto.Ropen); !ok {
+			t.Fatalf("Topen returned %s", rsp)
+		}
+	}
+	read := func(enc *styxproto.Encoder, rpc func(func()) styxproto.Msg, fid uint32, want string) {
+		t.Helper()
+		rsp := rpc(func() { enc.Tread(1, fid, 0, 100) })
+		if m, ok := rsp.(styxproto.Rread); !ok {
+			t.Errorf("Tread returned %s", rsp)
+		} else if data, _ := ioutil.ReadAll(m); string(data) != want {
+			t.Errorf("read %q, want %q", data, want)
+		}
+	}
+	for _, x := range []struct {
+		enc *styxproto.Encoder
+		rpc func(func()) styxproto.Msg
+	}{{encA, rpcA}, {encB, rpcB}} {
+		x.rpc(func() { x.enc.Tversion(styxproto.DefaultMaxSize, styxproto.Version9P2000) })
+		x.rpc(func() { x.enc.Tattach(1, 0, styxproto.NoFid, "", "a") })
+	}
+	rpcA(func() { encA.Tattach(1, 10, styxproto.NoFid, "", "b") })
+
+	// Each tree has its own responses.
+	open(encA, rpcA, 0, 1, "file")
+	read(encA, rpcA, 1, "a:/file:0")
+	open(encA, rpcA, 10, 11, "file")
+	read(encA, rpcA, 11, "b:/file:0")
+	open(encB, rpcB, 0, 1, "file")
+	read(encB, rpcB, 1, "a:/file:0")
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Errorf("handler answered %d Tread requests, want 2", n)
+	}
+
+	// A qid replaced on one connection is forgotten for all.
+	rpcA(func() { encA.Twstat(1, 1, blankStat("", "", "")) })
+	read(encB, rpcB, 1, "a:/file:1")
+
+	// Renaming a directory forgets the files beneath it.
+	open(encA, rpcA, 0, 2, "dir", "file")
+	read(encA, rpcA, 2, "a:/dir/file:1")
+	rpcA(func() { encA.Twalk(1, 0, 3, "dir") })
+	if rsp, ok := rpcA(func() { encA.Twstat(1, 3, blankStat("old", "", "")) }).(styxproto.Rwstat); !ok {
+		t.Fatalf("rename returned %s", rsp)
+	}
+	open(encB, rpcB, 0, 2, "dir", "file")
+	read(encB, rpcB, 2, "a:/dir/file:2")
+}
+
+// agentFile stands in for the file OpenAuth opens to an
+// authentication agent. It records what the client writes.
+type agentFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *agentFile) ReadAt(p []byte, off int64) (int, error) { return 0, io.EOF }
+
+func (f *agentFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *agentFile) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.data)
+}
+
+func TestServerOpenAuth(t *testing.T) {
+	srv := &Server{
+		Handler:  osFS(t.TempDir()),
+		OpenAuth: func() (interface{}, error) { return new(agentFile), nil },
+		Auth: func(rwc *Channel, user, access string) error {
+			if _, err := rwc.Read(make([]byte, 1)); err == nil {
+				return errors.New("read from auth channel")
+			}
+			if f, ok := rwc.Value("Auth").(*agentFile); !ok || f.String() != "secret" {
+				return errors.New("wrong password")
+			}
+			return nil
+		},
+	}
+	defer srv.Close()
+	for _, password := range []string{"secret", "hunter"} {
+		local, remote := net.Pipe()
+		go srv.ServeConn(remote)
+		client := Client{Auth: func(rwc *Channel, user, access string) error {
+			_, err := io.WriteString(rwc, password)
+			return err
+		}}
+		conn, err := client.NewClientConn(local, "glenda")
+		if password == "secret" && err != nil {
+			t.Errorf("right password: %v", err)
+		}
+		if password != "secret" && err == nil {
+			t.Error("attach succeeded with wrong password")
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
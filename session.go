@@ -1,15 +1,19 @@
 package styx
 
 import (
+	"crypto/tls"
 	"io"
+	"net"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"context"
 
 	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/internal/sys"
 	"aqwari.net/net/styx/internal/threadsafe"
 	"aqwari.net/net/styx/internal/util"
 	"aqwari.net/net/styx/styxproto"
@@ -30,9 +34,9 @@ type Session struct {
 	// Access is the name of the file tree requested by a client when
 	// it establishes a session, in the "aname" field of its "Tattach"
 	// request. When the EnableVHost option is used, if a client does
-	// not specify one, this is set to the hostname the client used
-	// to connect to the server, for non-TLS connections, and the SNI
-	// provided by the client, for TLS connections.
+	// not specify one, this is set to the address the client
+	// connected to, for non-TLS connections, and the SNI provided by
+	// the client, for TLS connections.
 	Access string
 
 	// Incoming requests from the client will be sent over the requests
@@ -70,6 +74,20 @@ type Session struct {
 
 	// Open (or unopened) files, indexed by fid.
 	files *threadsafe.Map
+
+	// Writes in progress, indexed by fid. Each value is a channel
+	// that is closed when the latest write to the fid is done, so
+	// that writes happen in the order they were received.
+	writes *threadsafe.Map
+
+	// The numeric id of the user, provided by clients using the
+	// 9P2000.u or 9P2000.L extensions, and NoUid otherwise.
+	uid uint32
+
+	// The contexts of the session's requests are derived from
+	// reqCtx, which is cancelled when the session is closed.
+	reqCtx    context.Context
+	cancelReq context.CancelFunc
 }
 
 // create a new session and register its fid in the conn.
@@ -77,29 +95,34 @@ type fattach interface {
 	styxproto.Msg
 	Uname() []byte
 	Aname() []byte
+	NUname() uint32
 }
 
 func newSession(c *conn, m fattach) *Session {
 	s := &Session{
 		User:     string(m.Uname()),
-		Access:   string(m.Aname()),
+		Access:   c.access(string(m.Aname())),
+		uid:      m.NUname(),
 		conn:     c,
 		files:    threadsafe.NewMap(),
+		writes:   threadsafe.NewMap(),
 		authC:    make(chan error, 1),
 		requests: make(chan Request),
 	}
+	s.reqCtx, s.cancelReq = context.WithCancel(c.ctx)
 	return s
 }
 
 func openFlag(mode uint8) int {
 	var flag int
-	if mode&styxproto.OWRITE != 0 {
+	// The access mode is in the low two bits; OEXEC is 3,
+	// so it cannot be tested as a single bit.
+	switch mode & 3 {
+	case styxproto.OWRITE:
 		flag = os.O_WRONLY
-	}
-	if mode&styxproto.ORDWR != 0 {
+	case styxproto.ORDWR:
 		flag = os.O_RDWR
-	}
-	if mode&styxproto.OEXEC != 0 {
+	default:
 		flag = os.O_RDONLY
 	}
 	if mode&styxproto.OTRUNC != 0 {
@@ -139,7 +162,11 @@ func (s *Session) Next() bool {
 	if s.conn.Flush() != nil {
 		return false
 	}
-	s.req, ok = <-s.requests
+	select {
+	case s.req, ok = <-s.requests:
+	case <-s.reqCtx.Done():
+		s.req = nil
+	}
 	if ok {
 		s.unhandled = true
 	}
@@ -160,6 +187,94 @@ func (s *Session) UpdateRequest(r Request) {
 	s.req = r
 }
 
+// RemoteAddr returns the network address of the client, if the
+// connection the session takes place on has one, and nil
+// otherwise.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.remoteAddr()
+}
+
+// LocalAddr returns the network address the client connected to,
+// if the connection the session takes place on has one, and nil
+// otherwise.
+func (s *Session) LocalAddr() net.Addr {
+	return localAddr(s.conn.rwc)
+}
+
+// TLSState returns the state of the TLS connection the session
+// takes place on, or nil if the connection does not use TLS.
+func (s *Session) TLSState() *tls.ConnectionState {
+	return tlsState(s.conn.rwc)
+}
+
+// MaxSize returns the maximum size of a 9P message, negotiated with
+// the client. The data in a single read or write is at most
+// MaxSize() - styxproto.IOHeaderSize bytes.
+func (s *Session) MaxSize() int64 {
+	return s.conn.msize
+}
+
+// Qid returns a copy of the qid that identifies the file at the
+// absolute path name to the client, or nil if the file has not been
+// walked to, created or listed on the session's connection. Qids are
+// assigned by the QidSource of the Server, if it has one.
+func (s *Session) Qid(name string) styxproto.Qid {
+	qid, ok := s.conn.qidpool.Get(name)
+	if !ok {
+		return nil
+	}
+	return append(styxproto.Qid(nil), qid...)
+}
+
+// SetQid replaces the qid of the file at the absolute path name
+// for the rest of the connection. It can be used to change the
+// version of a qid when a file is modified, so that clients which
+// cache file data notice the change; a Cache serving the file
+// forgets its responses for it, on every connection. The type of
+// qid should match the type of the file. Qids shorter than
+// styxproto.QidLen are logged and ignored.
+func (s *Session) SetQid(name string, qid styxproto.Qid) {
+	if len(qid) < styxproto.QidLen {
+		s.conn.srv.logf("SetQid %s: qid is %d bytes, want %d", name, len(qid), styxproto.QidLen)
+		return
+	}
+	qid = append(styxproto.Qid(nil), qid[:styxproto.QidLen]...)
+	s.conn.qidpool.Do(func(m map[interface{}]interface{}) {
+		m[name] = qid
+	})
+	s.conn.qidChanged(s.Access, name)
+}
+
+// Version returns the version of the 9P protocol negotiated with the
+// client; one of the Version constants in the styxproto package.
+func (s *Session) Version() string {
+	return s.conn.version
+}
+
+// CloseSession ends the session, without waiting for the client to
+// clunk its fids. Any files opened during the session are closed,
+// and requests in progress are cancelled. Next returns false, and
+// any further requests for the session's fids are answered with an
+// error. Other sessions on the same connection are not affected.
+func (s *Session) CloseSession() {
+	s.cancelReq()
+	s.cleanupHandler()
+}
+
+// Hangup ends the session like CloseSession, and closes the
+// connection it takes place on, ending any other sessions on the
+// same connection.
+func (s *Session) Hangup() {
+	s.CloseSession()
+	s.conn.rwc.Close()
+}
+
+// closed reports whether the session has been ended with
+// CloseSession, or its connection closed.
+func (s *Session) closed() bool {
+	return s.reqCtx.Err() != nil
+}
+
 func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file file) bool {
 	newfid := msg.Newfid()
 
@@ -187,7 +302,7 @@ func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file fil
 	// side effects.
 	if msg.Nwname() == 0 {
 		if newfid != msg.Fid() {
-			s.files.Put(newfid, file)
+			s.putFile(newfid, file)
 			s.conn.sessionFid.Put(newfid, s)
 			s.IncRef()
 		}
@@ -200,13 +315,22 @@ func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file fil
 	// see walk.go for more details
 	elem := make([]string, 0, msg.Nwname())
 	for i := 0; i < cap(elem); i++ {
-		elem = append(elem, string(msg.Wname(i)))
+		name := string(msg.Wname(i))
+		if strings.Contains(name, "/") {
+			s.conn.clearTag(msg.Tag())
+			s.conn.Rerror(msg.Tag(), "invalid path element %q", name)
+			s.conn.Flush()
+			return true
+		}
+		elem = append(elem, name)
 	}
 	walker := newWalker(s, ctx, msg, file.name, elem...)
 
 	for i := range elem {
 		fullpath := path.Join(file.name, strings.Join(elem[:i+1], "/"))
 		s.requests <- Twalk{
+			Name:    elem[i],
+			from:    path.Join(file.name, strings.Join(elem[:i], "/")),
 			index:   i,
 			walk:    walker,
 			reqInfo: newReqInfo(ctx, s, msg, fullpath),
@@ -216,21 +340,44 @@ func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file fil
 }
 
 func (s *Session) handleTopen(ctx context.Context, msg styxproto.Topen, file file) bool {
+	return s.open(ctx, msg, file, openFlag(msg.Mode()), msg.Mode())
+}
+
+// open is shared by Topen and the 9P2000.L Tlopen message.
+func (s *Session) open(ctx context.Context, msg fcall, file file, flag int, omode uint8) bool {
 	if file.rwc != nil {
 		s.conn.clearTag(msg.Tag())
 		s.conn.Rerror(msg.Tag(), "fid %d already open", msg.Fid())
 		s.conn.Flush()
 		return true
 	}
-	flag := openFlag(msg.Mode())
+	// Refuse to truncate append-only files before the handler
+	// has a chance to do so when opening them.
+	qid := s.conn.qid(file.name, 0)
+	if qid.Type()&styxproto.QTAPPEND != 0 && flag&os.O_TRUNC != 0 {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "%s", styxfile.ErrAppendTrunc)
+		s.conn.Flush()
+		return true
+	}
 	s.requests <- Topen{
-		Flag:    flag,
-		reqInfo: newReqInfo(ctx, s, msg, file.name),
+		Flag:          flag,
+		OpenMode:      omode,
+		Exec:          omode&3 == styxproto.OEXEC,
+		RemoveOnClose: omode&styxproto.ORCLOSE != 0,
+		reqInfo:       newReqInfo(ctx, s, msg, file.name),
 	}
 	return true
 }
 
 func (s *Session) handleTcreate(ctx context.Context, msg styxproto.Tcreate, file file) bool {
+	mode := styxfile.ModeOS(msg.Perm())
+	return s.create(ctx, msg, file, string(msg.Name()), mode, openFlag(msg.Mode()), msg.Mode())
+}
+
+// create is shared by Tcreate and the 9P2000.L Tlcreate and Tmkdir
+// messages.
+func (s *Session) create(ctx context.Context, msg fcall, file file, name string, mode os.FileMode, flag int, omode uint8) bool {
 	qid := s.conn.qid(file.name, 0)
 	if qid.Type()&styxproto.QTDIR == 0 {
 		s.conn.clearTag(msg.Tag())
@@ -238,11 +385,27 @@ func (s *Session) handleTcreate(ctx context.Context, msg styxproto.Tcreate, file
 		s.conn.Flush()
 		return true
 	}
+	perm := styxfile.Mode9P(mode)
+	if m, ok := msg.(styxproto.Tcreate); ok {
+		perm = m.Perm()
+		if perm&styxproto.DMSYMLINK != 0 && s.conn.version == styxproto.Version9P2000U {
+			s.requests <- Tsymlink{
+				Name:    name,
+				Target:  string(m.Extension()),
+				reqInfo: newReqInfo(ctx, s, msg, file.name),
+			}
+			return true
+		}
+	}
 	s.requests <- Tcreate{
-		Name:    string(msg.Name()),
-		Mode:    styxfile.ModeOS(msg.Perm()),
-		Flag:    openFlag(msg.Mode()),
-		reqInfo: newReqInfo(ctx, s, msg, file.name),
+		Name:          name,
+		Mode:          mode,
+		Perm9P:        perm,
+		Flag:          flag,
+		OpenMode:      omode,
+		Exec:          omode&3 == styxproto.OEXEC,
+		RemoveOnClose: omode&styxproto.ORCLOSE != 0,
+		reqInfo:       newReqInfo(ctx, s, msg, file.name),
 	}
 	return true
 }
@@ -255,9 +418,14 @@ func (s *Session) handleTremove(ctx context.Context, msg styxproto.Tremove, file
 }
 
 func (s *Session) handleTstat(ctx context.Context, msg styxproto.Tstat, file file) bool {
-	buf := make([]byte, styxproto.MaxStatLen)
+	return s.stat(ctx, msg, file)
+}
+
+// stat is shared by Tstat and the 9P2000.L Tgetattr message.
+func (s *Session) stat(ctx context.Context, msg fcall, file file) bool {
 	if file.auth {
-		stat, _, err := styxproto.NewStat(buf, "", "", "", "")
+		buf := make([]byte, styxproto.MaxStatLenU)
+		stat, _, err := s.conn.newStat(buf, "", "", "", "", "")
 		if err != nil {
 			// input is not user-controlled, this should
 			// never happen
@@ -272,10 +440,10 @@ func (s *Session) handleTstat(ctx context.Context, msg styxproto.Tstat, file fil
 		s.conn.clearTag(msg.Tag())
 		if qid, ok := s.conn.qidpool.Get(file.name); !ok {
 			s.conn.Rerror(msg.Tag(), "qid for %s not found", file.name)
-		} else if stat, err := styxfile.Stat(buf, file.rwc, file.name, qid); err != nil {
+		} else if info, err := styxfile.Info(file.rwc, file.name, qid); err != nil {
 			s.conn.Rerror(msg.Tag(), "%s", err)
 		} else {
-			s.conn.Rstat(msg.Tag(), stat)
+			s.rstat(msg, msg.Tag(), file.name, info)
 		}
 		s.conn.Flush()
 	} else {
@@ -286,9 +454,71 @@ func (s *Session) handleTstat(ctx context.Context, msg styxproto.Tstat, file fil
 	return true
 }
 
+// rstat answers msg, a Tstat or Tgetattr request with the given tag,
+// with the attributes in info. The contents of msg may have been
+// overwritten, so it is only consulted for its type.
+func (s *Session) rstat(msg styxproto.Msg, tag uint16, name string, info os.FileInfo) {
+	mode := styxfile.Mode9P(info.Mode())
+	qid := s.conn.qid(name, styxfile.QidType(mode))
+	if _, ok := msg.(styxproto.Tgetattr); ok {
+		s.conn.Rgetattr(tag, s.attr(name, info, qid))
+		return
+	}
+
+	buf := make([]byte, styxproto.MaxStatLenU)
+	uid, gid, muid := sys.FileOwner(info)
+	fname := info.Name()
+	if fname == "/" {
+		fname = "."
+	}
+	stat, _, err := s.conn.newStat(buf, fname, uid, gid, muid, styxfile.Extension(info))
+	if err != nil {
+		// should never happen
+		panic(err)
+	}
+	if nuid, ngid, ok := sys.FileOwnerID(info); ok {
+		stat.SetNUid(nuid)
+		stat.SetNGid(ngid)
+	}
+	stat.SetLength(info.Size())
+	stat.SetMode(mode)
+	stat.SetAtime(uint32(s.atime(name, info).Unix()))
+	stat.SetMtime(uint32(info.ModTime().Unix()))
+	stat.SetQid(qid)
+	s.conn.Rstat(tag, stat)
+}
+
+func (s *Session) atimeKey(name string) string {
+	return s.Access + "\x00" + name
+}
+
+// touch records that the file at name was accessed now, if the
+// server tracks access times.
+func (s *Session) touch(name string) {
+	s.setAtime(name, time.Now())
+}
+
+func (s *Session) setAtime(name string, t time.Time) {
+	if s.conn.srv.TrackAtime {
+		s.conn.srv.atimes.Store(s.atimeKey(name), t)
+	}
+}
+
+// atime returns the access time to report for the file at name,
+// described by info.
+func (s *Session) atime(name string, info os.FileInfo) time.Time {
+	if t, ok := sys.FileAtime(info); ok {
+		return t
+	}
+	if s.conn.srv.TrackAtime {
+		if t, ok := s.conn.srv.atimes.Load(s.atimeKey(name)); ok {
+			return t.(time.Time)
+		}
+	}
+	return info.ModTime()
+}
+
 func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file file) bool {
-	var n int
-	var err error
 	if file.rwc == nil {
 		s.conn.clearTag(msg.Tag())
 		s.conn.Rerror(msg.Tag(), "file %s is not open for reading", file.name)
@@ -301,6 +531,25 @@ func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file fil
 	msgCopy := styxproto.Tread(make([]byte, msg.Len()))
 	copy(msgCopy, msg)
 
+	qid := s.conn.qid(file.name, 0)
+	if s.conn.srv.HandleReads && !file.auth && qid.Type()&styxproto.QTDIR == 0 {
+		s.requests <- Tread{
+			Offset:  msgCopy.Offset(),
+			Count:   int(msgCopy.Count()),
+			file:    file,
+			reqInfo: newReqInfo(ctx, s, msgCopy, file.name),
+		}
+		return true
+	}
+	s.read(ctx, msgCopy, file)
+	return true
+}
+
+// read answers a Tread by reading from an open file, in the
+// background.
+func (s *Session) read(ctx context.Context, msg styxproto.Tread, file file) {
+	var n int
+	var err error
 	go func(msg styxproto.Tread) {
 		// TODO(droyo) allocations could hurt here, come up with a better
 		// way to do this (after measuring the impact, of course). The tricky bit
@@ -326,12 +575,19 @@ func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file fil
 			// on a file will disrupt any current and future reads on the
 			// same fid. However, that is preferrable to leaking goroutines.
 			file.rwc.Close()
-			s.conn.clearTag(msg.Tag())
+			s.cancelled(msg.Tag())
 			return
 		case <-done:
 		}
 
-		s.conn.clearTag(msg.Tag())
+		var result error
+		if n == 0 && err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			result = err
+		}
+		s.conn.answerTag(msg.Tag(), func() { recordResult(ctx, result) })
+		if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.touch(file.name)
+		}
 		if n > 0 {
 			s.conn.Rread(msg.Tag(), buf[:n])
 		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
@@ -340,8 +596,7 @@ func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file fil
 			s.conn.Rread(msg.Tag(), buf[:n])
 		}
 		s.conn.Flush()
-	}(msgCopy)
-	return true
+	}(msg)
 }
 
 func (s *Session) handleTwrite(ctx context.Context, msg styxproto.Twrite, file file) bool {
@@ -352,24 +607,95 @@ func (s *Session) handleTwrite(ctx context.Context, msg styxproto.Twrite, file f
 		return true
 	}
 
-	// BUG(droyo): cancellation of write requests is not yet implemented.
-	w := util.NewSectionWriter(file.rwc, msg.Offset(), msg.Count())
-	n, err := io.Copy(w, msg)
-	s.conn.clearTag(msg.Tag())
-	if n == 0 && err != nil {
+	// The data must be read from the connection before the next
+	// message can be, so copy it out.
+	data := make([]byte, int(msg.Count()))
+	n, err := io.ReadFull(msg, data)
+	if err != nil {
+		s.conn.clearTag(msg.Tag())
 		s.conn.Rerror(msg.Tag(), "%v", err)
-	} else {
-		s.conn.Rwrite(msg.Tag(), n)
+		s.conn.Flush()
+		return true
 	}
-	s.conn.Flush()
+	data = data[:n]
+
+	// Writes to a file are made one at a time, in order, but
+	// the connection need not wait for them, so that they can
+	// be cancelled with a Tflush, just like reads.
+	prev := make(chan struct{})
+	close(prev)
+	if v, ok := s.writes.Get(msg.Fid()); ok {
+		prev = v.(chan struct{})
+	}
+	done := make(chan struct{})
+	s.writes.Put(msg.Fid(), done)
+
+	go func(tag uint16, fid uint32, offset int64) {
+		defer func() {
+			close(done)
+			s.writes.Do(func(m map[interface{}]interface{}) {
+				if m[fid] == done {
+					delete(m, fid)
+				}
+			})
+		}()
+		select {
+		case <-ctx.Done():
+			s.cancelled(tag)
+			return
+		case <-prev:
+		}
+
+		var n int
+		var err error
+		if t, ok := ctx.Deadline(); ok {
+			styxfile.SetDeadline(file.rwc, t)
+		}
+		written := make(chan struct{})
+		go func() {
+			n, err = file.rwc.WriteAt(data, offset)
+			close(written)
+		}()
+		select {
+		case <-ctx.Done():
+			// As with reads, closing the file is the only
+			// way to interrupt most writes.
+			file.rwc.Close()
+			s.cancelled(tag)
+			return
+		case <-written:
+		}
+
+		s.conn.clearTag(tag)
+		if n == 0 && err != nil {
+			s.conn.Rerror(tag, "%v", err)
+		} else {
+			s.conn.Rwrite(tag, int64(n))
+		}
+		s.conn.Flush()
+	}(msg.Tag(), msg.Fid(), msg.Offset())
 	return true
 }
 
+// cancelled clears the tag of a read or write whose context was
+// cancelled. Requests that were flushed or timed out have already
+// been cleared; those of a closed session get an error.
+func (s *Session) cancelled(tag uint16) {
+	if s.conn.clearTag(tag) {
+		s.conn.Rerror(tag, "%s", errClosed)
+		s.conn.Flush()
+	}
+}
+
 func (s *Session) handleTclunk(ctx context.Context, msg styxproto.Tclunk, file file) bool {
 	defer s.conn.Flush()
+	// Let pending writes finish before the file is closed.
+	if v, ok := s.writes.Get(msg.Fid()); ok {
+		<-v.(chan struct{})
+	}
 	s.conn.sessionFid.Del(msg.Fid())
 	s.conn.clearTag(msg.Tag())
-	s.files.Del(msg.Fid())
+	s.delFile(msg.Fid())
 	if file.rwc != nil {
 		if err := file.rwc.Close(); err != nil {
 			s.conn.Rerror(msg.Tag(), "close %s: %v", file.name, err)
@@ -402,11 +728,25 @@ func (s *Session) endSession() {
 	s.closeMu.Unlock()
 }
 
-// Called when Serve9P exits. Any in-flight requests
-// must be cancelled and any open files closed. Because
-// this is running from the same goroutine as the connection's
-// serve() method, and Serve9P has returned, we can be
-// confident nothing is going to call Close on our files.
+// Called when Serve9P exits and the session is closed. The
+// request being processed, if unanswered, and any requests sent
+// before the client learns that the session has ended, are
+// answered with an error. The requests channel is closed once the
+// client uses all of the session's fids, or the connection closes.
+func (s *Session) drain() {
+	if s.req != nil && !s.req.handled() {
+		s.req.Rerror("%s", errClosed)
+	}
+	for req := range s.requests {
+		req.Rerror("%s", errClosed)
+	}
+	s.conn.Flush()
+}
+
+// Called when the session is closed. Any open files are
+// closed, and the references to them released. Requests in
+// progress have been cancelled, so the only other Close calls
+// on the files come from reads and writes being interrupted.
 func (s *Session) cleanupHandler() {
 	s.files.Do(func(m map[interface{}]interface{}) {
 		for fid, v := range m {
@@ -415,6 +755,7 @@ func (s *Session) cleanupHandler() {
 			if file.rwc != nil {
 				file.rwc.Close()
 			}
+			s.conn.release(file)
 		}
 	})
 }
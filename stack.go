@@ -1,11 +1,20 @@
 package styx
 
-// Stack combines multiple handlers into one. When a new message is received
-// from the client, it is passed to each handler, from left to right, until a
-// response is sent. If no response is sent.  by any handlers in the stack,
-// the documented default response for that message type will be sent to
-// the client. Handlers may use the UpdateRequest to pass information to
-// downstream handlers.
+// Stack combines multiple handlers into one. When a new message is
+// received from the client, it is passed to each handler, from left to
+// right, until a response is sent. If no response is sent by any
+// handler in the stack, the documented default response for that
+// message type is sent to the client.
+//
+// Handlers may use the UpdateRequest method of their Session to pass
+// a modified request to downstream handlers; the modified request is
+// also the one given the default response, if it goes unanswered.
+//
+// A handler that returns before its session ends is removed from the
+// stack. If it had not answered the request it was processing, the
+// request is passed on to the next handler. Once every handler has
+// returned, the remaining requests in the session receive default
+// responses.
 func Stack(handlers ...Handler) Handler {
 	h := make([]Handler, len(handlers))
 	copy(h, handlers)
@@ -15,49 +24,98 @@ func Stack(handlers ...Handler) Handler {
 type stack []Handler
 
 func (handlers stack) Serve9P(s *Session) {
-	running := make([]Session, len(handlers))
-	for i, handler := range handlers {
-		sub := &running[i]
-		sub.User = s.User
-		sub.Access = s.Access
-		sub.requests = make(chan Request)
-		sub.pipeline = make(chan Request)
-		sub.authC = s.authC
-		sub.conn = s.conn
-		sub.RefCount = s.RefCount
-		sub.files = s.files
-		go func(h Handler) {
-			h.Serve9P(sub)
-			close(sub.pipeline)
-		}(handler)
-	}
+	running := s.startHandlers(handlers)
 	for s.Next() {
 		req := s.Request()
-		for i := range running {
-			session := &running[i]
-			req.setSession(session)
-			session.requests <- req
-			if next, ok := <-session.pipeline; !ok {
-				// A handler has exited prematurely. abort
-				goto Cleanup
-			} else if next == nil {
+		for i, sub := range running {
+			if sub == nil {
+				continue
+			}
+			next, ok := sub.pass(req)
+			if !ok {
+				// The handler has exited, taking any changes it
+				// made to the request with it.
+				running[i] = nil
+				if sub.req != nil {
+					req = sub.req
+				}
+				if req.handled() {
+					break
+				}
+				continue
+			}
+			if next == nil {
 				// The request has been handled, no point
 				// in passing it down the chain.
-				s.unhandled = false
 				break
-			} else {
-				req = next
 			}
+			req = next
 		}
-		req.setSession(s)
+		s.UpdateRequest(req)
 	}
+	stopHandlers(running)
+}
 
-Cleanup:
-	for i := range running {
-		close(running[i].requests)
+// startHandlers runs each handler on its own sub-session of s.
+func (s *Session) startHandlers(handlers []Handler) []*Session {
+	running := make([]*Session, len(handlers))
+	for i, handler := range handlers {
+		sub := s.subSession()
+		running[i] = sub
+		go func(h Handler) {
+			h.Serve9P(sub)
+			close(sub.pipeline)
+		}(handler)
+	}
+	return running
+}
+
+// stopHandlers ends the sub-sessions started by startHandlers, and
+// waits for their handlers to exit.
+func stopHandlers(running []*Session) {
+	for _, sub := range running {
+		if sub == nil {
+			continue
+		}
+		close(sub.requests)
 
 		// Wait for the handler to exit
-		for range running[i].pipeline {
+		for range sub.pipeline {
 		}
 	}
 }
+
+// subSession creates a session for a handler in a stack. It shares
+// its user, file tree and files with s, but receives its requests
+// from the stack, and hands them back through its pipeline.
+func (s *Session) subSession() *Session {
+	return &Session{
+		User:     s.User,
+		Access:   s.Access,
+		requests: make(chan Request),
+		pipeline: make(chan Request),
+		authC:    s.authC,
+		conn:     s.conn,
+		files:    s.files,
+		uid:      s.uid,
+
+		reqCtx:    s.reqCtx,
+		cancelReq: s.cancelReq,
+	}
+}
+
+// pass hands req to the handler running on a sub-session, and waits
+// for it to be handed back. The returned request is nil if the
+// handler answered it. pass returns false if the handler has exited.
+func (s *Session) pass(req Request) (Request, bool) {
+	select {
+	case s.requests <- req:
+	case <-s.pipeline:
+		// The pipeline is only sent to after the handler
+		// receives a request, so it must be closed.
+		s.req = nil
+		return nil, false
+	}
+	next, ok := <-s.pipeline
+	return next, ok
+}
@@ -0,0 +1,115 @@
+package styx
+
+import (
+	"expvar"
+	"io"
+	"reflect"
+	"sync"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// Stats is a snapshot of the activity of a Server, for capacity
+// planning and monitoring. Counters are cumulative since the Server
+// started serving.
+type Stats struct {
+	Conns int // open connections
+	Fids  int // fids in use on open connections
+
+	// Messages received from clients, by type, such as "Twalk".
+	Messages map[string]int64
+
+	BytesIn  int64 // bytes received from clients
+	BytesOut int64 // bytes sent to clients
+	Errors   int64 // error responses sent to clients
+}
+
+// serverStats holds the counters of a Server. The number of
+// connections and fids are counted when a snapshot is taken.
+type serverStats struct {
+	mu       sync.Mutex
+	messages map[string]int64
+	bytesIn  int64
+	bytesOut int64
+	errors   int64
+}
+
+func (st *serverStats) message(m styxproto.Msg) {
+	kind := msgType(m)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.messages == nil {
+		st.messages = make(map[string]int64)
+	}
+	st.messages[kind]++
+}
+
+func (st *serverStats) error() {
+	st.mu.Lock()
+	st.errors++
+	st.mu.Unlock()
+}
+
+func msgType(m styxproto.Msg) string {
+	return reflect.TypeOf(m).Name()
+}
+
+// A statsReader counts the bytes read from a connection.
+type statsReader struct {
+	r     io.Reader
+	stats *serverStats
+}
+
+func (r statsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.stats.mu.Lock()
+	r.stats.bytesIn += int64(n)
+	r.stats.mu.Unlock()
+	return n, err
+}
+
+// A statsWriter counts the bytes written to a connection.
+type statsWriter struct {
+	w     io.Writer
+	stats *serverStats
+}
+
+func (w statsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.stats.mu.Lock()
+	w.stats.bytesOut += int64(n)
+	w.stats.mu.Unlock()
+	return n, err
+}
+
+// Stats returns a snapshot of the server's activity.
+func (srv *Server) Stats() Stats {
+	var s Stats
+	srv.mu.Lock()
+	s.Conns = len(srv.conns)
+	for c := range srv.conns {
+		c.sessionFid.Do(func(m map[interface{}]interface{}) {
+			s.Fids += len(m)
+		})
+	}
+	srv.mu.Unlock()
+
+	st := &srv.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s.Messages = make(map[string]int64, len(st.messages))
+	for k, v := range st.messages {
+		s.Messages[k] = v
+	}
+	s.BytesIn, s.BytesOut, s.Errors = st.bytesIn, st.bytesOut, st.errors
+	return s
+}
+
+// PublishExpvar publishes the server's Stats as the expvar variable
+// name, so that they are served by the expvar package's HTTP handler.
+// Like expvar.Publish, PublishExpvar panics if name is already in use.
+func (srv *Server) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return srv.Stats()
+	}))
+}
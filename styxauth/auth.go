@@ -52,3 +52,43 @@ func Whitelist(rules map[[2]string]bool) styx.AuthFunc {
 		return errAuthFailure
 	}
 }
+
+// Users returns a styx.AuthFunc that succeeds only for the named
+// users. It performs no authentication itself, and is meant to be
+// combined with other AuthFuncs using All.
+func Users(names ...string) styx.AuthFunc {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(rwc *styx.Channel, user, access string) error {
+		if allowed[user] {
+			return nil
+		}
+		return errAuthFailure
+	}
+}
+
+// Trees chooses a styx.AuthFunc based on the file tree a client
+// attaches to. Clients attaching to a tree that is not in the policy
+// map fail to authenticate. The policy map should not be modified
+// during authentication.
+//
+// For example, the following AuthFunc accepts TLS certificates or
+// tokens, but only lets alice and bob attach to the "data" tree:
+//
+//	styxauth.All(
+//		styxauth.Any(certAuth, tokenAuth),
+//		styxauth.Trees(map[string]styx.AuthFunc{
+//			"":     styxauth.All(),
+//			"data": styxauth.Users("alice", "bob"),
+//		}),
+//	)
+func Trees(policy map[string]styx.AuthFunc) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		if fn, ok := policy[access]; ok {
+			return fn(rwc, user, access)
+		}
+		return errAuthFailure
+	}
+}
@@ -0,0 +1,57 @@
+package styxauth
+
+import (
+	"errors"
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+func TestPolicies(t *testing.T) {
+	var (
+		accept = func(*styx.Channel, string, string) error { return nil }
+		reject = func(*styx.Channel, string, string) error { return errors.New("rejected") }
+	)
+	trees := Trees(map[string]styx.AuthFunc{
+		"":     All(),
+		"data": Users("alice", "bob"),
+		"logs": Users("carol"),
+	})
+	tests := []struct {
+		name   string
+		auth   styx.AuthFunc
+		user   string
+		access string
+		ok     bool
+	}{
+		{"Users allows listed user", Users("alice", "bob"), "bob", "", true},
+		{"Users denies other user", Users("alice", "bob"), "mallory", "", false},
+		{"Users with no names", Users(), "alice", "", false},
+
+		{"Trees default tree", trees, "mallory", "", true},
+		{"Trees allowed user", trees, "alice", "data", true},
+		{"Trees denied user", trees, "carol", "data", false},
+		{"Trees other tree", trees, "carol", "logs", true},
+		{"Trees unknown tree", trees, "alice", "secret", false},
+
+		{"All authenticated and allowed", All(accept, trees), "alice", "data", true},
+		{"All authenticated but denied", All(accept, trees), "carol", "data", false},
+		{"All allowed but not authenticated", All(reject, trees), "alice", "data", false},
+		{"Any of two users", Any(Users("alice"), Users("bob")), "bob", "", true},
+		{"Any of none", Any(Users("alice"), Users("bob")), "carol", "", false},
+		{"Any then Trees", All(Any(reject, accept), trees), "bob", "data", true},
+		{"Any then Trees denied", All(Any(reject, accept), trees), "bob", "logs", false},
+		{"Trees choosing Any", Trees(map[string]styx.AuthFunc{
+			"data": Any(Users("alice"), All(accept, Users("bob"))),
+		}), "bob", "data", true},
+	}
+	for _, tt := range tests {
+		err := tt.auth(nil, tt.user, tt.access)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s attaching to %q failed: %v", tt.name, tt.user, tt.access, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: %s attaching to %q succeeded", tt.name, tt.user, tt.access)
+		}
+	}
+}
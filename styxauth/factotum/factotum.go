@@ -0,0 +1,194 @@
+package factotum
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"aqwari.net/net/styx"
+)
+
+const (
+	//Factotum rpc responses
+	ARok       = "ok"
+	ARdone     = "done"
+	ARerror    = "error"
+	ARbadkey   = "badkey"
+	ARtoosmall = "toosmall"
+	ARphase    = "phase"
+	ARneedkey  = "needkey"
+
+	//Factotum rpc commands
+	ARread     = "read"
+	ARwrite    = "write"
+	ARauthinfo = "authinfo"
+	ARstart    = "start"
+
+	AuthRpcMax = 4096
+)
+
+var tab = []string{ARok, ARdone, ARerror, ARneedkey, ARbadkey, ARtoosmall, ARphase}
+
+var ErrMalformedRpc = errors.New("malformed rpc response")
+
+var ErrUnknownRpc = errors.New("Unknown rpc")
+
+var ErrBotchRpc = errors.New("authrpc botch")
+
+// An AuthRpc is a conversation with factotum over its rpc file.
+type AuthRpc struct {
+	io.ReadWriteCloser
+}
+
+//See /sys/src/libauth/auth_rpc.c:/^classify/
+func (a *AuthRpc) classify(b []byte) (string, []byte, error) {
+	for _, s := range tab {
+		if !bytes.HasPrefix(b, []byte(s)) {
+			continue
+		}
+		if len(b) == len(s) {
+			return s, nil, nil
+		}
+		if b[len(s)] == ' ' {
+			return s, b[len(s)+1:], nil
+		}
+	}
+	return "", nil, ErrMalformedRpc
+}
+
+//See /sys/src/libauth/auth_rpc.c:/^auth_rpc/
+func (a *AuthRpc) do(verb string, b []byte) (string, []byte, error) {
+	req := []byte(verb)
+	if len(b) > 0 {
+		req = append(append(req, ' '), b...)
+	}
+	if _, err := a.Write(req); err != nil {
+		return "", nil, err
+	}
+
+	b = make([]byte, AuthRpcMax)
+	n, err := a.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+	b = b[:n]
+
+	var ret string
+	ret, b, err = a.classify(b)
+	if err != nil {
+		return ret, b, err
+	}
+	log.Println("Got phase", ret)
+	switch ret {
+	default:
+		return ret, nil, ErrUnknownRpc
+	case ARdone:
+	case ARok:
+	case ARneedkey:
+		fallthrough
+	case ARbadkey:
+		fallthrough
+	case ARphase:
+		fallthrough
+	case ARerror:
+		return ret, nil, errors.New(string(b))
+	}
+	return ret, b, nil
+}
+
+//See /sys/src/lib9p/auth.c:/^_authread/
+func (a *AuthRpc) ReadAt(b []byte, off int64) (int, error) {
+	ret, resp, err := a.do(ARread, nil)
+	if err != nil {
+		return 0, err
+	}
+	switch ret {
+	case ARdone:
+		fallthrough
+	case ARok:
+		return copy(b, resp), nil
+	}
+	return 0, ErrBotchRpc
+}
+
+//See /sys/src/lib9p/auth.c:/^authwrite/
+func (a *AuthRpc) WriteAt(b []byte, off int64) (int, error) {
+	ret, _, err := a.do(ARwrite, b)
+	if err != nil {
+		return 0, err
+	}
+	switch ret {
+	case ARdone:
+		fallthrough
+	case ARok:
+		return len(b), nil
+	}
+	return 0, ErrBotchRpc
+}
+
+func (a *AuthRpc) Close() error {
+	return a.ReadWriteCloser.Close()
+}
+
+// Start returns functions for the Auth and OpenAuth fields of a
+// styx.Server that authenticate clients with the given factotum
+// protocol, such as "p9any", using the factotum reached by OpenRPC.
+func Start(proto string) (styx.AuthFunc, styx.AuthOpenFunc) {
+	return StartRPC(proto, OpenRPC)
+}
+
+// StartRPC is like Start, but opens the rpc file of factotum by
+// calling open. It can be used with DialRPC to use a factotum
+// served elsewhere.
+func StartRPC(proto string, open func() (io.ReadWriteCloser, error)) (styx.AuthFunc, styx.AuthOpenFunc) {
+	s := fmt.Sprintf("proto=%s role=server", proto)
+
+	af := func(rwc *styx.Channel, user, access string) error {
+		i := rwc.Context.Value("Auth")
+		if i == nil {
+			return errors.New("Tattach before Tauth")
+		}
+		a, ok := i.(*AuthRpc)
+		if !ok {
+			return errors.New("cast to AuthRpc failed")
+		}
+		ret, _, err := a.do(ARread, []byte{})
+		if err != nil {
+			return err
+		}
+		if ret != ARdone {
+			return errors.New("Auth is not done")
+		}
+		return nil
+	}
+	aof := func() (interface{}, error) {
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		a := &AuthRpc{f}
+
+		ret, _, err := a.do(ARstart, []byte(s))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ret != ARok {
+			f.Close()
+			return nil, errors.New("did not get OK for start")
+		}
+		return a, nil
+	}
+	return af, aof
+}
+
+// DialRPC opens the rpc file of a factotum served over 9P. The uri
+// may be in any form accepted by styx.Client.Open, such as
+// "unix!/tmp/ns.glenda.:0/factotum!/rpc".
+func DialRPC(uri string) (io.ReadWriteCloser, error) {
+	var client styx.Client
+	return client.OpenFile(uri, os.O_RDWR)
+}
@@ -0,0 +1,42 @@
+//go:build !plan9
+// +build !plan9
+
+package factotum
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// OpenRPC opens the rpc file of the plan9port factotum serving the
+// current user, through the factotum service in the user's name
+// space directory. The directory is taken from the NAMESPACE
+// environment variable, or derived from the user name and DISPLAY
+// as plan9port's getns does.
+func OpenRPC() (io.ReadWriteCloser, error) {
+	ns, err := namespace()
+	if err != nil {
+		return nil, err
+	}
+	return DialRPC("unix!" + filepath.Join(ns, "factotum") + "!/rpc")
+}
+
+func namespace() (string, error) {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	disp := os.Getenv("DISPLAY")
+	if disp == "" {
+		disp = ":0.0"
+	}
+	disp = strings.TrimSuffix(disp, ".0")
+	disp = strings.Replace(disp, "/", "_", -1)
+	return "/tmp/ns." + u.Username + "." + disp, nil
+}
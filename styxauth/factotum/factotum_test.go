@@ -0,0 +1,119 @@
+package factotum
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+// A fakeRPC stands in for the rpc file of factotum. Each read
+// returns the next of its replies.
+type fakeRPC struct {
+	replies  []string
+	requests []string
+	closed   bool
+}
+
+func (f *fakeRPC) Write(p []byte) (int, error) {
+	f.requests = append(f.requests, string(p))
+	return len(p), nil
+}
+
+func (f *fakeRPC) Read(p []byte) (int, error) {
+	if len(f.replies) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.replies[0])
+	f.replies = f.replies[1:]
+	return n, nil
+}
+
+func (f *fakeRPC) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeRPC) open() (io.ReadWriteCloser, error) { return f, nil }
+
+func checkRequests(t *testing.T, f *fakeRPC, want ...string) {
+	t.Helper()
+	if len(f.requests) != len(want) {
+		t.Fatalf("sent %q, want %q", f.requests, want)
+	}
+	for i := range want {
+		if f.requests[i] != want[i] {
+			t.Errorf("request %d is %q, want %q", i, f.requests[i], want[i])
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	rpc := &fakeRPC{replies: []string{"ok"}}
+	_, open := StartRPC("p9any", rpc.open)
+	if _, err := open(); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, rpc, "start proto=p9any role=server")
+	if rpc.closed {
+		t.Error("rpc file closed after successful start")
+	}
+
+	rpc = &fakeRPC{replies: []string{"error unknown protocol"}}
+	_, open = StartRPC("p9bogus", rpc.open)
+	if _, err := open(); err == nil || err.Error() != "unknown protocol" {
+		t.Errorf("start of unknown protocol returned %v", err)
+	}
+	if !rpc.closed {
+		t.Error("rpc file left open after failed start")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	rpc := &fakeRPC{replies: []string{
+		"ok v.2 p9sk1@example.com",
+		"ok",
+		"done",
+		"badkey no key for dom=example.com",
+		"okay",
+	}}
+	a := &AuthRpc{rpc}
+	buf := make([]byte, 64)
+	n, err := a.ReadAt(buf, 0)
+	if err != nil || string(buf[:n]) != "v.2 p9sk1@example.com" {
+		t.Errorf("read returned %q, %v", buf[:n], err)
+	}
+	if n, err := a.WriteAt([]byte("p9sk1 example.com"), 0); err != nil || n != 17 {
+		t.Errorf("write returned %d, %v", n, err)
+	}
+	if n, err := a.ReadAt(buf, 0); err != nil || n != 0 {
+		t.Errorf("read after done returned %q, %v", buf[:n], err)
+	}
+	if _, err := a.WriteAt([]byte("ticket"), 0); err == nil || err.Error() != "no key for dom=example.com" {
+		t.Errorf("write answered with badkey returned %v", err)
+	}
+	if _, err := a.ReadAt(buf, 0); err != ErrMalformedRpc {
+		t.Errorf("read answered with %q returned %v", "okay", err)
+	}
+	checkRequests(t, rpc, "read", "write p9sk1 example.com", "read", "write ticket", "read")
+}
+
+func TestAuth(t *testing.T) {
+	for _, reply := range []string{"done", "ok more", "phase wrong phase"} {
+		rpc := &fakeRPC{replies: []string{reply}}
+		auth, _ := StartRPC("p9any", rpc.open)
+		ctx := context.WithValue(context.Background(), "Auth", &AuthRpc{rpc})
+		err := auth(&styx.Channel{Context: ctx}, "glenda", "")
+		if reply == "done" && err != nil {
+			t.Errorf("%q: %v", reply, err)
+		}
+		if reply != "done" && err == nil {
+			t.Errorf("%q: authentication succeeded", reply)
+		}
+	}
+	auth, _ := StartRPC("p9any", nil)
+	if err := auth(&styx.Channel{Context: context.Background()}, "glenda", ""); err == nil {
+		t.Error("authentication succeeded without an auth file")
+	}
+}
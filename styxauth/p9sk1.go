@@ -0,0 +1,256 @@
+package styxauth
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"aqwari.net/net/styx"
+)
+
+// Plan 9 clients, such as drawterm, authenticate with the p9sk1
+// protocol, negotiated through the p9any protocol; see authsrv(6) and
+// factotum(4) in the Plan 9 manual. The client obtains a ticket from
+// the authentication server of its domain, encrypted with the key of
+// the server it is authenticating to. The server only needs its own
+// key to check the ticket, and does not contact the authentication
+// server itself.
+//
+// The dp9ik protocol of 9front, which replaces the weak DES keys of
+// p9sk1, is not supported.
+
+// Sizes of the fields in p9sk1 messages.
+const (
+	p9ANameLen   = 28
+	p9DomLen     = 48
+	p9ChalLen    = 8
+	p9DESKeyLen  = 7
+	p9TicketLen  = 1 + p9ChalLen + 2*p9ANameLen + p9DESKeyLen
+	p9AuthentLen = 1 + p9ChalLen + 4
+	p9TreqLen    = 1 + 3*p9ANameLen + p9DomLen + p9ChalLen
+)
+
+// Message types in p9sk1 messages.
+const (
+	p9AuthTreq = 1
+	p9AuthTs   = 64 // ticket encrypted with the server's key
+	p9AuthAs   = 66 // authenticator from the server
+	p9AuthAc   = 67 // authenticator from the client
+)
+
+var (
+	errP9Proto  = errors.New("p9any: client chose an unsupported protocol")
+	errP9Ticket = errors.New("p9sk1: invalid ticket")
+	errP9Auth   = errors.New("p9sk1: invalid authenticator")
+)
+
+// A Plan9Key is the key of a 9P server in a Plan 9 authentication
+// domain, shared with the domain's authentication server.
+type Plan9Key struct {
+	// ID is the user id of the server, known to the
+	// authentication server as its authid.
+	ID string
+
+	// Domain is the authentication domain.
+	Domain string
+
+	// Key is the DES key of ID, which can be derived from its
+	// password with PassToKey.
+	Key [p9DESKeyLen]byte
+}
+
+// PassToKey derives a DES key from a password, as the passtokey
+// function of Plan 9 does.
+func PassToKey(password string) [p9DESKeyLen]byte {
+	var key [p9DESKeyLen]byte
+	var buf [p9ANameLen]byte
+
+	n := len(password)
+	if n >= p9ANameLen {
+		n = p9ANameLen - 1
+	}
+	copy(buf[:], "        ")
+	copy(buf[:], password[:n])
+	buf[n] = 0
+
+	t := buf[:]
+	for {
+		for i := 0; i < p9DESKeyLen; i++ {
+			key[i] = t[i]>>uint(i) + t[i+1]<<uint(8-(i+1))
+		}
+		if n <= 8 {
+			return key
+		}
+		n -= 8
+		t = t[8:]
+		if n < 8 {
+			t = buf[len(buf)-len(t)-(8-n):]
+			n = 8
+		}
+		p9Encrypt(key, t[:8])
+	}
+}
+
+// P9SK1 authenticates Plan 9 clients with the p9sk1 protocol,
+// negotiated through p9any, using the server key in key. The user
+// named in the client's ticket must be the one in its attach
+// request.
+func P9SK1(key Plan9Key) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		if err := p9any(rwc, key.Domain); err != nil {
+			return err
+		}
+
+		cchal := make([]byte, p9ChalLen)
+		if _, err := io.ReadFull(rwc, cchal); err != nil {
+			return err
+		}
+		treq := make([]byte, p9TreqLen)
+		treq[0] = p9AuthTreq
+		putP9String(treq[1:1+p9ANameLen], key.ID)
+		putP9String(treq[1+p9ANameLen:1+p9ANameLen+p9DomLen], key.Domain)
+		schal := treq[1+p9ANameLen+p9DomLen : 1+p9ANameLen+p9DomLen+p9ChalLen]
+		if _, err := rand.Read(schal); err != nil {
+			return err
+		}
+		if _, err := rwc.Write(treq); err != nil {
+			return err
+		}
+
+		buf := make([]byte, p9TicketLen+p9AuthentLen)
+		if _, err := io.ReadFull(rwc, buf); err != nil {
+			return err
+		}
+		ticket, auth := buf[:p9TicketLen], buf[p9TicketLen:]
+		p9Decrypt(key.Key, ticket)
+		if ticket[0] != p9AuthTs || !bytes.Equal(ticket[1:1+p9ChalLen], schal) {
+			return errP9Ticket
+		}
+		suid := p9String(ticket[1+p9ChalLen+p9ANameLen : 1+p9ChalLen+2*p9ANameLen])
+		var tkey [p9DESKeyLen]byte
+		copy(tkey[:], ticket[1+p9ChalLen+2*p9ANameLen:])
+
+		p9Decrypt(tkey, auth)
+		if auth[0] != p9AuthAc || !bytes.Equal(auth[1:1+p9ChalLen], schal) {
+			return errP9Auth
+		}
+
+		// Prove to the client that the server could read
+		// the ticket.
+		reply := make([]byte, p9AuthentLen)
+		reply[0] = p9AuthAs
+		copy(reply[1:], cchal)
+		p9Encrypt(tkey, reply)
+		if _, err := rwc.Write(reply); err != nil {
+			return err
+		}
+		if suid != user {
+			return fmt.Errorf("ticket for %q cannot attach as %q", suid, user)
+		}
+		return nil
+	}
+}
+
+// p9any offers p9sk1 to the client, and waits for it to accept.
+func p9any(rwc io.ReadWriter, dom string) error {
+	if _, err := io.WriteString(rwc, "v.2 p9sk1@"+dom+"\x00"); err != nil {
+		return err
+	}
+	choice, err := readP9String(rwc, p9ANameLen+p9DomLen)
+	if err != nil {
+		return err
+	}
+	if f := strings.Fields(choice); len(f) != 2 || f[0] != "p9sk1" || f[1] != dom {
+		return errP9Proto
+	}
+	_, err = io.WriteString(rwc, "OK\x00")
+	return err
+}
+
+// readP9String reads a NUL-terminated string of at most max bytes,
+// one byte at a time, so as not to read past its end.
+func readP9String(r io.Reader, max int) (string, error) {
+	var buf []byte
+	c := make([]byte, 1)
+	for len(buf) < max {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, c[0])
+	}
+	return "", errP9Proto
+}
+
+// p9String returns the NUL-padded string in a fixed-size field.
+func p9String(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+func putP9String(field []byte, s string) {
+	copy(field[:len(field)-1], s)
+}
+
+// p9Encrypt and p9Decrypt implement the encrypt and decrypt functions
+// of Plan 9, which encrypt buffers that are not a multiple of the DES
+// block size by overlapping the last block with the one before it.
+func p9Encrypt(key [p9DESKeyLen]byte, buf []byte) {
+	block := p9Cipher(key)
+	n := len(buf) - 1
+	r, n := n%7, n/7
+	for i := 0; i < n; i++ {
+		block.Encrypt(buf[i*7:], buf[i*7:])
+	}
+	if r > 0 {
+		i := n*7 - 7 + r
+		block.Encrypt(buf[i:], buf[i:])
+	}
+}
+
+func p9Decrypt(key [p9DESKeyLen]byte, buf []byte) {
+	block := p9Cipher(key)
+	n := len(buf) - 1
+	r, n := n%7, n/7
+	if r > 0 {
+		i := n*7 - 7 + r
+		block.Decrypt(buf[i:], buf[i:])
+	}
+	for i := n - 1; i >= 0; i-- {
+		block.Decrypt(buf[i*7:], buf[i*7:])
+	}
+}
+
+// p9Cipher expands a 56-bit key to the 64 bits used by DES, leaving
+// the parity bits clear.
+func p9Cipher(k [p9DESKeyLen]byte) interface {
+	Encrypt(dst, src []byte)
+	Decrypt(dst, src []byte)
+} {
+	hi := binary.BigEndian.Uint32(k[:4])
+	lo := uint32(k[4])<<24 | uint32(k[5])<<16 | uint32(k[6])<<8
+	key := []byte{
+		byte(hi >> 24),
+		byte(hi >> 17),
+		byte(hi >> 10),
+		byte(hi >> 3),
+		byte(hi<<4 | lo>>28),
+		byte(lo >> 21),
+		byte(lo >> 14),
+		byte(lo >> 7),
+	}
+	block, err := des.NewCipher(key)
+	if err != nil {
+		panic(err) // the key is always the right size
+	}
+	return block
+}
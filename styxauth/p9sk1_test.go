@@ -0,0 +1,166 @@
+package styxauth
+
+import (
+	"bytes"
+	"crypto/des"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// The DES key 133457799BBCDFF1 without its parity bits.
+var testDESKey = [p9DESKeyLen]byte{0x12, 0x69, 0x5b, 0xc9, 0xb7, 0xb7, 0xf8}
+
+func TestP9Encrypt(t *testing.T) {
+	// The well-known DES test vector; a buffer of one block is
+	// encrypted as is.
+	buf, _ := hex.DecodeString("0123456789abcdef")
+	p9Encrypt(testDESKey, buf)
+	if got := hex.EncodeToString(buf); got != "85e813540f0ab405" {
+		t.Errorf("encrypted block is %s, want 85e813540f0ab405", got)
+	}
+	p9Decrypt(testDESKey, buf)
+	if got := hex.EncodeToString(buf); got != "0123456789abcdef" {
+		t.Errorf("decrypted block is %s, want 0123456789abcdef", got)
+	}
+
+	// Longer buffers are encrypted in blocks overlapping by one
+	// byte, with the last block overlapping the one before it.
+	key, _ := hex.DecodeString("133457799bbcdff1")
+	block, err := des.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := []byte("\x43challenge\x01\x02\x03")
+	want := append([]byte(nil), auth...)
+	block.Encrypt(want[0:], want[0:])
+	block.Encrypt(want[5:], want[5:])
+	p9Encrypt(testDESKey, auth)
+	if !bytes.Equal(auth, want) {
+		t.Errorf("encrypted authenticator is %x, want %x", auth, want)
+	}
+	p9Decrypt(testDESKey, auth)
+	if string(auth) != "\x43challenge\x01\x02\x03" {
+		t.Errorf("decrypted authenticator is %q", auth)
+	}
+}
+
+// A p9Client plays the client side of p9any and p9sk1, with a
+// ticket it makes up instead of one from an authentication server.
+type p9Client struct {
+	conn      net.Conn
+	serverKey [p9DESKeyLen]byte // key the ticket is encrypted with
+	ticketKey [p9DESKeyLen]byte // session key in the ticket
+	authKey   [p9DESKeyLen]byte // key the authenticator is encrypted with
+	suid      string            // user the ticket is for
+	cchal     []byte
+}
+
+// start negotiates p9sk1 and exchanges challenges, returning the
+// server's challenge.
+func (c *p9Client) start(t *testing.T) []byte {
+	t.Helper()
+	offer, err := readP9String(c.conn, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer != "v.2 p9sk1@testdom" {
+		t.Fatalf("server offered %q", offer)
+	}
+	io.WriteString(c.conn, "p9sk1 testdom\x00")
+	if ok, err := readP9String(c.conn, 3); err != nil || ok != "OK" {
+		t.Fatalf("server replied %q, %v", ok, err)
+	}
+	c.cchal = []byte("cchallng")
+	c.conn.Write(c.cchal)
+	treq := make([]byte, p9TreqLen)
+	if _, err := io.ReadFull(c.conn, treq); err != nil {
+		t.Fatal(err)
+	}
+	if treq[0] != p9AuthTreq || p9String(treq[1:1+p9ANameLen]) != "fs" {
+		t.Fatalf("bad ticket request %q", treq)
+	}
+	return treq[1+p9ANameLen+p9DomLen:]
+}
+
+// ticket returns a ticket and authenticator for schal.
+func (c *p9Client) ticket(schal []byte) []byte {
+	buf := make([]byte, p9TicketLen+p9AuthentLen)
+	ticket, auth := buf[:p9TicketLen], buf[p9TicketLen:]
+	ticket[0] = p9AuthTs
+	copy(ticket[1:], schal)
+	putP9String(ticket[1+p9ChalLen:1+p9ChalLen+p9ANameLen], c.suid)
+	putP9String(ticket[1+p9ChalLen+p9ANameLen:1+p9ChalLen+2*p9ANameLen], c.suid)
+	copy(ticket[1+p9ChalLen+2*p9ANameLen:], c.ticketKey[:])
+	p9Encrypt(c.serverKey, ticket)
+	auth[0] = p9AuthAc
+	copy(auth[1:], schal)
+	p9Encrypt(c.authKey, auth)
+	return buf
+}
+
+// verify checks the authenticator the server sends back.
+func (c *p9Client) verify(t *testing.T) {
+	t.Helper()
+	reply := make([]byte, p9AuthentLen)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	p9Decrypt(c.ticketKey, reply)
+	if reply[0] != p9AuthAs || !bytes.Equal(reply[1:1+p9ChalLen], c.cchal) {
+		t.Errorf("server sent bad authenticator %x", reply)
+	}
+}
+
+func TestP9SK1(t *testing.T) {
+	serverKey := Plan9Key{ID: "fs", Domain: "testdom", Key: testDESKey}
+	ticketKey := PassToKey("session")
+	good := p9Client{serverKey: testDESKey, ticketKey: ticketKey, authKey: ticketKey, suid: "glenda"}
+
+	conn, result := runAuth(t, P9SK1(serverKey), "glenda")
+	c := good
+	c.conn = conn
+	sent := c.ticket(c.start(t))
+	conn.Write(sent)
+	c.verify(t)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's challenge is new each time, so a recorded
+	// ticket and authenticator cannot be replayed.
+	conn, result = runAuth(t, P9SK1(serverKey), "glenda")
+	c.conn = conn
+	c.start(t)
+	conn.Write(sent)
+	if err := <-result; err != errP9Ticket {
+		t.Errorf("replayed ticket: got %v, want %v", err, errP9Ticket)
+	}
+
+	tests := []struct {
+		name   string
+		client p9Client
+		user   string
+		want   error
+	}{
+		{"bad server key", p9Client{serverKey: PassToKey("wrong"), ticketKey: ticketKey, authKey: ticketKey, suid: "glenda"}, "glenda", errP9Ticket},
+		{"bad authenticator key", p9Client{serverKey: testDESKey, ticketKey: ticketKey, authKey: PassToKey("wrong"), suid: "glenda"}, "glenda", errP9Auth},
+		{"wrong user", good, "bootes", nil},
+	}
+	for _, tt := range tests {
+		conn, result := runAuth(t, P9SK1(serverKey), tt.user)
+		c := tt.client
+		c.conn = conn
+		conn.Write(c.ticket(c.start(t)))
+		if tt.want == nil {
+			// The ticket is valid, but for another user.
+			c.verify(t)
+			if err := <-result; err == nil {
+				t.Errorf("%s: ticket for glenda attached as %s", tt.name, tt.user)
+			}
+		} else if err := <-result; err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
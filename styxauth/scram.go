@@ -0,0 +1,346 @@
+package styxauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"aqwari.net/net/styx"
+)
+
+// SCRAM-SHA-256, described in RFC 5802 and RFC 7677, lets a client
+// prove that it knows a password without sending it, and lets the
+// client check that the server knows the password, too. The server
+// does not need to store the password itself.
+//
+// Each message of the exchange is sent over the auth file like a
+// string in a 9P message: a two-byte, little-endian length, followed
+// by the message. Channel binding is not supported, and user names
+// are not normalized with SASLprep.
+
+var (
+	errSCRAMFormat    = errors.New("malformed SCRAM message")
+	errSCRAMBinding   = errors.New("SCRAM channel binding not supported")
+	errSCRAMUser      = errors.New("SCRAM user does not match attach request")
+	errSCRAMNonce     = errors.New("SCRAM nonce mismatch")
+	errSCRAMServerSig = errors.New("server failed to prove knowledge of password")
+)
+
+// DefaultSCRAMIterations is the number of iterations used by
+// NewSCRAMCredentials to derive keys from a password.
+const DefaultSCRAMIterations = 4096
+
+// The longest SCRAM message that is accepted.
+const maxSCRAMMsg = 1024
+
+// SCRAMCredentials hold what a server needs to know to verify that
+// a client knows its password, without storing the password.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the credentials for password, with
+// a random salt and DefaultSCRAMIterations iterations.
+func NewSCRAMCredentials(password string) (*SCRAMCredentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salted := scramSaltedPassword(password, salt, DefaultSCRAMIterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: DefaultSCRAMIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+// A SCRAMStore looks up the credentials of users authenticating
+// with SCRAM. Lookup must return a non-nil error if the user is
+// not known.
+type SCRAMStore interface {
+	Lookup(user string) (*SCRAMCredentials, error)
+}
+
+// SCRAMUsers is a SCRAMStore holding credentials in memory, indexed
+// by user name. It should not be modified during authentication.
+type SCRAMUsers map[string]*SCRAMCredentials
+
+// Lookup returns the credentials of user.
+func (m SCRAMUsers) Lookup(user string) (*SCRAMCredentials, error) {
+	if creds, ok := m[user]; ok {
+		return creds, nil
+	}
+	return nil, fmt.Errorf("unknown user %q", user)
+}
+
+// SCRAM authenticates users with SCRAM-SHA-256, using the
+// credentials in store. The user name sent by the client in the
+// exchange must match the one in its attach request.
+func SCRAM(store SCRAMStore) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		clientFirst, err := readSCRAM(rwc)
+		if err != nil {
+			return err
+		}
+		var bare string
+		switch {
+		case strings.HasPrefix(clientFirst, "n,,"), strings.HasPrefix(clientFirst, "y,,"):
+			bare = clientFirst[3:]
+		case strings.HasPrefix(clientFirst, "p="):
+			writeSCRAM(rwc, "e=channel-bindings-not-supported")
+			return errSCRAMBinding
+		default:
+			writeSCRAM(rwc, "e=other-error")
+			return errSCRAMFormat
+		}
+		gs2header := clientFirst[:3]
+		attr := scramAttrs(bare)
+		if attr['r'] == "" {
+			writeSCRAM(rwc, "e=other-error")
+			return errSCRAMFormat
+		}
+		if scramUnescape(attr['n']) != user {
+			writeSCRAM(rwc, "e=other-error")
+			return errSCRAMUser
+		}
+		creds, err := store.Lookup(user)
+		if err != nil {
+			// Carry on with made-up credentials, so that the
+			// exchange fails at the proof, as it does for a
+			// wrong password, and clients cannot learn which
+			// users exist.
+			creds = scramDecoy(user)
+		}
+
+		nonce, err := scramNonce()
+		if err != nil {
+			return err
+		}
+		nonce = attr['r'] + nonce
+		serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce,
+			base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+		if err := writeSCRAM(rwc, serverFirst); err != nil {
+			return err
+		}
+
+		clientFinal, err := readSCRAM(rwc)
+		if err != nil {
+			return err
+		}
+		i := strings.LastIndex(clientFinal, ",p=")
+		if i < 0 {
+			writeSCRAM(rwc, "e=other-error")
+			return errSCRAMFormat
+		}
+		attr = scramAttrs(clientFinal)
+		if attr['c'] != base64.StdEncoding.EncodeToString([]byte(gs2header)) {
+			writeSCRAM(rwc, "e=channel-bindings-dont-match")
+			return errAuthFailure
+		}
+		if attr['r'] != nonce {
+			writeSCRAM(rwc, "e=other-error")
+			return errSCRAMNonce
+		}
+		proof, err := base64.StdEncoding.DecodeString(attr['p'])
+		if err != nil || len(proof) != sha256.Size {
+			writeSCRAM(rwc, "e=invalid-proof")
+			return errAuthFailure
+		}
+
+		authMessage := bare + "," + serverFirst + "," + clientFinal[:i]
+		clientKey := scramHMAC(creds.StoredKey, authMessage)
+		for i := range clientKey {
+			clientKey[i] ^= proof[i]
+		}
+		storedKey := sha256.Sum256(clientKey)
+		if !hmac.Equal(storedKey[:], creds.StoredKey) {
+			writeSCRAM(rwc, "e=invalid-proof")
+			return errAuthFailure
+		}
+		serverSig := scramHMAC(creds.ServerKey, authMessage)
+		return writeSCRAM(rwc, "v="+base64.StdEncoding.EncodeToString(serverSig))
+	}
+}
+
+// SCRAMClient returns a styx.AuthFunc that authenticates a client
+// to a server using SCRAM, with password. It is meant to be used
+// as the Auth field of a styx.Client. Authentication fails if the
+// server cannot prove that it knows the password.
+func SCRAMClient(password string) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		cnonce, err := scramNonce()
+		if err != nil {
+			return err
+		}
+		gs2header := "n,,"
+		bare := "n=" + scramEscape(user) + ",r=" + cnonce
+		if err := writeSCRAM(rwc, gs2header+bare); err != nil {
+			return err
+		}
+
+		serverFirst, err := readSCRAM(rwc)
+		if err != nil {
+			return err
+		}
+		attr := scramAttrs(serverFirst)
+		if e, ok := attr['e']; ok {
+			return fmt.Errorf("SCRAM: %s", e)
+		}
+		if !strings.HasPrefix(attr['r'], cnonce) || len(attr['r']) == len(cnonce) {
+			return errSCRAMNonce
+		}
+		salt, err := base64.StdEncoding.DecodeString(attr['s'])
+		if err != nil {
+			return errSCRAMFormat
+		}
+		iter, err := strconv.Atoi(attr['i'])
+		if err != nil || iter < 1 {
+			return errSCRAMFormat
+		}
+
+		salted := scramSaltedPassword(password, salt, iter)
+		clientKey := scramHMAC(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2header)) + ",r=" + attr['r']
+		authMessage := bare + "," + serverFirst + "," + withoutProof
+		proof := scramHMAC(storedKey[:], authMessage)
+		for i := range proof {
+			proof[i] ^= clientKey[i]
+		}
+		clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+		if err := writeSCRAM(rwc, clientFinal); err != nil {
+			return err
+		}
+
+		serverFinal, err := readSCRAM(rwc)
+		if err != nil {
+			return err
+		}
+		attr = scramAttrs(serverFinal)
+		if e, ok := attr['e']; ok {
+			return fmt.Errorf("SCRAM: %s", e)
+		}
+		serverSig, err := base64.StdEncoding.DecodeString(attr['v'])
+		if err != nil {
+			return errSCRAMFormat
+		}
+		if !hmac.Equal(serverSig, scramHMAC(scramHMAC(salted, "Server Key"), authMessage)) {
+			return errSCRAMServerSig
+		}
+		return nil
+	}
+}
+
+func readSCRAM(r io.Reader) (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	n := binary.LittleEndian.Uint16(size[:])
+	if n > maxSCRAMMsg {
+		return "", errSCRAMFormat
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func writeSCRAM(w io.Writer, msg string) error {
+	buf := make([]byte, 2+len(msg))
+	binary.LittleEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// scramAttrs parses the comma-separated attributes of a SCRAM
+// message, such as "r=abc,s=def". The values of later attributes
+// replace earlier ones with the same name.
+func scramAttrs(msg string) map[byte]string {
+	attr := make(map[byte]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attr[field[0]] = field[2:]
+		}
+	}
+	return attr
+}
+
+// scramNonce generates the random part of a nonce. It is a variable
+// so that tests can reproduce known exchanges.
+var scramNonce = func() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+var (
+	scramDecoyOnce sync.Once
+	scramDecoyKey  [32]byte
+)
+
+// scramDecoy returns credentials for an unknown user, that no proof
+// will match. The salt is derived from the user name with a key that
+// is chosen once per process, so that it is the same each time the
+// user is looked up, as it would be for a real user.
+func scramDecoy(user string) *SCRAMCredentials {
+	scramDecoyOnce.Do(func() {
+		rand.Read(scramDecoyKey[:])
+	})
+	return &SCRAMCredentials{
+		Salt:       scramHMAC(scramDecoyKey[:], user)[:16],
+		Iterations: DefaultSCRAMIterations,
+	}
+}
+
+// User names may not contain the separators of SCRAM messages.
+var (
+	scramEscaper   = strings.NewReplacer("=", "=3D", ",", "=2C")
+	scramUnescaper = strings.NewReplacer("=3D", "=", "=2C", ",")
+)
+
+func scramEscape(name string) string   { return scramEscaper.Replace(name) }
+func scramUnescape(name string) string { return scramUnescaper.Replace(name) }
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, msg)
+	return mac.Sum(nil)
+}
+
+// scramSaltedPassword is the Hi function of RFC 5802; PBKDF2 with
+// HMAC-SHA-256, producing a single block.
+func scramSaltedPassword(password string, salt []byte, iter int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
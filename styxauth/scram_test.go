@@ -0,0 +1,205 @@
+package styxauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+// The SCRAM-SHA-256 exchange from section 3 of RFC 7677.
+const (
+	rfcUser        = "user"
+	rfcPassword    = "pencil"
+	rfcSalt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfcClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfcServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfcClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfcClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+// runAuth runs fn on one end of a pipe, as user attaching to the
+// "" tree. It returns the other end of the pipe, and a channel that
+// receives the result of fn.
+func runAuth(t *testing.T, fn styx.AuthFunc, user string) (net.Conn, <-chan error) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(&styx.Channel{Context: context.Background(), ReadWriteCloser: remote}, user, "")
+	}()
+	return local, result
+}
+
+func withSCRAMNonce(t *testing.T, nonce string) {
+	old := scramNonce
+	scramNonce = func() (string, error) { return nonce, nil }
+	t.Cleanup(func() { scramNonce = old })
+}
+
+func scramExpect(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	msg, err := readSCRAM(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != want {
+		t.Fatalf("got SCRAM message %q, want %q", msg, want)
+	}
+}
+
+func scramSend(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if err := writeSCRAM(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rfcStore(t *testing.T) SCRAMUsers {
+	salt, err := base64.StdEncoding.DecodeString(rfcSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salted := scramSaltedPassword(rfcPassword, salt, 4096)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return SCRAMUsers{
+		rfcUser: {
+			Salt:       salt,
+			Iterations: 4096,
+			StoredKey:  storedKey[:],
+			ServerKey:  scramHMAC(salted, "Server Key"),
+		},
+	}
+}
+
+func TestSCRAMServerVector(t *testing.T) {
+	withSCRAMNonce(t, rfcServerNonce)
+	conn, result := runAuth(t, SCRAM(rfcStore(t)), rfcUser)
+	scramSend(t, conn, rfcClientFirst)
+	scramExpect(t, conn, rfcServerFirst)
+	scramSend(t, conn, rfcClientFinal)
+	scramExpect(t, conn, rfcServerFinal)
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSCRAMClientVector(t *testing.T) {
+	withSCRAMNonce(t, rfcClientNonce)
+	conn, result := runAuth(t, SCRAMClient(rfcPassword), rfcUser)
+	scramExpect(t, conn, rfcClientFirst)
+	scramSend(t, conn, rfcServerFirst)
+	scramExpect(t, conn, rfcClientFinal)
+	scramSend(t, conn, rfcServerFinal)
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	creds, err := NewSCRAMCredentials("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := SCRAMUsers{"alice": creds}
+	for _, password := range []string{"secret", "guess"} {
+		local, remote := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- SCRAM(store)(&styx.Channel{Context: context.Background(), ReadWriteCloser: remote}, "alice", "")
+		}()
+		clientErr := SCRAMClient(password)(&styx.Channel{Context: context.Background(), ReadWriteCloser: local}, "alice", "")
+		err := <-serverErr
+		local.Close()
+		remote.Close()
+		if password == "secret" && (err != nil || clientErr != nil) {
+			t.Errorf("right password: server returned %v, client returned %v", err, clientErr)
+		}
+		if password != "secret" && (err == nil || clientErr == nil) {
+			t.Errorf("wrong password: server returned %v, client returned %v", err, clientErr)
+		}
+	}
+}
+
+func TestSCRAMBadProof(t *testing.T) {
+	withSCRAMNonce(t, rfcServerNonce)
+	conn, result := runAuth(t, SCRAM(rfcStore(t)), rfcUser)
+	scramSend(t, conn, rfcClientFirst)
+	scramExpect(t, conn, rfcServerFirst)
+	scramSend(t, conn, strings.Replace(rfcClientFinal, "p=dHzb", "p=eHzb", 1))
+	scramExpect(t, conn, "e=invalid-proof")
+	if err := <-result; err != errAuthFailure {
+		t.Errorf("got %v, want %v", err, errAuthFailure)
+	}
+}
+
+func TestSCRAMWrongNonce(t *testing.T) {
+	withSCRAMNonce(t, rfcServerNonce)
+	conn, result := runAuth(t, SCRAM(rfcStore(t)), rfcUser)
+	scramSend(t, conn, rfcClientFirst)
+	scramExpect(t, conn, rfcServerFirst)
+	scramSend(t, conn, strings.Replace(rfcClientFinal, rfcServerNonce, "forged", 1))
+	scramExpect(t, conn, "e=other-error")
+	if err := <-result; err != errSCRAMNonce {
+		t.Errorf("server got %v, want %v", err, errSCRAMNonce)
+	}
+
+	// The server's nonce must extend the client's.
+	withSCRAMNonce(t, rfcClientNonce)
+	conn, result = runAuth(t, SCRAMClient(rfcPassword), rfcUser)
+	scramExpect(t, conn, rfcClientFirst)
+	scramSend(t, conn, strings.Replace(rfcServerFirst, "r=rOpr", "r=xOpr", 1))
+	if err := <-result; err != errSCRAMNonce {
+		t.Errorf("client got %v, want %v", err, errSCRAMNonce)
+	}
+}
+
+func TestSCRAMBadServerSignature(t *testing.T) {
+	withSCRAMNonce(t, rfcClientNonce)
+	conn, result := runAuth(t, SCRAMClient(rfcPassword), rfcUser)
+	scramExpect(t, conn, rfcClientFirst)
+	scramSend(t, conn, rfcServerFirst)
+	scramExpect(t, conn, rfcClientFinal)
+	scramSend(t, conn, strings.Replace(rfcServerFinal, "v=6rri", "v=7rri", 1))
+	if err := <-result; err != errSCRAMServerSig {
+		t.Errorf("got %v, want %v", err, errSCRAMServerSig)
+	}
+}
+
+func TestSCRAMUnknownUser(t *testing.T) {
+	withSCRAMNonce(t, rfcServerNonce)
+	clientFirst := strings.Replace(rfcClientFirst, "n=user", "n=mallory", 1)
+	var salts []string
+	for i := 0; i < 2; i++ {
+		conn, result := runAuth(t, SCRAM(rfcStore(t)), "mallory")
+		scramSend(t, conn, clientFirst)
+		msg, err := readSCRAM(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attr := scramAttrs(msg)
+		if _, ok := attr['e']; ok || attr['i'] != "4096" || attr['s'] == "" {
+			t.Fatalf("server answered unknown user with %q", msg)
+		}
+		salts = append(salts, attr['s'])
+		scramSend(t, conn, rfcClientFinal)
+		scramExpect(t, conn, "e=invalid-proof")
+		if err := <-result; err != errAuthFailure {
+			t.Errorf("got %v, want %v", err, errAuthFailure)
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Errorf("unknown user was given salts %q and %q", salts[0], salts[1])
+	}
+}
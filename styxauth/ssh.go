@@ -0,0 +1,404 @@
+package styxauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"aqwari.net/net/styx"
+)
+
+// A client authenticates with an SSH key by signing a random
+// challenge from the server:
+//
+//	server: 32-byte challenge
+//	client: public key, signature
+//
+// The public key and signature are in the format used by the SSH
+// protocol, and are each sent as a four-byte, big-endian length
+// followed by their contents. The signed data binds the challenge to
+// the user and file tree of the attach request; see sshSignedData.
+// Ed25519 and RSA keys are supported, with RSA signatures using
+// SHA-256 or SHA-512.
+
+var (
+	errSSHKeyType = errors.New("unsupported SSH key type")
+	errSSHFormat  = errors.New("malformed SSH key or signature")
+	errSSHSig     = errors.New("invalid SSH signature")
+	errSSHKey     = errors.New("SSH key not authorized")
+	errSSHAgent   = errors.New("SSH agent failure")
+	errSSHNoKeys  = errors.New("SSH agent holds no supported keys")
+)
+
+const (
+	sshChallengeLen = 32
+	maxSSHBlob      = 8192
+
+	// SSH agent protocol; see draft-miller-ssh-agent.
+	sshAgentFailure          = 5
+	sshAgentRequestIDs       = 11
+	sshAgentIDsAnswer        = 12
+	sshAgentSignRequest      = 13
+	sshAgentSignResponse     = 14
+	sshAgentRSASHA256        = 2
+	maxSSHAgentResponseBytes = 256 << 10
+)
+
+// An SSHKeyFunc reports whether the SSH public key, in the wire
+// format of the SSH protocol, may be used to authenticate user.
+type SSHKeyFunc func(user string, key []byte) bool
+
+// AuthorizedKeys returns an SSHKeyFunc that allows each user the
+// keys in the contents of an OpenSSH authorized_keys file, indexed
+// by user name. Options preceding a key are ignored.
+func AuthorizedKeys(files map[string][]byte) (SSHKeyFunc, error) {
+	keys := make(map[string][][]byte, len(files))
+	for user, data := range files {
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for s.Scan() {
+			key, err := parseAuthorizedKey(s.Text())
+			if err != nil {
+				return nil, fmt.Errorf("authorized keys of %s: %v", user, err)
+			}
+			if key != nil {
+				keys[user] = append(keys[user], key)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return func(user string, key []byte) bool {
+		for _, k := range keys[user] {
+			if bytes.Equal(k, key) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// parseAuthorizedKey returns the key on a line of an authorized_keys
+// file, or nil for blank lines and comments.
+func parseAuthorizedKey(line string) ([]byte, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil, nil
+	}
+	// The key type is followed by the base64-encoded key, and
+	// may be preceded by options.
+	for i := 0; i+1 < len(fields); i++ {
+		key, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			continue
+		}
+		if typ, _, ok := sshString(key); ok && string(typ) == fields[i] {
+			return key, nil
+		}
+	}
+	return nil, errSSHFormat
+}
+
+// SSHPublicKey authenticates clients by their SSH keys. The client
+// must sign a challenge with a key that allowed accepts for the user
+// it attaches as.
+func SSHPublicKey(allowed SSHKeyFunc) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		challenge := make([]byte, sshChallengeLen)
+		if _, err := rand.Read(challenge); err != nil {
+			return err
+		}
+		if _, err := rwc.Write(challenge); err != nil {
+			return err
+		}
+		key, err := readSSHBlob(rwc)
+		if err != nil {
+			return err
+		}
+		sig, err := readSSHBlob(rwc)
+		if err != nil {
+			return err
+		}
+		if !allowed(user, key) {
+			return errSSHKey
+		}
+		return verifySSH(key, sig, sshSignedData(user, access, challenge))
+	}
+}
+
+// SSHSigner returns a styx.AuthFunc that authenticates a client to a
+// server using SSHPublicKey, signing challenges with key. The key
+// must be an ed25519.PrivateKey or an *rsa.PrivateKey.
+func SSHSigner(key crypto.Signer) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		pub, err := marshalSSHKey(key.Public())
+		if err != nil {
+			return err
+		}
+		return sshRespond(rwc, pub, func(data []byte) ([]byte, error) {
+			return signSSH(key, data)
+		}, user, access)
+	}
+}
+
+// SSHAgent returns a styx.AuthFunc that authenticates a client to a
+// server using SSHPublicKey, signing challenges with the first
+// Ed25519 or RSA key held by the SSH agent reached through agent,
+// usually a connection to the unix socket named by SSH_AUTH_SOCK.
+func SSHAgent(agent io.ReadWriter) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		pub, err := agentKey(agent)
+		if err != nil {
+			return err
+		}
+		return sshRespond(rwc, pub, func(data []byte) ([]byte, error) {
+			return agentSign(agent, pub, data)
+		}, user, access)
+	}
+}
+
+func sshRespond(rwc io.ReadWriter, pub []byte, sign func([]byte) ([]byte, error), user, access string) error {
+	challenge := make([]byte, sshChallengeLen)
+	if _, err := io.ReadFull(rwc, challenge); err != nil {
+		return err
+	}
+	sig, err := sign(sshSignedData(user, access, challenge))
+	if err != nil {
+		return err
+	}
+	_, err = rwc.Write(append(appendSSHString(nil, pub), appendSSHString(nil, sig)...))
+	return err
+}
+
+// sshSignedData is the data signed by the client. It is prefixed
+// with the name of the protocol, so that a signature cannot be used
+// for any other purpose, such as logging in with SSH.
+func sshSignedData(user, access string, challenge []byte) []byte {
+	var b []byte
+	b = appendSSHString(b, []byte("aqwari.net/net/styx/styxauth.SSHPublicKey"))
+	b = appendSSHString(b, []byte(user))
+	b = appendSSHString(b, []byte(access))
+	return appendSSHString(b, challenge)
+}
+
+func verifySSH(key, sig, data []byte) error {
+	typ, rest, ok := sshString(key)
+	if !ok {
+		return errSSHFormat
+	}
+	format, rest2, ok := sshString(sig)
+	if !ok {
+		return errSSHFormat
+	}
+	blob, _, ok := sshString(rest2)
+	if !ok {
+		return errSSHFormat
+	}
+	switch string(typ) {
+	case "ssh-ed25519":
+		pub, _, ok := sshString(rest)
+		if !ok || len(pub) != ed25519.PublicKeySize || string(format) != "ssh-ed25519" {
+			return errSSHFormat
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pub), data, blob) {
+			return errSSHSig
+		}
+		return nil
+	case "ssh-rsa":
+		e, rest, ok := sshString(rest)
+		if !ok {
+			return errSSHFormat
+		}
+		n, _, ok := sshString(rest)
+		if !ok {
+			return errSSHFormat
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return errSSHFormat
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+		var hash crypto.Hash
+		var sum []byte
+		switch string(format) {
+		case "rsa-sha2-256":
+			s := sha256.Sum256(data)
+			hash, sum = crypto.SHA256, s[:]
+		case "rsa-sha2-512":
+			s := sha512.Sum512(data)
+			hash, sum = crypto.SHA512, s[:]
+		default:
+			return errSSHKeyType
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, sum, blob) != nil {
+			return errSSHSig
+		}
+		return nil
+	}
+	return errSSHKeyType
+}
+
+func marshalSSHKey(pub crypto.PublicKey) ([]byte, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		b := appendSSHString(nil, []byte("ssh-ed25519"))
+		return appendSSHString(b, pub), nil
+	case *rsa.PublicKey:
+		b := appendSSHString(nil, []byte("ssh-rsa"))
+		b = appendSSHString(b, sshMpint(big.NewInt(int64(pub.E))))
+		return appendSSHString(b, sshMpint(pub.N)), nil
+	}
+	return nil, errSSHKeyType
+}
+
+func signSSH(key crypto.Signer, data []byte) ([]byte, error) {
+	var format string
+	var sig []byte
+	var err error
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		format = "ssh-ed25519"
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	case *rsa.PublicKey:
+		format = "rsa-sha2-256"
+		sum := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	default:
+		return nil, errSSHKeyType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appendSSHString(appendSSHString(nil, []byte(format)), sig), nil
+}
+
+// agentKey returns the first supported key held by an SSH agent.
+func agentKey(agent io.ReadWriter) ([]byte, error) {
+	resp, err := agentCall(agent, []byte{sshAgentRequestIDs})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != sshAgentIDsAnswer || len(resp) < 5 {
+		return nil, errSSHAgent
+	}
+	n := binary.BigEndian.Uint32(resp[1:])
+	rest := resp[5:]
+	for i := uint32(0); i < n; i++ {
+		var key []byte
+		var ok bool
+		if key, rest, ok = sshString(rest); !ok {
+			return nil, errSSHAgent
+		}
+		if _, rest, ok = sshString(rest); !ok { // comment
+			return nil, errSSHAgent
+		}
+		switch typ, _, _ := sshString(key); string(typ) {
+		case "ssh-ed25519", "ssh-rsa":
+			return key, nil
+		}
+	}
+	return nil, errSSHNoKeys
+}
+
+func agentSign(agent io.ReadWriter, key, data []byte) ([]byte, error) {
+	req := []byte{sshAgentSignRequest}
+	req = appendSSHString(req, key)
+	req = appendSSHString(req, data)
+	var flags uint32
+	if typ, _, _ := sshString(key); string(typ) == "ssh-rsa" {
+		flags = sshAgentRSASHA256
+	}
+	var fb [4]byte
+	binary.BigEndian.PutUint32(fb[:], flags)
+	req = append(req, fb[:]...)
+	resp, err := agentCall(agent, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != sshAgentSignResponse {
+		return nil, errSSHAgent
+	}
+	sig, _, ok := sshString(resp[1:])
+	if !ok {
+		return nil, errSSHAgent
+	}
+	return sig, nil
+}
+
+func agentCall(agent io.ReadWriter, req []byte) ([]byte, error) {
+	if _, err := agent.Write(appendSSHString(nil, req)); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(agent, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > maxSSHAgentResponseBytes {
+		return nil, errSSHAgent
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(agent, resp); err != nil {
+		return nil, err
+	}
+	if resp[0] == sshAgentFailure {
+		return nil, errSSHAgent
+	}
+	return resp, nil
+}
+
+func readSSHBlob(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxSSHBlob {
+		return nil, errSSHFormat
+	}
+	blob := make([]byte, n)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// sshString splits a string, as encoded in the SSH protocol, from
+// the front of b.
+func sshString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+func appendSSHString(b, s []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(s)))
+	return append(append(b, size[:]...), s...)
+}
+
+// sshMpint encodes a non-negative integer as an SSH mpint.
+func sshMpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package styxauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+func authorizedKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	pub, err := marshalSSHKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, _, _ := sshString(pub)
+	return string(typ) + " " + base64.StdEncoding.EncodeToString(pub) + " test key"
+}
+
+func TestSSHPublicKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unknown, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := AuthorizedKeys(map[string][]byte{
+		"alice": []byte("# alice's keys\n" +
+			authorizedKey(t, edKey) + "\n" +
+			`no-pty,from="10.0.0.0/8" ` + authorizedKey(t, rsaKey) + "\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		user string
+		want error
+	}{
+		{"ed25519", edKey, "alice", nil},
+		{"rsa", rsaKey, "alice", nil},
+		{"unknown key", unknown, "alice", errSSHKey},
+		{"other user", edKey, "bob", errSSHKey},
+	}
+	for _, tt := range tests {
+		conn, result := runAuth(t, SSHPublicKey(allowed), tt.user)
+		ch := &styx.Channel{Context: context.Background(), ReadWriteCloser: conn}
+		if err := SSHSigner(tt.key)(ch, tt.user, ""); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := <-result; err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSSHWrongChallenge(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := AuthorizedKeys(map[string][]byte{"alice": []byte(authorizedKey(t, key))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := marshalSSHKey(key.Public())
+
+	// The signature must cover the challenge sent by the server,
+	// and the user and tree of the attach request.
+	tests := []struct {
+		name   string
+		signed func(challenge []byte) []byte
+	}{
+		{"other challenge", func(c []byte) []byte {
+			return sshSignedData("alice", "", make([]byte, sshChallengeLen))
+		}},
+		{"other user", func(c []byte) []byte { return sshSignedData("bob", "", c) }},
+		{"other tree", func(c []byte) []byte { return sshSignedData("alice", "data", c) }},
+	}
+	for _, tt := range tests {
+		conn, result := runAuth(t, SSHPublicKey(allowed), "alice")
+		challenge := make([]byte, sshChallengeLen)
+		if _, err := io.ReadFull(conn, challenge); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signSSH(key, tt.signed(challenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(appendSSHString(nil, pub), appendSSHString(nil, sig)...))
+		if err := <-result; err != errSSHSig {
+			t.Errorf("%s: got %v, want %v", tt.name, err, errSSHSig)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package styxauth
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 
 	"aqwari.net/net/styx"
 )
 
 var (
-	errTLSConn = errors.New("not a TLS connection")
+	errTLSConn      = errors.New("not a TLS connection")
+	errNoClientCert = errors.New("no verified client certificate")
 )
 
 // TLSSubjectCN authenticates a client using the underyling tls
@@ -18,6 +20,16 @@ var (
 // TLSAuth type.
 var TLSSubjectCN = TLSAuth(checkSubjectCN)
 
+// TLSClientCert authenticates a client by the certificate it
+// presented during the TLS handshake, and is meant to be used as the
+// AttachAuth field of a styx.Server, so that clients need not make a
+// Tauth request. The certificate must have been verified by the
+// server, by setting the ClientAuth field of its tls.Config to
+// tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert. The
+// common name of the certificate's subject is the only user the
+// client may attach as.
+var TLSClientCert = TLSAuth(checkClientCert)
+
 // A TLSAuthFunc is called when validating an attach request based on
 // the underlying TLS connection.
 type TLSAuthFunc func(user, access string, state tls.ConnectionState) error
@@ -47,3 +59,13 @@ func checkSubjectCN(user, access string, state tls.ConnectionState) error {
 	}
 	return errAuthFailure
 }
+
+func checkClientCert(user, access string, state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return errNoClientCert
+	}
+	if cn := state.VerifiedChains[0][0].Subject.CommonName; cn != user {
+		return fmt.Errorf("certificate for %q cannot attach as %q", cn, user)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package styxauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"aqwari.net/net/styx"
+)
+
+// A bearer token is written to the auth file by the client as a
+// single line, terminated by a newline. Only JSON Web Tokens, signed
+// with HS256, RS256 or ES256, are understood.
+
+var (
+	errTokenFormat  = errors.New("malformed token")
+	errTokenTooLong = errors.New("token too long")
+	errTokenAlg     = errors.New("token signed with unsupported algorithm")
+	errTokenSig     = errors.New("invalid token signature")
+	errTokenExpired = errors.New("token expired")
+	errTokenEarly   = errors.New("token not valid yet")
+	errTokenAud     = errors.New("token not meant for this server")
+	errTokenIss     = errors.New("token from unknown issuer")
+)
+
+// The longest token that is accepted.
+const maxTokenLen = 8192
+
+// JWTConfig describes the JSON Web Tokens accepted by JWT.
+type JWTConfig struct {
+	// Key verifies the signatures of tokens. It must be a []byte
+	// for tokens signed with HS256, an *rsa.PublicKey for RS256,
+	// or an *ecdsa.PublicKey on the P-256 curve for ES256. Tokens
+	// signed with any other algorithm are rejected.
+	Key interface{}
+
+	// If Audience is not empty, it must be one of the audiences
+	// in the "aud" claim of a token.
+	Audience string
+
+	// If Issuer is not empty, it must match the "iss" claim of
+	// a token.
+	Issuer string
+
+	// UserClaim is the claim naming the user a token was issued
+	// to. If empty, the "sub" claim is used.
+	UserClaim string
+
+	// Leeway is allowed for differences between clocks when
+	// checking the "exp" and "nbf" claims.
+	Leeway time.Duration
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// JWT authenticates clients that write a JSON Web Token to the auth
+// file. The token must be signed with the key in cfg, must not have
+// expired, and must name the user the client attaches as. Tokens
+// without an "exp" claim are rejected.
+func JWT(cfg JWTConfig) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		token, err := readToken(rwc)
+		if err != nil {
+			return err
+		}
+		claims, err := cfg.verify(token)
+		if err != nil {
+			return err
+		}
+		claim := cfg.UserClaim
+		if claim == "" {
+			claim = "sub"
+		}
+		if name, _ := claims[claim].(string); name != user {
+			return fmt.Errorf("token for %q cannot attach as %q", name, user)
+		}
+		return nil
+	}
+}
+
+// SendToken returns a styx.AuthFunc that writes token to the auth
+// file, for use as the Auth field of a styx.Client connecting to a
+// server using JWT.
+func SendToken(token string) styx.AuthFunc {
+	return func(rwc *styx.Channel, user, access string) error {
+		_, err := io.WriteString(rwc, token+"\n")
+		return err
+	}
+}
+
+// readToken reads a line from r, one byte at a time, so as not to
+// read past its end.
+func readToken(r io.Reader) (string, error) {
+	var buf []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == '\n' {
+			return strings.TrimSuffix(string(buf), "\r"), nil
+		}
+		if len(buf) == maxTokenLen {
+			return "", errTokenTooLong
+		}
+		buf = append(buf, c[0])
+	}
+}
+
+func (cfg *JWTConfig) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenFormat
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenFormat
+	}
+	if err := cfg.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if cfg.Now != nil {
+		now = cfg.Now()
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errTokenFormat
+	}
+	if now.Add(-cfg.Leeway).After(time.Unix(int64(exp), 0)) {
+		return nil, errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errTokenEarly
+	}
+	if cfg.Issuer != "" && claims["iss"] != cfg.Issuer {
+		return nil, errTokenIss
+	}
+	if cfg.Audience != "" && !hasAudience(claims["aud"], cfg.Audience) {
+		return nil, errTokenAud
+	}
+	return claims, nil
+}
+
+// The algorithm is checked against the type of the key, so that a
+// token cannot, for instance, be signed with HMAC using a public key.
+func (cfg *JWTConfig) verifySignature(alg, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch key := cfg.Key.(type) {
+	case []byte:
+		if alg != "HS256" {
+			return errTokenAlg
+		}
+		mac := hmac.New(sha256.New, key)
+		io.WriteString(mac, signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errTokenSig
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return errTokenAlg
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return errTokenSig
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || key.Params().BitSize != 256 {
+			return errTokenAlg
+		}
+		if len(sig) != 64 {
+			return errTokenSig
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, sum[:], r, s) {
+			return errTokenSig
+		}
+	default:
+		return errTokenAlg
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errTokenFormat
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errTokenFormat
+	}
+	return nil
+}
+
+// The "aud" claim may be a single string or an array of them.
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package styxauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+// signToken makes a JSON Web Token with the given claims, signed
+// with key using alg. Keys of the wrong type leave the token
+// unsigned.
+func signToken(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		io.WriteString(mac, signed)
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// tamper changes a character near the end of the signature of token.
+func tamper(token string) string {
+	b := []byte(token)
+	i := len(b) - 5
+	if b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+	return string(b)
+}
+
+func TestJWTVerify(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := testNow.Add(time.Hour).Unix()
+	valid := map[string]interface{}{"sub": "alice", "aud": "fs", "exp": exp}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "exp": exp}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		key   interface{} // key in the JWTConfig
+		token string
+		want  error
+	}{
+		{"HS256", secret, signToken(t, "HS256", secret, valid), nil},
+		{"RS256", &rsaKey.PublicKey, signToken(t, "RS256", rsaKey, valid), nil},
+		{"ES256", &ecKey.PublicKey, signToken(t, "ES256", ecKey, valid), nil},
+		{"audience list", secret, signToken(t, "HS256", secret, claims(map[string]interface{}{"aud": []string{"web", "fs"}})), nil},
+		{"expired", secret, signToken(t, "HS256", secret, claims(map[string]interface{}{"aud": "fs", "exp": testNow.Add(-time.Hour).Unix()})), errTokenExpired},
+		{"no expiry", secret, signToken(t, "HS256", secret, map[string]interface{}{"sub": "alice", "aud": "fs"}), errTokenFormat},
+		{"not before", secret, signToken(t, "HS256", secret, claims(map[string]interface{}{"aud": "fs", "nbf": testNow.Add(time.Hour).Unix()})), errTokenEarly},
+		{"wrong audience", secret, signToken(t, "HS256", secret, claims(map[string]interface{}{"aud": "web"})), errTokenAud},
+		{"no audience", secret, signToken(t, "HS256", secret, claims(nil)), errTokenAud},
+		{"alg none", secret, signToken(t, "none", nil, valid), errTokenAlg},
+		{"alg none with RSA key", &rsaKey.PublicKey, signToken(t, "none", nil, valid), errTokenAlg},
+		{"HS256 with RSA public key", &rsaKey.PublicKey, signToken(t, "HS256", rsaPub, valid), errTokenAlg},
+		{"RS256 with HMAC key", secret, signToken(t, "RS256", rsaKey, valid), errTokenAlg},
+		{"HS256 bad signature", secret, signToken(t, "HS256", []byte("guess"), valid), errTokenSig},
+		{"RS256 bad signature", &rsaKey.PublicKey, tamper(signToken(t, "RS256", rsaKey, valid)), errTokenSig},
+		{"ES256 bad signature", &ecKey.PublicKey, tamper(signToken(t, "ES256", ecKey, valid)), errTokenSig},
+		{"malformed", secret, "not.a-token", errTokenFormat},
+	}
+	for _, tt := range tests {
+		cfg := JWTConfig{
+			Key:      tt.key,
+			Audience: "fs",
+			Now:      func() time.Time { return testNow },
+		}
+		if _, err := cfg.verify(tt.token); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestJWTLeeway(t *testing.T) {
+	secret := []byte("secret")
+	cfg := JWTConfig{
+		Key:    secret,
+		Leeway: time.Minute,
+		Now:    func() time.Time { return testNow },
+	}
+	token := signToken(t, "HS256", secret, map[string]interface{}{
+		"exp": testNow.Add(-30 * time.Second).Unix(),
+		"nbf": testNow.Add(30 * time.Second).Unix(),
+	})
+	if _, err := cfg.verify(token); err != nil {
+		t.Errorf("token within leeway: %v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("secret")
+	auth := JWT(JWTConfig{
+		Key: secret,
+		Now: func() time.Time { return testNow },
+	})
+	token := signToken(t, "HS256", secret, map[string]interface{}{
+		"sub": "alice",
+		"exp": testNow.Add(time.Hour).Unix(),
+	})
+	for _, user := range []string{"alice", "bob"} {
+		conn, result := runAuth(t, auth, user)
+		io.WriteString(conn, token+"\n")
+		err := <-result
+		if user == "alice" && err != nil {
+			t.Errorf("token for alice: %v", err)
+		}
+		if user != "alice" && err == nil {
+			t.Errorf("token for alice attached as %s", user)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package styxproto
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrBudget is returned by a Decoder, or given as the Err of a
+// BadMessage, when a message would take the memory charged to the
+// Decoder's Budget past its limit.
+var ErrBudget = errors.New("message exceeds memory budget")
+
+// A Budget limits the total size of the messages returned by a
+// Decoder that its caller is still holding on to, such as requests
+// a server has copied out of the Decoder and not yet answered. The
+// MaxSize of a Decoder bounds a single message; a Budget bounds
+// them all, so that a peer cannot make the program buffer an
+// unlimited number of messages at once.
+//
+// Each message other than a BadMessage or Tflush is charged its full
+// size, as reported by its Len method, when Next returns it; a
+// Tflush frees memory rather than holding it, and is never refused.
+// The caller gives the memory back with Release once it is done
+// with the message. A Budget is safe for concurrent use, so messages
+// may be released by other goroutines, and may be shared by any
+// number of Decoders.
+type Budget struct {
+	mu        sync.Mutex
+	room      sync.Cond
+	max, used int64
+}
+
+// NewBudget creates a Budget allowing max bytes of messages to be
+// held at once.
+func NewBudget(max int64) *Budget {
+	b := &Budget{max: max}
+	b.room.L = &b.mu
+	return b
+}
+
+// Release gives back n bytes charged to the Budget.
+func (b *Budget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.room.Broadcast()
+}
+
+// Used returns the number of bytes charged to the Budget and not yet
+// released.
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// acquire charges n bytes to the Budget, if they fit. If wait is
+// true, acquire waits for other messages to be released until they
+// do. A message larger than the whole Budget never fits.
+func (b *Budget) acquire(n int64, wait bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.max {
+		return false
+	}
+	for b.used+n > b.max {
+		if !wait {
+			return false
+		}
+		b.room.Wait()
+	}
+	b.used += n
+	return true
+}
@@ -0,0 +1,127 @@
+// Package capture decodes the 9P messages exchanged over TCP
+// connections captured with a packet sniffer, such as tcpdump, so
+// that real conversations between 9P clients and servers can be
+// examined with the styxproto package.
+//
+// The TCP payload of a capture is given to a Decoder as a sequence
+// of Segments, in the order it was captured. Segments can be read
+// from capture files with ReadPcap, or from any other source that
+// reassembles TCP streams.
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+var errMsgSize = errors.New("invalid message size")
+
+// A Direction is the direction a Segment of a connection travels in.
+type Direction uint8
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ServerToClient {
+		return "server->client"
+	}
+	return "client->server"
+}
+
+// A Segment is a piece of the payload of a TCP connection, sent
+// in one direction.
+type Segment struct {
+	// Conn identifies the connection the Segment belongs to. It
+	// is usually the address of the client.
+	Conn string
+
+	Dir  Direction
+	Data []byte
+}
+
+// A Message is a 9P message decoded from a capture.
+type Message struct {
+	Conn string
+	Dir  Direction
+	Msg  styxproto.Msg
+}
+
+// A Decoder decodes the 9P messages in the Segments of captured
+// connections. The protocol version of each connection is taken from
+// its Rversion message, so that messages of extensions to 9P2000 are
+// decoded correctly. A Decoder is not safe for concurrent use.
+type Decoder struct {
+	conns map[string]*conn
+}
+
+type conn struct {
+	version string
+	buf     [2][]byte // unparsed data, by direction
+	err     [2]error
+}
+
+// NewDecoder returns a Decoder with no connections.
+func NewDecoder() *Decoder {
+	return &Decoder{conns: make(map[string]*conn)}
+}
+
+// Decode adds the data of seg to its connection, and returns the
+// messages that it completes. Invalid messages are returned as
+// styxproto.BadMessage values. If the size of a message is invalid,
+// the message boundaries of the stream are lost; Decode returns an
+// error, and ignores any further data sent in that direction.
+func (d *Decoder) Decode(seg Segment) ([]Message, error) {
+	c, ok := d.conns[seg.Conn]
+	if !ok {
+		c = new(conn)
+		d.conns[seg.Conn] = c
+	}
+	dir := seg.Dir & 1
+	if c.err[dir] != nil {
+		return nil, nil
+	}
+	c.buf[dir] = append(c.buf[dir], seg.Data...)
+
+	var msgs []Message
+	buf := c.buf[dir]
+	for len(buf) >= 4 {
+		size := int64(buf[0]) | int64(buf[1])<<8 | int64(buf[2])<<16 | int64(buf[3])<<24
+		if size < 7 {
+			c.err[dir] = fmt.Errorf("%s %s: %v", seg.Conn, seg.Dir, errMsgSize)
+			c.buf[dir] = nil
+			return msgs, c.err[dir]
+		}
+		if int64(len(buf)) < size {
+			break
+		}
+		m, err := c.decode(buf[:size])
+		if err != nil {
+			return msgs, err
+		}
+		if r, ok := m.(styxproto.Rversion); ok {
+			c.version = string(r.Version())
+		}
+		msgs = append(msgs, Message{Conn: seg.Conn, Dir: seg.Dir, Msg: m})
+		buf = buf[size:]
+	}
+	// Move the remaining data to the front, so that the buffer
+	// does not grow without bound.
+	c.buf[dir] = append(c.buf[dir][:0], buf...)
+	return msgs, nil
+}
+
+// decode decodes a single, complete message.
+func (c *conn) decode(frame []byte) (styxproto.Msg, error) {
+	dec := styxproto.NewDecoderSize(bytes.NewReader(frame), len(frame))
+	dec.Version = c.version
+	if !dec.Next() {
+		return nil, dec.Err()
+	}
+	return styxproto.Clone(dec.Msg())
+}
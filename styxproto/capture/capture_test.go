@@ -0,0 +1,150 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// pcapFile builds a capture file of Ethernet frames.
+type pcapFile struct {
+	bytes.Buffer
+}
+
+func newPcapFile() *pcapFile {
+	f := new(pcapFile)
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkEthernet)
+	f.Write(hdr)
+	return f
+}
+
+// packet adds a TCP segment from port sport on 10.0.0.sip to dport on
+// 10.0.0.dip.
+func (f *pcapFile) packet(sip, dip byte, sport, dport uint16, seq uint32, syn bool, data []byte) {
+	frame := make([]byte, 14+20+20, 14+20+20+len(data))
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(data)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], []byte{10, 0, 0, sip})
+	copy(ip[16:], []byte{10, 0, 0, dip})
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x10
+	if syn {
+		tcp[13] |= 0x02
+	}
+	frame = append(frame, data...)
+
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+	f.Write(rec)
+	f.Write(frame)
+}
+
+func encode(fn func(enc *styxproto.Encoder)) []byte {
+	var buf bytes.Buffer
+	enc := styxproto.NewEncoder(&buf)
+	fn(enc)
+	enc.Flush()
+	return buf.Bytes()
+}
+
+func TestReadPcap(t *testing.T) {
+	tversion := encode(func(enc *styxproto.Encoder) { enc.Tversion(8192, "9P2000.L") })
+	rversion := encode(func(enc *styxproto.Encoder) { enc.Rversion(8192, "9P2000.L") })
+	twalk := encode(func(enc *styxproto.Encoder) { enc.Twalk(1, 0, 1, "usr", "glenda") })
+	tgetattr := encode(func(enc *styxproto.Encoder) { enc.Tgetattr(2, 1, styxproto.GetattrBasic) })
+	rwalk := encode(func(enc *styxproto.Encoder) {
+		enc.Rwalk(1, styxproto.Qid(make([]byte, 13)), styxproto.Qid(make([]byte, 13)))
+	})
+
+	const (
+		client = 1
+		server = 2
+		cport  = 40000
+		sport  = 564
+	)
+	f := newPcapFile()
+	f.packet(client, server, cport, sport, 100, true, nil)
+	f.packet(server, client, sport, cport, 500, true, nil)
+	f.packet(client, server, cport, sport, 101, false, tversion)
+	f.packet(server, client, sport, cport, 501, false, rversion)
+	// Another connection, to a different port, is ignored.
+	f.packet(client, server, cport+1, 80, 1, false, []byte("GET / HTTP/1.0\r\n"))
+
+	// Twalk is split in two and sent out of order, and then
+	// retransmitted in full along with Tgetattr.
+	seq := uint32(101 + len(tversion))
+	f.packet(client, server, cport, sport, seq+5, false, twalk[5:])
+	f.packet(client, server, cport, sport, seq, false, twalk[:5])
+	f.packet(client, server, cport, sport, seq, false, append(append([]byte(nil), twalk...), tgetattr...))
+	f.packet(server, client, sport, cport, 501+uint32(len(rversion)), false, rwalk)
+
+	segs, err := ReadPcap(f, sport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder()
+	var msgs []Message
+	for _, seg := range segs {
+		if seg.Conn != "10.0.0.1:40000" {
+			t.Errorf("segment has conn %q", seg.Conn)
+		}
+		m, err := dec.Decode(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m...)
+	}
+
+	want := []struct {
+		dir  Direction
+		kind string
+	}{
+		{ClientToServer, "styxproto.Tversion"},
+		{ServerToClient, "styxproto.Rversion"},
+		{ClientToServer, "styxproto.Twalk"},
+		{ClientToServer, "styxproto.Tgetattr"},
+		{ServerToClient, "styxproto.Rwalk"},
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(want))
+	}
+	for i, m := range msgs {
+		t.Logf("%s %T", m.Dir, m.Msg)
+		if kind := fmt.Sprintf("%T", m.Msg); m.Dir != want[i].dir || kind != want[i].kind {
+			t.Errorf("message %d is %s %s, want %s %s", i, m.Dir, kind, want[i].dir, want[i].kind)
+		}
+	}
+	if w, ok := msgs[2].Msg.(styxproto.Twalk); !ok || string(w.Wname(1)) != "glenda" {
+		t.Errorf("bad Twalk %v", msgs[2].Msg)
+	}
+}
+
+func TestDecodeBadSize(t *testing.T) {
+	dec := NewDecoder()
+	seg := Segment{Conn: "a", Data: []byte{3, 0, 0, 0, 0, 0, 0}}
+	if _, err := dec.Decode(seg); err == nil {
+		t.Fatal("expected error for message of size 3")
+	}
+	// The other direction is unaffected.
+	seg = Segment{Conn: "a", Dir: ServerToClient, Data: encode(func(enc *styxproto.Encoder) { enc.Rclunk(1) })}
+	if msgs, err := dec.Decode(seg); err != nil || len(msgs) != 1 {
+		t.Errorf("Decode = %d messages, %v", len(msgs), err)
+	}
+}
@@ -0,0 +1,282 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+var (
+	errPcapMagic = errors.New("not a pcap file")
+	errLinkType  = errors.New("unsupported link type")
+	errSnapLen   = errors.New("packet record too large")
+)
+
+// Link types of the packets in a pcap file.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+const maxPacket = 1 << 18
+
+// ReadPcap reads the packets in a capture file written by tcpdump
+// and other tools using the pcap format, and reassembles the TCP
+// connections to or from port, which is the port of the 9P server.
+// The payload of the connections is returned in the order it was
+// captured, with out-of-order segments put back in sequence and
+// retransmitted data removed. Only the original pcap format is
+// supported, with Ethernet, raw IP, loopback and Linux cooked link
+// types; pcapng files can be converted with editcap -F pcap.
+//
+// The Conn field of each Segment is the address of the client.
+func ReadPcap(r io.Reader, port int) ([]Segment, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errPcapMagic
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(hdr[:]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errPcapMagic
+	}
+	link := order.Uint32(hdr[20:]) & 0xffff
+
+	var (
+		segs  []Segment
+		flows = make(map[string]*flow)
+		rec   [16]byte
+		pkt   []byte
+	)
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return segs, err
+		}
+		n := order.Uint32(rec[8:])
+		if n > maxPacket {
+			return segs, errSnapLen
+		}
+		if cap(pkt) < int(n) {
+			pkt = make([]byte, n)
+		}
+		pkt = pkt[:n]
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return segs, err
+		}
+		ip, err := linkPayload(link, pkt)
+		if err != nil {
+			return segs, err
+		}
+		p, ok := parseIP(ip)
+		if !ok || (p.srcPort != port && p.dstPort != port) {
+			continue
+		}
+		seg := Segment{Dir: ClientToServer}
+		client := net.JoinHostPort(p.src.String(), strconv.Itoa(p.srcPort))
+		if p.srcPort == port {
+			seg.Dir = ServerToClient
+			client = net.JoinHostPort(p.dst.String(), strconv.Itoa(p.dstPort))
+		}
+		seg.Conn = client
+		key := client + " " + seg.Dir.String()
+		f, ok := flows[key]
+		if !ok {
+			f = new(flow)
+			flows[key] = f
+		}
+		for _, data := range f.add(p) {
+			seg.Data = data
+			segs = append(segs, seg)
+		}
+	}
+	return segs, nil
+}
+
+// linkPayload returns the IP packet in a link layer frame, or nil if
+// the frame does not hold an IP packet.
+func linkPayload(link uint32, pkt []byte) ([]byte, error) {
+	switch link {
+	case linkRaw:
+		return pkt, nil
+	case linkNull, linkLoop:
+		// The address family, in an unknown byte order; the
+		// version of the IP header tells us all we need.
+		if len(pkt) < 4 {
+			return nil, nil
+		}
+		return pkt[4:], nil
+	case linkEthernet:
+		if len(pkt) < 14 {
+			return nil, nil
+		}
+		etype, pkt := binary.BigEndian.Uint16(pkt[12:]), pkt[14:]
+		for etype == 0x8100 && len(pkt) >= 4 {
+			// 802.1Q VLAN tag
+			etype, pkt = binary.BigEndian.Uint16(pkt[2:]), pkt[4:]
+		}
+		return ethernetIP(etype, pkt), nil
+	case linkSLL:
+		if len(pkt) < 16 {
+			return nil, nil
+		}
+		return ethernetIP(binary.BigEndian.Uint16(pkt[14:]), pkt[16:]), nil
+	case linkSLL2:
+		if len(pkt) < 20 {
+			return nil, nil
+		}
+		return ethernetIP(binary.BigEndian.Uint16(pkt[0:]), pkt[20:]), nil
+	}
+	return nil, fmt.Errorf("%v %d", errLinkType, link)
+}
+
+func ethernetIP(etype uint16, pkt []byte) []byte {
+	if etype == 0x0800 || etype == 0x86dd {
+		return pkt
+	}
+	return nil
+}
+
+// A packet is a TCP segment.
+type packet struct {
+	src, dst         net.IP
+	srcPort, dstPort int
+	seq              uint32
+	syn              bool
+	data             []byte
+}
+
+// parseIP parses a TCP segment from an IPv4 or IPv6 packet. IPv6
+// extension headers and IPv4 fragments are not supported.
+func parseIP(ip []byte) (p packet, ok bool) {
+	var tcp []byte
+	if len(ip) < 1 {
+		return p, false
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return p, false
+		}
+		ihl := int(ip[0]&0xf) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:]))
+		fragment := binary.BigEndian.Uint16(ip[6:])&0x3fff != 0
+		if ip[9] != 6 || fragment || ihl < 20 || total < ihl || total > len(ip) {
+			return p, false
+		}
+		p.src, p.dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		tcp = ip[ihl:total]
+	case 6:
+		if len(ip) < 40 {
+			return p, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if ip[6] != 6 || total > len(ip) {
+			return p, false
+		}
+		p.src, p.dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		tcp = ip[40:total]
+	default:
+		return p, false
+	}
+	if len(tcp) < 20 {
+		return p, false
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < 20 || off > len(tcp) {
+		return p, false
+	}
+	p.srcPort = int(binary.BigEndian.Uint16(tcp[0:]))
+	p.dstPort = int(binary.BigEndian.Uint16(tcp[2:]))
+	p.seq = binary.BigEndian.Uint32(tcp[4:])
+	p.syn = tcp[13]&0x02 != 0
+	p.data = tcp[off:]
+	return p, true
+}
+
+// A flow reassembles one direction of a TCP connection.
+type flow struct {
+	started bool
+	next    uint32            // sequence number of the next byte
+	pending map[uint32][]byte // segments received out of order
+}
+
+// Limit the number of out-of-order segments held, in case the
+// capture missed a segment.
+const maxPending = 1024
+
+// add adds a segment to the flow, returning the data that is now in
+// sequence. The data is copied.
+func (f *flow) add(p packet) [][]byte {
+	if p.syn {
+		f.started = true
+		f.next = p.seq + 1
+		f.pending = nil
+		return nil
+	}
+	if len(p.data) == 0 {
+		return nil
+	}
+	if !f.started {
+		// The capture began after the connection was
+		// established.
+		f.started = true
+		f.next = p.seq
+	}
+	if f.pending == nil {
+		f.pending = make(map[uint32][]byte)
+	}
+	if d := int32(p.seq - f.next); d > 0 {
+		if len(f.pending) < maxPending {
+			f.pending[p.seq] = append([]byte(nil), p.data...)
+		}
+		return nil
+	}
+	var out [][]byte
+	seq, data := p.seq, p.data
+	for {
+		// Trim data that has already been seen.
+		if d := int(int32(f.next - seq)); d > 0 {
+			if d >= len(data) {
+				data = nil
+			} else {
+				data = data[d:]
+			}
+		}
+		if len(data) > 0 {
+			out = append(out, append([]byte(nil), data...))
+			f.next += uint32(len(data))
+		}
+		var ok bool
+		if seq, data, ok = f.nextPending(); !ok {
+			return out
+		}
+	}
+}
+
+// nextPending removes and returns a pending segment that starts at
+// or before the next sequence number.
+func (f *flow) nextPending() (uint32, []byte, bool) {
+	for seq, data := range f.pending {
+		if int32(seq-f.next) <= 0 {
+			delete(f.pending, seq)
+			return seq, data, true
+		}
+	}
+	return 0, nil, false
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"reflect"
 )
 
 var (
@@ -28,6 +29,12 @@ func NewDecoder(r io.Reader) *Decoder {
 // improve performance on connections that are heavily multiplexed,
 // where there messages from independent sessions that can be handled
 // in any order.
+//
+// The internal buffer never grows; it bounds the memory a Decoder
+// uses to hold messages, no matter what its peer sends. The data of
+// Twrite, Rread and Rreaddir messages is streamed from the underlying
+// io.Reader, while any other message that does not fit in the
+// buffer is handled according to the Decoder's Oversize policy.
 func NewDecoderSize(r io.Reader, bufsize int) *Decoder {
 	if bufsize < MinBufSize {
 		bufsize = MinBufSize
@@ -49,6 +56,36 @@ type Decoder struct {
 	// MaxSize is -1, a Decoder will accept any size message.
 	MaxSize int64
 
+	// Oversize determines what happens when a message is larger than
+	// MaxSize, cannot fit in the Decoder's internal buffer, or does
+	// not fit in the Budget.
+	Oversize OversizePolicy
+
+	// If Budget is not nil, the messages returned by Next are
+	// charged to it, and must be released by the caller. See the
+	// Budget type for details.
+	Budget *Budget
+
+	// If Strict is true, the Decoder rejects messages that are
+	// larger than the largest valid message of their type, or that
+	// have space left over after their last field. Some clients
+	// and servers pad their messages, so these checks are off by
+	// default; they are meant for tests, fuzzing, and gateways that
+	// must not pass along anything but well-formed messages.
+	Strict bool
+
+	// Limits sets the maximum lengths of the variable-length
+	// fields of the messages a Decoder accepts. Messages with
+	// longer fields are returned as a BadMessage.
+	Limits Limits
+
+	// Version is the protocol version in use on the stream, as
+	// negotiated through a Tversion/Rversion exchange. It determines
+	// how messages are parsed when their layout differs between
+	// versions of the protocol. If Version is not one of the versions
+	// supported by the styxproto package, plain 9P2000 is assumed.
+	Version string
+
 	// input source. we need to expose this so we can stitch together
 	// an io.Reader for large Twrite/Rread messages.
 	r io.Reader
@@ -56,6 +93,9 @@ type Decoder struct {
 	// internal buffer is used to store messages
 	br *bufio.Reader
 
+	// pool that br was taken from, if any
+	pool *BufferPool
+
 	// current selection in the buffered data
 	start, pos int
 
@@ -66,17 +106,105 @@ type Decoder struct {
 	// Last error encountered when reading from r
 	// or during parsing
 	err error
+
+	// bytes of msg charged to Budget
+	charged int64
+
+	// counters for Stats. Messages are counted by their type
+	// byte, and named when the first of each type is seen.
+	counts      [256]int64
+	names       [256]string
+	bytes       int64
+	badMessages int64
+}
+
+// DecoderStats are counters of the messages decoded by a Decoder.
+type DecoderStats struct {
+	// Valid messages decoded, by type, such as "Twalk".
+	Messages map[string]int64
+
+	Bytes       int64 // size of all messages decoded, including bad ones
+	BadMessages int64 // messages decoded as BadMessage
+}
+
+// Stats returns the counters of the messages decoded since the
+// Decoder was created or last Reset. Like the other methods of a
+// Decoder, it must not be called concurrently with Next.
+func (s *Decoder) Stats() DecoderStats {
+	st := DecoderStats{
+		Messages:    make(map[string]int64),
+		Bytes:       s.bytes,
+		BadMessages: s.badMessages,
+	}
+	for t, n := range s.counts {
+		if n > 0 {
+			st.Messages[s.names[t]] = n
+		}
+	}
+	return st
+}
+
+func (s *Decoder) count(m Msg) {
+	s.bytes += m.Len()
+	if _, ok := m.(BadMessage); ok {
+		s.badMessages++
+		return
+	}
+	t := m.bytes()[4]
+	if s.counts[t] == 0 {
+		s.names[t] = reflect.TypeOf(m).Name()
+	}
+	s.counts[t]++
 }
 
+// An OversizePolicy determines how a Decoder handles messages that
+// are too large.
+type OversizePolicy int
+
+const (
+	// OversizeError stops decoding the stream. Messages larger
+	// than MaxSize cause Err to return ErrMaxSize, messages
+	// larger than the Decoder's internal buffer cause it to return
+	// bufio.ErrBufferFull, and messages that do not fit in the
+	// Budget cause it to return ErrBudget. This is the default.
+	OversizeError OversizePolicy = iota
+
+	// OversizeSkip reports a message that is too large as a
+	// BadMessage, whose Err field is ErrMaxSize, or ErrBudget if
+	// it does not fit in the Budget, and discards its contents
+	// without buffering them on the next call to Next. Decoding
+	// continues with the following message.
+	OversizeSkip
+
+	// OversizeWait makes Next wait for earlier messages to be
+	// released until the next message fits in the Budget. Messages
+	// larger than the whole Budget, MaxSize or the internal buffer
+	// are handled as with OversizeError.
+	OversizeWait
+)
+
 // Reset resets a Decoder with a new io.Reader.
 func (s *Decoder) Reset(r io.Reader) {
 	s.MaxSize = -1
+	s.Oversize = OversizeError
+	s.Budget = nil
+	s.Strict = false
+	s.Limits = Limits{}
+	s.Version = ""
 	s.r = r
+	if s.br == nil {
+		// released to its pool
+		s.br = s.pool.reader(r)
+	}
 	s.br.Reset(s.r)
 	s.start = 0
 	s.pos = 0
 	s.msg = nil
 	s.err = nil
+	s.charged = 0
+	s.counts = [256]int64{}
+	s.bytes = 0
+	s.badMessages = 0
 }
 
 // Err returns the first error encountered during parsing.
@@ -126,10 +254,37 @@ func (s *Decoder) Next() bool {
 		return false
 	}
 	s.resetdot()
+	s.charged = 0
 	s.msg, s.err = s.fetchMessage()
+	if s.msg != nil && s.Budget != nil {
+		s.msg, s.err = s.charge(s.msg)
+	}
+	if s.msg != nil {
+		s.count(s.msg)
+	}
 	return s.msg != nil
 }
 
+// charge takes the size of m from the Decoder's Budget. A message
+// that does not fit is handled according to the Oversize policy.
+func (s *Decoder) charge(m Msg) (Msg, error) {
+	switch m.(type) {
+	case BadMessage, Tflush:
+		return m, nil
+	}
+	if s.Budget.acquire(m.Len(), s.Oversize == OversizeWait) {
+		s.charged = m.Len()
+		return m, nil
+	}
+	return s.oversize(msg(m.bytes()), ErrBudget)
+}
+
+// Charged returns the number of bytes the last message returned by
+// Next was charged to the Budget, which the caller must release.
+func (s *Decoder) Charged() int64 {
+	return s.charged
+}
+
 // A bufio.Reader is not just a way to smooth out I/O performance;
 // it can also be used as a "sliding window" over a byte stream.
 // If the terminology below seems odd, it is inspired by the sam
@@ -11,4 +11,14 @@
 // To minimize allocations, the styxproto package does not decode
 // messages. Instead, messages are validated and wrapped with convenient
 // accessor methods.
+//
+// The 9P2000.u extension, used by Unix clients such as the Linux
+// v9fs driver, adds fields to a few messages and to the Stat
+// structure. Set the Version field of a Decoder to Version9P2000U
+// to parse them, and use the Encoder methods with a U suffix, along
+// with NewStatU, to produce them.
+//
+// The 9P2000.L and 9P2000.e extensions add new messages, which are
+// recognized when the Version field of a Decoder is Version9P2000L
+// or Version9P2000E, respectively.
 package styxproto
@@ -0,0 +1,155 @@
+package styxproto
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The 9P2000.e extension, from Erlang on Xen, adds messages that let
+// a client on an unreliable transport resume its session on a new
+// connection, and read or write a whole file, named by a path
+// relative to a fid, in a single request. The messages are only
+// recognized by a Decoder whose Version is Version9P2000E.
+//
+// Based on
+// http://erlangonxen.org/more/9p2000e
+const (
+	msgTsession = 150 // size[4] Tsession tag[2] key[8]
+	msgRsession = 151 // size[4] Rsession tag[2]
+	msgTsread   = 152 // size[4] Tsread tag[2] fid[4] nwname[2] nwname*(wname[s])
+	msgRsread   = 153 // size[4] Rsread tag[2] count[4] data[count]
+	msgTswrite  = 154 // size[4] Tswrite tag[2] fid[4] nwname[2] nwname*(wname[s]) count[4] data[count]
+	msgRswrite  = 155 // size[4] Rswrite tag[2] count[4]
+)
+
+// A Tsession message asks the server to re-establish the session
+// identified by key, with all of its fids, on the current
+// connection. It is sent after Tversion, in place of Tattach.
+type Tsession []byte
+
+func (m Tsession) Tag() uint16   { return msg(m).Tag() }
+func (m Tsession) Len() int64    { return msg(m).Len() }
+func (m Tsession) nbytes() int64 { return msg(m).nbytes() }
+func (m Tsession) bytes() []byte { return m }
+
+// Key identifies the session to resume.
+func (m Tsession) Key() uint64 { return guint64(m[7:15]) }
+
+func (m Tsession) String() string { return fmt.Sprintf("Tsession key=%#x", m.Key()) }
+
+// An Rsession message is sent when a session is resumed.
+type Rsession []byte
+
+func (m Rsession) Tag() uint16   { return msg(m).Tag() }
+func (m Rsession) Len() int64    { return msg(m).Len() }
+func (m Rsession) nbytes() int64 { return msg(m).nbytes() }
+func (m Rsession) bytes() []byte { return m }
+
+func (m Rsession) String() string { return "Rsession" }
+
+// A Tsread message requests the contents of the file reached by
+// walking the path elements in Wname from Fid. The file is opened,
+// read and closed by the server, without allocating a new fid.
+type Tsread []byte
+
+func (m Tsread) Tag() uint16   { return msg(m).Tag() }
+func (m Tsread) Len() int64    { return msg(m).Len() }
+func (m Tsread) nbytes() int64 { return msg(m).nbytes() }
+func (m Tsread) bytes() []byte { return m }
+func (m Tsread) Fid() uint32   { return guint32(m[7:11]) }
+
+// Nwname is the number of path elements to walk.
+func (m Tsread) Nwname() int { return int(guint16(m[11:13])) }
+
+// Wname returns the nth path element.
+func (m Tsread) Wname(n int) []byte { return nthField(m, 13, n) }
+
+func (m Tsread) String() string {
+	return fmt.Sprintf("Tsread fid=%d wname=%q", m.Fid(), strings.Join(wnames(m, 13, m.Nwname()), "/"))
+}
+
+// An Rsread message contains the contents of the file named in a
+// Tsread request. As with Rread, the data can be consumed using the
+// io.Reader interface.
+type Rsread struct {
+	r   io.Reader
+	msg msg // headers plus any extra buffered data
+}
+
+// Read copies len(p) bytes from an Rsread message's data field into
+// p. It returns the number of bytes copied and an error, if any.
+func (m Rsread) Read(p []byte) (int, error) { return m.r.Read(p) }
+
+func (m Rsread) Tag() uint16   { return m.msg.Tag() }
+func (m Rsread) Len() int64    { return m.msg.Len() }
+func (m Rsread) nbytes() int64 { return m.msg.nbytes() }
+func (m Rsread) bytes() []byte { return m.msg[:11] }
+func (m Rsread) Count() int64  { return int64(guint32(m.msg[7:11])) }
+
+func (m Rsread) String() string { return fmt.Sprintf("Rsread count=%d", m.Count()) }
+
+// A Tswrite message replaces the contents of the file reached by
+// walking the path elements in Wname from Fid. As with Twrite, the
+// new contents can be consumed using the io.Reader interface.
+type Tswrite struct {
+	r   io.Reader
+	msg msg // headers plus any extra buffered data
+}
+
+// Read copies len(p) bytes from a Tswrite message's data field into
+// p. It returns the number of bytes copied and an error, if any.
+func (m Tswrite) Read(p []byte) (int, error) { return m.r.Read(p) }
+
+func (m Tswrite) Tag() uint16   { return m.msg.Tag() }
+func (m Tswrite) Len() int64    { return m.msg.Len() }
+func (m Tswrite) nbytes() int64 { return m.msg.nbytes() }
+func (m Tswrite) bytes() []byte { return m.msg[:m.countOffset()+4] }
+func (m Tswrite) Fid() uint32   { return guint32(m.msg[7:11]) }
+
+// Nwname is the number of path elements to walk.
+func (m Tswrite) Nwname() int { return int(guint16(m.msg[11:13])) }
+
+// Wname returns the nth path element.
+func (m Tswrite) Wname(n int) []byte { return nthField(m.msg, 13, n) }
+
+// The count field follows the last path element.
+func (m Tswrite) countOffset() int {
+	offset := 13
+	for i := 0; i < m.Nwname(); i++ {
+		offset += 2 + int(guint16(m.msg[offset:offset+2]))
+	}
+	return offset
+}
+
+func (m Tswrite) Count() int64 {
+	offset := m.countOffset()
+	return int64(guint32(m.msg[offset : offset+4]))
+}
+
+func (m Tswrite) String() string {
+	return fmt.Sprintf("Tswrite fid=%d wname=%q count=%d",
+		m.Fid(), strings.Join(wnames(m.msg, 13, m.Nwname()), "/"), m.Count())
+}
+
+// An Rswrite message is sent when a Tswrite request succeeds.
+type Rswrite []byte
+
+func (m Rswrite) Tag() uint16   { return msg(m).Tag() }
+func (m Rswrite) Len() int64    { return msg(m).Len() }
+func (m Rswrite) nbytes() int64 { return msg(m).nbytes() }
+func (m Rswrite) bytes() []byte { return m }
+
+// Count is the number of bytes written.
+func (m Rswrite) Count() int64 { return int64(guint32(m[7:11])) }
+
+func (m Rswrite) String() string { return fmt.Sprintf("Rswrite count=%d", m.Count()) }
+
+// wnames returns the n path elements starting at offset in m.
+func wnames(m []byte, offset, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = string(nthField(m, offset, i))
+	}
+	return names
+}
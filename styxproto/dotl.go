@@ -0,0 +1,915 @@
+package styxproto
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// The 9P2000.L extension, used by the Linux v9fs driver and by QEMU,
+// adds the following messages. They are numbered below the 9P2000
+// messages, and are only recognized by a Decoder whose Version is
+// Version9P2000L.
+//
+// Based on
+// https://github.com/chaos/diod/blob/master/protocol.md
+const (
+	msgTlerror      = 6
+	msgRlerror      = 7  // size[4] Rlerror tag[2] ecode[4]
+	msgTstatfs      = 8  // size[4] Tstatfs tag[2] fid[4]
+	msgRstatfs      = 9  // size[4] Rstatfs tag[2] type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4]
+	msgTlopen       = 12 // size[4] Tlopen tag[2] fid[4] flags[4]
+	msgRlopen       = 13 // size[4] Rlopen tag[2] qid[13] iounit[4]
+	msgTlcreate     = 14 // size[4] Tlcreate tag[2] fid[4] name[s] flags[4] mode[4] gid[4]
+	msgRlcreate     = 15 // size[4] Rlcreate tag[2] qid[13] iounit[4]
+	msgTsymlink     = 16 // size[4] Tsymlink tag[2] fid[4] name[s] symtgt[s] gid[4]
+	msgRsymlink     = 17 // size[4] Rsymlink tag[2] qid[13]
+	msgTmknod       = 18 // size[4] Tmknod tag[2] dfid[4] name[s] mode[4] major[4] minor[4] gid[4]
+	msgRmknod       = 19 // size[4] Rmknod tag[2] qid[13]
+	msgTrename      = 20 // size[4] Trename tag[2] fid[4] dfid[4] name[s]
+	msgRrename      = 21 // size[4] Rrename tag[2]
+	msgTreadlink    = 22 // size[4] Treadlink tag[2] fid[4]
+	msgRreadlink    = 23 // size[4] Rreadlink tag[2] target[s]
+	msgTgetattr     = 24 // size[4] Tgetattr tag[2] fid[4] request_mask[8]
+	msgRgetattr     = 25 // size[4] Rgetattr tag[2] valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8]
+	msgTsetattr     = 26 // size[4] Tsetattr tag[2] fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16]
+	msgRsetattr     = 27 // size[4] Rsetattr tag[2]
+	msgTxattrwalk   = 30 // size[4] Txattrwalk tag[2] fid[4] newfid[4] name[s]
+	msgRxattrwalk   = 31 // size[4] Rxattrwalk tag[2] size[8]
+	msgTxattrcreate = 32 // size[4] Txattrcreate tag[2] fid[4] name[s] attr_size[8] flags[4]
+	msgRxattrcreate = 33 // size[4] Rxattrcreate tag[2]
+	msgTreaddir     = 40 // size[4] Treaddir tag[2] fid[4] offset[8] count[4]
+	msgRreaddir     = 41 // size[4] Rreaddir tag[2] count[4] data[count]
+	msgTfsync       = 50 // size[4] Tfsync tag[2] fid[4] datasync[4]
+	msgRfsync       = 51 // size[4] Rfsync tag[2]
+	msgTlock        = 52 // size[4] Tlock tag[2] fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s]
+	msgRlock        = 53 // size[4] Rlock tag[2] status[1]
+	msgTgetlock     = 54 // size[4] Tgetlock tag[2] fid[4] type[1] start[8] length[8] proc_id[4] client_id[s]
+	msgRgetlock     = 55 // size[4] Rgetlock tag[2] type[1] start[8] length[8] proc_id[4] client_id[s]
+	msgTlink        = 70 // size[4] Tlink tag[2] dfid[4] fid[4] name[s]
+	msgRlink        = 71 // size[4] Rlink tag[2]
+	msgTmkdir       = 72 // size[4] Tmkdir tag[2] dfid[4] name[s] mode[4] gid[4]
+	msgRmkdir       = 73 // size[4] Rmkdir tag[2] qid[13]
+	msgTrenameat    = 74 // size[4] Trenameat tag[2] olddirfid[4] oldname[s] newdirfid[4] newname[s]
+	msgRrenameat    = 75 // size[4] Rrenameat tag[2]
+	msgTunlinkat    = 76 // size[4] Tunlinkat tag[2] dirfd[4] name[s] flags[4]
+	msgRunlinkat    = 77 // size[4] Runlinkat tag[2]
+)
+
+// Flags for the flags field in Tlopen and Tlcreate messages. These
+// are the values used by Linux for the open(2) system call, which
+// may differ from those of the host operating system.
+const (
+	LRDONLY    = 00000000
+	LWRONLY    = 00000001
+	LRDWR      = 00000002
+	LCREATE    = 00000100
+	LEXCL      = 00000200
+	LNOCTTY    = 00000400
+	LTRUNC     = 00001000
+	LAPPEND    = 00002000
+	LNONBLOCK  = 00004000
+	LDSYNC     = 00010000
+	LFASYNC    = 00020000
+	LDIRECT    = 00040000
+	LLARGEFILE = 00100000
+	LDIRECTORY = 00200000
+	LNOFOLLOW  = 00400000
+	LNOATIME   = 01000000
+	LCLOEXEC   = 02000000
+	LSYNC      = 04000000
+
+	// Mask for the access mode
+	LACCMODE = 00000003
+)
+
+// Bits in the request_mask field of a Tgetattr message and the valid
+// field of an Rgetattr message.
+const (
+	GetattrMode        = 0x00000001
+	GetattrNlink       = 0x00000002
+	GetattrUid         = 0x00000004
+	GetattrGid         = 0x00000008
+	GetattrRdev        = 0x00000010
+	GetattrAtime       = 0x00000020
+	GetattrMtime       = 0x00000040
+	GetattrCtime       = 0x00000080
+	GetattrIno         = 0x00000100
+	GetattrSize        = 0x00000200
+	GetattrBlocks      = 0x00000400
+	GetattrBtime       = 0x00000800
+	GetattrGen         = 0x00001000
+	GetattrDataVersion = 0x00002000
+
+	// The fields provided by the Unix stat(2) system call.
+	GetattrBasic = 0x000007ff
+	GetattrAll   = 0x00003fff
+)
+
+// Bits in the valid field of a Tsetattr message.
+const (
+	SetattrMode     = 0x00000001
+	SetattrUid      = 0x00000002
+	SetattrGid      = 0x00000004
+	SetattrSize     = 0x00000008
+	SetattrAtime    = 0x00000010 // set atime to the current time, unless SetattrAtimeSet is present
+	SetattrMtime    = 0x00000020 // set mtime to the current time, unless SetattrMtimeSet is present
+	SetattrCtime    = 0x00000040
+	SetattrAtimeSet = 0x00000080
+	SetattrMtimeSet = 0x00000100
+)
+
+// Values for the type field of Tlock, Tgetlock and Rgetlock messages.
+const (
+	LockTypeRdlck = 0
+	LockTypeWrlck = 1
+	LockTypeUnlck = 2
+)
+
+// Bits in the flags field of a Tlock message.
+const (
+	LockFlagsBlock   = 1
+	LockFlagsReclaim = 2
+)
+
+// Values for the status field of an Rlock message.
+const (
+	LockSuccess = 0
+	LockBlocked = 1
+	LockError   = 2
+	LockGrace   = 3
+)
+
+// ATREMOVEDIR may be set in the flags field of a Tunlinkat message
+// to remove a directory.
+const ATREMOVEDIR = 0x200
+
+// Values for the type field of a Dirent, from the Linux dirent.h
+const (
+	DTUNKNOWN = 0
+	DTFIFO    = 1
+	DTCHR     = 2
+	DTDIR     = 4
+	DTBLK     = 6
+	DTREG     = 8
+	DTLNK     = 10
+	DTSOCK    = 12
+)
+
+// 9P2000.L uses the Linux numbering for errors; these are the values
+// most commonly sent in an Rlerror message, or in the errno field of
+// a 9P2000.u Rerror message.
+const (
+	EPERM        = 1
+	ENOENT       = 2
+	EINTR        = 4
+	EIO          = 5
+	EBADF        = 9
+	EAGAIN       = 11
+	ENOMEM       = 12
+	EACCES       = 13
+	EBUSY        = 16
+	EEXIST       = 17
+	EXDEV        = 18
+	ENOTDIR      = 20
+	EISDIR       = 21
+	EINVAL       = 22
+	EFBIG        = 27
+	ENOSPC       = 28
+	EROFS        = 30
+	EMLINK       = 31
+	ERANGE       = 34
+	ENAMETOOLONG = 36
+	ENOSYS       = 38
+	ENOTEMPTY    = 39
+	ELOOP        = 40
+	ENODATA      = 61
+	EOPNOTSUPP   = 95
+	ETIMEDOUT    = 110
+	EDQUOT       = 122
+)
+
+// Unix timestamps in 9P2000.L messages are stored as a number of
+// seconds and nanoseconds.
+func gtime(b []byte) time.Time {
+	sec, nsec := guint64(b[:8]), guint64(b[8:16])
+	if sec == 0 && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func unixTime(t time.Time) (sec, nsec uint64) {
+	if t.IsZero() {
+		return 0, 0
+	}
+	return uint64(t.Unix()), uint64(t.Nanosecond())
+}
+
+// An Rlerror message replaces the Rerror message in 9P2000.L. Rather
+// than a descriptive string, it contains only a Linux error number.
+type Rlerror []byte
+
+func (m Rlerror) Tag() uint16   { return msg(m).Tag() }
+func (m Rlerror) Len() int64    { return msg(m).Len() }
+func (m Rlerror) nbytes() int64 { return msg(m).nbytes() }
+func (m Rlerror) bytes() []byte { return m }
+
+// Ecode is the Linux error number describing the failure.
+func (m Rlerror) Ecode() uint32 { return guint32(m[7:11]) }
+
+func (m Rlerror) String() string { return fmt.Sprintf("Rlerror ecode=%d", m.Ecode()) }
+
+// A Tstatfs message requests information about the file system
+// containing fid.
+type Tstatfs []byte
+
+func (m Tstatfs) Tag() uint16   { return msg(m).Tag() }
+func (m Tstatfs) Len() int64    { return msg(m).Len() }
+func (m Tstatfs) nbytes() int64 { return msg(m).nbytes() }
+func (m Tstatfs) bytes() []byte { return m }
+func (m Tstatfs) Fid() uint32   { return guint32(m[7:11]) }
+
+func (m Tstatfs) String() string { return fmt.Sprintf("Tstatfs fid=%d", m.Fid()) }
+
+// Statfs describes a file system, as in the Linux statfs(2) system
+// call. It is used to construct Rstatfs messages.
+type Statfs struct {
+	Type    uint32 // type of file system
+	Bsize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in file system
+	Bfree   uint64 // free blocks in fs
+	Bavail  uint64 // free blocks avail to non-superuser
+	Files   uint64 // total file nodes in file system
+	Ffree   uint64 // free file nodes in fs
+	Fsid    uint64 // file system id
+	Namelen uint32 // maximum length of filenames
+}
+
+// An Rstatfs message is sent in response to a Tstatfs message.
+type Rstatfs []byte
+
+func (m Rstatfs) Tag() uint16     { return msg(m).Tag() }
+func (m Rstatfs) Len() int64      { return msg(m).Len() }
+func (m Rstatfs) nbytes() int64   { return msg(m).nbytes() }
+func (m Rstatfs) bytes() []byte   { return m }
+func (m Rstatfs) Type() uint32    { return guint32(m[7:11]) }
+func (m Rstatfs) Bsize() uint32   { return guint32(m[11:15]) }
+func (m Rstatfs) Blocks() uint64  { return guint64(m[15:23]) }
+func (m Rstatfs) Bfree() uint64   { return guint64(m[23:31]) }
+func (m Rstatfs) Bavail() uint64  { return guint64(m[31:39]) }
+func (m Rstatfs) Files() uint64   { return guint64(m[39:47]) }
+func (m Rstatfs) Ffree() uint64   { return guint64(m[47:55]) }
+func (m Rstatfs) Fsid() uint64    { return guint64(m[55:63]) }
+func (m Rstatfs) Namelen() uint32 { return guint32(m[63:67]) }
+
+func (m Rstatfs) String() string {
+	return fmt.Sprintf("Rstatfs type=%#x bsize=%d blocks=%d bfree=%d bavail=%d files=%d ffree=%d fsid=%d namelen=%d",
+		m.Type(), m.Bsize(), m.Blocks(), m.Bfree(), m.Bavail(), m.Files(), m.Ffree(), m.Fsid(), m.Namelen())
+}
+
+// The Tlopen message replaces Topen in 9P2000.L. Its flags field
+// contains Linux open(2) flags, such as LRDWR and LTRUNC.
+type Tlopen []byte
+
+func (m Tlopen) Tag() uint16   { return msg(m).Tag() }
+func (m Tlopen) Len() int64    { return msg(m).Len() }
+func (m Tlopen) nbytes() int64 { return msg(m).nbytes() }
+func (m Tlopen) bytes() []byte { return m }
+func (m Tlopen) Fid() uint32   { return guint32(m[7:11]) }
+func (m Tlopen) Flags() uint32 { return guint32(m[11:15]) }
+
+func (m Tlopen) String() string { return fmt.Sprintf("Tlopen fid=%d flags=%#o", m.Fid(), m.Flags()) }
+
+// An Rlopen message is sent in response to a Tlopen message.
+type Rlopen []byte
+
+func (m Rlopen) Tag() uint16   { return msg(m).Tag() }
+func (m Rlopen) Len() int64    { return msg(m).Len() }
+func (m Rlopen) nbytes() int64 { return msg(m).nbytes() }
+func (m Rlopen) bytes() []byte { return m }
+func (m Rlopen) Qid() Qid      { return Ropen(m).Qid() }
+func (m Rlopen) IOunit() int64 { return Ropen(m).IOunit() }
+
+func (m Rlopen) String() string { return fmt.Sprintf("Rlopen qid=%q iounit=%d", m.Qid(), m.IOunit()) }
+
+// The Tlcreate message replaces Tcreate in 9P2000.L. The new file is
+// created in the directory represented by fid, and fid is opened to
+// the new file with the given flags.
+type Tlcreate []byte
+
+func (m Tlcreate) Tag() uint16   { return msg(m).Tag() }
+func (m Tlcreate) Len() int64    { return msg(m).Len() }
+func (m Tlcreate) nbytes() int64 { return msg(m).nbytes() }
+func (m Tlcreate) bytes() []byte { return m }
+func (m Tlcreate) Fid() uint32   { return guint32(m[7:11]) }
+func (m Tlcreate) Name() []byte  { return nthField(m, 11, 0) }
+
+// Flags contains Linux open(2) flags used to open the new file.
+func (m Tlcreate) Flags() uint32 { return guint32(m[13+len(m.Name()):]) }
+
+// Mode contains the permissions of the new file, as Unix mode bits.
+func (m Tlcreate) Mode() uint32 { return guint32(m[17+len(m.Name()):]) }
+
+// Gid is the numeric group id of the new file.
+func (m Tlcreate) Gid() uint32 { return guint32(m[21+len(m.Name()):]) }
+
+func (m Tlcreate) String() string {
+	return fmt.Sprintf("Tlcreate fid=%d name=%q flags=%#o mode=%#o gid=%d",
+		m.Fid(), m.Name(), m.Flags(), m.Mode(), m.Gid())
+}
+
+// An Rlcreate message is sent in response to a Tlcreate message.
+type Rlcreate []byte
+
+func (m Rlcreate) Tag() uint16   { return msg(m).Tag() }
+func (m Rlcreate) Len() int64    { return msg(m).Len() }
+func (m Rlcreate) nbytes() int64 { return msg(m).nbytes() }
+func (m Rlcreate) bytes() []byte { return m }
+func (m Rlcreate) Qid() Qid      { return Ropen(m).Qid() }
+func (m Rlcreate) IOunit() int64 { return Ropen(m).IOunit() }
+
+func (m Rlcreate) String() string {
+	return fmt.Sprintf("Rlcreate qid=%q iounit=%d", m.Qid(), m.IOunit())
+}
+
+// A Tsymlink message creates a symbolic link, Name, in the directory
+// represented by fid, that points to Target.
+type Tsymlink []byte
+
+func (m Tsymlink) Tag() uint16    { return msg(m).Tag() }
+func (m Tsymlink) Len() int64     { return msg(m).Len() }
+func (m Tsymlink) nbytes() int64  { return msg(m).nbytes() }
+func (m Tsymlink) bytes() []byte  { return m }
+func (m Tsymlink) Fid() uint32    { return guint32(m[7:11]) }
+func (m Tsymlink) Name() []byte   { return nthField(m, 11, 0) }
+func (m Tsymlink) Target() []byte { return nthField(m, 11, 1) }
+
+// Gid is the numeric group id of the new link.
+func (m Tsymlink) Gid() uint32 { return guint32(m[15+len(m.Name())+len(m.Target()):]) }
+
+func (m Tsymlink) String() string {
+	return fmt.Sprintf("Tsymlink fid=%d name=%q target=%q gid=%d",
+		m.Fid(), m.Name(), m.Target(), m.Gid())
+}
+
+// An Rsymlink message is sent in response to a Tsymlink message.
+type Rsymlink []byte
+
+func (m Rsymlink) Tag() uint16   { return msg(m).Tag() }
+func (m Rsymlink) Len() int64    { return msg(m).Len() }
+func (m Rsymlink) nbytes() int64 { return msg(m).nbytes() }
+func (m Rsymlink) bytes() []byte { return m }
+func (m Rsymlink) Qid() Qid      { return Qid(m[7:20]) }
+
+func (m Rsymlink) String() string { return fmt.Sprintf("Rsymlink qid=%q", m.Qid()) }
+
+// A Tmknod message creates a device node, named pipe or socket, Name,
+// in the directory represented by Fid.
+type Tmknod []byte
+
+func (m Tmknod) Tag() uint16   { return msg(m).Tag() }
+func (m Tmknod) Len() int64    { return msg(m).Len() }
+func (m Tmknod) nbytes() int64 { return msg(m).nbytes() }
+func (m Tmknod) bytes() []byte { return m }
+
+// Fid is the directory in which to create the new file.
+func (m Tmknod) Fid() uint32  { return guint32(m[7:11]) }
+func (m Tmknod) Name() []byte { return nthField(m, 11, 0) }
+
+// Mode contains the file type and permissions, as Unix mode bits.
+func (m Tmknod) Mode() uint32  { return guint32(m[13+len(m.Name()):]) }
+func (m Tmknod) Major() uint32 { return guint32(m[17+len(m.Name()):]) }
+func (m Tmknod) Minor() uint32 { return guint32(m[21+len(m.Name()):]) }
+func (m Tmknod) Gid() uint32   { return guint32(m[25+len(m.Name()):]) }
+
+func (m Tmknod) String() string {
+	return fmt.Sprintf("Tmknod dfid=%d name=%q mode=%#o major=%d minor=%d gid=%d",
+		m.Fid(), m.Name(), m.Mode(), m.Major(), m.Minor(), m.Gid())
+}
+
+// An Rmknod message is sent in response to a Tmknod message.
+type Rmknod []byte
+
+func (m Rmknod) Tag() uint16   { return msg(m).Tag() }
+func (m Rmknod) Len() int64    { return msg(m).Len() }
+func (m Rmknod) nbytes() int64 { return msg(m).nbytes() }
+func (m Rmknod) bytes() []byte { return m }
+func (m Rmknod) Qid() Qid      { return Qid(m[7:20]) }
+
+func (m Rmknod) String() string { return fmt.Sprintf("Rmknod qid=%q", m.Qid()) }
+
+// A Trename message moves the file represented by fid into the
+// directory represented by dfid, with the new name Name.
+type Trename []byte
+
+func (m Trename) Tag() uint16   { return msg(m).Tag() }
+func (m Trename) Len() int64    { return msg(m).Len() }
+func (m Trename) nbytes() int64 { return msg(m).nbytes() }
+func (m Trename) bytes() []byte { return m }
+func (m Trename) Fid() uint32   { return guint32(m[7:11]) }
+func (m Trename) Dfid() uint32  { return guint32(m[11:15]) }
+func (m Trename) Name() []byte  { return nthField(m, 15, 0) }
+
+func (m Trename) String() string {
+	return fmt.Sprintf("Trename fid=%d dfid=%d name=%q", m.Fid(), m.Dfid(), m.Name())
+}
+
+// An Rrename message is sent in response to a Trename message.
+type Rrename []byte
+
+func (m Rrename) Tag() uint16   { return msg(m).Tag() }
+func (m Rrename) Len() int64    { return msg(m).Len() }
+func (m Rrename) nbytes() int64 { return msg(m).nbytes() }
+func (m Rrename) bytes() []byte { return m }
+
+func (m Rrename) String() string { return "Rrename" }
+
+// A Treadlink message requests the target of the symbolic link
+// represented by fid.
+type Treadlink []byte
+
+func (m Treadlink) Tag() uint16   { return msg(m).Tag() }
+func (m Treadlink) Len() int64    { return msg(m).Len() }
+func (m Treadlink) nbytes() int64 { return msg(m).nbytes() }
+func (m Treadlink) bytes() []byte { return m }
+func (m Treadlink) Fid() uint32   { return guint32(m[7:11]) }
+
+func (m Treadlink) String() string { return fmt.Sprintf("Treadlink fid=%d", m.Fid()) }
+
+// An Rreadlink message is sent in response to a Treadlink message.
+type Rreadlink []byte
+
+func (m Rreadlink) Tag() uint16    { return msg(m).Tag() }
+func (m Rreadlink) Len() int64     { return msg(m).Len() }
+func (m Rreadlink) nbytes() int64  { return msg(m).nbytes() }
+func (m Rreadlink) bytes() []byte  { return m }
+func (m Rreadlink) Target() []byte { return nthField(m, 7, 0) }
+
+func (m Rreadlink) String() string { return fmt.Sprintf("Rreadlink target=%q", m.Target()) }
+
+// The Tgetattr message replaces Tstat in 9P2000.L. RequestMask is a
+// bitmask of the Getattr constants, describing the attributes the
+// client is interested in.
+type Tgetattr []byte
+
+func (m Tgetattr) Tag() uint16         { return msg(m).Tag() }
+func (m Tgetattr) Len() int64          { return msg(m).Len() }
+func (m Tgetattr) nbytes() int64       { return msg(m).nbytes() }
+func (m Tgetattr) bytes() []byte       { return m }
+func (m Tgetattr) Fid() uint32         { return guint32(m[7:11]) }
+func (m Tgetattr) RequestMask() uint64 { return guint64(m[11:19]) }
+
+func (m Tgetattr) String() string {
+	return fmt.Sprintf("Tgetattr fid=%d request_mask=%#x", m.Fid(), m.RequestMask())
+}
+
+// Attr contains the attributes of a file, as in the Linux stat(2)
+// system call. It is used to construct Rgetattr messages. The Valid
+// field is a bitmask of the Getattr constants, describing which of
+// the other fields are set.
+type Attr struct {
+	Valid       uint64
+	Qid         Qid
+	Mode        uint32 // file type and permissions, as Unix mode bits
+	Uid, Gid    uint32
+	Nlink       uint64
+	Rdev        uint64
+	Size        uint64
+	Blksize     uint64
+	Blocks      uint64
+	Atime       time.Time
+	Mtime       time.Time
+	Ctime       time.Time
+	Btime       time.Time
+	Gen         uint64
+	DataVersion uint64
+}
+
+// An Rgetattr message is sent in response to a Tgetattr message.
+type Rgetattr []byte
+
+func (m Rgetattr) Tag() uint16   { return msg(m).Tag() }
+func (m Rgetattr) Len() int64    { return msg(m).Len() }
+func (m Rgetattr) nbytes() int64 { return msg(m).nbytes() }
+func (m Rgetattr) bytes() []byte { return m }
+
+// Valid is a bitmask of the Getattr constants, describing which
+// fields of the message contain meaningful values.
+func (m Rgetattr) Valid() uint64       { return guint64(m[7:15]) }
+func (m Rgetattr) Qid() Qid            { return Qid(m[15:28]) }
+func (m Rgetattr) Mode() uint32        { return guint32(m[28:32]) }
+func (m Rgetattr) Uid() uint32         { return guint32(m[32:36]) }
+func (m Rgetattr) Gid() uint32         { return guint32(m[36:40]) }
+func (m Rgetattr) Nlink() uint64       { return guint64(m[40:48]) }
+func (m Rgetattr) Rdev() uint64        { return guint64(m[48:56]) }
+func (m Rgetattr) Size() uint64        { return guint64(m[56:64]) }
+func (m Rgetattr) Blksize() uint64     { return guint64(m[64:72]) }
+func (m Rgetattr) Blocks() uint64      { return guint64(m[72:80]) }
+func (m Rgetattr) Atime() time.Time    { return gtime(m[80:96]) }
+func (m Rgetattr) Mtime() time.Time    { return gtime(m[96:112]) }
+func (m Rgetattr) Ctime() time.Time    { return gtime(m[112:128]) }
+func (m Rgetattr) Btime() time.Time    { return gtime(m[128:144]) }
+func (m Rgetattr) Gen() uint64         { return guint64(m[144:152]) }
+func (m Rgetattr) DataVersion() uint64 { return guint64(m[152:160]) }
+
+func (m Rgetattr) String() string {
+	return fmt.Sprintf("Rgetattr valid=%#x qid=%q mode=%#o uid=%d gid=%d nlink=%d size=%d mtime=%d",
+		m.Valid(), m.Qid(), m.Mode(), m.Uid(), m.Gid(), m.Nlink(), m.Size(), m.Mtime().Unix())
+}
+
+// The Tsetattr message replaces Twstat in 9P2000.L. Valid is a
+// bitmask of the Setattr constants, describing the attributes
+// to change.
+type Tsetattr []byte
+
+func (m Tsetattr) Tag() uint16      { return msg(m).Tag() }
+func (m Tsetattr) Len() int64       { return msg(m).Len() }
+func (m Tsetattr) nbytes() int64    { return msg(m).nbytes() }
+func (m Tsetattr) bytes() []byte    { return m }
+func (m Tsetattr) Fid() uint32      { return guint32(m[7:11]) }
+func (m Tsetattr) Valid() uint32    { return guint32(m[11:15]) }
+func (m Tsetattr) Mode() uint32     { return guint32(m[15:19]) }
+func (m Tsetattr) Uid() uint32      { return guint32(m[19:23]) }
+func (m Tsetattr) Gid() uint32      { return guint32(m[23:27]) }
+func (m Tsetattr) Size() uint64     { return guint64(m[27:35]) }
+func (m Tsetattr) Atime() time.Time { return gtime(m[35:51]) }
+func (m Tsetattr) Mtime() time.Time { return gtime(m[51:67]) }
+
+func (m Tsetattr) String() string {
+	return fmt.Sprintf("Tsetattr fid=%d valid=%#x mode=%#o uid=%d gid=%d size=%d",
+		m.Fid(), m.Valid(), m.Mode(), m.Uid(), m.Gid(), m.Size())
+}
+
+// SetAttr contains the attributes to change in a Tsetattr message.
+type SetAttr struct {
+	Valid        uint32
+	Mode         uint32
+	Uid, Gid     uint32
+	Size         uint64
+	Atime, Mtime time.Time
+}
+
+// An Rsetattr message is sent in response to a Tsetattr message.
+type Rsetattr []byte
+
+func (m Rsetattr) Tag() uint16   { return msg(m).Tag() }
+func (m Rsetattr) Len() int64    { return msg(m).Len() }
+func (m Rsetattr) nbytes() int64 { return msg(m).nbytes() }
+func (m Rsetattr) bytes() []byte { return m }
+
+func (m Rsetattr) String() string { return "Rsetattr" }
+
+// A Txattrwalk message prepares newfid to read the extended attribute
+// Name of the file represented by fid. If Name is empty, newfid is
+// prepared to read the list of extended attributes of the file.
+type Txattrwalk []byte
+
+func (m Txattrwalk) Tag() uint16    { return msg(m).Tag() }
+func (m Txattrwalk) Len() int64     { return msg(m).Len() }
+func (m Txattrwalk) nbytes() int64  { return msg(m).nbytes() }
+func (m Txattrwalk) bytes() []byte  { return m }
+func (m Txattrwalk) Fid() uint32    { return guint32(m[7:11]) }
+func (m Txattrwalk) Newfid() uint32 { return guint32(m[11:15]) }
+func (m Txattrwalk) Name() []byte   { return nthField(m, 15, 0) }
+
+func (m Txattrwalk) String() string {
+	return fmt.Sprintf("Txattrwalk fid=%d newfid=%d name=%q", m.Fid(), m.Newfid(), m.Name())
+}
+
+// An Rxattrwalk message is sent in response to a Txattrwalk message.
+type Rxattrwalk []byte
+
+func (m Rxattrwalk) Tag() uint16   { return msg(m).Tag() }
+func (m Rxattrwalk) Len() int64    { return msg(m).Len() }
+func (m Rxattrwalk) nbytes() int64 { return msg(m).nbytes() }
+func (m Rxattrwalk) bytes() []byte { return m }
+func (m Rxattrwalk) Size() uint64  { return guint64(m[7:15]) }
+
+func (m Rxattrwalk) String() string { return fmt.Sprintf("Rxattrwalk size=%d", m.Size()) }
+
+// A Txattrcreate message prepares fid to write the extended attribute
+// Name of its file.
+type Txattrcreate []byte
+
+func (m Txattrcreate) Tag() uint16      { return msg(m).Tag() }
+func (m Txattrcreate) Len() int64       { return msg(m).Len() }
+func (m Txattrcreate) nbytes() int64    { return msg(m).nbytes() }
+func (m Txattrcreate) bytes() []byte    { return m }
+func (m Txattrcreate) Fid() uint32      { return guint32(m[7:11]) }
+func (m Txattrcreate) Name() []byte     { return nthField(m, 11, 0) }
+func (m Txattrcreate) AttrSize() uint64 { return guint64(m[13+len(m.Name()):]) }
+func (m Txattrcreate) Flags() uint32    { return guint32(m[21+len(m.Name()):]) }
+
+func (m Txattrcreate) String() string {
+	return fmt.Sprintf("Txattrcreate fid=%d name=%q attr_size=%d flags=%#x",
+		m.Fid(), m.Name(), m.AttrSize(), m.Flags())
+}
+
+// An Rxattrcreate message is sent in response to a Txattrcreate message.
+type Rxattrcreate []byte
+
+func (m Rxattrcreate) Tag() uint16   { return msg(m).Tag() }
+func (m Rxattrcreate) Len() int64    { return msg(m).Len() }
+func (m Rxattrcreate) nbytes() int64 { return msg(m).nbytes() }
+func (m Rxattrcreate) bytes() []byte { return m }
+
+func (m Rxattrcreate) String() string { return "Rxattrcreate" }
+
+// A Treaddir message requests directory entries from the open
+// directory represented by fid. Offset is zero on the first request,
+// and is otherwise the Offset of the last Dirent received.
+type Treaddir []byte
+
+func (m Treaddir) Tag() uint16    { return msg(m).Tag() }
+func (m Treaddir) Len() int64     { return msg(m).Len() }
+func (m Treaddir) nbytes() int64  { return msg(m).nbytes() }
+func (m Treaddir) bytes() []byte  { return m }
+func (m Treaddir) Fid() uint32    { return guint32(m[7:11]) }
+func (m Treaddir) Offset() uint64 { return guint64(m[11:19]) }
+func (m Treaddir) Count() uint32  { return guint32(m[19:23]) }
+
+func (m Treaddir) String() string {
+	return fmt.Sprintf("Treaddir fid=%d offset=%d count=%d", m.Fid(), m.Offset(), m.Count())
+}
+
+// An Rreaddir message is sent in response to a Treaddir message. Its
+// data is a sequence of Dirent structures, and can be consumed using
+// the io.Reader interface.
+type Rreaddir struct {
+	r   io.Reader
+	msg msg // headers plus any extra buffered data
+}
+
+// Read copies len(p) bytes from an Rreaddir message's data field into
+// p. It returns the number of bytes copied and an error, if any.
+func (m Rreaddir) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+func (m Rreaddir) Tag() uint16   { return m.msg.Tag() }
+func (m Rreaddir) Len() int64    { return m.msg.Len() }
+func (m Rreaddir) nbytes() int64 { return m.msg.nbytes() }
+func (m Rreaddir) bytes() []byte { return m.msg[:11] }
+func (m Rreaddir) Count() int64  { return int64(guint32(m.msg[7:11])) }
+
+func (m Rreaddir) String() string { return fmt.Sprintf("Rreaddir count=%d", m.Count()) }
+
+// A Dirent is a directory entry in the data of an Rreaddir message.
+//
+//	qid[13] offset[8] type[1] name[s]
+type Dirent []byte
+
+// Qid is the qid of the file named by the directory entry.
+func (d Dirent) Qid() Qid { return Qid(d[:13]) }
+
+// Offset is an opaque value that may be used in a Treaddir request
+// to retrieve the entries following this one.
+func (d Dirent) Offset() uint64 { return guint64(d[13:21]) }
+
+// Type is the type of the file, one of the DT constants.
+func (d Dirent) Type() uint8  { return d[21] }
+func (d Dirent) Name() []byte { return nthField(d, 22, 0) }
+
+func (d Dirent) String() string {
+	return fmt.Sprintf("qid=%q offset=%d type=%d name=%q", d.Qid(), d.Offset(), d.Type(), d.Name())
+}
+
+// NewDirent creates a Dirent in buf. If buf is not large enough to
+// hold the Dirent, NewDirent returns a non-nil error. NewDirent returns
+// the remaining space in buf after the Dirent.
+func NewDirent(buf []byte, qid Qid, offset uint64, dtype uint8, name string) (Dirent, []byte, error) {
+	if len(name) > MaxFilenameLen {
+		return nil, buf, errLongFilename
+	}
+	n := direntFixedSize + len(name)
+	if len(buf) < n {
+		return nil, buf, errShortDirent
+	}
+	copy(buf, qid)
+	buint64(buf[13:21], offset)
+	buf[21] = dtype
+	buint16(buf[22:24], uint16(len(name)))
+	copy(buf[24:], name)
+	return Dirent(buf[:n]), buf[n:], nil
+}
+
+// A Tfsync message requests that the file represented by fid be flushed
+// to durable storage. If Datasync is non-zero, only the file data need
+// be flushed, as in the Linux fdatasync(2) system call.
+type Tfsync []byte
+
+func (m Tfsync) Tag() uint16   { return msg(m).Tag() }
+func (m Tfsync) Len() int64    { return msg(m).Len() }
+func (m Tfsync) nbytes() int64 { return msg(m).nbytes() }
+func (m Tfsync) bytes() []byte { return m }
+func (m Tfsync) Fid() uint32   { return guint32(m[7:11]) }
+
+// Datasync is only sent by newer clients, and is zero if not present.
+func (m Tfsync) Datasync() uint32 { return optUint32(m, 11, 0) }
+
+func (m Tfsync) String() string {
+	return fmt.Sprintf("Tfsync fid=%d datasync=%d", m.Fid(), m.Datasync())
+}
+
+// An Rfsync message is sent in response to a Tfsync message.
+type Rfsync []byte
+
+func (m Rfsync) Tag() uint16   { return msg(m).Tag() }
+func (m Rfsync) Len() int64    { return msg(m).Len() }
+func (m Rfsync) nbytes() int64 { return msg(m).nbytes() }
+func (m Rfsync) bytes() []byte { return m }
+
+func (m Rfsync) String() string { return "Rfsync" }
+
+// A Tlock message acquires or releases a POSIX record lock on the
+// file represented by fid.
+type Tlock []byte
+
+func (m Tlock) Tag() uint16      { return msg(m).Tag() }
+func (m Tlock) Len() int64       { return msg(m).Len() }
+func (m Tlock) nbytes() int64    { return msg(m).nbytes() }
+func (m Tlock) bytes() []byte    { return m }
+func (m Tlock) Fid() uint32      { return guint32(m[7:11]) }
+func (m Tlock) Type() uint8      { return m[11] }
+func (m Tlock) Flags() uint32    { return guint32(m[12:16]) }
+func (m Tlock) Start() uint64    { return guint64(m[16:24]) }
+func (m Tlock) Length() uint64   { return guint64(m[24:32]) }
+func (m Tlock) ProcID() uint32   { return guint32(m[32:36]) }
+func (m Tlock) ClientID() []byte { return nthField(m, 36, 0) }
+
+func (m Tlock) String() string {
+	return fmt.Sprintf("Tlock fid=%d type=%d flags=%#x start=%d length=%d proc_id=%d client_id=%q",
+		m.Fid(), m.Type(), m.Flags(), m.Start(), m.Length(), m.ProcID(), m.ClientID())
+}
+
+// An Rlock message is sent in response to a Tlock message.
+type Rlock []byte
+
+func (m Rlock) Tag() uint16   { return msg(m).Tag() }
+func (m Rlock) Len() int64    { return msg(m).Len() }
+func (m Rlock) nbytes() int64 { return msg(m).nbytes() }
+func (m Rlock) bytes() []byte { return m }
+
+// Status is one of the Lock status constants, such as LockSuccess.
+func (m Rlock) Status() uint8 { return m[7] }
+
+func (m Rlock) String() string { return fmt.Sprintf("Rlock status=%d", m.Status()) }
+
+// A Tgetlock message tests for the existence of a POSIX record lock
+// on the file represented by fid.
+type Tgetlock []byte
+
+func (m Tgetlock) Tag() uint16      { return msg(m).Tag() }
+func (m Tgetlock) Len() int64       { return msg(m).Len() }
+func (m Tgetlock) nbytes() int64    { return msg(m).nbytes() }
+func (m Tgetlock) bytes() []byte    { return m }
+func (m Tgetlock) Fid() uint32      { return guint32(m[7:11]) }
+func (m Tgetlock) Type() uint8      { return m[11] }
+func (m Tgetlock) Start() uint64    { return guint64(m[12:20]) }
+func (m Tgetlock) Length() uint64   { return guint64(m[20:28]) }
+func (m Tgetlock) ProcID() uint32   { return guint32(m[28:32]) }
+func (m Tgetlock) ClientID() []byte { return nthField(m, 32, 0) }
+
+func (m Tgetlock) String() string {
+	return fmt.Sprintf("Tgetlock fid=%d type=%d start=%d length=%d proc_id=%d client_id=%q",
+		m.Fid(), m.Type(), m.Start(), m.Length(), m.ProcID(), m.ClientID())
+}
+
+// An Rgetlock message is sent in response to a Tgetlock message. If
+// there is no conflicting lock, Type is LockTypeUnlck.
+type Rgetlock []byte
+
+func (m Rgetlock) Tag() uint16      { return msg(m).Tag() }
+func (m Rgetlock) Len() int64       { return msg(m).Len() }
+func (m Rgetlock) nbytes() int64    { return msg(m).nbytes() }
+func (m Rgetlock) bytes() []byte    { return m }
+func (m Rgetlock) Type() uint8      { return m[7] }
+func (m Rgetlock) Start() uint64    { return guint64(m[8:16]) }
+func (m Rgetlock) Length() uint64   { return guint64(m[16:24]) }
+func (m Rgetlock) ProcID() uint32   { return guint32(m[24:28]) }
+func (m Rgetlock) ClientID() []byte { return nthField(m, 28, 0) }
+
+func (m Rgetlock) String() string {
+	return fmt.Sprintf("Rgetlock type=%d start=%d length=%d proc_id=%d client_id=%q",
+		m.Type(), m.Start(), m.Length(), m.ProcID(), m.ClientID())
+}
+
+// A Tlink message creates a hard link, Name, in the directory
+// represented by Dfid, to the file represented by Fid.
+type Tlink []byte
+
+func (m Tlink) Tag() uint16   { return msg(m).Tag() }
+func (m Tlink) Len() int64    { return msg(m).Len() }
+func (m Tlink) nbytes() int64 { return msg(m).nbytes() }
+func (m Tlink) bytes() []byte { return m }
+func (m Tlink) Dfid() uint32  { return guint32(m[7:11]) }
+func (m Tlink) Fid() uint32   { return guint32(m[11:15]) }
+func (m Tlink) Name() []byte  { return nthField(m, 15, 0) }
+
+func (m Tlink) String() string {
+	return fmt.Sprintf("Tlink dfid=%d fid=%d name=%q", m.Dfid(), m.Fid(), m.Name())
+}
+
+// An Rlink message is sent in response to a Tlink message.
+type Rlink []byte
+
+func (m Rlink) Tag() uint16   { return msg(m).Tag() }
+func (m Rlink) Len() int64    { return msg(m).Len() }
+func (m Rlink) nbytes() int64 { return msg(m).nbytes() }
+func (m Rlink) bytes() []byte { return m }
+
+func (m Rlink) String() string { return "Rlink" }
+
+// A Tmkdir message creates a directory, Name, in the directory
+// represented by Fid. Unlike Tcreate, Fid is left unchanged.
+type Tmkdir []byte
+
+func (m Tmkdir) Tag() uint16   { return msg(m).Tag() }
+func (m Tmkdir) Len() int64    { return msg(m).Len() }
+func (m Tmkdir) nbytes() int64 { return msg(m).nbytes() }
+func (m Tmkdir) bytes() []byte { return m }
+
+// Fid is the directory in which to create the new directory.
+func (m Tmkdir) Fid() uint32  { return guint32(m[7:11]) }
+func (m Tmkdir) Name() []byte { return nthField(m, 11, 0) }
+
+// Mode contains the permissions of the new directory, as Unix mode
+// bits.
+func (m Tmkdir) Mode() uint32 { return guint32(m[13+len(m.Name()):]) }
+func (m Tmkdir) Gid() uint32  { return guint32(m[17+len(m.Name()):]) }
+
+func (m Tmkdir) String() string {
+	return fmt.Sprintf("Tmkdir dfid=%d name=%q mode=%#o gid=%d", m.Fid(), m.Name(), m.Mode(), m.Gid())
+}
+
+// An Rmkdir message is sent in response to a Tmkdir message.
+type Rmkdir []byte
+
+func (m Rmkdir) Tag() uint16   { return msg(m).Tag() }
+func (m Rmkdir) Len() int64    { return msg(m).Len() }
+func (m Rmkdir) nbytes() int64 { return msg(m).nbytes() }
+func (m Rmkdir) bytes() []byte { return m }
+func (m Rmkdir) Qid() Qid      { return Qid(m[7:20]) }
+
+func (m Rmkdir) String() string { return fmt.Sprintf("Rmkdir qid=%q", m.Qid()) }
+
+// A Trenameat message renames the file Oldname in the directory
+// represented by Fid to Newname in the directory represented by
+// Newdirfid.
+type Trenameat []byte
+
+func (m Trenameat) Tag() uint16   { return msg(m).Tag() }
+func (m Trenameat) Len() int64    { return msg(m).Len() }
+func (m Trenameat) nbytes() int64 { return msg(m).nbytes() }
+func (m Trenameat) bytes() []byte { return m }
+
+// Fid is the directory containing the file to rename.
+func (m Trenameat) Fid() uint32       { return guint32(m[7:11]) }
+func (m Trenameat) Oldname() []byte   { return nthField(m, 11, 0) }
+func (m Trenameat) Newdirfid() uint32 { return guint32(m[13+len(m.Oldname()):]) }
+func (m Trenameat) Newname() []byte   { return nthField(m, 17+len(m.Oldname()), 0) }
+
+func (m Trenameat) String() string {
+	return fmt.Sprintf("Trenameat olddirfid=%d oldname=%q newdirfid=%d newname=%q",
+		m.Fid(), m.Oldname(), m.Newdirfid(), m.Newname())
+}
+
+// An Rrenameat message is sent in response to a Trenameat message.
+type Rrenameat []byte
+
+func (m Rrenameat) Tag() uint16   { return msg(m).Tag() }
+func (m Rrenameat) Len() int64    { return msg(m).Len() }
+func (m Rrenameat) nbytes() int64 { return msg(m).nbytes() }
+func (m Rrenameat) bytes() []byte { return m }
+
+func (m Rrenameat) String() string { return "Rrenameat" }
+
+// A Tunlinkat message removes the file Name from the directory
+// represented by Fid. To remove a directory, ATREMOVEDIR must be
+// set in Flags.
+type Tunlinkat []byte
+
+func (m Tunlinkat) Tag() uint16   { return msg(m).Tag() }
+func (m Tunlinkat) Len() int64    { return msg(m).Len() }
+func (m Tunlinkat) nbytes() int64 { return msg(m).nbytes() }
+func (m Tunlinkat) bytes() []byte { return m }
+
+// Fid is the directory containing the file to remove.
+func (m Tunlinkat) Fid() uint32   { return guint32(m[7:11]) }
+func (m Tunlinkat) Name() []byte  { return nthField(m, 11, 0) }
+func (m Tunlinkat) Flags() uint32 { return guint32(m[13+len(m.Name()):]) }
+
+func (m Tunlinkat) String() string {
+	return fmt.Sprintf("Tunlinkat dirfd=%d name=%q flags=%#x", m.Fid(), m.Name(), m.Flags())
+}
+
+// An Runlinkat message is sent in response to a Tunlinkat message.
+type Runlinkat []byte
+
+func (m Runlinkat) Tag() uint16   { return msg(m).Tag() }
+func (m Runlinkat) Len() int64    { return msg(m).Len() }
+func (m Runlinkat) nbytes() int64 { return msg(m).nbytes() }
+func (m Runlinkat) bytes() []byte { return m }
+
+func (m Runlinkat) String() string { return "Runlinkat" }
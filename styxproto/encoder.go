@@ -2,26 +2,48 @@ package styxproto
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"sync"
 )
 
+// The data of Rread and Twrite messages at least this large is
+// written directly to the underlying io.Writer, instead of being
+// copied through an Encoder's buffer.
+const directWriteSize = 4096
+
 // An Encoder writes 9P messages to an underlying
 // io.Writer.
 type Encoder struct {
 	MaxSize int64
-	mu      sync.Mutex
-	w       *bufio.Writer
+
+	// Limits sets the maximum lengths of the variable-length
+	// fields of the messages an Encoder writes. The documentation
+	// of each method refers to the default limits.
+	Limits Limits
+
+	mu     sync.Mutex
+	w      *bufio.Writer
+	direct *stickyWriter
+	pool   *BufferPool // pool that w was taken from, if any
+
+	// used by writeData
+	hdr  bytes.Buffer
+	vec  [2][]byte
+	bufs net.Buffers
 }
 
 // NewEncoder creates a new Encoder that writes 9P messages
 // to w. Encoders are safe to use from multiple goroutines.
 // An Encoder does not perform any buffering of messages.
 func NewEncoder(w io.Writer) *Encoder {
+	direct := &stickyWriter{w: w}
 	return &Encoder{
-		w: bufio.NewWriterSize(w, MinBufSize),
+		w:      bufio.NewWriterSize(direct, MinBufSize),
+		direct: direct,
 	}
 }
 
@@ -30,10 +52,56 @@ func NewEncoder(w io.Writer) *Encoder {
 func (enc *Encoder) Err() error {
 	enc.mu.Lock()
 	defer enc.mu.Unlock()
+	if enc.direct.err != nil {
+		return enc.direct.err
+	}
 	_, err := enc.w.Write(nil)
 	return err
 }
 
+// A stickyWriter remembers the first error returned by w. Because
+// large payloads bypass an Encoder's bufio.Writer, it must learn of
+// their errors through its underlying io.Writer.
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *stickyWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(p)
+	sw.err = err
+	return n, err
+}
+
+// writeData writes data following the message header in enc.hdr.
+// Small messages are buffered like any other. Large data is written
+// along with its header in a single call to the underlying
+// io.Writer, once any buffered messages are flushed, using writev(2)
+// if it is a network connection that supports it. It returns the
+// number of bytes of data written. The caller must hold enc.mu.
+func (enc *Encoder) writeData(data []byte) (int, error) {
+	if len(data) < directWriteSize {
+		enc.w.Write(enc.hdr.Bytes())
+		return enc.w.Write(data)
+	}
+	if err := enc.w.Flush(); err != nil {
+		return 0, err
+	}
+	nhdr := int64(enc.hdr.Len())
+	enc.vec = [2][]byte{enc.hdr.Bytes(), data}
+	enc.bufs = enc.vec[:]
+	n, err := enc.bufs.WriteTo(enc.direct.w)
+	enc.vec = [2][]byte{}
+	enc.direct.err = err
+	if n -= nhdr; n < 0 {
+		n = 0
+	}
+	return int(n), err
+}
+
 // Flush flushes any buffered data to the underlying io.Writer.
 func (enc *Encoder) Flush() error {
 	enc.mu.Lock()
@@ -45,8 +113,8 @@ func (enc *Encoder) Flush() error {
 // The Tag of the written message will be NoTag. If the version string
 // is longer than MaxVersionLen, it is truncated.
 func (enc *Encoder) Tversion(msize uint32, version string) {
-	if len(version) > MaxVersionLen {
-		version = version[:MaxVersionLen]
+	if len(version) > enc.Limits.version() {
+		version = version[:enc.Limits.version()]
 	}
 	size := uint32(minSizeLUT[msgTversion] + len(version))
 
@@ -60,8 +128,8 @@ func (enc *Encoder) Tversion(msize uint32, version string) {
 // Rversion writes an Rversion message to the underlying io.Writer.
 // If the version string is longer than MaxVerisonLen, it is truncated.
 func (enc *Encoder) Rversion(msize uint32, version string) {
-	if len(version) > MaxVersionLen {
-		version = version[:MaxVersionLen]
+	if len(version) > enc.Limits.version() {
+		version = version[:enc.Limits.version()]
 	}
 	size := uint32(minSizeLUT[msgRversion] + len(version))
 
@@ -76,11 +144,11 @@ func (enc *Encoder) Rversion(msize uint32, version string) {
 // and aname parameters will be truncated if they are longer than MaxUidLen
 // and MaxAttachLen, respectively.
 func (enc *Encoder) Tauth(tag uint16, afid uint32, uname, aname string) {
-	if len(uname) > MaxUidLen {
-		uname = uname[:MaxUidLen]
+	if len(uname) > enc.Limits.uid() {
+		uname = uname[:enc.Limits.uid()]
 	}
-	if len(aname) > MaxAttachLen {
-		aname = aname[:MaxAttachLen]
+	if len(aname) > enc.Limits.attach() {
+		aname = aname[:enc.Limits.attach()]
 	}
 	size := uint32(minSizeLUT[msgTauth] + len(uname) + len(aname))
 
@@ -91,6 +159,26 @@ func (enc *Encoder) Tauth(tag uint16, afid uint32, uname, aname string) {
 	pstring(enc.w, uname, aname)
 }
 
+// TauthU writes a 9P2000.u Tauth message to enc's underlying io.Writer,
+// which contains the numeric id of the user, nuname, in addition to the
+// fields written by Tauth.
+func (enc *Encoder) TauthU(tag uint16, afid uint32, uname, aname string, nuname uint32) {
+	if len(uname) > enc.Limits.uid() {
+		uname = uname[:enc.Limits.uid()]
+	}
+	if len(aname) > enc.Limits.attach() {
+		aname = aname[:enc.Limits.attach()]
+	}
+	size := uint32(dialectU.minSize(msgTauth) + len(uname) + len(aname))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTauth, tag, afid)
+	pstring(enc.w, uname, aname)
+	puint32(enc.w, nuname)
+}
+
 // Rauth writes a new Rauth message to the underlying io.Writer.
 func (enc *Encoder) Rauth(tag uint16, qid Qid) {
 	size := uint32(maxSizeLUT[msgRauth])
@@ -107,11 +195,11 @@ func (enc *Encoder) Rauth(tag uint16, qid Qid) {
 // The uname and aname parameters will be truncated if they are longer
 // than MaxUidLen and MaxAttachLen, respectively.
 func (enc *Encoder) Tattach(tag uint16, fid, afid uint32, uname, aname string) {
-	if len(uname) > MaxUidLen {
-		uname = uname[:MaxUidLen]
+	if len(uname) > enc.Limits.uid() {
+		uname = uname[:enc.Limits.uid()]
 	}
-	if len(aname) > MaxAttachLen {
-		aname = aname[:MaxAttachLen]
+	if len(aname) > enc.Limits.attach() {
+		aname = aname[:enc.Limits.attach()]
 	}
 	size := uint32(minSizeLUT[msgTattach] + len(uname) + len(aname))
 
@@ -122,6 +210,26 @@ func (enc *Encoder) Tattach(tag uint16, fid, afid uint32, uname, aname string) {
 	pstring(enc.w, uname, aname)
 }
 
+// TattachU writes a 9P2000.u Tattach message to the underlying
+// io.Writer, which contains the numeric id of the user, nuname, in
+// addition to the fields written by Tattach.
+func (enc *Encoder) TattachU(tag uint16, fid, afid uint32, uname, aname string, nuname uint32) {
+	if len(uname) > enc.Limits.uid() {
+		uname = uname[:enc.Limits.uid()]
+	}
+	if len(aname) > enc.Limits.attach() {
+		aname = aname[:enc.Limits.attach()]
+	}
+	size := uint32(dialectU.minSize(msgTattach) + len(uname) + len(aname))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTattach, tag, fid, afid)
+	pstring(enc.w, uname, aname)
+	puint32(enc.w, nuname)
+}
+
 // Rattach writes a new Rattach message to the underlying io.Writer.
 func (enc *Encoder) Rattach(tag uint16, qid Qid) {
 	size := uint32(maxSizeLUT[msgRattach])
@@ -142,8 +250,8 @@ func (enc *Encoder) Rerror(tag uint16, errfmt string, v ...interface{}) {
 	if len(v) > 0 {
 		ename = fmt.Sprintf(errfmt, v...)
 	}
-	if len(ename) > MaxErrorLen {
-		ename = ename[:MaxErrorLen]
+	if len(ename) > enc.Limits.ename() {
+		ename = ename[:enc.Limits.ename()]
 	}
 	size := uint32(minSizeLUT[msgRerror] + len(ename))
 
@@ -154,6 +262,27 @@ func (enc *Encoder) Rerror(tag uint16, errfmt string, v ...interface{}) {
 	pstring(enc.w, ename)
 }
 
+// RerrorU writes a 9P2000.u Rerror message to the underlying io.Writer,
+// which contains the numeric error code errno in addition to the error
+// string. Errno is typically a unix error number.
+func (enc *Encoder) RerrorU(tag uint16, errno uint32, errfmt string, v ...interface{}) {
+	ename := errfmt
+	if len(v) > 0 {
+		ename = fmt.Sprintf(errfmt, v...)
+	}
+	if len(ename) > enc.Limits.ename() {
+		ename = ename[:enc.Limits.ename()]
+	}
+	size := uint32(dialectU.minSize(msgRerror) + len(ename))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRerror, tag)
+	pstring(enc.w, ename)
+	puint32(enc.w, errno)
+}
+
 // Tflush writes a new Tflush message to the underlying io.Writer.
 func (enc *Encoder) Tflush(tag, oldtag uint16) {
 	size := uint32(maxSizeLUT[msgTflush])
@@ -185,7 +314,7 @@ func (enc *Encoder) Twalk(tag uint16, fid, newfid uint32, wname ...string) error
 	}
 	size := uint32(minSizeLUT[msgTwalk])
 	for _, v := range wname {
-		if len(v) > MaxFilenameLen {
+		if len(v) > enc.Limits.filename() {
 			return errLongFilename
 		}
 		size += 2
@@ -246,8 +375,8 @@ func (enc *Encoder) Ropen(tag uint16, qid Qid, iounit uint32) {
 // Tcreate writes a new Tcreate message to the underlying io.Writer. If
 // name is longer than MaxFilenameLen, it is truncated.
 func (enc *Encoder) Tcreate(tag uint16, fid uint32, name string, perm uint32, mode uint8) {
-	if len(name) > MaxFilenameLen {
-		name = name[:MaxFilenameLen]
+	if len(name) > enc.Limits.filename() {
+		name = name[:enc.Limits.filename()]
 	}
 	size := uint32(minSizeLUT[msgTcreate] + len(name))
 
@@ -260,6 +389,31 @@ func (enc *Encoder) Tcreate(tag uint16, fid uint32, name string, perm uint32, mo
 	puint8(enc.w, mode)
 }
 
+// TcreateU writes a 9P2000.u Tcreate message to the underlying
+// io.Writer. The extension string is used to create special files,
+// such as symbolic links and device files. An error is returned if
+// extension is longer than MaxExtensionLen. If name is longer than
+// MaxFilenameLen, it is truncated.
+func (enc *Encoder) TcreateU(tag uint16, fid uint32, name string, perm uint32, mode uint8, extension string) error {
+	if len(extension) > enc.Limits.extension() {
+		return errLongExtension
+	}
+	if len(name) > enc.Limits.filename() {
+		name = name[:enc.Limits.filename()]
+	}
+	size := uint32(dialectU.minSize(msgTcreate) + len(name) + len(extension))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTcreate, tag, fid)
+	pstring(enc.w, name)
+	puint32(enc.w, perm)
+	puint8(enc.w, mode)
+	pstring(enc.w, extension)
+	return nil
+}
+
 // Rcreate writes a new Rcreate message to the underlying io.Writer.
 func (enc *Encoder) Rcreate(tag uint16, qid Qid, iounit uint32) {
 	size := uint32(maxSizeLUT[msgRcreate])
@@ -314,8 +468,9 @@ func (enc *Encoder) Rread(tag uint16, data []byte) (n int, err error) {
 		size := uint32(minSizeLUT[msgRread]) + uint32(len(chunk))
 
 		enc.mu.Lock()
-		pheader(enc.w, size, msgRread, tag, uint32(len(chunk)))
-		nchunk, err = enc.w.Write(chunk)
+		enc.hdr.Reset()
+		pheader(&enc.hdr, size, msgRread, tag, uint32(len(chunk)))
+		nchunk, err = enc.writeData(chunk)
 		enc.mu.Unlock()
 
 		n += nchunk
@@ -338,10 +493,36 @@ func (enc *Encoder) Twrite(tag uint16, fid uint32, offset int64, data []byte) (i
 	enc.mu.Lock()
 	defer enc.mu.Unlock()
 
+	enc.hdr.Reset()
+	pheader(&enc.hdr, size, msgTwrite, tag, fid)
+	puint64(&enc.hdr, uint64(offset))
+	puint32(&enc.hdr, uint32(len(data)))
+	return enc.writeData(data)
+}
+
+// TwriteFrom writes a Twrite message to the underlying io.Writer,
+// copying its n bytes of data from r, so that large writes need not
+// be held in memory. Other messages cannot be written until the copy
+// completes. An error is returned if n bytes cannot fit inside a
+// single 9P message. If r returns fewer than n bytes, the message is
+// left incomplete and the connection cannot be used any further.
+func (enc *Encoder) TwriteFrom(tag uint16, fid uint32, offset int64, r io.Reader, n int64) (int64, error) {
+	if n < 0 || int64(math.MaxUint32-minSizeLUT[msgTwrite]) < n {
+		return 0, errTooBig
+	}
+	size := uint32(minSizeLUT[msgTwrite]) + uint32(n)
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
 	pheader(enc.w, size, msgTwrite, tag, fid)
 	puint64(enc.w, uint64(offset))
-	puint32(enc.w, uint32(len(data)))
-	return enc.w.Write(data)
+	puint32(enc.w, uint32(n))
+	written, err := io.CopyN(enc.w, r, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
 }
 
 // Rwrite writes an Rwrite message to the underlying io.Writer.
@@ -411,9 +592,9 @@ func (enc *Encoder) Tstat(tag uint16, fid uint32) {
 
 // Rstat writes an Rstat message to the underlying io.Writer.
 // If the Stat is larger than the maximum size allowed by
-// the NewStat function, a run-time panic occurs.
+// the NewStatU function, a run-time panic occurs.
 func (enc *Encoder) Rstat(tag uint16, stat Stat) {
-	if len(stat) > MaxStatLen {
+	if len(stat) > MaxStatLenU {
 		panic(errLongStat)
 	}
 	if len(stat) < minStatLen {
@@ -430,9 +611,9 @@ func (enc *Encoder) Rstat(tag uint16, stat Stat) {
 
 // Twstat writes a Twstat message to the underlying io.Writer.
 // If the Stat is larger than the maximum size allowed by the
-// NewStat function, a run-time panic occurs.
+// NewStatU function, a run-time panic occurs.
 func (enc *Encoder) Twstat(tag uint16, fid uint32, stat Stat) {
-	if len(stat) > MaxStatLen {
+	if len(stat) > MaxStatLenU {
 		panic(errLongStat)
 	}
 	if len(stat) < minStatLen {
@@ -0,0 +1,121 @@
+package styxproto
+
+// Encoder methods for the 9P2000.e extension. The data of Rsread and
+// Tswrite messages cannot be split across messages; an error is
+// returned if a message would be larger than the Encoder's MaxSize.
+
+// Tsession writes a Tsession message to the underlying io.Writer.
+func (enc *Encoder) Tsession(tag uint16, key uint64) {
+	size := uint32(minSizeLUT[msgTsession])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTsession, tag)
+	puint64(enc.w, key)
+}
+
+// Rsession writes an Rsession message to the underlying io.Writer.
+func (enc *Encoder) Rsession(tag uint16) {
+	size := uint32(minSizeLUT[msgRsession])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRsession, tag)
+}
+
+// wnameSize returns the size of a list of path elements, or an
+// error if the list is too long or an element is longer than the
+// Encoder's filename limit.
+func (enc *Encoder) wnameSize(wname []string) (uint32, error) {
+	if len(wname) > MaxWElem {
+		return 0, errMaxWElem
+	}
+	var size uint32
+	for _, v := range wname {
+		if len(v) > enc.Limits.filename() {
+			return 0, errLongFilename
+		}
+		size += 2 + uint32(len(v))
+	}
+	return size, nil
+}
+
+// checkSize returns an error if a message of the given size is
+// larger than the Encoder's MaxSize.
+func (enc *Encoder) checkSize(size int64) error {
+	if size > maxMsgSize || (enc.MaxSize > 0 && size > enc.MaxSize) {
+		return errTooBig
+	}
+	return nil
+}
+
+// Tsread writes a Tsread message to the underlying io.Writer. An
+// error is returned if wname has more than MaxWElem elements, or if
+// any element is longer than MaxFilenameLen bytes.
+func (enc *Encoder) Tsread(tag uint16, fid uint32, wname ...string) error {
+	n, err := enc.wnameSize(wname)
+	if err != nil {
+		return err
+	}
+	size := uint32(minSizeLUT[msgTsread]) + n
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTsread, tag, fid)
+	puint16(enc.w, uint16(len(wname)))
+	pstring(enc.w, wname...)
+	return nil
+}
+
+// Rsread writes an Rsread message to the underlying io.Writer.
+func (enc *Encoder) Rsread(tag uint16, data []byte) error {
+	size := int64(minSizeLUT[msgRsread]) + int64(len(data))
+	if err := enc.checkSize(size); err != nil {
+		return err
+	}
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, uint32(size), msgRsread, tag, uint32(len(data)))
+	enc.w.Write(data)
+	return nil
+}
+
+// Tswrite writes a Tswrite message to the underlying io.Writer. An
+// error is returned if wname has more than MaxWElem elements, if any
+// element is longer than MaxFilenameLen bytes, or if the message
+// would be too large.
+func (enc *Encoder) Tswrite(tag uint16, fid uint32, wname []string, data []byte) error {
+	n, err := enc.wnameSize(wname)
+	if err != nil {
+		return err
+	}
+	size := int64(minSizeLUT[msgTswrite]) + int64(n) + int64(len(data))
+	if err := enc.checkSize(size); err != nil {
+		return err
+	}
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, uint32(size), msgTswrite, tag, fid)
+	puint16(enc.w, uint16(len(wname)))
+	pstring(enc.w, wname...)
+	puint32(enc.w, uint32(len(data)))
+	enc.w.Write(data)
+	return nil
+}
+
+// Rswrite writes an Rswrite message to the underlying io.Writer.
+func (enc *Encoder) Rswrite(tag uint16, count int64) {
+	size := uint32(minSizeLUT[msgRswrite])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRswrite, tag, uint32(count))
+}
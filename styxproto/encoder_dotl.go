@@ -0,0 +1,519 @@
+package styxproto
+
+import (
+	"io"
+	"time"
+)
+
+// Encoder methods for the 9P2000.L extension. As with Tcreate, file
+// names longer than the Encoder's filename limit are truncated.
+
+func (enc *Encoder) truncName(name string) string {
+	if len(name) > enc.Limits.filename() {
+		return name[:enc.Limits.filename()]
+	}
+	return name
+}
+
+func ptime(w io.Writer, t ...time.Time) {
+	for _, tt := range t {
+		sec, nsec := unixTime(tt)
+		puint64(w, sec)
+		puint64(w, nsec)
+	}
+}
+
+// Rlerror writes an Rlerror message to the underlying io.Writer.
+// ecode should be a Linux error number, such as ENOENT.
+func (enc *Encoder) Rlerror(tag uint16, ecode uint32) {
+	size := uint32(minSizeLUT[msgRlerror])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRlerror, tag, ecode)
+}
+
+// Tstatfs writes a Tstatfs message to the underlying io.Writer.
+func (enc *Encoder) Tstatfs(tag uint16, fid uint32) {
+	size := uint32(minSizeLUT[msgTstatfs])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTstatfs, tag, fid)
+}
+
+// Rstatfs writes an Rstatfs message to the underlying io.Writer.
+func (enc *Encoder) Rstatfs(tag uint16, st Statfs) {
+	size := uint32(minSizeLUT[msgRstatfs])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRstatfs, tag, st.Type, st.Bsize)
+	puint64(enc.w, st.Blocks)
+	puint64(enc.w, st.Bfree)
+	puint64(enc.w, st.Bavail)
+	puint64(enc.w, st.Files)
+	puint64(enc.w, st.Ffree)
+	puint64(enc.w, st.Fsid)
+	puint32(enc.w, st.Namelen)
+}
+
+// Tlopen writes a Tlopen message to the underlying io.Writer.
+func (enc *Encoder) Tlopen(tag uint16, fid, flags uint32) {
+	size := uint32(minSizeLUT[msgTlopen])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTlopen, tag, fid, flags)
+}
+
+// Rlopen writes an Rlopen message to the underlying io.Writer.
+func (enc *Encoder) Rlopen(tag uint16, qid Qid, iounit uint32) {
+	size := uint32(minSizeLUT[msgRlopen])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRlopen, tag)
+	pqid(enc.w, qid)
+	puint32(enc.w, iounit)
+}
+
+// Tlcreate writes a Tlcreate message to the underlying io.Writer.
+func (enc *Encoder) Tlcreate(tag uint16, fid uint32, name string, flags, mode, gid uint32) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTlcreate] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTlcreate, tag, fid)
+	pstring(enc.w, name)
+	puint32(enc.w, flags, mode, gid)
+}
+
+// Rlcreate writes an Rlcreate message to the underlying io.Writer.
+func (enc *Encoder) Rlcreate(tag uint16, qid Qid, iounit uint32) {
+	size := uint32(minSizeLUT[msgRlcreate])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRlcreate, tag)
+	pqid(enc.w, qid)
+	puint32(enc.w, iounit)
+}
+
+// Tsymlink writes a Tsymlink message to the underlying io.Writer. An
+// error is returned if target is longer than MaxExtensionLen.
+func (enc *Encoder) Tsymlink(tag uint16, fid uint32, name, target string, gid uint32) error {
+	if len(target) > enc.Limits.extension() {
+		return errLongExtension
+	}
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTsymlink] + len(name) + len(target))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTsymlink, tag, fid)
+	pstring(enc.w, name, target)
+	puint32(enc.w, gid)
+	return nil
+}
+
+// Rsymlink writes an Rsymlink message to the underlying io.Writer.
+func (enc *Encoder) Rsymlink(tag uint16, qid Qid) {
+	enc.rqid(msgRsymlink, tag, qid)
+}
+
+// Tmknod writes a Tmknod message to the underlying io.Writer.
+func (enc *Encoder) Tmknod(tag uint16, dfid uint32, name string, mode, major, minor, gid uint32) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTmknod] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTmknod, tag, dfid)
+	pstring(enc.w, name)
+	puint32(enc.w, mode, major, minor, gid)
+}
+
+// Rmknod writes an Rmknod message to the underlying io.Writer.
+func (enc *Encoder) Rmknod(tag uint16, qid Qid) {
+	enc.rqid(msgRmknod, tag, qid)
+}
+
+// Trename writes a Trename message to the underlying io.Writer.
+func (enc *Encoder) Trename(tag uint16, fid, dfid uint32, name string) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTrename] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTrename, tag, fid, dfid)
+	pstring(enc.w, name)
+}
+
+// Rrename writes an Rrename message to the underlying io.Writer.
+func (enc *Encoder) Rrename(tag uint16) {
+	enc.rempty(msgRrename, tag)
+}
+
+// Treadlink writes a Treadlink message to the underlying io.Writer.
+func (enc *Encoder) Treadlink(tag uint16, fid uint32) {
+	size := uint32(minSizeLUT[msgTreadlink])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTreadlink, tag, fid)
+}
+
+// Rreadlink writes an Rreadlink message to the underlying io.Writer.
+// An error is returned if target is longer than MaxExtensionLen.
+func (enc *Encoder) Rreadlink(tag uint16, target string) error {
+	if len(target) > enc.Limits.extension() {
+		return errLongExtension
+	}
+	size := uint32(minSizeLUT[msgRreadlink] + len(target))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRreadlink, tag)
+	pstring(enc.w, target)
+	return nil
+}
+
+// Tgetattr writes a Tgetattr message to the underlying io.Writer.
+func (enc *Encoder) Tgetattr(tag uint16, fid uint32, mask uint64) {
+	size := uint32(minSizeLUT[msgTgetattr])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTgetattr, tag, fid)
+	puint64(enc.w, mask)
+}
+
+// Rgetattr writes an Rgetattr message to the underlying io.Writer.
+func (enc *Encoder) Rgetattr(tag uint16, attr Attr) {
+	size := uint32(minSizeLUT[msgRgetattr])
+	qid := attr.Qid
+	if qid == nil {
+		qid = make(Qid, QidLen)
+	}
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRgetattr, tag)
+	puint64(enc.w, attr.Valid)
+	pqid(enc.w, qid)
+	puint32(enc.w, attr.Mode, attr.Uid, attr.Gid)
+	puint64(enc.w, attr.Nlink)
+	puint64(enc.w, attr.Rdev)
+	puint64(enc.w, attr.Size)
+	puint64(enc.w, attr.Blksize)
+	puint64(enc.w, attr.Blocks)
+	ptime(enc.w, attr.Atime, attr.Mtime, attr.Ctime, attr.Btime)
+	puint64(enc.w, attr.Gen)
+	puint64(enc.w, attr.DataVersion)
+}
+
+// Tsetattr writes a Tsetattr message to the underlying io.Writer.
+func (enc *Encoder) Tsetattr(tag uint16, fid uint32, attr SetAttr) {
+	size := uint32(minSizeLUT[msgTsetattr])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTsetattr, tag, fid, attr.Valid, attr.Mode, attr.Uid, attr.Gid)
+	puint64(enc.w, attr.Size)
+	ptime(enc.w, attr.Atime, attr.Mtime)
+}
+
+// Rsetattr writes an Rsetattr message to the underlying io.Writer.
+func (enc *Encoder) Rsetattr(tag uint16) {
+	enc.rempty(msgRsetattr, tag)
+}
+
+// Txattrwalk writes a Txattrwalk message to the underlying io.Writer.
+func (enc *Encoder) Txattrwalk(tag uint16, fid, newfid uint32, name string) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTxattrwalk] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTxattrwalk, tag, fid, newfid)
+	pstring(enc.w, name)
+}
+
+// Rxattrwalk writes an Rxattrwalk message to the underlying io.Writer.
+func (enc *Encoder) Rxattrwalk(tag uint16, attrSize uint64) {
+	size := uint32(minSizeLUT[msgRxattrwalk])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRxattrwalk, tag)
+	puint64(enc.w, attrSize)
+}
+
+// Txattrcreate writes a Txattrcreate message to the underlying io.Writer.
+func (enc *Encoder) Txattrcreate(tag uint16, fid uint32, name string, attrSize uint64, flags uint32) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTxattrcreate] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTxattrcreate, tag, fid)
+	pstring(enc.w, name)
+	puint64(enc.w, attrSize)
+	puint32(enc.w, flags)
+}
+
+// Rxattrcreate writes an Rxattrcreate message to the underlying io.Writer.
+func (enc *Encoder) Rxattrcreate(tag uint16) {
+	enc.rempty(msgRxattrcreate, tag)
+}
+
+// Treaddir writes a Treaddir message to the underlying io.Writer.
+func (enc *Encoder) Treaddir(tag uint16, fid uint32, offset uint64, count uint32) {
+	size := uint32(minSizeLUT[msgTreaddir])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTreaddir, tag, fid)
+	puint64(enc.w, offset)
+	puint32(enc.w, count)
+}
+
+// Rreaddir writes an Rreaddir message to the underlying io.Writer.
+// data should be a sequence of Dirent structures, such as those
+// created by NewDirent. Unlike Rread, Rreaddir does not split data
+// into multiple messages, as the client could not tell them apart.
+// If data does not fit within the Encoder's MaxSize, it is cut
+// after the last whole Dirent that fits, and the client may ask
+// for the rest with another Treaddir. Rreaddir returns the number
+// of bytes of data written, plus any IO errors encountered.
+func (enc *Encoder) Rreaddir(tag uint16, data []byte) (int, error) {
+	msize := enc.MaxSize
+	if msize < MinBufSize {
+		msize = MinBufSize
+	}
+	if max := msize - int64(minSizeLUT[msgRreaddir]); int64(len(data)) > max {
+		data = data[:direntsLen(data, int(max))]
+	}
+	size := uint32(minSizeLUT[msgRreaddir] + len(data))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRreaddir, tag, uint32(len(data)))
+	return enc.w.Write(data)
+}
+
+// direntsLen returns the length of the whole Dirent structures at
+// the start of data that fit in max bytes.
+func direntsLen(data []byte, max int) int {
+	n := 0
+	for n+direntFixedSize <= len(data) {
+		size := direntFixedSize + int(guint16(data[n+22:n+24]))
+		if n+size > max || n+size > len(data) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// Tfsync writes a Tfsync message to the underlying io.Writer.
+func (enc *Encoder) Tfsync(tag uint16, fid, datasync uint32) {
+	size := uint32(minSizeLUT[msgTfsync] + 4)
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTfsync, tag, fid, datasync)
+}
+
+// Rfsync writes an Rfsync message to the underlying io.Writer.
+func (enc *Encoder) Rfsync(tag uint16) {
+	enc.rempty(msgRfsync, tag)
+}
+
+// Tlock writes a Tlock message to the underlying io.Writer. An
+// error is returned if clientID is longer than MaxClientIDLen.
+func (enc *Encoder) Tlock(tag uint16, fid uint32, ltype uint8, flags uint32, start, length uint64, procID uint32, clientID string) error {
+	if len(clientID) > enc.Limits.clientID() {
+		return errLongClientID
+	}
+	size := uint32(minSizeLUT[msgTlock] + len(clientID))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTlock, tag, fid)
+	puint8(enc.w, ltype)
+	puint32(enc.w, flags)
+	puint64(enc.w, start)
+	puint64(enc.w, length)
+	puint32(enc.w, procID)
+	pstring(enc.w, clientID)
+	return nil
+}
+
+// Rlock writes an Rlock message to the underlying io.Writer.
+func (enc *Encoder) Rlock(tag uint16, status uint8) {
+	size := uint32(minSizeLUT[msgRlock])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRlock, tag)
+	puint8(enc.w, status)
+}
+
+// Tgetlock writes a Tgetlock message to the underlying io.Writer. An
+// error is returned if clientID is longer than MaxClientIDLen.
+func (enc *Encoder) Tgetlock(tag uint16, fid uint32, ltype uint8, start, length uint64, procID uint32, clientID string) error {
+	if len(clientID) > enc.Limits.clientID() {
+		return errLongClientID
+	}
+	size := uint32(minSizeLUT[msgTgetlock] + len(clientID))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTgetlock, tag, fid)
+	puint8(enc.w, ltype)
+	puint64(enc.w, start)
+	puint64(enc.w, length)
+	puint32(enc.w, procID)
+	pstring(enc.w, clientID)
+	return nil
+}
+
+// Rgetlock writes an Rgetlock message to the underlying io.Writer. An
+// error is returned if clientID is longer than MaxClientIDLen.
+func (enc *Encoder) Rgetlock(tag uint16, ltype uint8, start, length uint64, procID uint32, clientID string) error {
+	if len(clientID) > enc.Limits.clientID() {
+		return errLongClientID
+	}
+	size := uint32(minSizeLUT[msgRgetlock] + len(clientID))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRgetlock, tag)
+	puint8(enc.w, ltype)
+	puint64(enc.w, start)
+	puint64(enc.w, length)
+	puint32(enc.w, procID)
+	pstring(enc.w, clientID)
+	return nil
+}
+
+// Tlink writes a Tlink message to the underlying io.Writer.
+func (enc *Encoder) Tlink(tag uint16, dfid, fid uint32, name string) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTlink] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTlink, tag, dfid, fid)
+	pstring(enc.w, name)
+}
+
+// Rlink writes an Rlink message to the underlying io.Writer.
+func (enc *Encoder) Rlink(tag uint16) {
+	enc.rempty(msgRlink, tag)
+}
+
+// Tmkdir writes a Tmkdir message to the underlying io.Writer.
+func (enc *Encoder) Tmkdir(tag uint16, dfid uint32, name string, mode, gid uint32) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTmkdir] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTmkdir, tag, dfid)
+	pstring(enc.w, name)
+	puint32(enc.w, mode, gid)
+}
+
+// Rmkdir writes an Rmkdir message to the underlying io.Writer.
+func (enc *Encoder) Rmkdir(tag uint16, qid Qid) {
+	enc.rqid(msgRmkdir, tag, qid)
+}
+
+// Trenameat writes a Trenameat message to the underlying io.Writer.
+func (enc *Encoder) Trenameat(tag uint16, olddirfid uint32, oldname string, newdirfid uint32, newname string) {
+	oldname, newname = enc.truncName(oldname), enc.truncName(newname)
+	size := uint32(minSizeLUT[msgTrenameat] + len(oldname) + len(newname))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTrenameat, tag, olddirfid)
+	pstring(enc.w, oldname)
+	puint32(enc.w, newdirfid)
+	pstring(enc.w, newname)
+}
+
+// Rrenameat writes an Rrenameat message to the underlying io.Writer.
+func (enc *Encoder) Rrenameat(tag uint16) {
+	enc.rempty(msgRrenameat, tag)
+}
+
+// Tunlinkat writes a Tunlinkat message to the underlying io.Writer.
+func (enc *Encoder) Tunlinkat(tag uint16, dirfid uint32, name string, flags uint32) {
+	name = enc.truncName(name)
+	size := uint32(minSizeLUT[msgTunlinkat] + len(name))
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgTunlinkat, tag, dirfid)
+	pstring(enc.w, name)
+	puint32(enc.w, flags)
+}
+
+// Runlinkat writes an Runlinkat message to the underlying io.Writer.
+func (enc *Encoder) Runlinkat(tag uint16) {
+	enc.rempty(msgRunlinkat, tag)
+}
+
+// Many 9P2000.L responses consist of only a header, or a header
+// and a single qid.
+func (enc *Encoder) rempty(mtype uint8, tag uint16) {
+	size := uint32(minSizeLUT[mtype])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, mtype, tag)
+}
+
+func (enc *Encoder) rqid(mtype uint8, tag uint16, qid Qid) {
+	size := uint32(minSizeLUT[mtype])
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, mtype, tag)
+	pqid(enc.w, qid)
+}
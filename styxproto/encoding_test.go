@@ -2,8 +2,17 @@ package styxproto
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func bytesFrom(v interface{}) []byte {
@@ -103,3 +112,775 @@ func TestEncode(t *testing.T) {
 	enc.Rwstat(7)
 	check(nil)
 }
+
+func TestEncodeU(t *testing.T) {
+	var (
+		buf     bytes.Buffer
+		qbuf    = make([]byte, QidLen)
+		statbuf = make([]byte, MaxStatLenU)
+	)
+	enc := NewEncoder(&buf)
+	dec := NewDecoder(&buf)
+	dec.Version = Version9P2000U
+	dec.Strict = true
+
+	next := func() Msg {
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !dec.Next() {
+			t.Fatalf("× %s", dec.Err())
+		}
+		msg := dec.Msg()
+		if b, ok := msg.(BadMessage); ok {
+			t.Fatalf("× %s", b.Err)
+		}
+		t.Logf("%T %s", msg, msg)
+		return msg
+	}
+
+	qid, _, err := NewQid(qbuf, QTSYMLINK, 0, 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _, err := NewStatU(statbuf, "link", "root", "wheel", "", "/etc/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat.SetMode(DMSYMLINK | 0777)
+	stat.SetQid(qid)
+	stat.SetNUid(0)
+	stat.SetNGid(10)
+
+	enc.TauthU(1, 2, "gopher", "", 1000)
+	if m := next().(Tauth); m.NUname() != 1000 {
+		t.Errorf("Tauth n_uname is %d, want 1000", m.NUname())
+	}
+	enc.TattachU(1, 1, NoFid, "gopher", "/", 1000)
+	if m := next().(Tattach); m.NUname() != 1000 || string(m.Aname()) != "/" {
+		t.Errorf("Tattach aname=%q n_uname=%d, want \"/\" 1000", m.Aname(), m.NUname())
+	}
+	enc.RerrorU(1, 2, "no such file")
+	if m := next().(Rerror); m.Errno() != 2 || string(m.Ename()) != "no such file" {
+		t.Errorf("Rerror ename=%q errno=%d, want \"no such file\" 2", m.Ename(), m.Errno())
+	}
+	if err := enc.TcreateU(1, 1, "link", DMSYMLINK|0777, OREAD, "/etc/motd"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Tcreate); string(m.Extension()) != "/etc/motd" || m.Mode() != OREAD {
+		t.Errorf("Tcreate ext=%q mode=%d, want \"/etc/motd\" 0", m.Extension(), m.Mode())
+	}
+	enc.Rstat(1, stat)
+	if m := next().(Rstat); string(m.Stat().Extension()) != "/etc/motd" ||
+		m.Stat().NUid() != 0 || m.Stat().NGid() != 10 || m.Stat().NMuid() != NoUid {
+		t.Errorf("Rstat stat %s has wrong 9P2000.u fields", m.Stat())
+	}
+	enc.Twstat(1, 1, stat)
+	if m := next().(Twstat); string(m.Stat().Name()) != "link" {
+		t.Errorf("Twstat name is %q, want \"link\"", m.Stat().Name())
+	}
+
+	// 9P2000 messages lack the fields added by 9P2000.u
+	dec.Version = Version9P2000
+	enc.Rerror(1, "no such file")
+	if m := next().(Rerror); m.Errno() != 0 {
+		t.Errorf("9P2000 Rerror has errno %d", m.Errno())
+	}
+	enc.Tcreate(1, 1, "file", 0644, OREAD)
+	if m := next().(Tcreate); m.Extension() != nil {
+		t.Errorf("9P2000 Tcreate has extension %q", m.Extension())
+	}
+}
+
+func TestEncodeL(t *testing.T) {
+	var (
+		buf       bytes.Buffer
+		qbuf      = make([]byte, QidLen)
+		direntbuf = make([]byte, 512)
+	)
+	enc := NewEncoder(&buf)
+	dec := NewDecoder(&buf)
+	dec.Version = Version9P2000L
+	dec.Strict = true
+
+	next := func() Msg {
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !dec.Next() {
+			t.Fatalf("× %s", dec.Err())
+		}
+		msg := dec.Msg()
+		if b, ok := msg.(BadMessage); ok {
+			t.Fatalf("× %s", b.Err)
+		}
+		t.Logf("%T %s", msg, msg)
+		return msg
+	}
+
+	qid, _, err := NewQid(qbuf, QTDIR, 3, 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 12345)
+
+	enc.TattachU(1, 1, NoFid, "", "/srv", 1000)
+	if m := next().(Tattach); m.NUname() != 1000 {
+		t.Errorf("Tattach n_uname is %d, want 1000", m.NUname())
+	}
+	enc.Rlerror(1, ENOENT)
+	if m := next().(Rlerror); m.Ecode() != ENOENT {
+		t.Errorf("Rlerror ecode is %d, want %d", m.Ecode(), ENOENT)
+	}
+	enc.Tlopen(1, 1, LRDWR|LTRUNC)
+	if m := next().(Tlopen); m.Flags() != LRDWR|LTRUNC {
+		t.Errorf("Tlopen flags are %#o", m.Flags())
+	}
+	enc.Rlopen(1, qid, 8192)
+	if m := next().(Rlopen); m.IOunit() != 8192 || !bytes.Equal(m.Qid(), qid) {
+		t.Errorf("Rlopen qid=%q iounit=%d", m.Qid(), m.IOunit())
+	}
+	enc.Tlcreate(1, 1, "file", LWRONLY|LCREATE, 0644, 100)
+	if m := next().(Tlcreate); string(m.Name()) != "file" || m.Flags() != LWRONLY|LCREATE || m.Mode() != 0644 || m.Gid() != 100 {
+		t.Errorf("Tlcreate has wrong fields: %s", m)
+	}
+	if err := enc.Tsymlink(1, 1, "link", "../file", 100); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Tsymlink); string(m.Name()) != "link" || string(m.Target()) != "../file" || m.Gid() != 100 {
+		t.Errorf("Tsymlink has wrong fields: %s", m)
+	}
+	if err := enc.Rreadlink(1, "../file"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Rreadlink); string(m.Target()) != "../file" {
+		t.Errorf("Rreadlink target is %q", m.Target())
+	}
+	enc.Tgetattr(1, 1, GetattrBasic)
+	if m := next().(Tgetattr); m.RequestMask() != GetattrBasic {
+		t.Errorf("Tgetattr request_mask is %#x", m.RequestMask())
+	}
+	enc.Rgetattr(1, Attr{
+		Valid: GetattrBasic,
+		Qid:   qid,
+		Mode:  040755,
+		Uid:   1000,
+		Nlink: 2,
+		Size:  4096,
+		Mtime: mtime,
+	})
+	if m := next().(Rgetattr); m.Mode() != 040755 || m.Uid() != 1000 || m.Size() != 4096 ||
+		!m.Mtime().Equal(mtime) || !m.Atime().IsZero() || !bytes.Equal(m.Qid(), qid) {
+		t.Errorf("Rgetattr has wrong fields: %s", m)
+	}
+	enc.Tsetattr(1, 1, SetAttr{Valid: SetattrSize | SetattrMtimeSet, Size: 10, Mtime: mtime})
+	if m := next().(Tsetattr); m.Valid() != SetattrSize|SetattrMtimeSet || m.Size() != 10 || !m.Mtime().Equal(mtime) {
+		t.Errorf("Tsetattr has wrong fields: %s", m)
+	}
+	enc.Treaddir(1, 1, 42, 8192)
+	if m := next().(Treaddir); m.Offset() != 42 || m.Count() != 8192 {
+		t.Errorf("Treaddir has wrong fields: %s", m)
+	}
+	d1, rest, err := NewDirent(direntbuf, qid, 1, DTDIR, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, _, err := NewDirent(rest, qid, 2, DTREG, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Rreaddir(1, direntbuf[:len(d1)+len(d2)])
+	if m := next().(Rreaddir); m.Count() != int64(len(d1)+len(d2)) {
+		t.Errorf("Rreaddir count is %d, want %d", m.Count(), len(d1)+len(d2))
+	} else if data, err := ioutil.ReadAll(m); err != nil {
+		t.Error(err)
+	} else if d := Dirent(data[len(d1):]); string(d.Name()) != "file" || d.Type() != DTREG || d.Offset() != 2 {
+		t.Errorf("second dirent is %s", d)
+	}
+	enc.Tmkdir(1, 1, "dir", 0755, 100)
+	if m := next().(Tmkdir); string(m.Name()) != "dir" || m.Mode() != 0755 || m.Gid() != 100 {
+		t.Errorf("Tmkdir has wrong fields: %s", m)
+	}
+	enc.Trenameat(1, 1, "old", 2, "new")
+	if m := next().(Trenameat); string(m.Oldname()) != "old" || m.Newdirfid() != 2 || string(m.Newname()) != "new" {
+		t.Errorf("Trenameat has wrong fields: %s", m)
+	}
+	enc.Tunlinkat(1, 1, "dir", ATREMOVEDIR)
+	if m := next().(Tunlinkat); string(m.Name()) != "dir" || m.Flags() != ATREMOVEDIR {
+		t.Errorf("Tunlinkat has wrong fields: %s", m)
+	}
+	if err := enc.Tlock(1, 1, LockTypeWrlck, LockFlagsBlock, 0, 100, 42, "host"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Tlock); m.Type() != LockTypeWrlck || m.Length() != 100 || m.ProcID() != 42 || string(m.ClientID()) != "host" {
+		t.Errorf("Tlock has wrong fields: %s", m)
+	}
+	enc.Tfsync(1, 1, 1)
+	if m := next().(Tfsync); m.Datasync() != 1 {
+		t.Errorf("Tfsync datasync is %d", m.Datasync())
+	}
+	enc.Rstatfs(1, Statfs{Type: 0x01021997, Bsize: 4096, Namelen: MaxFilenameLen})
+	if m := next().(Rstatfs); m.Bsize() != 4096 || m.Namelen() != MaxFilenameLen {
+		t.Errorf("Rstatfs has wrong fields: %s", m)
+	}
+
+	// 9P2000.L messages are not valid in other versions of the protocol.
+	dec.Version = Version9P2000
+	enc.Tgetattr(1, 1, GetattrAll)
+	enc.Flush()
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	if _, ok := dec.Msg().(BadMessage); !ok {
+		t.Errorf("9P2000 decoder accepted %T", dec.Msg())
+	}
+}
+
+func TestRreaddirMaxSize(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.MaxSize = MinBufSize
+	dec := NewDecoder(&buf)
+	dec.Version = Version9P2000L
+
+	qid := make(Qid, QidLen)
+	data := make([]byte, 2*MinBufSize)
+	rest := data
+	for i := 0; len(rest) > direntFixedSize+MaxFilenameLen; i++ {
+		_, rest, _ = NewDirent(rest, qid, uint64(i), DTREG, strings.Repeat("x", MaxFilenameLen))
+	}
+	data = data[:len(data)-len(rest)]
+	n, err := enc.Rreaddir(1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Flush()
+
+	size := direntFixedSize + MaxFilenameLen
+	if want := (MinBufSize - 11) / size * size; n != want {
+		t.Errorf("Rreaddir wrote %d bytes, want %d", n, want)
+	}
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	m := dec.Msg().(Rreaddir)
+	if m.Len() > MinBufSize || m.Count() != int64(n) {
+		t.Errorf("Rreaddir is %d bytes with count %d", m.Len(), m.Count())
+	}
+	got, err := ioutil.ReadAll(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:n]) {
+		t.Error("Rreaddir data differs from the first whole Dirents")
+	}
+}
+
+func TestTwriteFrom(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	dec := NewDecoder(&buf)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	n, err := enc.TwriteFrom(1, 4, 10, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("TwriteFrom wrote %d bytes, want %d", n, len(data))
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	m, ok := dec.Msg().(Twrite)
+	if !ok {
+		t.Fatalf("decoded %T, want Twrite", dec.Msg())
+	}
+	if m.Fid() != 4 || m.Offset() != 10 || m.Count() != int64(len(data)) {
+		t.Errorf("Twrite has wrong fields: %s", m)
+	}
+	got, err := ioutil.ReadAll(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Twrite data differs from what was written")
+	}
+
+	_, err = enc.TwriteFrom(2, 4, 0, strings.NewReader("short"), 10)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("TwriteFrom of a short reader returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// bufferedRread writes an Rread message the way Encoders did before
+// large payloads bypassed their buffer, for comparison.
+func bufferedRread(enc *Encoder, tag uint16, data []byte) {
+	size := uint32(minSizeLUT[msgRread]) + uint32(len(data))
+	enc.mu.Lock()
+	pheader(enc.w, size, msgRread, tag, uint32(len(data)))
+	enc.w.Write(data)
+	enc.mu.Unlock()
+}
+
+func BenchmarkRread(b *testing.B) {
+	for _, size := range []int{512, 8 << 10, 64 << 10, 1 << 20} {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("%d/buffered", size), func(b *testing.B) {
+			enc := NewEncoder(ioutil.Discard)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bufferedRread(enc, 1, data)
+				enc.Flush()
+			}
+		})
+		b.Run(fmt.Sprintf("%d/direct", size), func(b *testing.B) {
+			enc := NewEncoder(ioutil.Discard)
+			enc.MaxSize = math.MaxUint32
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				enc.Rread(1, data)
+				enc.Flush()
+			}
+		})
+	}
+}
+
+func BenchmarkRreadTCP(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	data := make([]byte, 64<<10)
+	for _, direct := range []bool{false, true} {
+		name := "buffered"
+		if direct {
+			name = "direct"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			enc := NewEncoder(conn)
+			enc.MaxSize = math.MaxUint32
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if direct {
+					enc.Rread(1, data)
+				} else {
+					bufferedRread(enc, 1, data)
+				}
+				enc.Flush()
+			}
+		})
+	}
+}
+
+func TestWriteLarge(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.MaxSize = math.MaxUint32
+	dec := NewDecoder(&buf)
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("x"), 3*directWriteSize)
+	enc.Rread(1, small)
+	if n, err := enc.Rread(2, large); err != nil || n != len(large) {
+		t.Fatalf("Rread wrote %d bytes, %v", n, err)
+	}
+	if n, err := enc.Twrite(3, 1, 0, large); err != nil || n != len(large) {
+		t.Fatalf("Twrite wrote %d bytes, %v", n, err)
+	}
+	enc.Flush()
+
+	for _, want := range [][]byte{small, large, large} {
+		if !dec.Next() {
+			t.Fatal(dec.Err())
+		}
+		got, err := ioutil.ReadAll(dec.Msg().(io.Reader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%T has %d bytes of data, want %d", dec.Msg(), len(got), len(want))
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestWriteLargeError(t *testing.T) {
+	enc := NewEncoder(failWriter{})
+	enc.MaxSize = math.MaxUint32
+	if _, err := enc.Rread(1, make([]byte, directWriteSize)); err == nil {
+		t.Fatal("Rread to a failing writer succeeded")
+	}
+	if enc.Err() == nil {
+		t.Error("Encoder did not remember write error")
+	}
+}
+
+func TestDecoderStats(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Tclunk(1, 1)
+	enc.Tclunk(2, 2)
+	enc.Twrite(3, 1, 0, []byte("hello"))
+	enc.Tflush(4, 1)
+	enc.Flush()
+	size := int64(buf.Len())
+	buf.Write([]byte("\x07\x00\x00\x00\x01\x05\x00"))
+
+	dec := NewDecoder(&buf)
+	for dec.Next() {
+	}
+	st := dec.Stats()
+	want := map[string]int64{"Tclunk": 2, "Twrite": 1, "Tflush": 1}
+	if !reflect.DeepEqual(st.Messages, want) {
+		t.Errorf("Messages = %v, want %v", st.Messages, want)
+	}
+	if st.Bytes != size+7 {
+		t.Errorf("Bytes = %d, want %d", st.Bytes, size+7)
+	}
+	if st.BadMessages != 1 {
+		t.Errorf("BadMessages = %d, want 1", st.BadMessages)
+	}
+}
+
+func TestDirIterator(t *testing.T) {
+	var dir []byte
+	names := []string{"a", "bb", "ccc"}
+	for _, name := range names {
+		stat, _, err := NewStat(make([]byte, MaxStatLen), name, "uid", "gid", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir = append(dir, stat...)
+	}
+
+	it := NewDirIterator(bytes.NewReader(dir))
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Stat().Name()))
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("iterated over %q, want %q", got, names)
+	}
+
+	it = NewDirIterator(bytes.NewReader(dir[:len(dir)-1]))
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != len(names)-1 || it.Err() != io.ErrUnexpectedEOF {
+		t.Errorf("truncated directory: got %d stats, error %v", n, it.Err())
+	}
+}
+
+func TestStatBuilder(t *testing.T) {
+	qbuf := make([]byte, QidLen)
+	qid, _, _ := NewQid(qbuf, QTFILE, 1, 2)
+	stat, _, err := NewStatU(make([]byte, MaxStatLenU), "old", "uid", "gid", "", "ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat.SetQid(qid)
+	stat.SetMode(0644)
+	stat.SetLength(100)
+	stat.SetNUid(1000)
+
+	b := NewStatBuilder(stat)
+	b.Name = "a much longer name"
+	b.Uid = "someone"
+	b.Length = 200
+	got, _, err := b.Build(make([]byte, MaxStatLenU))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyStatU(got, nil); err != nil {
+		t.Fatalf("built invalid stat %s: %v", got, err)
+	}
+	if string(got.Name()) != b.Name || string(got.Uid()) != b.Uid || string(got.Gid()) != "gid" {
+		t.Errorf("wrong string fields in %s", got)
+	}
+	if got.Length() != 200 || got.Mode() != 0644 || !bytes.Equal(got.Qid(), qid) {
+		t.Errorf("wrong fixed fields in %s", got)
+	}
+	if string(got.Extension()) != "ext" || got.NUid() != 1000 || got.NGid() != NoUid {
+		t.Errorf("wrong 9P2000.u fields in %s", got)
+	}
+
+	if _, _, err := b.Build(make([]byte, minStatLen)); err == nil {
+		t.Error("built a stat in a buffer that is too small")
+	}
+}
+
+func TestClone(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Tclunk(1, 7)
+	enc.Twrite(2, 7, 0, bytes.Repeat([]byte("x"), 2*DefaultBufSize))
+	enc.Tclunk(3, 8)
+	enc.Flush()
+
+	dec := NewDecoder(&buf)
+	var clones []Msg
+	for dec.Next() {
+		m, err := Clone(dec.Msg())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clones = append(clones, m)
+	}
+	if len(clones) != 3 {
+		t.Fatalf("decoded %d messages, want 3", len(clones))
+	}
+	if m := clones[0].(Tclunk); m.Tag() != 1 || m.Fid() != 7 {
+		t.Errorf("clone changed after Next: %s", m)
+	}
+	w := clones[1].(Twrite)
+	data, err := ioutil.ReadAll(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Tag() != 2 || len(data) != 2*DefaultBufSize {
+		t.Errorf("cloned %s with %d bytes of data", w, len(data))
+	}
+	var out bytes.Buffer
+	if _, err := Write(&out, clones[2]); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != int(clones[2].Len()) {
+		t.Errorf("wrote %d bytes of %s", out.Len(), clones[2])
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	qid, _, _ := NewQid(make([]byte, QidLen), QTDIR, 1, 2)
+	enc.Twalk(1, 0, 1, "usr", "glenda")
+	enc.Rwalk(1, qid)
+	enc.Twrite(2, 1, 0, []byte("hello"))
+	enc.Flush()
+
+	want := []string{
+		`{"fid":0,"newfid":1,"nwname":2,"tag":1,"type":"Twalk","wname":["usr","glenda"]}`,
+		`{"nwqid":1,"tag":1,"type":"Rwalk","wqid":[{"type":128,"version":1,"path":2}]}`,
+		`{"count":5,"fid":1,"offset":0,"tag":2,"type":"Twrite"}`,
+	}
+	dec := NewDecoder(&buf)
+	for i := 0; dec.Next(); i++ {
+		got, err := json.Marshal(dec.Msg())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[i] {
+			t.Errorf("got %s, want %s", got, want[i])
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var buf bytes.Buffer
+	uname := strings.Repeat("u", 80)
+
+	enc := NewEncoder(&buf)
+	enc.Tattach(1, 0, NoFid, uname, "")
+	enc.Flush()
+	dec := NewDecoder(&buf)
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	if m := dec.Msg().(Tattach); len(m.Uname()) != MaxUidLen {
+		t.Errorf("default Encoder wrote uname of length %d, want %d", len(m.Uname()), MaxUidLen)
+	}
+
+	enc.Limits.Uid = 100
+	enc.Tattach(1, 0, NoFid, uname, "")
+	enc.Tattach(2, 0, NoFid, uname, "")
+	enc.Flush()
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	if m, ok := dec.Msg().(BadMessage); !ok || m.Err != errLongUsername {
+		t.Errorf("default Decoder accepted long uname: %v", dec.Msg())
+	}
+	dec.Limits.Uid = 100
+	dec.Strict = true
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	if m, ok := dec.Msg().(Tattach); !ok || string(m.Uname()) != uname {
+		t.Errorf("Decoder with raised limit got %v", dec.Msg())
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(DefaultBufSize)
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		enc := pool.NewEncoder(&buf)
+		enc.Tclunk(uint16(i), 1)
+		enc.Flush()
+		enc.Release()
+
+		dec := pool.NewDecoder(&buf)
+		if !dec.Next() {
+			t.Fatal(dec.Err())
+		}
+		if m, ok := dec.Msg().(Tclunk); !ok || m.Tag() != uint16(i) {
+			t.Errorf("got %v, want Tclunk with tag %d", dec.Msg(), i)
+		}
+		dec.Release()
+		if dec.Next() {
+			t.Errorf("released Decoder returned %v", dec.Msg())
+		}
+
+		// A released Decoder can be reused after Reset.
+		var next bytes.Buffer
+		enc = NewEncoder(&next)
+		enc.Rclunk(uint16(i))
+		enc.Flush()
+		dec.Reset(&next)
+		if !dec.Next() {
+			t.Fatal(dec.Err())
+		}
+		if _, ok := dec.Msg().(Rclunk); !ok {
+			t.Errorf("got %v after Reset, want Rclunk", dec.Msg())
+		}
+		dec.Release()
+	}
+}
+
+func TestEncodeE(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	dec := NewDecoder(&buf)
+	dec.Version = Version9P2000E
+	dec.Strict = true
+	next := func() Msg {
+		enc.Flush()
+		if !dec.Next() {
+			t.Fatal(dec.Err())
+		}
+		t.Logf("%T %s", dec.Msg(), dec.Msg())
+		return dec.Msg()
+	}
+
+	enc.Tsession(1, 0xdeadbeef)
+	if m := next().(Tsession); m.Key() != 0xdeadbeef {
+		t.Errorf("Tsession key is %#x", m.Key())
+	}
+	enc.Rsession(1)
+	next()
+	if err := enc.Tsread(1, 0, "etc", "motd"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Tsread); m.Nwname() != 2 || string(m.Wname(1)) != "motd" {
+		t.Errorf("Tsread has wrong fields: %s", m)
+	}
+	if err := enc.Rsread(1, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(next().(Rsread)); err != nil || string(data) != "hello" {
+		t.Errorf("Rsread data is %q, %v", data, err)
+	}
+	if err := enc.Tswrite(1, 0, []string{"tmp", "x"}, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if m := next().(Tswrite); string(m.Wname(0)) != "tmp" || m.Count() != 5 {
+		t.Errorf("Tswrite has wrong fields: %s", m)
+	} else if data, err := ioutil.ReadAll(m); err != nil || string(data) != "world" {
+		t.Errorf("Tswrite data is %q, %v", data, err)
+	}
+	enc.Rswrite(1, 5)
+	if m := next().(Rswrite); m.Count() != 5 {
+		t.Errorf("Rswrite count is %d", m.Count())
+	}
+	if err := enc.Tsread(1, 0, make([]string, MaxWElem+1)...); err == nil {
+		t.Error("Tsread accepted too many path elements")
+	}
+
+	// 9P2000.e messages are not valid in other versions of the protocol.
+	dec.Version = Version9P2000
+	enc.Rsession(1)
+	if _, ok := next().(BadMessage); !ok {
+		t.Errorf("9P2000 decoder accepted %T", dec.Msg())
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	data := make([]byte, 2*MinBufSize)
+
+	if err := WriteRversion(&buf, 8192, "9P2000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTwalk(&buf, 1, 0, 1, "usr", "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteRerror(&buf, 2, "no such file %q", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := WriteRread(&buf, 3, data); err != nil || n != len(data) {
+		t.Fatalf("WriteRread = %d, %v", n, err)
+	}
+	if err := WriteTwalk(&buf, 4, 0, 1, make([]string, MaxWElem+1)...); err == nil {
+		t.Error("WriteTwalk accepted too many path elements")
+	}
+
+	dec := NewDecoder(&buf)
+	var msgs []Msg
+	for dec.Next() {
+		if m, ok := dec.Msg().(Rread); ok {
+			if got, _ := ioutil.ReadAll(m); len(got) != len(data) {
+				t.Errorf("Rread has %d bytes of data, want %d", len(got), len(data))
+			}
+		}
+		msgs = append(msgs, dec.Msg())
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Rversion", "Twalk", "Rerror", "Rread"}
+	if len(msgs) != len(want) {
+		t.Fatalf("decoded %d messages, want %d", len(msgs), len(want))
+	}
+	for i, m := range msgs {
+		if kind := reflect.TypeOf(m).Name(); kind != want[i] {
+			t.Errorf("message %d is %s, want %s", i, kind, want[i])
+		}
+	}
+	if m := msgs[2].(Rerror); string(m.Ename()) != `no such file "x"` {
+		t.Errorf("Rerror ename is %q", m.Ename())
+	}
+}
@@ -33,6 +33,17 @@ const (
 	msgRwstat                // size[4] Rwstat tag[2]
 )
 
+// Protocol versions understood by the styxproto package. A Decoder
+// must be told which version is in use on a stream, through its
+// Version field, to parse the messages whose layout differs between
+// versions.
+const (
+	Version9P2000  = "9P2000"
+	Version9P2000U = "9P2000.u"
+	Version9P2000L = "9P2000.L"
+	Version9P2000E = "9P2000.e"
+)
+
 // QidLen is the length of a Qid in bytes.
 const QidLen = 13
 
@@ -44,6 +55,10 @@ const NoTag = ^uint16(0)
 // to authenticate his session.
 const NoFid = ^uint32(0)
 
+// NoUid is the value of the numeric user and group ids in 9P2000.u
+// messages when no id is provided.
+const NoUid = ^uint32(0)
+
 // Flags for the mode field in Topen and Tcreate messages
 const (
 	OREAD   = 0  // open read-only
@@ -57,15 +72,21 @@ const (
 
 // File modes
 const (
-	DMDIR    = 0x80000000 // mode bit for directories
-	DMAPPEND = 0x40000000 // mode bit for append only files
-	DMEXCL   = 0x20000000 // mode bit for exclusive use files
-	DMMOUNT  = 0x10000000 // mode bit for mounted channel
-	DMAUTH   = 0x08000000 // mode bit for authentication file
-	DMTMP    = 0x04000000 // mode bit for non-backed-up file
-	DMREAD   = 0x4        // mode bit for read permission
-	DMWRITE  = 0x2        // mode bit for write permission
-	DMEXEC   = 0x1        // mode bit for execute permission
+	DMDIR       = 0x80000000 // mode bit for directories
+	DMAPPEND    = 0x40000000 // mode bit for append only files
+	DMEXCL      = 0x20000000 // mode bit for exclusive use files
+	DMMOUNT     = 0x10000000 // mode bit for mounted channel
+	DMAUTH      = 0x08000000 // mode bit for authentication file
+	DMTMP       = 0x04000000 // mode bit for non-backed-up file
+	DMSYMLINK   = 0x02000000 // mode bit for symbolic links (9P2000.u)
+	DMDEVICE    = 0x00800000 // mode bit for device files (9P2000.u)
+	DMNAMEDPIPE = 0x00200000 // mode bit for named pipes (9P2000.u)
+	DMSOCKET    = 0x00100000 // mode bit for sockets (9P2000.u)
+	DMSETUID    = 0x00080000 // mode bit for setuid (9P2000.u)
+	DMSETGID    = 0x00040000 // mode bit for setgid (9P2000.u)
+	DMREAD      = 0x4        // mode bit for read permission
+	DMWRITE     = 0x2        // mode bit for write permission
+	DMEXEC      = 0x1        // mode bit for execute permission
 
 	// Mask for the type bits
 	DMTYPE = DMDIR | DMAPPEND | DMEXCL | DMMOUNT | DMTMP
@@ -12,7 +12,9 @@ var (
 	errInvalidQidType = parseError("invalid type field in qid")
 	errInvalidUTF8    = parseError("string is not valid utf8")
 	errLongAname      = parseError("aname field too long")
+	errLongClientID   = parseError("lock client_id too long")
 	errLongError      = parseError("error message too long")
+	errLongExtension  = parseError("extension field too long")
 	errLongFilename   = parseError("file name too long")
 	errLongSize       = parseError("size field is longer than actual message size")
 	errLongLength     = parseError("long length field in stat structure")
@@ -23,6 +25,7 @@ var (
 	errMaxWElem       = parseError("maximum walk elements exceeded")
 	errNullString     = parseError("NUL in string field")
 	errOverSize       = parseError("size of field exceeds size of message")
+	errShortDirent    = parseError("dirent structure too short")
 	errShortStat      = parseError("stat structure too short")
 	errTooBig         = parseError("message is too long")
 	errTooSmall       = parseError("message is too small")
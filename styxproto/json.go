@@ -0,0 +1,204 @@
+package styxproto
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Messages are marshaled to JSON as an object holding their type and
+// tag, along with the value of each of their fields, named after the
+// methods that return them, in lower case:
+//
+//	{"type":"Twalk","tag":1,"fid":0,"newfid":1,"wname":["usr","glenda"]}
+//
+// The Type field of Rstatfs messages is named fstype, and that of
+// lock messages locktype, so as not to hide the type of the message.
+// String fields are marshaled as JSON strings, and Qid and Stat
+// values as objects. The data of Twrite, Rread and Rreaddir messages
+// is not included; only its length is, as the count field.
+
+// Methods that are not fields of a message.
+var jsonSkip = map[string]bool{
+	"Tag":         true,
+	"Len":         true,
+	"String":      true,
+	"Err":         true,
+	"MarshalJSON": true,
+}
+
+// Fields of messages that are renamed, by message type.
+var jsonRename = map[string]map[string]string{
+	"Rstatfs":  {"Type": "fstype"},
+	"Tlock":    {"Type": "locktype"},
+	"Tgetlock": {"Type": "locktype"},
+	"Rgetlock": {"Type": "locktype"},
+}
+
+// marshalJSON marshals the fields of v, which are found by calling
+// each of its exported methods that take no arguments and return a
+// single value.
+func marshalJSON(v interface{}, obj map[string]interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	for i := 0; i < rt.NumMethod(); i++ {
+		method := rt.Method(i)
+		if jsonSkip[method.Name] || method.Type.NumIn() != 1 || method.Type.NumOut() != 1 {
+			continue
+		}
+		value := rv.Method(i).Call(nil)[0].Interface()
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		name := method.Name
+		if to, ok := jsonRename[rt.Name()][name]; ok {
+			name = to
+		}
+		obj[jsonName(name)] = value
+	}
+	return json.Marshal(obj)
+}
+
+func marshalMsg(m Msg, obj map[string]interface{}) ([]byte, error) {
+	if obj == nil {
+		obj = make(map[string]interface{})
+	}
+	obj["type"] = rtypeName(m)
+	obj["tag"] = m.Tag()
+	return marshalJSON(m, obj)
+}
+
+func rtypeName(v interface{}) string {
+	return reflect.TypeOf(v).Name()
+}
+
+// jsonName lowers the case of a method name, such as "IOunit".
+func jsonName(method string) string {
+	return strings.Map(unicode.ToLower, method)
+}
+
+// MarshalJSON marshals a Qid as an object holding its type, version
+// and path.
+func (q Qid) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type    uint8  `json:"type"`
+		Version uint32 `json:"version"`
+		Path    uint64 `json:"path"`
+	}{q.Type(), q.Version(), q.Path()})
+}
+
+// MarshalJSON marshals the fields of a Stat as an object.
+func (s Stat) MarshalJSON() ([]byte, error) {
+	return marshalJSON(s, make(map[string]interface{}))
+}
+
+// MarshalJSON marshals a BadMessage as an object holding its tag,
+// length and the reason it is invalid.
+func (m BadMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":  "BadMessage",
+		"tag":   m.Tag(),
+		"len":   m.Len(),
+		"error": m.Err.Error(),
+	})
+}
+
+// The path elements of a Twalk message and the qids of an Rwalk
+// message are not returned by methods without arguments, and are
+// listed explicitly.
+
+func (m Twalk) MarshalJSON() ([]byte, error) {
+	wname := make([]string, m.Nwname())
+	for i := range wname {
+		wname[i] = string(m.Wname(i))
+	}
+	return marshalMsg(m, map[string]interface{}{"wname": wname})
+}
+
+func (m Rwalk) MarshalJSON() ([]byte, error) {
+	wqid := make([]Qid, m.Nwqid())
+	for i := range wqid {
+		wqid[i] = m.Wqid(i)
+	}
+	return marshalMsg(m, map[string]interface{}{"wqid": wqid})
+}
+
+func (m Tsread) MarshalJSON() ([]byte, error) {
+	return marshalMsg(m, map[string]interface{}{"wname": wnames(m, 13, m.Nwname())})
+}
+
+func (m Tswrite) MarshalJSON() ([]byte, error) {
+	return marshalMsg(m, map[string]interface{}{"wname": wnames(m.msg, 13, m.Nwname())})
+}
+
+// The fields of all other messages are found by marshalMsg.
+
+func (m Tversion) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rversion) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tauth) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Rauth) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Tattach) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rattach) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rerror) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Tflush) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rflush) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Topen) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Ropen) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Tcreate) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rcreate) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Tread) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Rread) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Twrite) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rwrite) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Tclunk) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rclunk) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Tremove) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rremove) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Tstat) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Rstat) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Twstat) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rwstat) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rlerror) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Tstatfs) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rstatfs) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Tlopen) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rlopen) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Tlcreate) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rlcreate) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tsymlink) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rsymlink) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tmknod) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rmknod) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Trename) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Rrename) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
+func (m Treadlink) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Rreadlink) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Tgetattr) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rgetattr) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tsetattr) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rsetattr) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Txattrwalk) MarshalJSON() ([]byte, error)   { return marshalMsg(m, nil) }
+func (m Rxattrwalk) MarshalJSON() ([]byte, error)   { return marshalMsg(m, nil) }
+func (m Txattrcreate) MarshalJSON() ([]byte, error) { return marshalMsg(m, nil) }
+func (m Rxattrcreate) MarshalJSON() ([]byte, error) { return marshalMsg(m, nil) }
+func (m Treaddir) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rreaddir) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tfsync) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rfsync) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Tlock) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Rlock) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Tgetlock) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rgetlock) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Tlink) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Rlink) MarshalJSON() ([]byte, error)        { return marshalMsg(m, nil) }
+func (m Tmkdir) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rmkdir) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Trenameat) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Rrenameat) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Tunlinkat) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Runlinkat) MarshalJSON() ([]byte, error)    { return marshalMsg(m, nil) }
+func (m Tsession) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rsession) MarshalJSON() ([]byte, error)     { return marshalMsg(m, nil) }
+func (m Rsread) MarshalJSON() ([]byte, error)       { return marshalMsg(m, nil) }
+func (m Rswrite) MarshalJSON() ([]byte, error)      { return marshalMsg(m, nil) }
@@ -35,6 +35,55 @@ var minSizeLUT = [...]int{
 	msgRstat:    9 + minStatLen, // size[4] Rstat tag[2] stat[n]
 	msgTwstat:   11,             // size[4] Twstat tag[2] fid[4] stat[n]
 	msgRwstat:   7,              // size[4] Rwstat tag[2]
+
+	// 9P2000.L messages; see dotl.go for their layout
+	msgRlerror:      11,
+	msgTstatfs:      11,
+	msgRstatfs:      67,
+	msgTlopen:       15,
+	msgRlopen:       24,
+	msgTlcreate:     25,
+	msgRlcreate:     24,
+	msgTsymlink:     19,
+	msgRsymlink:     20,
+	msgTmknod:       29,
+	msgRmknod:       20,
+	msgTrename:      17,
+	msgRrename:      7,
+	msgTreadlink:    11,
+	msgRreadlink:    9,
+	msgTgetattr:     19,
+	msgRgetattr:     160,
+	msgTsetattr:     67,
+	msgRsetattr:     7,
+	msgTxattrwalk:   17,
+	msgRxattrwalk:   15,
+	msgTxattrcreate: 25,
+	msgRxattrcreate: 7,
+	msgTreaddir:     23,
+	msgRreaddir:     11,
+	msgTfsync:       11,
+	msgRfsync:       7,
+	msgTlock:        38,
+	msgRlock:        8,
+	msgTgetlock:     34,
+	msgRgetlock:     30,
+	msgTlink:        17,
+	msgRlink:        7,
+	msgTmkdir:       21,
+	msgRmkdir:       20,
+	msgTrenameat:    19,
+	msgRrenameat:    7,
+	msgTunlinkat:    17,
+	msgRunlinkat:    7,
+
+	// 9P2000.e messages; see dote.go for their layout
+	msgTsession: 15,
+	msgRsession: 7,
+	msgTsread:   13,
+	msgRsread:   11,
+	msgTswrite:  17,
+	msgRswrite:  11,
 }
 
 // Maximum size of a message
@@ -45,7 +94,7 @@ var maxSizeLUT = [...]int{
 	msgRauth:    minSizeLUT[msgRauth],
 	msgTattach:  minSizeLUT[msgTattach] + MaxUidLen + MaxAttachLen,
 	msgRattach:  minSizeLUT[msgRattach],
-	msgRerror:   minSizeLUT[msgRerror],
+	msgRerror:   minSizeLUT[msgRerror] + MaxErrorLen,
 	msgTflush:   minSizeLUT[msgTflush],
 	msgRflush:   minSizeLUT[msgRflush],
 	msgTwalk:    minSizeLUT[msgTwalk] + (MaxFilenameLen+2)*MaxWElem,
@@ -66,6 +115,72 @@ var maxSizeLUT = [...]int{
 	msgRstat:    minSizeLUT[msgRstat] + MaxFilenameLen + (MaxUidLen * 3),
 	msgTwstat:   minSizeLUT[msgTwstat] + MaxFilenameLen + (MaxUidLen * 3),
 	msgRwstat:   minSizeLUT[msgRwstat],
+
+	msgRlerror:      minSizeLUT[msgRlerror],
+	msgTstatfs:      minSizeLUT[msgTstatfs],
+	msgRstatfs:      minSizeLUT[msgRstatfs],
+	msgTlopen:       minSizeLUT[msgTlopen],
+	msgRlopen:       minSizeLUT[msgRlopen],
+	msgTlcreate:     minSizeLUT[msgTlcreate] + MaxFilenameLen,
+	msgRlcreate:     minSizeLUT[msgRlcreate],
+	msgTsymlink:     minSizeLUT[msgTsymlink] + MaxFilenameLen + MaxExtensionLen,
+	msgRsymlink:     minSizeLUT[msgRsymlink],
+	msgTmknod:       minSizeLUT[msgTmknod] + MaxFilenameLen,
+	msgRmknod:       minSizeLUT[msgRmknod],
+	msgTrename:      minSizeLUT[msgTrename] + MaxFilenameLen,
+	msgRrename:      minSizeLUT[msgRrename],
+	msgTreadlink:    minSizeLUT[msgTreadlink],
+	msgRreadlink:    minSizeLUT[msgRreadlink] + MaxExtensionLen,
+	msgTgetattr:     minSizeLUT[msgTgetattr],
+	msgRgetattr:     minSizeLUT[msgRgetattr],
+	msgTsetattr:     minSizeLUT[msgTsetattr],
+	msgRsetattr:     minSizeLUT[msgRsetattr],
+	msgTxattrwalk:   minSizeLUT[msgTxattrwalk] + MaxFilenameLen,
+	msgRxattrwalk:   minSizeLUT[msgRxattrwalk],
+	msgTxattrcreate: minSizeLUT[msgTxattrcreate] + MaxFilenameLen,
+	msgRxattrcreate: minSizeLUT[msgRxattrcreate],
+	msgTreaddir:     minSizeLUT[msgTreaddir],
+	msgRreaddir:     1<<32 - 1,
+	msgTfsync:       minSizeLUT[msgTfsync] + 4,
+	msgRfsync:       minSizeLUT[msgRfsync],
+	msgTlock:        minSizeLUT[msgTlock] + MaxClientIDLen,
+	msgRlock:        minSizeLUT[msgRlock],
+	msgTgetlock:     minSizeLUT[msgTgetlock] + MaxClientIDLen,
+	msgRgetlock:     minSizeLUT[msgRgetlock] + MaxClientIDLen,
+	msgTlink:        minSizeLUT[msgTlink] + MaxFilenameLen,
+	msgRlink:        minSizeLUT[msgRlink],
+	msgTmkdir:       minSizeLUT[msgTmkdir] + MaxFilenameLen,
+	msgRmkdir:       minSizeLUT[msgRmkdir],
+	msgTrenameat:    minSizeLUT[msgTrenameat] + MaxFilenameLen*2,
+	msgRrenameat:    minSizeLUT[msgRrenameat],
+	msgTunlinkat:    minSizeLUT[msgTunlinkat] + MaxFilenameLen,
+	msgRunlinkat:    minSizeLUT[msgRunlinkat],
+
+	msgTsession: minSizeLUT[msgTsession],
+	msgRsession: minSizeLUT[msgRsession],
+	msgTsread:   minSizeLUT[msgTsread] + (MaxFilenameLen+2)*MaxWElem,
+	msgRsread:   1<<32 - 1,
+	msgTswrite:  1<<32 - 1,
+	msgRswrite:  minSizeLUT[msgRswrite],
+}
+
+// The 9P2000.u extension appends fields to some messages. This is the
+// number of bytes each message grows by in its minimum size.
+var extraSizeLUTu = [...]int{
+	msgTauth:   4,          // n_uname[4]
+	msgTattach: 4,          // n_uname[4]
+	msgRerror:  4,          // errno[4]
+	msgTcreate: 2,          // extension[s]
+	msgRstat:   statExtraU, // extension[s] n_uid[4] n_gid[4] n_muid[4]
+	msgTwstat:  statExtraU, // extension[s] n_uid[4] n_gid[4] n_muid[4]
+	msgRwstat:  0,
+}
+
+// 9P2000.L borrows the 9P2000.u layout of the Tauth and Tattach
+// messages.
+var extraSizeLUTL = [...]int{
+	msgTauth:   4, // n_uname[4]
+	msgTattach: 4, // n_uname[4]
 }
 
 // IOHeaderSize is the length of all fixed-width fields in a Twrite or Tread
@@ -103,10 +218,106 @@ const MaxUidLen = 45
 // in an Rerror message.
 const MaxErrorLen = 512
 
+// MaxExtensionLen is the maximum length (in bytes) of the extension
+// field in 9P2000.u Tcreate messages and Stat structures. The extension
+// field holds the target of symbolic links and the major and minor
+// numbers of device files.
+const MaxExtensionLen = 1024
+
+// MaxClientIDLen is the maximum length (in bytes) of the client_id
+// field in 9P2000.L lock messages.
+const MaxClientIDLen = 255
+
 // MaxAttachLen is the maximum length (in bytes) of the aname field
 // of Tattach and Tauth requests.
 const MaxAttachLen = 255
 
+// Limits holds the maximum lengths (in bytes) of the variable-length
+// fields of 9P messages, for a Decoder or Encoder. A zero field
+// selects the default limit, given by the package constant of the
+// same name, such as MaxUidLen for Uid. Raising the limits allows a
+// Decoder or Encoder to interoperate with peers that use longer
+// names; a Decoder must still have a buffer large enough to hold the
+// larger messages.
+type Limits struct {
+	Version   int // protocol version string
+	Filename  int // file names and walk elements
+	Uid       int // user and group names
+	Error     int // Rerror ename
+	Extension int // 9P2000.u extension and 9P2000.L link target
+	ClientID  int // 9P2000.L lock client_id
+	Attach    int // Tattach and Tauth aname
+}
+
+func limit(n, def int) int {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
+// The methods of a *Limits may be called on a nil pointer, which
+// holds the default limits.
+
+func (l *Limits) version() int {
+	if l == nil {
+		return MaxVersionLen
+	}
+	return limit(l.Version, MaxVersionLen)
+}
+
+func (l *Limits) filename() int {
+	if l == nil {
+		return MaxFilenameLen
+	}
+	return limit(l.Filename, MaxFilenameLen)
+}
+
+func (l *Limits) uid() int {
+	if l == nil {
+		return MaxUidLen
+	}
+	return limit(l.Uid, MaxUidLen)
+}
+
+func (l *Limits) ename() int {
+	if l == nil {
+		return MaxErrorLen
+	}
+	return limit(l.Error, MaxErrorLen)
+}
+
+func (l *Limits) extension() int {
+	if l == nil {
+		return MaxExtensionLen
+	}
+	return limit(l.Extension, MaxExtensionLen)
+}
+
+func (l *Limits) clientID() int {
+	if l == nil {
+		return MaxClientIDLen
+	}
+	return limit(l.ClientID, MaxClientIDLen)
+}
+
+func (l *Limits) attach() int {
+	if l == nil {
+		return MaxAttachLen
+	}
+	return limit(l.Attach, MaxAttachLen)
+}
+
+// maximum size of a Stat structure
+func (l *Limits) statLen() int {
+	return minStatLen + l.filename() + l.uid()*3
+}
+
+// maximum size of a 9P2000.u Stat structure
+func (l *Limits) statLenU() int {
+	return l.statLen() + statExtraU + l.extension()
+}
+
 // MinBufSize is the minimum size (in bytes) of the internal buffers in a Decoder.
 const MinBufSize = MaxWElem*(MaxFilenameLen+2) + 13 + 4
 
@@ -126,6 +337,15 @@ const minStatLen = statFixedSize + (4 * 2) // name[s], uid[s], gid[s], muid[s]
 // MaxStatLen is the maximum size of a Stat structure.
 const MaxStatLen = minStatLen + MaxFilenameLen + (MaxUidLen * 3)
 
+// 9P2000.u Stat structures end with extension[s] n_uid[4] n_gid[4] n_muid[4]
+const statExtraU = 2 + 4 + 4 + 4
+
+// MaxStatLenU is the maximum size of a 9P2000.u Stat structure.
+const MaxStatLenU = MaxStatLen + statExtraU + MaxExtensionLen
+
+// See dotl.go for details on the Dirent structure
+const direntFixedSize = 13 + 8 + 1 + 2
+
 const maxWalkLen = MaxWElem * MaxFilenameLen
 
 // largest possible message
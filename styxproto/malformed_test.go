@@ -1,11 +1,13 @@
 package styxproto
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 // These tests ensure that bad messages, discovered by
@@ -45,3 +47,204 @@ func testInvalidMsg(t *testing.T, r io.Reader) {
 		t.Logf("parsed %T", d.Msg())
 	}
 }
+
+func TestOversize(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// A Tstat claiming to be much larger than the Decoder's buffer,
+	// padded with garbage.
+	const huge = 1 << 20
+	hdr := make([]byte, 11)
+	buint32(hdr, huge)
+	hdr[4] = msgTstat
+	buint16(hdr[5:], 1)
+	buf.Write(hdr)
+	buf.Write(make([]byte, huge-len(hdr)))
+
+	enc.Twrite(2, 1, 0, make([]byte, 64<<10))
+	enc.Tclunk(3, 1)
+	enc.Flush()
+	stream := buf.Bytes()
+
+	d := NewDecoder(bytes.NewReader(stream))
+	d.MaxSize = 8192
+	if d.Next() {
+		t.Fatalf("decoded %T past an oversized message", d.Msg())
+	}
+	if d.Err() == nil {
+		t.Error("no error decoding an oversized message")
+	}
+
+	d = NewDecoder(bytes.NewReader(stream))
+	d.MaxSize = 8192
+	d.Oversize = OversizeSkip
+	for _, tag := range []uint16{1, 2} {
+		if !d.Next() {
+			t.Fatal(d.Err())
+		}
+		m, ok := d.Msg().(BadMessage)
+		if !ok || m.Err != ErrMaxSize || m.Tag() != tag {
+			t.Errorf("got %T %v, want bad message with tag %d", d.Msg(), d.Msg(), tag)
+		}
+	}
+	if !d.Next() {
+		t.Fatal(d.Err())
+	}
+	if m, ok := d.Msg().(Tclunk); !ok || m.Tag() != 3 {
+		t.Errorf("got %T %v after oversized messages, want Tclunk", d.Msg(), d.Msg())
+	}
+
+	// Without a MaxSize, only messages that cannot be buffered
+	// are too large.
+	d = NewDecoder(bytes.NewReader(stream))
+	d.Oversize = OversizeSkip
+	if !d.Next() {
+		t.Fatal(d.Err())
+	}
+	if _, ok := d.Msg().(BadMessage); !ok {
+		t.Errorf("got %T, want bad message", d.Msg())
+	}
+	if !d.Next() {
+		t.Fatal(d.Err())
+	}
+	if _, ok := d.Msg().(Twrite); !ok {
+		t.Errorf("got %T, want Twrite", d.Msg())
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for tag := uint16(1); tag <= 3; tag++ {
+		enc.Tclunk(tag, 1)
+	}
+	enc.Twrite(4, 1, 0, make([]byte, 64))
+	enc.Tclunk(5, 1)
+	enc.Flush()
+	stream := buf.Bytes()
+
+	// Two Tclunk messages fit in the budget.
+	const clunk = 11
+	d := NewDecoder(bytes.NewReader(stream))
+	d.Budget = NewBudget(2 * clunk)
+	for i := 0; i < 2; i++ {
+		if !d.Next() {
+			t.Fatal(d.Err())
+		}
+	}
+	if d.Next() {
+		t.Fatalf("decoded %T past the budget", d.Msg())
+	}
+	if d.Err() != ErrBudget {
+		t.Errorf("got error %v, want %v", d.Err(), ErrBudget)
+	}
+
+	d = NewDecoder(bytes.NewReader(stream))
+	d.Budget = NewBudget(2 * clunk)
+	d.Oversize = OversizeSkip
+	for _, tag := range []uint16{1, 2, 3, 4, 5} {
+		if !d.Next() {
+			t.Fatal(d.Err())
+		}
+		_, bad := d.Msg().(BadMessage)
+		if tag == 3 || tag == 4 {
+			if !bad || d.Msg().(BadMessage).Err != ErrBudget {
+				t.Errorf("got %T %v, want message over budget", d.Msg(), d.Msg())
+			}
+		} else if bad {
+			t.Errorf("got %v, want message %d", d.Msg(), tag)
+		} else if d.Msg().Tag() != tag {
+			t.Errorf("got message %d, want %d", d.Msg().Tag(), tag)
+		}
+		// The Twrite is larger than the whole budget.
+		if tag == 3 {
+			d.Budget.Release(2 * clunk)
+		}
+	}
+	if n := d.Budget.Used(); n != clunk {
+		t.Errorf("budget has %d bytes in use, want %d", n, clunk)
+	}
+
+	d = NewDecoder(bytes.NewReader(stream))
+	d.Budget = NewBudget(2 * clunk)
+	d.Oversize = OversizeWait
+	for i := 0; i < 2; i++ {
+		if !d.Next() {
+			t.Fatal(d.Err())
+		}
+	}
+	decoded := make(chan bool)
+	go func() { decoded <- d.Next() }()
+	select {
+	case <-decoded:
+		t.Fatal("decoded a message past the budget without waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Budget.Release(clunk)
+	if !<-decoded {
+		t.Fatal(d.Err())
+	}
+	if m, ok := d.Msg().(Tclunk); !ok || m.Tag() != 3 {
+		t.Errorf("got %T %v, want Tclunk 3", d.Msg(), d.Msg())
+	}
+	// The Twrite can never fit.
+	if d.Next() {
+		t.Fatalf("decoded %T larger than the budget", d.Msg())
+	}
+	if d.Err() != ErrBudget {
+		t.Errorf("got error %v, want %v", d.Err(), ErrBudget)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Tversion(8192, "9P2000")
+	enc.Twalk(1, 0, 1, "usr", "glenda")
+	enc.Rerror(2, "no such file")
+	enc.Tclunk(3, 1)
+	enc.Flush()
+	valid := buf.Bytes()
+
+	// pad appends n bytes of garbage to each message in stream.
+	pad := func(stream []byte, n int) []byte {
+		var out []byte
+		for len(stream) > 0 {
+			size := int(guint32(stream[:4]))
+			msg := append([]byte(nil), stream[:size]...)
+			buint32(msg, uint32(size+n))
+			out = append(append(out, msg...), make([]byte, n)...)
+			stream = stream[size:]
+		}
+		return out
+	}
+	tests := []struct {
+		stream []byte
+		strict bool
+		bad    int
+	}{
+		{valid, false, 0},
+		{valid, true, 0},
+		{pad(valid, 3), false, 0},
+		{pad(valid, 3), true, 4},
+	}
+	for i, tt := range tests {
+		d := NewDecoder(bytes.NewReader(tt.stream))
+		d.Strict = tt.strict
+		n, bad := 0, 0
+		for d.Next() {
+			n++
+			if m, ok := d.Msg().(BadMessage); ok {
+				t.Logf("%d: %v", i, m.Err)
+				bad++
+			}
+		}
+		if d.Err() != nil {
+			t.Errorf("%d: %v", i, d.Err())
+		}
+		if n != 4 || bad != tt.bad {
+			t.Errorf("%d: got %d messages, %d bad; want 4, %d bad", i, n, bad, tt.bad)
+		}
+	}
+}
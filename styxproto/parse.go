@@ -1,12 +1,14 @@
 package styxproto
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
+	"strings"
 )
 
-var msgParseLUT = [...]func(msg, io.Reader) (Msg, error){
+var msgParseLUT = [...]func(msg, io.Reader, *Limits) (Msg, error){
 	msgTversion: parseTversion,
 	msgRversion: parseRversion,
 	msgTauth:    parseTauth,
@@ -36,6 +38,133 @@ var msgParseLUT = [...]func(msg, io.Reader) (Msg, error){
 	msgRwstat:   parseRwstat,
 }
 
+// The 9P2000.u extension changes the layout of a few messages.
+var msgParseLUTu = [...]func(msg, io.Reader, *Limits) (Msg, error){
+	msgTauth:   parseTauthU,
+	msgTattach: parseTattachU,
+	msgRerror:  parseRerrorU,
+	msgTcreate: parseTcreateU,
+	msgRstat:   parseRstatU,
+	msgTwstat:  parseTwstatU,
+}
+
+// A dialect is a variant of the 9P2000 protocol.
+type dialect uint8
+
+const (
+	dialect9P2000 dialect = iota
+	dialectU
+	dialectL
+	dialectE
+)
+
+func dialectOf(version string) dialect {
+	switch version {
+	case Version9P2000U:
+		return dialectU
+	case Version9P2000L:
+		return dialectL
+	case Version9P2000E:
+		return dialectE
+	}
+	return dialect9P2000
+}
+
+// minimum size of a message of type t
+func (d dialect) minSize(t uint8) int {
+	n := minSizeLUT[t]
+	switch d {
+	case dialectU:
+		if int(t) < len(extraSizeLUTu) {
+			n += extraSizeLUTu[t]
+		}
+	case dialectL:
+		if int(t) < len(extraSizeLUTL) {
+			n += extraSizeLUTL[t]
+		}
+	}
+	return n
+}
+
+// maximum size of a message of type t, with fields no longer than
+// the limits in lim
+func (d dialect) maxSize(t uint8, lim *Limits) int {
+	layout := d.layout(t)
+	if layout == "" || strings.IndexByte(layout, 'd') >= 0 {
+		return maxSizeLUT[t]
+	}
+	n := minMsgSize
+	for i := 0; i < len(layout); i++ {
+		switch c := layout[i]; c {
+		case 'v':
+			n += 2 + lim.version()
+		case 'u':
+			n += 2 + lim.uid()
+		case 'a':
+			n += 2 + lim.attach()
+		case 'e':
+			n += 2 + lim.ename()
+		case 'n':
+			n += 2 + lim.filename()
+		case 'x':
+			n += 2 + lim.extension()
+		case 'c':
+			n += 2 + lim.clientID()
+		case 'S':
+			if d == dialectU {
+				n += 2 + lim.statLenU()
+			} else {
+				n += 2 + lim.statLen()
+			}
+		case 'w':
+			n += 2 + MaxWElem*(2+lim.filename())
+		case 'q':
+			n += 2 + MaxWElem*QidLen
+		default:
+			n += int(c - '0')
+		}
+	}
+	return n
+}
+
+// parser returns the parsing function for messages of type t, or
+// nil if t is not a valid message type in the dialect.
+func (d dialect) parser(t uint8) func(msg, io.Reader, *Limits) (Msg, error) {
+	switch d {
+	case dialectU:
+		if int(t) < len(msgParseLUTu) && msgParseLUTu[t] != nil {
+			return msgParseLUTu[t]
+		}
+	case dialectL:
+		if int(t) < len(msgParseLUTL) && msgParseLUTL[t] != nil {
+			return msgParseLUTL[t]
+		}
+	case dialectE:
+		if int(t) < len(msgParseLUTe) && msgParseLUTe[t] != nil {
+			return msgParseLUTe[t]
+		}
+	}
+	if int(t) < len(msgParseLUT) {
+		return msgParseLUT[t]
+	}
+	return nil
+}
+
+// streamed reports whether messages of type t may be larger than a
+// Decoder's buffer, in which case their data is read from the
+// underlying io.Reader as the message is consumed.
+func (d dialect) streamed(t uint8) bool {
+	switch t {
+	case msgTwrite, msgRread:
+		return true
+	case msgRreaddir:
+		return d == dialectL
+	case msgRsread, msgTswrite:
+		return d == dialectE
+	}
+	return false
+}
+
 var (
 	errShortRead = errors.New("not enough data in buffer to complete message")
 )
@@ -55,40 +184,47 @@ func (s *Decoder) fetchMessage() (Msg, error) {
 		return nil, err
 	}
 
-	if err := verifySizeAndType(dot); err != nil {
+	d := dialectOf(s.Version)
+	if err := verifySizeAndType(d, dot, s.Strict, &s.Limits); err != nil {
 		return s.badMessage(dot, err)
 	}
 
 	msgType := dot.Type()
 	msgSize := dot.Len()
 	if s.MaxSize > 0 && msgSize > s.MaxSize {
-		return nil, ErrMaxSize
+		return s.oversize(dot, ErrMaxSize)
 	}
 
-	minSize := minSizeLUT[msgType]
+	minSize := d.minSize(msgType)
 
 	if _, err := s.growdot(minSize); err != nil {
 		return nil, err
 	}
 
-	if msgType == msgTwrite || msgType == msgRread {
-		return s.readRW()
+	if d.streamed(msgType) {
+		return s.readRW(d)
 	}
-	return s.readFixed()
+	return s.readFixed(d)
 }
 
 // Every message besides Twrite and Rread have a small maximum size,
 // and are stored wholly in memory for convenience.
-func (s *Decoder) readFixed() (Msg, error) {
+func (s *Decoder) readFixed(d dialect) (Msg, error) {
 	msg := msg(s.dot())
 	msgSize, msgType := msg.Len(), msg.Type()
 
+	if msgSize > int64(s.br.Size()) {
+		return s.oversize(msg, bufio.ErrBufferFull)
+	}
 	msg, err := s.growdot(int(msgSize))
 	if err != nil {
 		return nil, err
 	}
 
-	parsed, err := parseMsg(msgType, msg, nil)
+	parsed, err := parseMsg(d, msgType, msg, nil, &s.Limits)
+	if err == nil && s.Strict {
+		err = verifyFilled(d, msg)
+	}
 
 	// Nothing left to read, all that's possible are parsing errors
 	if err != nil {
@@ -98,26 +234,33 @@ func (s *Decoder) readFixed() (Msg, error) {
 	return parsed, nil
 }
 
-func (s *Decoder) readRW() (Msg, error) {
+func (s *Decoder) readRW(d dialect) (Msg, error) {
 	var err error
 
 	msg := msg(s.dot())
 	msgSize, msgType := msg.Len(), msg.Type()
 
 	readSize := s.buflen() + s.dotlen()
+	if msgType == msgTswrite {
+		// The path elements of a Tswrite message precede its
+		// data, and must be buffered to be parsed.
+		readSize = s.br.Size()
+	}
 	if int64(readSize) > msgSize {
 		readSize = int(msgSize)
 	}
 
 	msg, err = s.growdot(readSize)
-	if err != nil {
+	if err != nil && msgType == msgTswrite {
+		return nil, err
+	} else if err != nil {
 		// we have already buffered IOHeaderSize bytes, so
 		// we are reading from the bufio.Reader's internal buffer.
 		// The docs state this should never fail.
 		panic("read of buffered data failed: " + err.Error())
 	}
 
-	parsed, err := parseMsg(msgType, msg, s.r)
+	parsed, err := parseMsg(d, msgType, msg, s.r, &s.Limits)
 	if err != nil {
 		return s.badMessage(msg, err)
 	}
@@ -125,8 +268,27 @@ func (s *Decoder) readRW() (Msg, error) {
 	return parsed, nil
 }
 
-func parseMsg(t uint8, m msg, r io.Reader) (Msg, error) {
-	return msgParseLUT[t](m, r)
+func parseMsg(d dialect, t uint8, m msg, r io.Reader, lim *Limits) (Msg, error) {
+	return d.parser(t)(m, r, lim)
+}
+
+// oversize handles a message that is too large to be decoded, according
+// to the Decoder's Oversize policy. With OversizeSkip, the message is
+// left for Next to discard, as it may not be buffered.
+func (s *Decoder) oversize(big msg, err error) (Msg, error) {
+	if s.Oversize != OversizeSkip {
+		return nil, err
+	}
+	if err != ErrBudget {
+		// To the peer, the buffer is just another limit on
+		// the size of a message.
+		err = ErrMaxSize
+	}
+	return BadMessage{
+		Err:    err,
+		tag:    big.Tag(),
+		length: big.Len(),
+	}, nil
 }
 
 func (s *Decoder) badMessage(bad msg, reason error) (Msg, error) {
@@ -159,88 +321,114 @@ func (s *Decoder) badMessage(bad msg, reason error) (Msg, error) {
 	return msg, nil
 }
 
-func parseTversion(dot msg, _ io.Reader) (Msg, error) {
+func parseTversion(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	if ver, _, err := verifyField(dot.Body()[4:], true, 0); err != nil {
 		return nil, err
 	} else if err := verifyString(ver); err != nil {
 		return nil, err
-	} else if len(ver) > MaxVersionLen {
+	} else if len(ver) > lim.version() {
 		return nil, errLongVersion
 	}
 	return Tversion(dot), nil
 }
 
-func parseRversion(dot msg, _ io.Reader) (Msg, error) {
-	msg, err := parseTversion(dot, nil)
+func parseRversion(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	msg, err := parseTversion(dot, nil, lim)
 	if err != nil {
 		return nil, err
 	}
 	return Rversion(msg.(Tversion)), nil
 }
 
-func parseTauth(dot msg, _ io.Reader) (Msg, error) {
-	if err := parseTauthBody(dot.Body()); err != nil {
+func parseTauth(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if err := parseTauthBody(dot.Body(), 0, lim); err != nil {
+		return nil, err
+	}
+	return Tauth(dot), nil
+}
+
+// size[4] Tauth tag[2] afid[4] uname[s] aname[s] n_uname[4]
+func parseTauthU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if err := parseTauthBody(dot.Body(), 4, lim); err != nil {
 		return nil, err
 	}
 	return Tauth(dot), nil
 }
 
-func parseTauthBody(body []byte) error {
-	if uname, rest, err := verifyField(body[4:], false, 2); err != nil {
+// padding is the number of bytes that follow the aname field
+func parseTauthBody(body []byte, padding int, lim *Limits) error {
+	if uname, rest, err := verifyField(body[4:], false, 2+padding); err != nil {
 		return err
 	} else if err := verifyString(uname); err != nil {
 		return err
-	} else if len(uname) > MaxUidLen {
+	} else if len(uname) > lim.uid() {
 		return errLongUsername
-	} else if aname, _, err := verifyField(rest, true, 0); err != nil {
+	} else if aname, _, err := verifyField(rest, true, padding); err != nil {
 		return err
 	} else if err := verifyString(aname); err != nil {
 		return err
-	} else if len(aname) > MaxAttachLen {
+	} else if len(aname) > lim.attach() {
 		return errLongAname
 	}
 	return nil
 }
 
-func parseRauth(dot msg, _ io.Reader) (Msg, error) {
+func parseRauth(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rauth(dot), nil
 }
 
-func parseTattach(dot msg, _ io.Reader) (Msg, error) {
-	if err := parseTauthBody(dot.Body()[4:]); err != nil {
+func parseTattach(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if err := parseTauthBody(dot.Body()[4:], 0, lim); err != nil {
 		return nil, err
 	}
 	return Tattach(dot), nil
 }
 
-func parseRattach(dot msg, _ io.Reader) (Msg, error) {
-	msg, err := parseRauth(dot, nil)
+// size[4] Tattach tag[2] fid[4] afid[4] uname[s] aname[s] n_uname[4]
+func parseTattachU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if err := parseTauthBody(dot.Body()[4:], 4, lim); err != nil {
+		return nil, err
+	}
+	return Tattach(dot), nil
+}
+
+func parseRattach(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	msg, err := parseRauth(dot, nil, lim)
 	if err != nil {
 		return nil, err
 	}
 	return Rattach(msg.(Rauth)), nil
 }
 
-func parseRerror(dot msg, _ io.Reader) (Msg, error) {
-	if str, _, err := verifyField(dot.Body(), true, 0); err != nil {
+func parseRerror(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return parseRerrorBody(dot, 0, lim)
+}
+
+// size[4] Rerror tag[2] ename[s] errno[4]
+func parseRerrorU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return parseRerrorBody(dot, 4, lim)
+}
+
+func parseRerrorBody(dot msg, padding int, lim *Limits) (Msg, error) {
+	if str, _, err := verifyField(dot.Body(), true, padding); err != nil {
 		return nil, err
 	} else if err := verifyString(str); err != nil {
 		return nil, err
-	} else if len(str) > MaxErrorLen {
+	} else if len(str) > lim.ename() {
 		return nil, errLongError
 	}
 	return Rerror(dot), nil
 }
 
-func parseTflush(dot msg, _ io.Reader) (Msg, error) {
+func parseTflush(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Tflush(dot), nil
 }
 
-func parseRflush(dot msg, _ io.Reader) (Msg, error) {
+func parseRflush(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rflush(dot), nil
 }
 
-func parseTwalk(dot msg, _ io.Reader) (Msg, error) {
+func parseTwalk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	// size[4] Twalk tag[2] fid[4] newfid[4] nwname[2] nwname*(wname[s])
 	var (
 		err       error
@@ -262,14 +450,14 @@ func parseTwalk(dot msg, _ io.Reader) (Msg, error) {
 			return nil, err
 		} else if err := verifyPathElem(el); err != nil {
 			return nil, err
-		} else if len(el) > MaxFilenameLen {
+		} else if len(el) > lim.filename() {
 			return nil, errLongFilename
 		}
 	}
 	return Twalk(dot), nil
 }
 
-func parseRwalk(dot msg, _ io.Reader) (Msg, error) {
+func parseRwalk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	nwqid := guint16(dot.Body()[:2])
 	if nwqid > MaxWElem {
 		return nil, errMaxWElem
@@ -278,6 +466,7 @@ func parseRwalk(dot msg, _ io.Reader) (Msg, error) {
 	msgSize := dot.Len()
 	realSize := int64(minSizeLUT[msgRwalk]) + int64(nwqid)*13
 	if realSize < msgSize {
+		// Checked by verifyFilled in strict mode.
 		//return nil, errUnderSize
 	} else if realSize > msgSize {
 		return nil, errOverSize
@@ -285,39 +474,57 @@ func parseRwalk(dot msg, _ io.Reader) (Msg, error) {
 	return Rwalk(dot), nil
 }
 
-func parseTopen(dot msg, _ io.Reader) (Msg, error) {
+func parseTopen(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Topen(dot), nil
 }
 
-func parseRopen(dot msg, _ io.Reader) (Msg, error) {
+func parseRopen(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Ropen(dot), nil
 }
 
-func parseTcreate(dot msg, _ io.Reader) (Msg, error) {
+func parseTcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	if name, _, err := verifyField(dot.Body()[4:], true, 5); err != nil {
 		return nil, err
 	} else if err := verifyString(name); err != nil {
 		return nil, err
-	} else if len(name) > MaxFilenameLen {
+	} else if len(name) > lim.filename() {
 		return nil, errLongFilename
 	}
 	return Tcreate(dot), nil
 }
 
-func parseRcreate(dot msg, _ io.Reader) (Msg, error) {
-	msg, err := parseRopen(dot, nil)
+// size[4] Tcreate tag[2] fid[4] name[s] perm[4] mode[1] extension[s]
+func parseTcreateU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if name, rest, err := verifyField(dot.Body()[4:], false, 5+2); err != nil {
+		return nil, err
+	} else if err := verifyString(name); err != nil {
+		return nil, err
+	} else if len(name) > lim.filename() {
+		return nil, errLongFilename
+	} else if ext, _, err := verifyField(rest[5:], true, 0); err != nil {
+		return nil, err
+	} else if err := verifyString(ext); err != nil {
+		return nil, err
+	} else if len(ext) > lim.extension() {
+		return nil, errLongExtension
+	}
+	return Tcreate(dot), nil
+}
+
+func parseRcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	msg, err := parseRopen(dot, nil, lim)
 	if err != nil {
 		return nil, err
 	}
 	return Rcreate(msg.(Ropen)), nil
 }
 
-func parseTread(dot msg, _ io.Reader) (Msg, error) {
+func parseTread(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	// size[4] Tread tag[2] fid[4] offset[8] count[4]
 	return Tread(dot), nil
 }
 
-func parseRread(dot msg, r io.Reader) (Msg, error) {
+func parseRread(dot msg, r io.Reader, lim *Limits) (Msg, error) {
 	// size[4] Rread tag[2] count[4] data[count]
 	m := Rread{msg: dot}
 
@@ -342,7 +549,7 @@ func parseRread(dot msg, r io.Reader) (Msg, error) {
 	return m, nil
 }
 
-func parseTwrite(dot msg, r io.Reader) (Msg, error) {
+func parseTwrite(dot msg, r io.Reader, lim *Limits) (Msg, error) {
 	// size[4] Twrite tag[2] fid[4] offset[8] count[4]  data[count]
 	m := Twrite{msg: dot}
 	offset := m.Offset()
@@ -372,52 +579,74 @@ func parseTwrite(dot msg, r io.Reader) (Msg, error) {
 	return m, nil
 }
 
-func parseRwrite(dot msg, _ io.Reader) (Msg, error) {
+func parseRwrite(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rwrite(dot), nil
 }
 
-func parseTclunk(dot msg, _ io.Reader) (Msg, error) {
+func parseTclunk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Tclunk(dot), nil
 }
 
-func parseRclunk(dot msg, _ io.Reader) (Msg, error) {
+func parseRclunk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rclunk(dot), nil
 }
 
-func parseTremove(dot msg, _ io.Reader) (Msg, error) {
+func parseTremove(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Tremove(dot), nil
 }
 
-func parseRremove(dot msg, _ io.Reader) (Msg, error) {
+func parseRremove(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rremove(dot), nil
 }
 
-func parseTstat(dot msg, _ io.Reader) (Msg, error) {
+func parseTstat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Tstat(dot), nil
 }
 
-func parseRstat(dot msg, _ io.Reader) (Msg, error) {
+func parseRstat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	stat, _, err := verifyField(dot.Body(), true, 0)
 	if err != nil {
 		return nil, err
 	}
-	if err := verifyStat(stat); err != nil {
+	if err := verifyStat(stat, lim); err != nil {
 		return nil, err
 	}
 	return Rstat(dot), nil
 }
 
-func parseTwstat(dot msg, _ io.Reader) (Msg, error) {
+func parseRstatU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	stat, _, err := verifyField(dot.Body(), true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyStatU(stat, lim); err != nil {
+		return nil, err
+	}
+	return Rstat(dot), nil
+}
+
+func parseTwstat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	stat, _, err := verifyField(dot.Body()[4:], true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyStat(stat, lim); err != nil {
+		return nil, err
+	}
+	return Twstat(dot), nil
+}
+
+func parseTwstatU(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	stat, _, err := verifyField(dot.Body()[4:], true, 0)
 	if err != nil {
 		return nil, err
 	}
-	if err := verifyStat(stat); err != nil {
+	if err := verifyStatU(stat, lim); err != nil {
 		return nil, err
 	}
 	return Twstat(dot), nil
 }
 
-func parseRwstat(dot msg, _ io.Reader) (Msg, error) {
+func parseRwstat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
 	return Rwstat(dot), nil
 }
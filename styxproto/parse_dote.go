@@ -0,0 +1,108 @@
+package styxproto
+
+import (
+	"bytes"
+	"io"
+)
+
+// Messages added by the 9P2000.e extension.
+var msgParseLUTe = [...]func(msg, io.Reader, *Limits) (Msg, error){
+	msgTsession: parseTsession,
+	msgRsession: parseRsession,
+	msgTsread:   parseTsread,
+	msgRsread:   parseRsread,
+	msgTswrite:  parseTswrite,
+	msgRswrite:  parseRswrite,
+}
+
+// verifyWname checks a list of path elements, preceded by a 2-byte
+// count, at the beginning of data, and returns the data after it.
+func verifyWname(data []byte, lim *Limits) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errOverSize
+	}
+	nwname := guint16(data[:2])
+	if nwname > MaxWElem {
+		return nil, errMaxWElem
+	}
+	rest := data[2:]
+	for i := uint16(0); i < nwname; i++ {
+		if len(rest) < 2 {
+			return nil, errOverSize
+		}
+		el, next, err := verifyField(rest, false, 0)
+		if err != nil {
+			return nil, err
+		} else if err := verifyPathElem(el); err != nil {
+			return nil, err
+		} else if len(el) > lim.filename() {
+			return nil, errLongFilename
+		}
+		rest = next
+	}
+	return rest, nil
+}
+
+// dataReader checks that the count[4] field at the beginning of data
+// matches the size of the message, and returns a reader for the data
+// that follows it, which may not all be buffered.
+func dataReader(dot msg, data []byte, r io.Reader) (io.Reader, error) {
+	if len(data) < 4 {
+		return nil, errOverSize
+	}
+	count := int64(guint32(data[:4]))
+	realSize := dot.Len() - int64(len(dot)) + int64(len(data)) - 4
+	if count < realSize {
+		return nil, errUnderSize
+	} else if count > realSize {
+		return nil, errOverSize
+	}
+	buffered := data[4:]
+	var rd io.Reader = bytes.NewReader(buffered)
+	if int64(len(buffered)) < count {
+		rd = io.MultiReader(rd, io.LimitReader(r, count-int64(len(buffered))))
+	}
+	return rd, nil
+}
+
+func parseTsession(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tsession(dot), nil
+}
+
+func parseRsession(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rsession(dot), nil
+}
+
+func parseTsread(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tsread tag[2] fid[4] nwname[2] nwname*(wname[s])
+	if _, err := verifyWname(dot.Body()[4:], lim); err != nil {
+		return nil, err
+	}
+	return Tsread(dot), nil
+}
+
+func parseRsread(dot msg, r io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Rsread tag[2] count[4] data[count]
+	data, err := dataReader(dot, dot.Body(), r)
+	if err != nil {
+		return nil, err
+	}
+	return Rsread{r: data, msg: dot}, nil
+}
+
+func parseTswrite(dot msg, r io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tswrite tag[2] fid[4] nwname[2] nwname*(wname[s]) count[4] data[count]
+	rest, err := verifyWname(dot.Body()[4:], lim)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dataReader(dot, rest, r)
+	if err != nil {
+		return nil, err
+	}
+	return Tswrite{r: data, msg: dot}, nil
+}
+
+func parseRswrite(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rswrite(dot), nil
+}
@@ -0,0 +1,329 @@
+package styxproto
+
+import (
+	"bytes"
+	"io"
+)
+
+// Messages added or changed by the 9P2000.L extension.
+var msgParseLUTL = [...]func(msg, io.Reader, *Limits) (Msg, error){
+	msgRlerror:      parseRlerror,
+	msgTstatfs:      parseTstatfs,
+	msgRstatfs:      parseRstatfs,
+	msgTlopen:       parseTlopen,
+	msgRlopen:       parseRlopen,
+	msgTlcreate:     parseTlcreate,
+	msgRlcreate:     parseRlcreate,
+	msgTsymlink:     parseTsymlink,
+	msgRsymlink:     parseRsymlink,
+	msgTmknod:       parseTmknod,
+	msgRmknod:       parseRmknod,
+	msgTrename:      parseTrename,
+	msgRrename:      parseRrename,
+	msgTreadlink:    parseTreadlink,
+	msgRreadlink:    parseRreadlink,
+	msgTgetattr:     parseTgetattr,
+	msgRgetattr:     parseRgetattr,
+	msgTsetattr:     parseTsetattr,
+	msgRsetattr:     parseRsetattr,
+	msgTxattrwalk:   parseTxattrwalk,
+	msgRxattrwalk:   parseRxattrwalk,
+	msgTxattrcreate: parseTxattrcreate,
+	msgRxattrcreate: parseRxattrcreate,
+	msgTreaddir:     parseTreaddir,
+	msgRreaddir:     parseRreaddir,
+	msgTfsync:       parseTfsync,
+	msgRfsync:       parseRfsync,
+	msgTlock:        parseTlock,
+	msgRlock:        parseRlock,
+	msgTgetlock:     parseTgetlock,
+	msgRgetlock:     parseRgetlock,
+	msgTlink:        parseTlink,
+	msgRlink:        parseRlink,
+	msgTmkdir:       parseTmkdir,
+	msgRmkdir:       parseRmkdir,
+	msgTrenameat:    parseTrenameat,
+	msgRrenameat:    parseRrenameat,
+	msgTunlinkat:    parseTunlinkat,
+	msgRunlinkat:    parseRunlinkat,
+
+	msgTauth:   parseTauthU,
+	msgTattach: parseTattachU,
+}
+
+// verifyName checks a file name field at the beginning of data,
+// followed by padding bytes.
+func verifyName(data []byte, padding int, lim *Limits) ([]byte, error) {
+	name, rest, err := verifyField(data, false, padding)
+	if err != nil {
+		return nil, err
+	} else if err := verifyPathElem(name); err != nil {
+		return nil, err
+	} else if len(name) > lim.filename() {
+		return nil, errLongFilename
+	}
+	return rest, nil
+}
+
+func parseRlerror(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rlerror(dot), nil
+}
+
+func parseTstatfs(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tstatfs(dot), nil
+}
+
+func parseRstatfs(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rstatfs(dot), nil
+}
+
+func parseTlopen(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tlopen(dot), nil
+}
+
+func parseRlopen(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rlopen(dot), nil
+}
+
+func parseTlcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tlcreate tag[2] fid[4] name[s] flags[4] mode[4] gid[4]
+	if _, err := verifyName(dot.Body()[4:], 12, lim); err != nil {
+		return nil, err
+	}
+	return Tlcreate(dot), nil
+}
+
+func parseRlcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rlcreate(dot), nil
+}
+
+func parseTsymlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tsymlink tag[2] fid[4] name[s] symtgt[s] gid[4]
+	rest, err := verifyName(dot.Body()[4:], 2+4, lim)
+	if err != nil {
+		return nil, err
+	}
+	if target, _, err := verifyField(rest, true, 4); err != nil {
+		return nil, err
+	} else if err := verifyString(target); err != nil {
+		return nil, err
+	} else if len(target) > lim.extension() {
+		return nil, errLongExtension
+	}
+	return Tsymlink(dot), nil
+}
+
+func parseRsymlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rsymlink(dot), nil
+}
+
+func parseTmknod(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tmknod tag[2] dfid[4] name[s] mode[4] major[4] minor[4] gid[4]
+	if _, err := verifyName(dot.Body()[4:], 16, lim); err != nil {
+		return nil, err
+	}
+	return Tmknod(dot), nil
+}
+
+func parseRmknod(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rmknod(dot), nil
+}
+
+func parseTrename(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Trename tag[2] fid[4] dfid[4] name[s]
+	if _, err := verifyName(dot.Body()[8:], 0, lim); err != nil {
+		return nil, err
+	}
+	return Trename(dot), nil
+}
+
+func parseRrename(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rrename(dot), nil
+}
+
+func parseTreadlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Treadlink(dot), nil
+}
+
+func parseRreadlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	if target, _, err := verifyField(dot.Body(), true, 0); err != nil {
+		return nil, err
+	} else if err := verifyString(target); err != nil {
+		return nil, err
+	} else if len(target) > lim.extension() {
+		return nil, errLongExtension
+	}
+	return Rreadlink(dot), nil
+}
+
+func parseTgetattr(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tgetattr(dot), nil
+}
+
+func parseRgetattr(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rgetattr(dot), nil
+}
+
+func parseTsetattr(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tsetattr(dot), nil
+}
+
+func parseRsetattr(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rsetattr(dot), nil
+}
+
+func parseTxattrwalk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Txattrwalk tag[2] fid[4] newfid[4] name[s]
+	if name, _, err := verifyField(dot.Body()[8:], true, 0); err != nil {
+		return nil, err
+	} else if err := verifyString(name); err != nil {
+		return nil, err
+	} else if len(name) > lim.filename() {
+		return nil, errLongFilename
+	}
+	return Txattrwalk(dot), nil
+}
+
+func parseRxattrwalk(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rxattrwalk(dot), nil
+}
+
+func parseTxattrcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Txattrcreate tag[2] fid[4] name[s] attr_size[8] flags[4]
+	if name, _, err := verifyField(dot.Body()[4:], false, 12); err != nil {
+		return nil, err
+	} else if err := verifyString(name); err != nil {
+		return nil, err
+	} else if len(name) > lim.filename() {
+		return nil, errLongFilename
+	}
+	return Txattrcreate(dot), nil
+}
+
+func parseRxattrcreate(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rxattrcreate(dot), nil
+}
+
+func parseTreaddir(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Treaddir(dot), nil
+}
+
+func parseRreaddir(dot msg, r io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Rreaddir tag[2] count[4] data[count]
+	m := Rreaddir{msg: dot}
+
+	count := m.Count()
+	if realSize := count + int64(minSizeLUT[msgRreaddir]); realSize > m.Len() {
+		return nil, errOverSize
+	} else if realSize < m.Len() {
+		return nil, errUnderSize
+	}
+
+	buffered := dot[minSizeLUT[msgRreaddir]:]
+	m.r = bytes.NewReader(buffered)
+	if int64(len(buffered)) < count {
+		m.r = io.MultiReader(
+			m.r,
+			io.LimitReader(r, count-int64(len(buffered))))
+	}
+	return m, nil
+}
+
+func parseTfsync(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Tfsync(dot), nil
+}
+
+func parseRfsync(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rfsync(dot), nil
+}
+
+func parseTlock(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tlock tag[2] fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s]
+	if err := verifyClientID(dot.Body()[29:], lim); err != nil {
+		return nil, err
+	}
+	return Tlock(dot), nil
+}
+
+func parseRlock(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rlock(dot), nil
+}
+
+func parseTgetlock(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tgetlock tag[2] fid[4] type[1] start[8] length[8] proc_id[4] client_id[s]
+	if err := verifyClientID(dot.Body()[25:], lim); err != nil {
+		return nil, err
+	}
+	return Tgetlock(dot), nil
+}
+
+func parseRgetlock(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Rgetlock tag[2] type[1] start[8] length[8] proc_id[4] client_id[s]
+	if err := verifyClientID(dot.Body()[21:], lim); err != nil {
+		return nil, err
+	}
+	return Rgetlock(dot), nil
+}
+
+func verifyClientID(data []byte, lim *Limits) error {
+	if id, _, err := verifyField(data, true, 0); err != nil {
+		return err
+	} else if err := verifyString(id); err != nil {
+		return err
+	} else if len(id) > lim.clientID() {
+		return errLongClientID
+	}
+	return nil
+}
+
+func parseTlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tlink tag[2] dfid[4] fid[4] name[s]
+	if _, err := verifyName(dot.Body()[8:], 0, lim); err != nil {
+		return nil, err
+	}
+	return Tlink(dot), nil
+}
+
+func parseRlink(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rlink(dot), nil
+}
+
+func parseTmkdir(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tmkdir tag[2] dfid[4] name[s] mode[4] gid[4]
+	if _, err := verifyName(dot.Body()[4:], 8, lim); err != nil {
+		return nil, err
+	}
+	return Tmkdir(dot), nil
+}
+
+func parseRmkdir(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rmkdir(dot), nil
+}
+
+func parseTrenameat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Trenameat tag[2] olddirfid[4] oldname[s] newdirfid[4] newname[s]
+	rest, err := verifyName(dot.Body()[4:], 4+2, lim)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifyName(rest[4:], 0, lim); err != nil {
+		return nil, err
+	}
+	return Trenameat(dot), nil
+}
+
+func parseRrenameat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Rrenameat(dot), nil
+}
+
+func parseTunlinkat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	// size[4] Tunlinkat tag[2] dirfd[4] name[s] flags[4]
+	if _, err := verifyName(dot.Body()[4:], 4, lim); err != nil {
+		return nil, err
+	}
+	return Tunlinkat(dot), nil
+}
+
+func parseRunlinkat(dot msg, _ io.Reader, lim *Limits) (Msg, error) {
+	return Runlinkat(dot), nil
+}
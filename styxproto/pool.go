@@ -0,0 +1,93 @@
+package styxproto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errReleased = errors.New("use of released Decoder")
+
+// A BufferPool holds the internal buffers of Decoders and Encoders
+// for reuse, so that programs creating many short-lived Decoders and
+// Encoders, such as servers handling many connections, do not have to
+// allocate new buffers for each one. A BufferPool is safe for
+// concurrent use, and may be shared by any number of Decoders and
+// Encoders.
+type BufferPool struct {
+	size    int
+	readers sync.Pool
+	writers sync.Pool
+}
+
+// NewBufferPool creates a BufferPool for Decoders with internal
+// buffers of size max(MinBufSize, bufsize) bytes.
+func NewBufferPool(bufsize int) *BufferPool {
+	if bufsize < MinBufSize {
+		bufsize = MinBufSize
+	}
+	return &BufferPool{size: bufsize}
+}
+
+// NewDecoder returns a Decoder reading from r, whose internal buffer
+// is taken from the pool. The buffer is returned to the pool by the
+// Decoder's Release method.
+func (p *BufferPool) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, br: p.reader(r), MaxSize: -1, pool: p}
+}
+
+func (p *BufferPool) reader(r io.Reader) *bufio.Reader {
+	br, ok := p.readers.Get().(*bufio.Reader)
+	if !ok {
+		return bufio.NewReaderSize(r, p.size)
+	}
+	br.Reset(r)
+	return br
+}
+
+// NewEncoder returns an Encoder writing to w, whose internal buffer
+// is taken from the pool. The buffer is returned to the pool by the
+// Encoder's Release method.
+func (p *BufferPool) NewEncoder(w io.Writer) *Encoder {
+	direct := &stickyWriter{w: w}
+	bw, ok := p.writers.Get().(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriterSize(direct, MinBufSize)
+	} else {
+		bw.Reset(direct)
+	}
+	return &Encoder{w: bw, direct: direct, pool: p}
+}
+
+// Release returns the internal buffer of a Decoder created by a
+// BufferPool to its pool. Any message returned by the Decoder
+// becomes invalid, and subsequent calls to Next return false, until
+// the Decoder is given a new buffer by Reset. Release does nothing
+// for Decoders that were not created by a BufferPool.
+func (s *Decoder) Release() {
+	if s.pool == nil || s.br == nil {
+		return
+	}
+	s.br.Reset(nil)
+	s.pool.readers.Put(s.br)
+	s.br = nil
+	s.msg = nil
+	s.err = errReleased
+}
+
+// Release returns the internal buffer of an Encoder created by a
+// BufferPool to its pool. Buffered data that has not been written by
+// Flush is lost. An Encoder must not be used after it is released.
+// Release does nothing for Encoders that were not created by a
+// BufferPool.
+func (enc *Encoder) Release() {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if enc.pool == nil || enc.w == nil {
+		return
+	}
+	enc.w.Reset(nil)
+	enc.pool.writers.Put(enc.w)
+	enc.w = nil
+}
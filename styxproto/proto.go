@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"strings"
 )
 
@@ -42,6 +43,27 @@ func nthField(m []byte, offset, n int) []byte {
 	return m[offset+2 : offset+2+size]
 }
 
+// Protocol extensions such as 9P2000.u append fields to existing
+// messages. The optField and optUint32 helpers fetch such a field
+// at offset, returning nil or def if the message ends before it.
+func optField(m []byte, offset int) []byte {
+	if len(m) < offset+2 {
+		return nil
+	}
+	size := int(guint16(m[offset : offset+2]))
+	if len(m) < offset+2+size {
+		return nil
+	}
+	return m[offset+2 : offset+2+size]
+}
+
+func optUint32(m []byte, offset int, def uint32) uint32 {
+	if len(m) < offset+4 {
+		return def
+	}
+	return guint32(m[offset : offset+4])
+}
+
 // A Msg is a 9P message. 9P messages are sent by clients (T-messages)
 // and servers (R-messages).
 type Msg interface {
@@ -73,6 +95,52 @@ func Write(w io.Writer, m Msg) (written int64, err error) {
 	return int64(n), err
 }
 
+// Clone returns a copy of m that does not share memory with it, and
+// remains valid after the next call to the Next method of the Decoder
+// that m came from. The data of Twrite, Rread and Rreaddir messages
+// is read into memory, and cannot be read from m afterwards; an error
+// is returned if it cannot be read in full.
+func Clone(m Msg) (Msg, error) {
+	switch m := m.(type) {
+	case BadMessage:
+		return m, nil
+	case Twrite:
+		hdr, r, err := cloneData(m.bytes(), m, m.Count())
+		return Twrite{msg: hdr, r: r}, err
+	case Rread:
+		hdr, r, err := cloneData(m.bytes(), m, m.Count())
+		return Rread{msg: hdr, r: r}, err
+	case Rreaddir:
+		hdr, r, err := cloneData(m.bytes(), m, m.Count())
+		return Rreaddir{msg: hdr, r: r}, err
+	case Rsread:
+		hdr, r, err := cloneData(m.bytes(), m, m.Count())
+		return Rsread{msg: hdr, r: r}, err
+	case Tswrite:
+		hdr, r, err := cloneData(m.bytes(), m, m.Count())
+		return Tswrite{msg: hdr, r: r}, err
+	}
+	// All other messages are byte slices.
+	v := reflect.ValueOf(m)
+	c := reflect.New(v.Type()).Elem()
+	c.SetBytes(append([]byte(nil), v.Bytes()...))
+	return c.Interface().(Msg), nil
+}
+
+// cloneData reads count bytes of data from r, and returns a message
+// holding a copy of the headers hdr followed by the data, along with
+// a reader for the data.
+func cloneData(hdr []byte, r io.Reader, count int64) (msg, io.Reader, error) {
+	buf := make([]byte, int64(len(hdr))+count)
+	copy(buf, hdr)
+	n, err := io.ReadFull(r, buf[len(hdr):])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	buf = buf[:len(hdr)+n]
+	return msg(buf), bytes.NewReader(buf[len(hdr):]), err
+}
+
 // The version request negotiates the protocol version and message
 // size to be used on the connection and initializes the connection
 // for I/O.  Tversion must be the first message sent on the 9P connection,
@@ -156,6 +224,13 @@ func (m Tauth) Uname() []byte { return nthField(m, 11, 0) }
 // may be empty.
 func (m Tauth) Aname() []byte { return nthField(m, 11, 1) }
 
+// NUname contains the numeric id of the user to authenticate, in
+// the 9P2000.u extension. NUname returns NoUid if the field is not
+// present.
+func (m Tauth) NUname() uint32 {
+	return optUint32(m, 11+4+len(m.Uname())+len(m.Aname()), NoUid)
+}
+
 func (m Tauth) String() string {
 	return fmt.Sprintf("Tauth afid=%d uname=%q aname=%q", m.Afid(), m.Uname(), m.Aname())
 }
@@ -198,6 +273,12 @@ func (m Tattach) Uname() []byte { return nthField(m, 15, 0) }
 // Aname is the name of the file tree that the client wants to access.
 func (m Tattach) Aname() []byte { return nthField(m, 15, 1) }
 
+// NUname is the numeric id of the attaching user, in the 9P2000.u
+// extension. NUname returns NoUid if the field is not present.
+func (m Tattach) NUname() uint32 {
+	return optUint32(m, 15+4+len(m.Uname())+len(m.Aname()), NoUid)
+}
+
 func (m Tattach) String() string {
 	if m.Afid() == NoFid {
 		return fmt.Sprintf("Tattach fid=%d afid=NOFID uname=%q aname=%q",
@@ -239,9 +320,19 @@ func (m Rerror) bytes() []byte { return m }
 // Ename is a UTF-8 string describing the error that occured.
 func (m Rerror) Ename() []byte { return nthField(m, 7, 0) }
 
+// Errno is the numeric error code sent alongside the error string in
+// the 9P2000.u extension. Errno returns 0 if the field is not present.
+func (m Rerror) Errno() uint32 { return optUint32(m, 9+len(m.Ename()), 0) }
+
 // Err creates a new value of type error using an Rerror message.
-func (m Rerror) Err() error     { return errors.New(string(m.Ename())) }
-func (m Rerror) String() string { return fmt.Sprintf("Rerror ename=%q", m.Ename()) }
+func (m Rerror) Err() error { return errors.New(string(m.Ename())) }
+
+func (m Rerror) String() string {
+	if errno := m.Errno(); errno != 0 {
+		return fmt.Sprintf("Rerror ename=%q errno=%d", m.Ename(), errno)
+	}
+	return fmt.Sprintf("Rerror ename=%q", m.Ename())
+}
 
 // When the response to a request is no longer needed, such as
 // when a user interrupts a process doing a read(2), a Tflush
@@ -421,7 +512,17 @@ func (m Tcreate) Perm() uint32 {
 }
 func (m Tcreate) Mode() uint8 { return m[len(m.Name())+17] }
 
+// Extension is used by the 9P2000.u extension to create special
+// files. It holds the target of a symbolic link, or the type and
+// major and minor numbers of a device file. Extension returns nil
+// if the field is not present.
+func (m Tcreate) Extension() []byte { return optField(m, len(m.Name())+18) }
+
 func (m Tcreate) String() string {
+	if ext := m.Extension(); ext != nil {
+		return fmt.Sprintf("Tcreate fid=%d name=%q perm=%o mode=%#o ext=%q",
+			m.Fid(), m.Name(), m.Perm(), m.Mode(), ext)
+	}
 	return fmt.Sprintf("Tcreate fid=%d name=%q perm=%o mode=%#o",
 		m.Fid(), m.Name(), m.Perm(), m.Mode())
 }
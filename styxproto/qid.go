@@ -49,11 +49,13 @@ func (q Qid) String() string {
 // as a bit vector corresponding to the high 8 bits of the file's mode
 // word.
 const (
-	QTDIR    = 0x80 // directories
-	QTAPPEND = 0x40 // append only files
-	QTEXCL   = 0x20 // exclusive use files
-	QTMOUNT  = 0x10 // mounted channel
-	QTAUTH   = 0x08 // authentication file (afid)
-	QTTMP    = 0x04 // non-backed-up file
-	QTFILE   = 0x00
+	QTDIR     = 0x80 // directories
+	QTAPPEND  = 0x40 // append only files
+	QTEXCL    = 0x20 // exclusive use files
+	QTMOUNT   = 0x10 // mounted channel
+	QTAUTH    = 0x08 // authentication file (afid)
+	QTTMP     = 0x04 // non-backed-up file
+	QTSYMLINK = 0x02 // symbolic link (9P2000.u)
+	QTLINK    = 0x01 // hard link (9P2000.u)
+	QTFILE    = 0x00
 )
@@ -57,11 +57,76 @@ func (s Stat) Gid() []byte { return nthField(s, statFixedSize, 2) }
 // Muid returns the name of the user who last modified the file
 func (s Stat) Muid() []byte { return nthField(s, statFixedSize, 3) }
 
+// The 9P2000.u extension appends extension[s] n_uid[4] n_gid[4]
+// n_muid[4] to a Stat structure. uext returns these fields, or nil
+// if s is a 9P2000 Stat.
+func (s Stat) uext() []byte {
+	offset := statFixedSize
+	for i := 0; i < 4; i++ {
+		offset += 2 + int(guint16(s[offset:offset+2]))
+	}
+	if len(s)-offset < statExtraU {
+		return nil
+	}
+	return s[offset:]
+}
+
+// Extension returns the extension field of a 9P2000.u Stat
+// structure. It holds the target of a symbolic link, or the type
+// and major and minor numbers of a device file. Extension returns
+// nil for a 9P2000 Stat structure.
+func (s Stat) Extension() []byte {
+	if ext := s.uext(); ext != nil {
+		return nthField(ext, 0, 0)
+	}
+	return nil
+}
+
+// NUid returns the numeric id of the file's owner in a 9P2000.u
+// Stat structure. It returns NoUid for a 9P2000 Stat structure.
+func (s Stat) NUid() uint32 { return s.nid(0) }
+
+// NGid returns the numeric id of the file's group in a 9P2000.u
+// Stat structure. It returns NoUid for a 9P2000 Stat structure.
+func (s Stat) NGid() uint32 { return s.nid(1) }
+
+// NMuid returns the numeric id of the user who last modified the
+// file in a 9P2000.u Stat structure. It returns NoUid for a 9P2000
+// Stat structure.
+func (s Stat) NMuid() uint32 { return s.nid(2) }
+
+// SetNUid, SetNGid and SetNMuid set the numeric ids of a 9P2000.u
+// Stat structure. They have no effect on a 9P2000 Stat structure.
+func (s Stat) SetNUid(id uint32)  { s.setNid(0, id) }
+func (s Stat) SetNGid(id uint32)  { s.setNid(1, id) }
+func (s Stat) SetNMuid(id uint32) { s.setNid(2, id) }
+
+func (s Stat) nid(n int) uint32 {
+	ext := s.uext()
+	if ext == nil {
+		return NoUid
+	}
+	offset := 2 + int(guint16(ext[:2])) + 4*n
+	return guint32(ext[offset : offset+4])
+}
+
+func (s Stat) setNid(n int, id uint32) {
+	if ext := s.uext(); ext != nil {
+		offset := 2 + int(guint16(ext[:2])) + 4*n
+		buint32(ext[offset:offset+4], id)
+	}
+}
+
 func (s Stat) String() string {
-	return fmt.Sprintf("type=%x dev=%x qid=%q mode=%o atime=%d "+
+	str := fmt.Sprintf("type=%x dev=%x qid=%q mode=%o atime=%d "+
 		"mtime=%d length=%d name=%q uid=%q gid=%q muid=%q",
 		s.Type(), s.Dev(), s.Qid(), s.Mode(), s.Atime(), s.Mtime(),
 		s.Length(), s.Name(), s.Uid(), s.Gid(), s.Muid())
+	if s.uext() != nil {
+		str += fmt.Sprintf(" ext=%q n_uid=%d n_gid=%d n_muid=%d",
+			s.Extension(), s.NUid(), s.NGid(), s.NMuid())
+	}
+	return str
 }
 
 // NewStat creates a new Stat structure. The name, uid, gid, and muid
@@ -71,10 +136,13 @@ func (s Stat) String() string {
 // than MaxUidLen bytes long. Additional fields in the Stat structure
 // can be set by using the appropriate Set method on the Stat value.
 func NewStat(buf []byte, name, uid, gid, muid string) (Stat, []byte, error) {
+	if len(name) > MaxFilenameLen {
+		return nil, buf, errLongFilename
+	}
 	if len(uid) > MaxUidLen || len(gid) > MaxUidLen || len(muid) > MaxUidLen {
 		return nil, buf, errLongUsername
 	}
-	if len(buf) < minStatLen+len(uid)+len(gid)+len(muid) {
+	if len(buf) < minStatLen+len(name)+len(uid)+len(gid)+len(muid) {
 		return nil, buf, io.ErrShortBuffer
 	}
 
@@ -100,6 +168,225 @@ func NewStat(buf []byte, name, uid, gid, muid string) (Stat, []byte, error) {
 	return Stat(buf[:length]), b, nil
 }
 
+// NewStatU creates a new Stat structure in the format used by the
+// 9P2000.u extension. In addition to the fields of NewStat, it
+// contains an extension string, which is considered read-only once
+// the Stat is created, and numeric user and group ids, which are
+// initialized to NoUid. An error is returned if extension is longer
+// than MaxExtensionLen bytes.
+func NewStatU(buf []byte, name, uid, gid, muid, extension string) (Stat, []byte, error) {
+	if len(extension) > MaxExtensionLen {
+		return nil, buf, errLongExtension
+	}
+	_, b, err := NewStat(buf, name, uid, gid, muid)
+	if err != nil {
+		return nil, buf, err
+	}
+	if len(b) < statExtraU+len(extension) {
+		return nil, buf, io.ErrShortBuffer
+	}
+	buint16(b, uint16(len(extension)))
+	b = b[2:]
+	b = b[copy(b, extension):]
+	for i := 0; i < 3; i++ {
+		buint32(b, NoUid)
+		b = b[4:]
+	}
+
+	length := len(buf) - len(b)
+	buint16(buf[:2], uint16(length-2))
+	return Stat(buf[:length]), b, nil
+}
+
+// A StatBuilder holds the fields of a Stat structure as Go values,
+// so that they may be changed freely, including the string fields
+// that are fixed in size once a Stat is created. It is useful for
+// modifying a Stat received in a Twstat or Rstat message.
+type StatBuilder struct {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length int64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+
+	// If U is true, Build creates a 9P2000.u Stat structure,
+	// with the following fields.
+	U         bool
+	Extension string
+	NUid      uint32
+	NGid      uint32
+	NMuid     uint32
+}
+
+// NewStatBuilder returns a StatBuilder holding the fields of s,
+// which does not share memory with s. If s is nil, the StatBuilder
+// is empty.
+func NewStatBuilder(s Stat) *StatBuilder {
+	if s == nil {
+		return &StatBuilder{NUid: NoUid, NGid: NoUid, NMuid: NoUid}
+	}
+	return &StatBuilder{
+		Type:      s.Type(),
+		Dev:       s.Dev(),
+		Qid:       append(Qid(nil), s.Qid()...),
+		Mode:      s.Mode(),
+		Atime:     s.Atime(),
+		Mtime:     s.Mtime(),
+		Length:    s.Length(),
+		Name:      string(s.Name()),
+		Uid:       string(s.Uid()),
+		Gid:       string(s.Gid()),
+		Muid:      string(s.Muid()),
+		U:         s.uext() != nil,
+		Extension: string(s.Extension()),
+		NUid:      s.NUid(),
+		NGid:      s.NGid(),
+		NMuid:     s.NMuid(),
+	}
+}
+
+// Build writes a Stat structure with the fields of b to buf, and
+// returns it along with the remaining space in buf. An error is
+// returned if buf is too small, or if any of the string fields of b
+// are too long, as with NewStat and NewStatU.
+func (b *StatBuilder) Build(buf []byte) (Stat, []byte, error) {
+	var (
+		stat Stat
+		rest []byte
+		err  error
+	)
+	if b.U {
+		stat, rest, err = NewStatU(buf, b.Name, b.Uid, b.Gid, b.Muid, b.Extension)
+	} else {
+		stat, rest, err = NewStat(buf, b.Name, b.Uid, b.Gid, b.Muid)
+	}
+	if err != nil {
+		return nil, buf, err
+	}
+	stat.SetType(b.Type)
+	stat.SetDev(b.Dev)
+	if len(b.Qid) == QidLen {
+		stat.SetQid(b.Qid)
+	} else {
+		stat.SetQid(make(Qid, QidLen))
+	}
+	stat.SetMode(b.Mode)
+	stat.SetAtime(b.Atime)
+	stat.SetMtime(b.Mtime)
+	stat.SetLength(b.Length)
+	stat.SetNUid(b.NUid)
+	stat.SetNGid(b.NGid)
+	stat.SetNMuid(b.NMuid)
+	return stat, rest, nil
+}
+
+// UnpackStats splits the data returned by a Tread request on a
+// directory into its Stat structures. The returned Stats share
+// memory with data. An error is returned if any Stat structure is
+// invalid or incomplete.
+func UnpackStats(data []byte) ([]Stat, error) {
+	var stats []Stat
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errShortStat
+		}
+		n := int(guint16(data[:2])) + 2
+		if n > len(data) {
+			return nil, errOverSize
+		}
+		if err := verifyStat(data[:n], nil); err != nil {
+			return nil, err
+		}
+		stats = append(stats, Stat(data[:n]))
+		data = data[n:]
+	}
+	return stats, nil
+}
+
+// A DirIterator reads the Stat structures in the contents of a
+// directory, as returned by Tread requests, from an io.Reader.
+// Successive calls to the Next method validate and fetch each
+// Stat in turn, until the end of the stream or an invalid Stat is
+// reached. A DirIterator does not read past the Stat it returns.
+type DirIterator struct {
+	// Version is the protocol version of the Stat structures,
+	// which determines their layout. If Version is not
+	// Version9P2000U, plain 9P2000 Stat structures are expected.
+	Version string
+
+	r    io.Reader
+	buf  []byte
+	stat Stat
+	err  error
+}
+
+// NewDirIterator returns a DirIterator that reads Stat structures
+// from r.
+func NewDirIterator(r io.Reader) *DirIterator {
+	return &DirIterator{r: r}
+}
+
+// Next fetches the next Stat structure from the underlying io.Reader.
+// It returns false at the end of the stream, or if an error is
+// encountered, which is then returned by the Err method.
+func (it *DirIterator) Next() bool {
+	it.stat = nil
+	if it.err != nil {
+		return false
+	}
+	max, verify := MaxStatLen, verifyStat
+	if it.Version == Version9P2000U {
+		max, verify = MaxStatLenU, verifyStatU
+	}
+	if len(it.buf) < max {
+		it.buf = make([]byte, max)
+	}
+	if _, err := io.ReadFull(it.r, it.buf[:2]); err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		return false
+	}
+	n := int(guint16(it.buf[:2])) + 2
+	if n > max {
+		it.err = errLongStat
+		return false
+	}
+	if _, err := io.ReadFull(it.r, it.buf[2:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		it.err = err
+		return false
+	}
+	if err := verify(it.buf[:n], nil); err != nil {
+		it.err = err
+		return false
+	}
+	it.stat = Stat(it.buf[:n])
+	return true
+}
+
+// Stat returns the Stat structure fetched by the last call to Next.
+// It is only valid until the next call to Next.
+func (it *DirIterator) Stat() Stat {
+	return it.stat
+}
+
+// Err returns the first error encountered by Next. Reaching the
+// end of the stream between Stat structures is not an error; if the
+// stream ends within a Stat structure, Err returns
+// io.ErrUnexpectedEOF.
+func (it *DirIterator) Err() error {
+	return it.err
+}
+
 // verifyStat ensures that a Stat structure is valid and safe to use
 // as a Stat. This *must* be called on all received Stats, otherwise
 // there is no guarantee that a bad actor threw in some illegal sizes
@@ -111,40 +398,67 @@ func NewStat(buf []byte, name, uid, gid, muid string) (Stat, []byte, error) {
 // providing explicit ``don't touch'' values in the stat data that is sent:
 // zero-length strings for text values and the maximum unsigned value of
 // appropriate size for integral values.
-func verifyStat(data []byte) error {
+func verifyStat(data []byte, lim *Limits) error {
+	_, err := verifyStatFields(data, lim.statLen(), 0, lim)
+	return err
+}
+
+// verifyStatU verifies a 9P2000.u Stat structure, which appends
+// extension[s] n_uid[4] n_gid[4] n_muid[4] to the fields of a 9P2000
+// Stat structure.
+func verifyStatU(data []byte, lim *Limits) error {
+	rest, err := verifyStatFields(data, lim.statLenU(), statExtraU, lim)
+	if err != nil {
+		return err
+	}
+	ext, _, err := verifyField(rest, true, 12)
+	if err != nil {
+		return err
+	} else if err := verifyString(ext); err != nil {
+		return err
+	} else if len(ext) > lim.extension() {
+		return errLongExtension
+	}
+	return nil
+}
+
+// verifyStatFields verifies the fields common to all Stat structures.
+// extra is the number of bytes expected after the muid field. The
+// remaining data after the muid field is returned.
+func verifyStatFields(data []byte, max, extra int, lim *Limits) ([]byte, error) {
 	var field []byte
 
 	// type[2] dev[4] qid[13] mod[4] atime[4]
 	// mtime[4] length[8] name[s] uid[s] gid[s] muid[s]
-	if len(data) < minStatLen {
-		return errShortStat
-	} else if len(data) > MaxStatLen {
-		return errLongStat
+	if len(data) < minStatLen+extra {
+		return nil, errShortStat
+	} else if len(data) > max {
+		return nil, errLongStat
 	}
 
 	const sizeHeaders = 2 * 4 // name[s], uid[s], gid[s], muid[s], 2-byte length headers each
-	name, rest, err := verifyField(data[statFixedSize:], false, sizeHeaders-2)
+	name, rest, err := verifyField(data[statFixedSize:], false, sizeHeaders-2+extra)
 	if err != nil {
-		return err
+		return nil, err
 	} else if err := verifyPathElem(name); err != nil {
-		return err
-	} else if len(name) > MaxFilenameLen {
-		return errLongFilename
+		return nil, err
+	} else if len(name) > lim.filename() {
+		return nil, errLongFilename
 	}
 
 	for i := 0; i < 3; i++ {
-		padding := 4 - i*2
+		padding := 4 - i*2 + extra
 		field, rest, err = verifyField(rest, i == 2, padding)
 		if err != nil {
-			return err
+			return nil, err
 		} else if err := verifyString(field); err != nil {
-			return err
-		} else if len(field) > MaxUidLen {
-			return errLongUsername
+			return nil, err
+		} else if len(field) > lim.uid() {
+			return nil, errLongUsername
 		}
 		if len(rest) < padding {
-			return errOverSize
+			return nil, errOverSize
 		}
 	}
-	return nil
+	return rest, nil
 }
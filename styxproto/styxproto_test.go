@@ -67,7 +67,8 @@ func TestMinBufSize(t *testing.T) {
 			"of an int. This breaks assumptions in the code.")
 	}
 	for mtype, v := range maxSizeLUT {
-		if mtype == msgTwrite || mtype == msgRread {
+		switch mtype {
+		case msgTwrite, msgRread, msgRreaddir, msgRsread, msgTswrite:
 			continue
 		}
 		if MinBufSize < v {
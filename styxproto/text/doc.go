@@ -0,0 +1,36 @@
+/*
+Package text converts 9P messages to and from a line-oriented text
+format, for golden-file tests, interactive debugging and replaying
+logged conversations. The format is close to the one printed by the
+fcall(2) routines of Plan 9, but is not ambiguous, so that every
+line can be parsed back into the message it came from.
+
+Each message is a single line, starting with the type of the message
+and followed by pairs of field names and values:
+
+	Tversion tag 65535 msize 8192 version "9P2000"
+	Twalk tag 1 fid 0 newfid 1 wname "usr" "glenda"
+	Rwalk tag 1 wqid (0000000000000002 0 d) (0000000000000005 3)
+	Twrite tag 2 fid 1 offset 0 data "hello, world\n"
+	Rstat tag 3 stat [name "lib" uid "glenda" gid "glenda" muid "" qid (0000000000000005 3 d) mode 020000000755 atime 0 mtime 0 length 0 type 0 dev 0]
+
+Strings, including the data of Twrite and Rread messages, are quoted
+with the rules of the Go language. The wname and wqid fields of
+Twalk and Rwalk messages take all of the values that follow them. A
+qid is written in parentheses, as its path in hexadecimal, its
+version, and the letters of its type bits, if any:
+
+	d	QTDIR
+	a	QTAPPEND
+	l	QTEXCL
+	m	QTMOUNT
+	A	QTAUTH
+	t	QTTMP
+	L	QTSYMLINK
+	h	QTLINK
+
+Only the messages of 9P2000 are supported; the fields added by the
+9P2000.u extension are left out, and 9P2000.L messages cannot be
+formatted or parsed.
+*/
+package text
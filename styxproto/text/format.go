@@ -0,0 +1,141 @@
+package text
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// The letters used for the type bits of a qid, from the most
+// significant bit to the least.
+const qidTypes = "dalmAtLh"
+
+// Format returns the text form of m. The data of Twrite and Rread
+// messages is read from m, and cannot be read from it afterwards.
+// An error is returned if the data cannot be read, or if m is not a
+// 9P2000 message.
+func Format(m styxproto.Msg) (string, error) {
+	var b strings.Builder
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(&b, " %s %v", name, value)
+	}
+	b.WriteString(msgType(m))
+	field("tag", m.Tag())
+
+	switch m := m.(type) {
+	case styxproto.Tversion:
+		field("msize", m.Msize())
+		field("version", strconv.Quote(string(m.Version())))
+	case styxproto.Rversion:
+		field("msize", m.Msize())
+		field("version", strconv.Quote(string(m.Version())))
+	case styxproto.Tauth:
+		field("afid", m.Afid())
+		field("uname", strconv.Quote(string(m.Uname())))
+		field("aname", strconv.Quote(string(m.Aname())))
+	case styxproto.Rauth:
+		field("aqid", formatQid(m.Aqid()))
+	case styxproto.Tattach:
+		field("fid", m.Fid())
+		field("afid", m.Afid())
+		field("uname", strconv.Quote(string(m.Uname())))
+		field("aname", strconv.Quote(string(m.Aname())))
+	case styxproto.Rattach:
+		field("qid", formatQid(m.Qid()))
+	case styxproto.Rerror:
+		field("ename", strconv.Quote(string(m.Ename())))
+	case styxproto.Tflush:
+		field("oldtag", m.Oldtag())
+	case styxproto.Rflush:
+	case styxproto.Twalk:
+		field("fid", m.Fid())
+		field("newfid", m.Newfid())
+		b.WriteString(" wname")
+		for i := 0; i < m.Nwname(); i++ {
+			b.WriteString(" " + strconv.Quote(string(m.Wname(i))))
+		}
+	case styxproto.Rwalk:
+		b.WriteString(" wqid")
+		for i := 0; i < m.Nwqid(); i++ {
+			b.WriteString(" " + formatQid(m.Wqid(i)))
+		}
+	case styxproto.Topen:
+		field("fid", m.Fid())
+		field("mode", m.Mode())
+	case styxproto.Ropen:
+		field("qid", formatQid(m.Qid()))
+		field("iounit", m.IOunit())
+	case styxproto.Tcreate:
+		field("fid", m.Fid())
+		field("name", strconv.Quote(string(m.Name())))
+		field("perm", fmt.Sprintf("%#o", m.Perm()))
+		field("mode", m.Mode())
+	case styxproto.Rcreate:
+		field("qid", formatQid(m.Qid()))
+		field("iounit", m.IOunit())
+	case styxproto.Tread:
+		field("fid", m.Fid())
+		field("offset", m.Offset())
+		field("count", m.Count())
+	case styxproto.Rread:
+		data, err := ioutil.ReadAll(m)
+		if err != nil {
+			return "", err
+		}
+		field("data", strconv.Quote(string(data)))
+	case styxproto.Twrite:
+		field("fid", m.Fid())
+		field("offset", m.Offset())
+		data, err := ioutil.ReadAll(m)
+		if err != nil {
+			return "", err
+		}
+		field("data", strconv.Quote(string(data)))
+	case styxproto.Rwrite:
+		field("count", m.Count())
+	case styxproto.Tclunk:
+		field("fid", m.Fid())
+	case styxproto.Rclunk:
+	case styxproto.Tremove:
+		field("fid", m.Fid())
+	case styxproto.Rremove:
+	case styxproto.Tstat:
+		field("fid", m.Fid())
+	case styxproto.Rstat:
+		field("stat", formatStat(m.Stat()))
+	case styxproto.Twstat:
+		field("fid", m.Fid())
+		field("stat", formatStat(m.Stat()))
+	case styxproto.Rwstat:
+	default:
+		return "", fmt.Errorf("cannot format %T message", m)
+	}
+	return b.String(), nil
+}
+
+func msgType(m styxproto.Msg) string {
+	name := fmt.Sprintf("%T", m)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func formatQid(q styxproto.Qid) string {
+	var types []byte
+	for i := range qidTypes {
+		if q.Type()&(0x80>>uint(i)) != 0 {
+			types = append(types, qidTypes[i])
+		}
+	}
+	if len(types) == 0 {
+		return fmt.Sprintf("(%016x %d)", q.Path(), q.Version())
+	}
+	return fmt.Sprintf("(%016x %d %s)", q.Path(), q.Version(), types)
+}
+
+func formatStat(s styxproto.Stat) string {
+	return fmt.Sprintf("[name %q uid %q gid %q muid %q qid %s mode %#o atime %d mtime %d length %d type %d dev %d]",
+		s.Name(), s.Uid(), s.Gid(), s.Muid(), formatQid(s.Qid()), s.Mode(),
+		s.Atime(), s.Mtime(), uint64(s.Length()), s.Type(), s.Dev())
+}
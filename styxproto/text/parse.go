@@ -0,0 +1,371 @@
+package text
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+var (
+	errEmpty   = errors.New("empty message")
+	errQuote   = errors.New("unterminated string")
+	errGroup   = errors.New("unbalanced brackets")
+	errBadQid  = errors.New("malformed qid")
+	errBadStat = errors.New("malformed stat")
+)
+
+// A token is a word, a quoted string, or a qid or stat, whose
+// tokens are held in sub.
+type token struct {
+	kind byte // 'w', '"', '(' or '['
+	text string
+	sub  []token
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case '(':
+		return "qid"
+	case '[':
+		return "stat"
+	}
+	return t.text
+}
+
+// tokenize splits s into tokens, stopping at end, which is the
+// closing bracket of a group, or 0 for the end of the line. It
+// returns the remaining input after end.
+func tokenize(s string, end byte) ([]token, string, error) {
+	var toks []token
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			if end != 0 {
+				return nil, "", errGroup
+			}
+			return toks, "", nil
+		}
+		switch c := s[0]; c {
+		case end:
+			return toks, s[1:], nil
+		case ')', ']':
+			return nil, "", errGroup
+		case '(', '[':
+			closing := byte(')')
+			if c == '[' {
+				closing = ']'
+			}
+			sub, rest, err := tokenize(s[1:], closing)
+			if err != nil {
+				return nil, "", err
+			}
+			toks = append(toks, token{kind: c, sub: sub})
+			s = rest
+		case '"':
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, "", errQuote
+			}
+			str, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return nil, "", err
+			}
+			toks = append(toks, token{kind: '"', text: str})
+			s = s[i+1:]
+		default:
+			i := strings.IndexAny(s, " \t\r\n()[]\"")
+			if i < 0 {
+				i = len(s)
+			}
+			toks = append(toks, token{kind: 'w', text: s[:i]})
+			s = s[i:]
+		}
+	}
+}
+
+// fields holds the values of a message or stat, by name. Values
+// are removed as they are used, so that unknown fields can be
+// reported.
+type fields struct {
+	m   map[string][]token
+	err error
+}
+
+// newFields pairs the names in toks with their values. The names in
+// list take all of the tokens after them.
+func newFields(toks []token, list ...string) (*fields, error) {
+	f := &fields{m: make(map[string][]token)}
+	for len(toks) > 0 {
+		name := toks[0]
+		if name.kind != 'w' {
+			return nil, fmt.Errorf("expected field name, found %s", name)
+		}
+		if _, ok := f.m[name.text]; ok {
+			return nil, fmt.Errorf("duplicate field %s", name.text)
+		}
+		n := 1
+		for _, l := range list {
+			if name.text == l {
+				n = len(toks) - 1
+			}
+		}
+		if len(toks) < n+1 {
+			return nil, fmt.Errorf("missing value of field %s", name.text)
+		}
+		f.m[name.text] = toks[1 : n+1]
+		toks = toks[n+1:]
+	}
+	return f, nil
+}
+
+func (f *fields) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *fields) list(name string) []token {
+	v, ok := f.m[name]
+	if !ok {
+		f.fail(fmt.Errorf("missing field %s", name))
+	}
+	delete(f.m, name)
+	return v
+}
+
+func (f *fields) value(name string, kind byte) token {
+	v := f.list(name)
+	if len(v) != 1 {
+		return token{}
+	}
+	if v[0].kind != kind {
+		f.fail(fmt.Errorf("bad value %s for field %s", v[0], name))
+	}
+	return v[0]
+}
+
+func (f *fields) uint(name string, bits int) uint64 {
+	return f.parseUint(name, f.value(name, 'w').text, bits)
+}
+
+func (f *fields) parseUint(name, s string, bits int) uint64 {
+	n, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		f.fail(fmt.Errorf("bad value %q for field %s", s, name))
+	}
+	return n
+}
+
+func (f *fields) str(name string) string {
+	return f.value(name, '"').text
+}
+
+func (f *fields) qid(name string) styxproto.Qid {
+	return f.parseQid(name, f.value(name, '('))
+}
+
+func (f *fields) parseQid(name string, t token) styxproto.Qid {
+	if t.kind != '(' || len(t.sub) < 2 || len(t.sub) > 3 {
+		f.fail(errBadQid)
+		return make(styxproto.Qid, styxproto.QidLen)
+	}
+	for _, v := range t.sub {
+		if v.kind != 'w' {
+			f.fail(errBadQid)
+		}
+	}
+	path, err := strconv.ParseUint(t.sub[0].text, 16, 64)
+	if err != nil {
+		f.fail(errBadQid)
+	}
+	version := f.parseUint(name, t.sub[1].text, 32)
+	var qtype uint8
+	if len(t.sub) == 3 {
+		for _, c := range t.sub[2].text {
+			i := strings.IndexRune(qidTypes, c)
+			if i < 0 {
+				f.fail(errBadQid)
+			}
+			qtype |= 0x80 >> uint(i)
+		}
+	}
+	qid, _, _ := styxproto.NewQid(make([]byte, styxproto.QidLen), qtype, uint32(version), path)
+	return qid
+}
+
+func (f *fields) stat(name string) styxproto.Stat {
+	t := f.value(name, '[')
+	sf, err := newFields(t.sub)
+	if err != nil {
+		f.fail(err)
+		return nil
+	}
+	b := styxproto.NewStatBuilder(nil)
+	b.Name = sf.str("name")
+	b.Uid = sf.str("uid")
+	b.Gid = sf.str("gid")
+	b.Muid = sf.str("muid")
+	b.Qid = sf.qid("qid")
+	b.Mode = uint32(sf.uint("mode", 32))
+	b.Atime = uint32(sf.uint("atime", 32))
+	b.Mtime = uint32(sf.uint("mtime", 32))
+	b.Length = int64(sf.uint("length", 64))
+	b.Type = uint16(sf.uint("type", 16))
+	b.Dev = uint32(sf.uint("dev", 32))
+	if err := sf.done(); err != nil {
+		f.fail(err)
+		return nil
+	}
+	stat, _, err := b.Build(make([]byte, styxproto.MaxStatLen))
+	if err != nil {
+		f.fail(err)
+	}
+	return stat
+}
+
+// done returns the first error encountered, or an error if any
+// fields were not used.
+func (f *fields) done() error {
+	if f.err != nil {
+		return f.err
+	}
+	for name := range f.m {
+		return fmt.Errorf("unknown field %s", name)
+	}
+	return nil
+}
+
+// Parse parses a message in the text form produced by Format.
+func Parse(line string) (styxproto.Msg, error) {
+	toks, _, err := tokenize(line, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, errEmpty
+	}
+	mtype := toks[0]
+	if mtype.kind != 'w' {
+		return nil, fmt.Errorf("expected message type, found %s", mtype)
+	}
+	f, err := newFields(toks[1:], "wname", "wqid")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := styxproto.NewEncoder(&buf)
+	enc.MaxSize = math.MaxUint32
+	tag := uint16(f.uint("tag", 16))
+
+	switch mtype.text {
+	case "Tversion":
+		// The tag of version messages is always NoTag.
+		enc.Tversion(uint32(f.uint("msize", 32)), f.str("version"))
+	case "Rversion":
+		enc.Rversion(uint32(f.uint("msize", 32)), f.str("version"))
+	case "Tauth":
+		enc.Tauth(tag, uint32(f.uint("afid", 32)), f.str("uname"), f.str("aname"))
+	case "Rauth":
+		enc.Rauth(tag, f.qid("aqid"))
+	case "Tattach":
+		enc.Tattach(tag, uint32(f.uint("fid", 32)), uint32(f.uint("afid", 32)), f.str("uname"), f.str("aname"))
+	case "Rattach":
+		enc.Rattach(tag, f.qid("qid"))
+	case "Rerror":
+		enc.Rerror(tag, "%s", f.str("ename"))
+	case "Tflush":
+		enc.Tflush(tag, uint16(f.uint("oldtag", 16)))
+	case "Rflush":
+		enc.Rflush(tag)
+	case "Twalk":
+		fid, newfid := uint32(f.uint("fid", 32)), uint32(f.uint("newfid", 32))
+		var wname []string
+		for _, t := range f.list("wname") {
+			if t.kind != '"' {
+				f.fail(fmt.Errorf("bad value %s for field wname", t))
+			}
+			wname = append(wname, t.text)
+		}
+		if f.err == nil {
+			f.fail(enc.Twalk(tag, fid, newfid, wname...))
+		}
+	case "Rwalk":
+		var wqid []styxproto.Qid
+		for _, t := range f.list("wqid") {
+			wqid = append(wqid, f.parseQid("wqid", t))
+		}
+		if f.err == nil {
+			f.fail(enc.Rwalk(tag, wqid...))
+		}
+	case "Topen":
+		enc.Topen(tag, uint32(f.uint("fid", 32)), uint8(f.uint("mode", 8)))
+	case "Ropen":
+		enc.Ropen(tag, f.qid("qid"), uint32(f.uint("iounit", 32)))
+	case "Tcreate":
+		enc.Tcreate(tag, uint32(f.uint("fid", 32)), f.str("name"), uint32(f.uint("perm", 32)), uint8(f.uint("mode", 8)))
+	case "Rcreate":
+		enc.Rcreate(tag, f.qid("qid"), uint32(f.uint("iounit", 32)))
+	case "Tread":
+		f.fail(enc.Tread(tag, uint32(f.uint("fid", 32)), int64(f.uint("offset", 63)), int64(f.uint("count", 32))))
+	case "Rread":
+		if _, err := enc.Rread(tag, []byte(f.str("data"))); err != nil {
+			f.fail(err)
+		}
+	case "Twrite":
+		fid, offset := uint32(f.uint("fid", 32)), int64(f.uint("offset", 63))
+		if _, err := enc.Twrite(tag, fid, offset, []byte(f.str("data"))); err != nil {
+			f.fail(err)
+		}
+	case "Rwrite":
+		enc.Rwrite(tag, int64(f.uint("count", 32)))
+	case "Tclunk":
+		enc.Tclunk(tag, uint32(f.uint("fid", 32)))
+	case "Rclunk":
+		enc.Rclunk(tag)
+	case "Tremove":
+		enc.Tremove(tag, uint32(f.uint("fid", 32)))
+	case "Rremove":
+		enc.Rremove(tag)
+	case "Tstat":
+		enc.Tstat(tag, uint32(f.uint("fid", 32)))
+	case "Rstat":
+		if stat := f.stat("stat"); stat != nil {
+			enc.Rstat(tag, stat)
+		}
+	case "Twstat":
+		fid := uint32(f.uint("fid", 32))
+		if stat := f.stat("stat"); stat != nil {
+			enc.Twstat(tag, fid, stat)
+		}
+	case "Rwstat":
+		enc.Rwstat(tag)
+	default:
+		return nil, fmt.Errorf("unknown message type %q", mtype.text)
+	}
+	if err := f.done(); err != nil {
+		return nil, fmt.Errorf("%s: %v", mtype.text, err)
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	dec := styxproto.NewDecoder(&buf)
+	if !dec.Next() {
+		return nil, dec.Err()
+	}
+	if bad, ok := dec.Msg().(styxproto.BadMessage); ok {
+		return nil, fmt.Errorf("%s: %v", mtype.text, bad.Err)
+	}
+	return styxproto.Clone(dec.Msg())
+}
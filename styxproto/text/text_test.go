@@ -0,0 +1,75 @@
+package text
+
+import (
+	"testing"
+)
+
+var messages = []string{
+	`Tversion tag 65535 msize 8192 version "9P2000"`,
+	`Rversion tag 65535 msize 8192 version "9P2000"`,
+	`Tauth tag 1 afid 0 uname "glenda" aname ""`,
+	`Rauth tag 1 aqid (0000000000000001 0 A)`,
+	`Tattach tag 1 fid 1 afid 4294967295 uname "glenda" aname "main"`,
+	`Rattach tag 1 qid (0000000000000002 0 d)`,
+	`Rerror tag 1 ename "file does not exist"`,
+	`Tflush tag 2 oldtag 1`,
+	`Rflush tag 2`,
+	`Twalk tag 1 fid 0 newfid 1 wname "usr" "glenda"`,
+	`Twalk tag 1 fid 0 newfid 1 wname`,
+	`Rwalk tag 1 wqid (0000000000000002 0 d) (0000000000000005 3)`,
+	`Topen tag 1 fid 1 mode 16`,
+	`Ropen tag 1 qid (00000000000000ff 7 al) iounit 8192`,
+	`Tcreate tag 1 fid 1 name "new" perm 020000000755 mode 0`,
+	`Rcreate tag 1 qid (0000000000000003 0) iounit 0`,
+	`Tread tag 1 fid 1 offset 100 count 8192`,
+	`Rread tag 1 data "hello, world\n\x00\xff"`,
+	`Twrite tag 2 fid 1 offset 0 data "hello, \"world\""`,
+	`Rwrite tag 2 count 14`,
+	`Tclunk tag 1 fid 1`,
+	`Rclunk tag 1`,
+	`Tremove tag 1 fid 1`,
+	`Rremove tag 1`,
+	`Tstat tag 3 fid 1`,
+	`Rstat tag 3 stat [name "lib" uid "glenda" gid "glenda" muid "" qid (0000000000000005 3 d) mode 020000000755 atime 0 mtime 1500000000 length 0 type 0 dev 0]`,
+	`Twstat tag 4 fid 1 stat [name "" uid "" gid "" muid "" qid (ffffffffffffffff 4294967295 dalmAtLh) mode 037777777777 atime 4294967295 mtime 4294967295 length 18446744073709551615 type 65535 dev 4294967295]`,
+	`Rwstat tag 4`,
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, line := range messages {
+		m, err := Parse(line)
+		if err != nil {
+			t.Errorf("parse %s: %v", line, err)
+			continue
+		}
+		got, err := Format(m)
+		if err != nil {
+			t.Errorf("format %s: %v", line, err)
+			continue
+		}
+		if got != line {
+			t.Errorf("round trip changed message\n\thave %s\n\twant %s", got, line)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		``,
+		`Tfoo tag 1`,
+		`Tclunk tag 1`,
+		`Tclunk tag 1 fid 1 extra 2`,
+		`Tclunk tag 1 fid "1"`,
+		`Tclunk tag 70000 fid 1`,
+		`Rerror tag 1 ename "unterminated`,
+		`Rattach tag 1 qid (0000000000000002 0 d`,
+		`Rattach tag 1 qid (0000000000000002 0 x)`,
+		`Twalk tag 1 fid 0 newfid 1 wname "a/b"`,
+		`Rstat tag 3 stat [name "lib"]`,
+	}
+	for _, line := range bad {
+		if m, err := Parse(line); err == nil {
+			t.Errorf("parsed invalid message %q as %s", line, m)
+		}
+	}
+}
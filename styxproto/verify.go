@@ -4,26 +4,27 @@ import "unicode/utf8"
 
 // verification functions for the various fields in a 9P message
 
-func validType(t uint8) bool {
-	return int(t) < len(msgParseLUT) && msgParseLUT[t] != nil
+func validType(d dialect, t uint8) bool {
+	return d.parser(t) != nil
 }
 
 // check that a message is as big or as small as
 // it needs to be, given what we know about its
-// type.
-func verifySizeAndType(m msg) error {
+// type. The maximum size is only enforced if strict
+// is true.
+func verifySizeAndType(d dialect, m msg, strict bool, lim *Limits) error {
 	t, n := m.Type(), m.Len()
-	if !validType(t) {
+	if !validType(d, t) {
 		return errInvalidMsgType
 	}
-	if min := int64(minSizeLUT[t]); n < min {
+	if min := int64(d.minSize(t)); n < min {
 		return errTooSmall
 	}
-	if max := int64(maxSizeLUT[t]); n > max {
+	if max := int64(d.maxSize(t, lim)); strict && n > max {
 		// Some servers/clients do not seem to "shrink-wrap"
 		// messages -- there can be empty space after the message
 		// data
-		//return errTooBig
+		return errTooBig
 	}
 	return nil
 }
@@ -58,8 +59,116 @@ func verifyField(data []byte, fill bool, padding int) ([]byte, []byte, error) {
 	} else if fill && size+2 < len(data)-padding {
 		// Some clients/servers leave empty space at the end
 		// of their messages, and the docs are silent on the matter.
+		// Checked by verifyFilled in strict mode.
 		//return nil, nil, errUnderSize
 	}
 	field := data[2:]
 	return field[:size], field[size:], nil
 }
+
+// The layout of the fields of messages with variable-length fields,
+// after the tag. Digits are fixed-size fields of that many bytes. The
+// letters v, u, a, e, n, x, c and S are strings holding a version,
+// user name, aname, error, file name, extension, client id and Stat
+// structure, respectively; w is a list of file names and q a list of
+// qids, each preceded by a 2-byte count, and d is data preceded by a
+// 4-byte count.
+var layoutLUT = [...]string{
+	msgTversion: "4v",
+	msgRversion: "4v",
+	msgTauth:    "4ua",
+	msgTattach:  "44ua",
+	msgRerror:   "e",
+	msgTwalk:    "44w",
+	msgRwalk:    "q",
+	msgTcreate:  "4n41",
+	msgRstat:    "S",
+	msgTwstat:   "4S",
+
+	msgTlcreate:     "4n444",
+	msgTsymlink:     "4nx4",
+	msgTmknod:       "4n4444",
+	msgTrename:      "44n",
+	msgRreadlink:    "x",
+	msgTxattrwalk:   "44n",
+	msgTxattrcreate: "4n84",
+	msgTlock:        "414884c",
+	msgTgetlock:     "41884c",
+	msgRgetlock:     "1884c",
+	msgTlink:        "44n",
+	msgTmkdir:       "4n44",
+	msgTrenameat:    "4n4n",
+	msgTunlinkat:    "4n4",
+
+	msgTsread:  "4w",
+	msgRsread:  "d",
+	msgTswrite: "4wd",
+}
+
+// Layouts of the messages changed by the 9P2000.u extension.
+var layoutLUTu = [...]string{
+	msgTauth:   "4ua4",
+	msgTattach: "44ua4",
+	msgRerror:  "e4",
+	msgTcreate: "4n41x",
+}
+
+func (d dialect) layout(t uint8) string {
+	if d != dialect9P2000 && (t == msgTauth || t == msgTattach) ||
+		d == dialectU && int(t) < len(layoutLUTu) && layoutLUTu[t] != "" {
+		return layoutLUTu[t]
+	}
+	if int(t) < len(layoutLUT) {
+		return layoutLUT[t]
+	}
+	return ""
+}
+
+// verifyFilled checks that the fields of a message fill it, with no
+// empty space after the last field. Messages with only fixed-size
+// fields are checked by verifySizeAndType.
+func verifyFilled(d dialect, m msg) error {
+	layout := d.layout(m.Type())
+	if layout == "" {
+		return nil
+	}
+	body := m.Body()
+	n := 0
+	for i := 0; i < len(layout); i++ {
+		switch c := layout[i]; {
+		case '0' <= c && c <= '9':
+			n += int(c - '0')
+		case c == 'd':
+			if n+4 > len(body) {
+				return errOverSize
+			}
+			n += 4 + int(guint32(body[n:]))
+		case c == 'w' || c == 'q':
+			if n+2 > len(body) {
+				return errOverSize
+			}
+			count := int(guint16(body[n:]))
+			n += 2
+			for j := 0; j < count; j++ {
+				if c == 'q' {
+					n += QidLen
+				} else if n+2 > len(body) {
+					return errOverSize
+				} else {
+					n += 2 + int(guint16(body[n:]))
+				}
+			}
+		default:
+			if n+2 > len(body) {
+				return errOverSize
+			}
+			n += 2 + int(guint16(body[n:]))
+		}
+	}
+	if n > len(body) {
+		return errOverSize
+	} else if n < len(body) {
+		return errUnderSize
+	}
+	return nil
+}
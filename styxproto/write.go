@@ -0,0 +1,611 @@
+package styxproto
+
+import "io"
+
+// The functions in this file write a single message to an io.Writer
+// without an Encoder, for programs that only send the occasional
+// message. Each takes the same arguments as the Encoder method of the
+// same name, and the same limits apply. Messages carrying data, such
+// as Rread and Twrite, are never split; an error is returned if they
+// do not fit in a single 9P message.
+
+// writers holds the Encoders used by the Write* functions.
+var writers = NewBufferPool(MinBufSize)
+
+func writeMsg(w io.Writer, fn func(enc *Encoder) error) error {
+	enc := writers.NewEncoder(w)
+	defer enc.Release()
+
+	enc.MaxSize = maxMsgSize
+	if err := fn(enc); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	return enc.Err()
+}
+
+// Messages from the 9P2000 and 9P2000.u protocols.
+
+// WriteTversion writes a Tversion message to w.
+func WriteTversion(w io.Writer, msize uint32, version string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tversion(msize, version)
+		return nil
+	})
+}
+
+// WriteRversion writes an Rversion message to w.
+func WriteRversion(w io.Writer, msize uint32, version string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rversion(msize, version)
+		return nil
+	})
+}
+
+// WriteTauth writes a Tauth message to w.
+func WriteTauth(w io.Writer, tag uint16, afid uint32, uname, aname string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tauth(tag, afid, uname, aname)
+		return nil
+	})
+}
+
+// WriteTauthU writes a 9P2000.u Tauth message to w.
+func WriteTauthU(w io.Writer, tag uint16, afid uint32, uname, aname string, nuname uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.TauthU(tag, afid, uname, aname, nuname)
+		return nil
+	})
+}
+
+// WriteRauth writes an Rauth message to w.
+func WriteRauth(w io.Writer, tag uint16, qid Qid) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rauth(tag, qid)
+		return nil
+	})
+}
+
+// WriteTattach writes a Tattach message to w.
+func WriteTattach(w io.Writer, tag uint16, fid, afid uint32, uname, aname string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tattach(tag, fid, afid, uname, aname)
+		return nil
+	})
+}
+
+// WriteTattachU writes a 9P2000.u Tattach message to w.
+func WriteTattachU(w io.Writer, tag uint16, fid, afid uint32, uname, aname string, nuname uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.TattachU(tag, fid, afid, uname, aname, nuname)
+		return nil
+	})
+}
+
+// WriteRattach writes an Rattach message to w.
+func WriteRattach(w io.Writer, tag uint16, qid Qid) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rattach(tag, qid)
+		return nil
+	})
+}
+
+// WriteRerror writes an Rerror message to w.
+func WriteRerror(w io.Writer, tag uint16, errfmt string, v ...interface{}) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rerror(tag, errfmt, v...)
+		return nil
+	})
+}
+
+// WriteRerrorU writes a 9P2000.u Rerror message to w.
+func WriteRerrorU(w io.Writer, tag uint16, errno uint32, errfmt string, v ...interface{}) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.RerrorU(tag, errno, errfmt, v...)
+		return nil
+	})
+}
+
+// WriteTflush writes a Tflush message to w.
+func WriteTflush(w io.Writer, tag, oldtag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tflush(tag, oldtag)
+		return nil
+	})
+}
+
+// WriteRflush writes an Rflush message to w.
+func WriteRflush(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rflush(tag)
+		return nil
+	})
+}
+
+// WriteTwalk writes a Twalk message to w.
+func WriteTwalk(w io.Writer, tag uint16, fid, newfid uint32, wname ...string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Twalk(tag, fid, newfid, wname...) })
+}
+
+// WriteRwalk writes an Rwalk message to w.
+func WriteRwalk(w io.Writer, tag uint16, wqid ...Qid) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Rwalk(tag, wqid...) })
+}
+
+// WriteTopen writes a Topen message to w.
+func WriteTopen(w io.Writer, tag uint16, fid uint32, mode uint8) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Topen(tag, fid, mode)
+		return nil
+	})
+}
+
+// WriteRopen writes an Ropen message to w.
+func WriteRopen(w io.Writer, tag uint16, qid Qid, iounit uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Ropen(tag, qid, iounit)
+		return nil
+	})
+}
+
+// WriteTcreate writes a Tcreate message to w.
+func WriteTcreate(w io.Writer, tag uint16, fid uint32, name string, perm uint32, mode uint8) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tcreate(tag, fid, name, perm, mode)
+		return nil
+	})
+}
+
+// WriteTcreateU writes a 9P2000.u Tcreate message to w.
+func WriteTcreateU(w io.Writer, tag uint16, fid uint32, name string, perm uint32, mode uint8, extension string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.TcreateU(tag, fid, name, perm, mode, extension) })
+}
+
+// WriteRcreate writes an Rcreate message to w.
+func WriteRcreate(w io.Writer, tag uint16, qid Qid, iounit uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rcreate(tag, qid, iounit)
+		return nil
+	})
+}
+
+// WriteTread writes a Tread message to w.
+func WriteTread(w io.Writer, tag uint16, fid uint32, offset, count int64) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tread(tag, fid, offset, count) })
+}
+
+// WriteRread writes an Rread message to w.
+func WriteRread(w io.Writer, tag uint16, data []byte) (int, error) {
+	var n int
+	err := writeMsg(w, func(enc *Encoder) (err error) {
+		n, err = enc.Rread(tag, data)
+		return err
+	})
+	return n, err
+}
+
+// WriteTwrite writes a Twrite message to w.
+func WriteTwrite(w io.Writer, tag uint16, fid uint32, offset int64, data []byte) (int, error) {
+	var n int
+	err := writeMsg(w, func(enc *Encoder) (err error) {
+		n, err = enc.Twrite(tag, fid, offset, data)
+		return err
+	})
+	return n, err
+}
+
+// WriteRwrite writes an Rwrite message to w.
+func WriteRwrite(w io.Writer, tag uint16, count int64) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rwrite(tag, count)
+		return nil
+	})
+}
+
+// WriteTclunk writes a Tclunk message to w.
+func WriteTclunk(w io.Writer, tag uint16, fid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tclunk(tag, fid)
+		return nil
+	})
+}
+
+// WriteRclunk writes an Rclunk message to w.
+func WriteRclunk(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rclunk(tag)
+		return nil
+	})
+}
+
+// WriteTremove writes a Tremove message to w.
+func WriteTremove(w io.Writer, tag uint16, fid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tremove(tag, fid)
+		return nil
+	})
+}
+
+// WriteRremove writes an Rremove message to w.
+func WriteRremove(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rremove(tag)
+		return nil
+	})
+}
+
+// WriteTstat writes a Tstat message to w.
+func WriteTstat(w io.Writer, tag uint16, fid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tstat(tag, fid)
+		return nil
+	})
+}
+
+// WriteRstat writes an Rstat message to w.
+func WriteRstat(w io.Writer, tag uint16, stat Stat) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rstat(tag, stat)
+		return nil
+	})
+}
+
+// WriteTwstat writes a Twstat message to w.
+func WriteTwstat(w io.Writer, tag uint16, fid uint32, stat Stat) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Twstat(tag, fid, stat)
+		return nil
+	})
+}
+
+// WriteRwstat writes an Rwstat message to w.
+func WriteRwstat(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rwstat(tag)
+		return nil
+	})
+}
+
+// Messages from the 9P2000.L extension.
+
+// WriteRlerror writes an Rlerror message to w.
+func WriteRlerror(w io.Writer, tag uint16, ecode uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rlerror(tag, ecode)
+		return nil
+	})
+}
+
+// WriteTstatfs writes a Tstatfs message to w.
+func WriteTstatfs(w io.Writer, tag uint16, fid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tstatfs(tag, fid)
+		return nil
+	})
+}
+
+// WriteRstatfs writes an Rstatfs message to w.
+func WriteRstatfs(w io.Writer, tag uint16, st Statfs) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rstatfs(tag, st)
+		return nil
+	})
+}
+
+// WriteTlopen writes a Tlopen message to w.
+func WriteTlopen(w io.Writer, tag uint16, fid, flags uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tlopen(tag, fid, flags)
+		return nil
+	})
+}
+
+// WriteRlopen writes an Rlopen message to w.
+func WriteRlopen(w io.Writer, tag uint16, qid Qid, iounit uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rlopen(tag, qid, iounit)
+		return nil
+	})
+}
+
+// WriteTlcreate writes a Tlcreate message to w.
+func WriteTlcreate(w io.Writer, tag uint16, fid uint32, name string, flags, mode, gid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tlcreate(tag, fid, name, flags, mode, gid)
+		return nil
+	})
+}
+
+// WriteRlcreate writes an Rlcreate message to w.
+func WriteRlcreate(w io.Writer, tag uint16, qid Qid, iounit uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rlcreate(tag, qid, iounit)
+		return nil
+	})
+}
+
+// WriteTsymlink writes a Tsymlink message to w.
+func WriteTsymlink(w io.Writer, tag uint16, fid uint32, name, target string, gid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tsymlink(tag, fid, name, target, gid) })
+}
+
+// WriteRsymlink writes an Rsymlink message to w.
+func WriteRsymlink(w io.Writer, tag uint16, qid Qid) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rsymlink(tag, qid)
+		return nil
+	})
+}
+
+// WriteTmknod writes a Tmknod message to w.
+func WriteTmknod(w io.Writer, tag uint16, dfid uint32, name string, mode, major, minor, gid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tmknod(tag, dfid, name, mode, major, minor, gid)
+		return nil
+	})
+}
+
+// WriteRmknod writes an Rmknod message to w.
+func WriteRmknod(w io.Writer, tag uint16, qid Qid) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rmknod(tag, qid)
+		return nil
+	})
+}
+
+// WriteTrename writes a Trename message to w.
+func WriteTrename(w io.Writer, tag uint16, fid, dfid uint32, name string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Trename(tag, fid, dfid, name)
+		return nil
+	})
+}
+
+// WriteRrename writes an Rrename message to w.
+func WriteRrename(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rrename(tag)
+		return nil
+	})
+}
+
+// WriteTreadlink writes a Treadlink message to w.
+func WriteTreadlink(w io.Writer, tag uint16, fid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Treadlink(tag, fid)
+		return nil
+	})
+}
+
+// WriteRreadlink writes an Rreadlink message to w.
+func WriteRreadlink(w io.Writer, tag uint16, target string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Rreadlink(tag, target) })
+}
+
+// WriteTgetattr writes a Tgetattr message to w.
+func WriteTgetattr(w io.Writer, tag uint16, fid uint32, mask uint64) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tgetattr(tag, fid, mask)
+		return nil
+	})
+}
+
+// WriteRgetattr writes an Rgetattr message to w.
+func WriteRgetattr(w io.Writer, tag uint16, attr Attr) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rgetattr(tag, attr)
+		return nil
+	})
+}
+
+// WriteTsetattr writes a Tsetattr message to w.
+func WriteTsetattr(w io.Writer, tag uint16, fid uint32, attr SetAttr) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tsetattr(tag, fid, attr)
+		return nil
+	})
+}
+
+// WriteRsetattr writes an Rsetattr message to w.
+func WriteRsetattr(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rsetattr(tag)
+		return nil
+	})
+}
+
+// WriteTxattrwalk writes a Txattrwalk message to w.
+func WriteTxattrwalk(w io.Writer, tag uint16, fid, newfid uint32, name string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Txattrwalk(tag, fid, newfid, name)
+		return nil
+	})
+}
+
+// WriteRxattrwalk writes an Rxattrwalk message to w.
+func WriteRxattrwalk(w io.Writer, tag uint16, attrSize uint64) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rxattrwalk(tag, attrSize)
+		return nil
+	})
+}
+
+// WriteTxattrcreate writes a Txattrcreate message to w.
+func WriteTxattrcreate(w io.Writer, tag uint16, fid uint32, name string, attrSize uint64, flags uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Txattrcreate(tag, fid, name, attrSize, flags)
+		return nil
+	})
+}
+
+// WriteRxattrcreate writes an Rxattrcreate message to w.
+func WriteRxattrcreate(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rxattrcreate(tag)
+		return nil
+	})
+}
+
+// WriteTreaddir writes a Treaddir message to w.
+func WriteTreaddir(w io.Writer, tag uint16, fid uint32, offset uint64, count uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Treaddir(tag, fid, offset, count)
+		return nil
+	})
+}
+
+// WriteRreaddir writes an Rreaddir message to w.
+func WriteRreaddir(w io.Writer, tag uint16, data []byte) (int, error) {
+	var n int
+	err := writeMsg(w, func(enc *Encoder) (err error) {
+		n, err = enc.Rreaddir(tag, data)
+		return err
+	})
+	return n, err
+}
+
+// WriteTfsync writes a Tfsync message to w.
+func WriteTfsync(w io.Writer, tag uint16, fid, datasync uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tfsync(tag, fid, datasync)
+		return nil
+	})
+}
+
+// WriteRfsync writes an Rfsync message to w.
+func WriteRfsync(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rfsync(tag)
+		return nil
+	})
+}
+
+// WriteTlock writes a Tlock message to w.
+func WriteTlock(w io.Writer, tag uint16, fid uint32, ltype uint8, flags uint32, start, length uint64, procID uint32, clientID string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tlock(tag, fid, ltype, flags, start, length, procID, clientID) })
+}
+
+// WriteRlock writes an Rlock message to w.
+func WriteRlock(w io.Writer, tag uint16, status uint8) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rlock(tag, status)
+		return nil
+	})
+}
+
+// WriteTgetlock writes a Tgetlock message to w.
+func WriteTgetlock(w io.Writer, tag uint16, fid uint32, ltype uint8, start, length uint64, procID uint32, clientID string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tgetlock(tag, fid, ltype, start, length, procID, clientID) })
+}
+
+// WriteRgetlock writes an Rgetlock message to w.
+func WriteRgetlock(w io.Writer, tag uint16, ltype uint8, start, length uint64, procID uint32, clientID string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Rgetlock(tag, ltype, start, length, procID, clientID) })
+}
+
+// WriteTlink writes a Tlink message to w.
+func WriteTlink(w io.Writer, tag uint16, dfid, fid uint32, name string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tlink(tag, dfid, fid, name)
+		return nil
+	})
+}
+
+// WriteRlink writes an Rlink message to w.
+func WriteRlink(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rlink(tag)
+		return nil
+	})
+}
+
+// WriteTmkdir writes a Tmkdir message to w.
+func WriteTmkdir(w io.Writer, tag uint16, dfid uint32, name string, mode, gid uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tmkdir(tag, dfid, name, mode, gid)
+		return nil
+	})
+}
+
+// WriteRmkdir writes an Rmkdir message to w.
+func WriteRmkdir(w io.Writer, tag uint16, qid Qid) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rmkdir(tag, qid)
+		return nil
+	})
+}
+
+// WriteTrenameat writes a Trenameat message to w.
+func WriteTrenameat(w io.Writer, tag uint16, olddirfid uint32, oldname string, newdirfid uint32, newname string) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Trenameat(tag, olddirfid, oldname, newdirfid, newname)
+		return nil
+	})
+}
+
+// WriteRrenameat writes an Rrenameat message to w.
+func WriteRrenameat(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rrenameat(tag)
+		return nil
+	})
+}
+
+// WriteTunlinkat writes a Tunlinkat message to w.
+func WriteTunlinkat(w io.Writer, tag uint16, dirfid uint32, name string, flags uint32) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tunlinkat(tag, dirfid, name, flags)
+		return nil
+	})
+}
+
+// WriteRunlinkat writes an Runlinkat message to w.
+func WriteRunlinkat(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Runlinkat(tag)
+		return nil
+	})
+}
+
+// Messages from the 9P2000.e extension.
+
+// WriteTsession writes a Tsession message to w.
+func WriteTsession(w io.Writer, tag uint16, key uint64) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Tsession(tag, key)
+		return nil
+	})
+}
+
+// WriteRsession writes an Rsession message to w.
+func WriteRsession(w io.Writer, tag uint16) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rsession(tag)
+		return nil
+	})
+}
+
+// WriteTsread writes a Tsread message to w.
+func WriteTsread(w io.Writer, tag uint16, fid uint32, wname ...string) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tsread(tag, fid, wname...) })
+}
+
+// WriteRsread writes an Rsread message to w.
+func WriteRsread(w io.Writer, tag uint16, data []byte) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Rsread(tag, data) })
+}
+
+// WriteTswrite writes a Tswrite message to w.
+func WriteTswrite(w io.Writer, tag uint16, fid uint32, wname []string, data []byte) error {
+	return writeMsg(w, func(enc *Encoder) error { return enc.Tswrite(tag, fid, wname, data) })
+}
+
+// WriteRswrite writes an Rswrite message to w.
+func WriteRswrite(w io.Writer, tag uint16, count int64) error {
+	return writeMsg(w, func(enc *Encoder) error {
+		enc.Rswrite(tag, count)
+		return nil
+	})
+}
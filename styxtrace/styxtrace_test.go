@@ -0,0 +1,76 @@
+package styxtrace
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+func TestDecoder(t *testing.T) {
+	var input bytes.Buffer
+	enc := styxproto.NewEncoder(&input)
+	enc.Tversion(8192, "9P2000")
+	enc.Twrite(1, 1, 0, []byte("hello, world"))
+	enc.Flush()
+	want := append([]byte(nil), input.Bytes()...)
+
+	var raw bytes.Buffer
+	var events []Event
+	tr := Tracer{Raw: true, Func: func(ev Event) {
+		raw.Write(ev.Raw)
+		ev.Raw = nil
+		events = append(events, ev)
+	}}
+	dec := tr.Decoder(&input)
+	var data []byte
+	for dec.Next() {
+		if m, ok := dec.Msg().(styxproto.Twrite); ok {
+			data, _ = ioutil.ReadAll(m)
+		}
+	}
+	if string(data) != "hello, world" {
+		t.Errorf("decoded Twrite data %q", data)
+	}
+	if !bytes.Equal(raw.Bytes(), want) {
+		t.Errorf("raw bytes differ from input:\n%x\n%x", raw.Bytes(), want)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for _, ev := range events {
+		if ev.Dir != Received || ev.Time.IsZero() || ev.Bytes != ev.Msg.Len() {
+			t.Errorf("bad event %+v", ev)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var mu sync.Mutex
+	var events []Event
+	done := make(chan struct{})
+	var output bytes.Buffer
+	enc := Encoder(&output, func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ev.Raw != nil {
+			t.Error("Raw set when not requested")
+		}
+		events = append(events, ev)
+		if _, ok := ev.Msg.(styxproto.Rclunk); ok {
+			close(done)
+		}
+	})
+	enc.Rversion(8192, "9P2000")
+	enc.Rclunk(1)
+	enc.Flush()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0].Dir != Sent || events[0].Bytes != 19 {
+		t.Errorf("bad events %+v", events)
+	}
+}
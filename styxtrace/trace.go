@@ -0,0 +1,150 @@
+// Package styxtrace provides tracing of sent and received 9P
+// messages.
+//
+// A Tracer wraps the styxproto.Decoder and styxproto.Encoder of a
+// connection, and reports every message that passes through them to
+// a callback, along with its direction, size and the time it was
+// seen. It is used to implement the TraceLog and Trace hooks of a
+// styx.Server, and can be used in the same way by clients and proxies.
+package styxtrace
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Direction tells whether a traced message was received or sent.
+type Direction int
+
+const (
+	// Received messages are read from a Decoder.
+	Received Direction = iota
+	// Sent messages are written to an Encoder.
+	Sent
+)
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// An Event describes a single traced message.
+type Event struct {
+	Dir Direction
+
+	// The time the message was read from or written to the
+	// connection.
+	Time time.Time
+
+	// The message. It is not copied; it should not be modified,
+	// and should not be accessed after the Func returns. The data
+	// of Twrite, Rread and similar messages should not be read
+	// from Msg; use Raw instead.
+	Msg styxproto.Msg
+
+	// The size of the message, in bytes.
+	Bytes int64
+
+	// If the Tracer's Raw field is set, Raw contains the complete
+	// message as it appears on the wire, including its data. Like
+	// Msg, it is only valid until the Func returns.
+	Raw []byte
+}
+
+// A Func is called for each traced message. It is called from
+// the goroutine reading or writing the connection, and should not
+// block.
+type Func func(Event)
+
+// A Tracer reports the messages passing through the Decoders and
+// Encoders it creates to a Func.
+type Tracer struct {
+	Func Func
+
+	// If Raw is true, the Raw field of each Event is set.
+	Raw bool
+}
+
+const kilobyte = 1 << 10
+
+// Decoder creates a new styxproto.Decoder that traces messages
+// received on r.
+//
+// The messages on r are parsed by a second, internal Decoder. So
+// that it can parse protocol extensions such as 9P2000.L, it adopts
+// the version proposed in the first Tversion message it sees.
+func (t *Tracer) Decoder(r io.Reader) *styxproto.Decoder {
+	rd, wr := io.Pipe()
+	decoderInput := styxproto.NewDecoderSize(r, 8*kilobyte)
+	decoderTrace := styxproto.NewDecoderSize(rd, 8*kilobyte)
+	go func() {
+		var buf bytes.Buffer
+		for decoderInput.Next() {
+			if m, ok := decoderInput.Msg().(styxproto.Tversion); ok {
+				decoderInput.Version = string(m.Version())
+			}
+			t.trace(&buf, wr, Received, decoderInput.Msg())
+		}
+		wr.Close()
+	}()
+	return decoderTrace
+}
+
+// Encoder creates a new styxproto.Encoder that traces messages
+// before writing them to w. Like Decoder, the internal Decoder
+// used to trace messages adopts the version in any Rversion
+// message written to the Encoder.
+func (t *Tracer) Encoder(w io.Writer) *styxproto.Encoder {
+	rd, wr := io.Pipe()
+	encoder := styxproto.NewEncoder(wr)
+	decoder := styxproto.NewDecoderSize(rd, 8*kilobyte)
+	go func() {
+		var buf bytes.Buffer
+		for decoder.Next() {
+			if m, ok := decoder.Msg().(styxproto.Rversion); ok {
+				decoder.Version = string(m.Version())
+			}
+			t.trace(&buf, w, Sent, decoder.Msg())
+		}
+	}()
+	return encoder
+}
+
+// trace reports m to the Tracer's Func and copies it to w. If the
+// raw bytes of m are wanted, they are collected in buf first.
+func (t *Tracer) trace(buf *bytes.Buffer, w io.Writer, dir Direction, m styxproto.Msg) {
+	ev := Event{Dir: dir, Time: time.Now(), Msg: m, Bytes: m.Len()}
+	if !t.Raw {
+		if t.Func != nil {
+			t.Func(ev)
+		}
+		styxproto.Write(w, m)
+		return
+	}
+	buf.Reset()
+	styxproto.Write(buf, m)
+	ev.Raw = buf.Bytes()
+	if t.Func != nil {
+		t.Func(ev)
+	}
+	w.Write(ev.Raw)
+}
+
+// Decoder creates a new styxproto.Decoder that calls fn for every
+// message received on r.
+func Decoder(r io.Reader, fn Func) *styxproto.Decoder {
+	t := Tracer{Func: fn}
+	return t.Decoder(r)
+}
+
+// Encoder creates a new styxproto.Encoder that calls fn for every
+// message before writing it to w.
+func Encoder(w io.Writer, fn Func) *styxproto.Encoder {
+	t := Tracer{Func: fn}
+	return t.Encoder(w)
+}
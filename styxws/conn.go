@@ -0,0 +1,228 @@
+package styxws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// WebSocket opcodes, from RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	finalBit = 0x80
+	maskBit  = 0x80
+
+	// Control frames carry at most 125 bytes of payload.
+	maxControlPayload = 125
+
+	// Status code sent in close frames, for a normal closure.
+	closeNormal = 1000
+)
+
+var (
+	errTextFrame    = errors.New("styxws: received text message")
+	errMasking      = errors.New("styxws: frame masking does not match peer role")
+	errControlFrame = errors.New("styxws: malformed control frame")
+	errFrameSize    = errors.New("styxws: frame too large")
+)
+
+// A conn is a net.Conn that reads and writes the payload of binary
+// WebSocket messages. Read and Write may be called concurrently
+// with each other, but not with themselves.
+type conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // clients mask the frames they send
+
+	// state of the frame being read
+	remain  int64
+	masked  bool
+	mask    [4]byte
+	maskPos int
+	rerr    error
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func newConn(nc net.Conn, br *bufio.Reader, client bool) *conn {
+	if br == nil {
+		br = bufio.NewReader(nc)
+	}
+	return &conn{Conn: nc, br: br, client: client}
+}
+
+// Read reads the payload of data frames. Control frames received
+// from the peer are handled, and a close frame ends the stream
+// with io.EOF.
+func (c *conn) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.nextFrame()
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		c.unmask(p[:n])
+	}
+	c.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *conn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads frame headers until it finds a data frame,
+// handling any control frames on the way.
+func (c *conn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0F
+	final := hdr[0]&finalBit != 0
+	c.masked = hdr[1]&maskBit != 0
+	if c.masked == c.client {
+		return errMasking
+	}
+	size := int64(hdr[1] &^ maskBit)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		if ext[0]&0x80 != 0 {
+			return errFrameSize
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opBinary, opContinuation:
+		c.remain = size
+		return nil
+	case opText:
+		c.writeClose(1003)
+		return errTextFrame
+	case opClose, opPing, opPong:
+	default:
+		return fmt.Errorf("styxws: unknown opcode %#x", opcode)
+	}
+
+	if !final || size > maxControlPayload {
+		return errControlFrame
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if c.masked {
+		c.unmask(payload)
+	}
+	switch opcode {
+	case opPing:
+		if err := c.writeFrame(opPong, payload); err != nil {
+			return err
+		}
+	case opClose:
+		c.writeClose(closeNormal)
+		return io.EOF
+	}
+	return nil
+}
+
+// Write sends p as a single binary message.
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *conn) writeFrame(opcode byte, p []byte) error {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, finalBit|opcode)
+	var lenMask byte
+	if c.client {
+		lenMask = maskBit
+	}
+	switch n := len(p); {
+	case n < 126:
+		buf = append(buf, lenMask|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, lenMask|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, lenMask|127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		buf = append(buf, ext[:]...)
+	}
+	if c.client {
+		mask := newMask()
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, p...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, p...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// writeClose sends a close frame with the given status code, once.
+func (c *conn) writeClose(code uint16) {
+	c.closeOnce.Do(func() {
+		var status [2]byte
+		binary.BigEndian.PutUint16(status[:], code)
+		c.writeFrame(opClose, status[:])
+	})
+}
+
+// Close sends a close frame, if one has not been sent, and closes
+// the underlying connection.
+func (c *conn) Close() error {
+	c.writeClose(closeNormal)
+	return c.Conn.Close()
+}
@@ -0,0 +1,30 @@
+package styxws
+
+import (
+	"context"
+	"net/url"
+
+	"aqwari.net/net/styx"
+)
+
+// DialWebsocket establishes a session with the 9P server at the ws
+// or wss URL in uri, using the settings of c. The session is made as
+// the user named in uri, if any, or as the current user. Paths given
+// to the methods of the returned ClientConn are relative to the root
+// of the server's file tree.
+func DialWebsocket(ctx context.Context, c *styx.Client, uri string) (*styx.ClientConn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	var user string
+	if u.User != nil {
+		user = u.User.Username()
+		u.User = nil
+	}
+	conn, err := Dial(ctx, u.String(), c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewClientConn(conn, user)
+}
@@ -0,0 +1,26 @@
+/*
+Package styxws carries 9P connections over WebSocket, so that 9P
+file servers can be reached from web browsers, and through HTTP
+proxies and load balancers.
+
+The 9P protocol stream is sent in binary WebSocket messages. Message
+boundaries carry no meaning; a 9P message may span several WebSocket
+messages, and a WebSocket message may hold several 9P messages. The
+client offers the "9p" subprotocol during the opening handshake, and
+the server accepts it if offered.
+
+A Listener is an http.Handler that accepts WebSocket connections, and
+a net.Listener that can be passed to the Serve method of a
+styx.Server:
+
+	ln := styxws.NewListener()
+	http.Handle("/9p", ln)
+	go http.ListenAndServe(":8080", nil)
+	srv := styx.Server{Handler: fs}
+	log.Fatal(srv.Serve(ln))
+
+Clients connect with DialWebsocket:
+
+	conn, err := styxws.DialWebsocket(ctx, &styx.Client{}, "ws://example.net:8080/9p")
+*/
+package styxws
@@ -0,0 +1,228 @@
+package styxws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Subprotocol is the WebSocket subprotocol offered by clients.
+const Subprotocol = "9p"
+
+// From RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errNotWebsocket = errors.New("styxws: not a websocket handshake")
+	errBadAccept    = errors.New("styxws: bad Sec-WebSocket-Accept from server")
+	errBadOrigin    = errors.New("styxws: request origin not allowed")
+)
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func newMask() [4]byte {
+	var mask [4]byte
+	rand.Read(mask[:])
+	return mask
+}
+
+// headerContains reports whether the comma-separated list of
+// tokens in the named header contains token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether r has no Origin header, or one naming
+// the host r was sent to. Browsers send the Origin header with every
+// WebSocket handshake, so this keeps pages on other sites from
+// reaching the server through their visitors' browsers.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade completes the server side of the WebSocket opening
+// handshake, and returns a connection carrying the 9P protocol
+// stream, which can be passed to the ServeConn method of a
+// styx.Server. If the request is not a valid WebSocket handshake,
+// Upgrade responds with an HTTP error and returns a non-nil error.
+// Requests whose Origin header names a host other than the one
+// they were sent to are rejected; use a Listener with a CheckOrigin
+// function to accept them.
+func Upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	return upgrade(w, r, sameOrigin)
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, errNotWebsocket.Error(), http.StatusBadRequest)
+		return nil, errNotWebsocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errNotWebsocket
+	}
+	if !checkOrigin(r) {
+		http.Error(w, errBadOrigin.Error(), http.StatusForbidden)
+		return nil, errBadOrigin
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot hijack connection", http.StatusInternalServerError)
+		return nil, errors.New("styxws: ResponseWriter is not a Hijacker")
+	}
+	nc, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+		rw.WriteString("Sec-WebSocket-Protocol: " + Subprotocol + "\r\n")
+	}
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return newConn(nc, rw.Reader, false), nil
+}
+
+// Dial opens a WebSocket connection to the ws or wss URL in uri,
+// and returns a connection carrying the 9P protocol stream, which
+// can be passed to the NewClientConn method of a styx.Client.
+// config is used for wss URLs, and may be nil.
+func Dial(ctx context.Context, uri string, config *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ws":
+		if port == "" {
+			port = "80"
+		}
+	case "wss":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return nil, fmt.Errorf("styxws: unsupported scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	// Abandon the handshakes if ctx is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-done:
+		}
+	}()
+	conn, err := handshake(nc, u, config)
+	if err != nil {
+		nc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func handshake(nc net.Conn, u *url.URL, config *tls.Config) (net.Conn, error) {
+	if u.Scheme == "wss" {
+		config = config.Clone()
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(nc, config)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		nc = tc
+	}
+	return clientHandshake(nc, u)
+}
+
+func clientHandshake(nc net.Conn, u *url.URL) (net.Conn, error) {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-Websocket-Key":      {key},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {Subprotocol},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("styxws: handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errBadAccept
+	}
+	return newConn(nc, br, true), nil
+}
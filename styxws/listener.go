@@ -0,0 +1,87 @@
+package styxws
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// A Listener accepts 9P connections made over WebSocket. It is an
+// http.Handler, which upgrades the requests it receives to WebSocket
+// connections, and a net.Listener, which returns them from Accept.
+type Listener struct {
+	// CheckOrigin, if not nil, is called with each handshake
+	// request, and the request is rejected if it returns false.
+	// If nil, requests whose Origin header names a host other
+	// than the one they were sent to are rejected, as by Upgrade.
+	CheckOrigin func(*http.Request) bool
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewListener returns a new Listener. It does not accept any
+// connections until it is registered with an HTTP server.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades r to a WebSocket connection, and hands it to a
+// caller of Accept. Requests that are not WebSocket handshakes are
+// answered with an HTTP error.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	checkOrigin := l.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	conn, err := upgrade(w, r, checkOrigin)
+	if err != nil {
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for and returns the next WebSocket connection. Once
+// the Listener is closed, Accept returns an error wrapping
+// net.ErrClosed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "websocket", Err: net.ErrClosed}
+	}
+}
+
+// Close stops the Listener from accepting connections. It does not
+// close the HTTP server the Listener is registered with, nor any
+// connections already accepted.
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns a placeholder address; the network address is that
+// of the HTTP server the Listener is registered with.
+func (l *Listener) Addr() net.Addr {
+	return addr{}
+}
+
+type addr struct{}
+
+func (addr) Network() string { return "websocket" }
+func (addr) String() string  { return "websocket" }
@@ -0,0 +1,151 @@
+package styxws
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aqwari.net/net/styx"
+)
+
+// serveDir serves the files in dir.
+func serveDir(dir string) styx.Handler {
+	return styx.HandlerFunc(func(s *styx.Session) {
+		for s.Next() {
+			req := s.Request()
+			name := filepath.Join(dir, filepath.FromSlash(req.Path()))
+			fi, err := os.Stat(name)
+			switch req := req.(type) {
+			case styx.Twalk:
+				req.Rwalk(fi, err)
+			case styx.Tstat:
+				req.Rstat(fi, err)
+			case styx.Topen:
+				if err != nil {
+					req.Ropen(nil, err)
+				} else if fi.IsDir() {
+					req.Ropen(ioutil.ReadDir(name))
+				} else {
+					req.Ropen(os.Open(name))
+				}
+			}
+		}
+	})
+}
+
+func TestWebsocket(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte(strings.Repeat("hello", 20000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener()
+	hs := httptest.NewServer(ln)
+	defer hs.Close()
+	srv := styx.Server{Handler: serveDir(dir)}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	uri := "ws://" + strings.TrimPrefix(hs.URL, "http://") + "/9p"
+	conn, err := DialWebsocket(ctx, &styx.Client{}, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := conn.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil || string(got) != strings.Repeat("hello", 20000) {
+		t.Errorf("read %d bytes, %v", len(got), err)
+	}
+	f.Close()
+	conn.Close()
+
+	srv.Close()
+	if err := <-done; err != styx.ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ln := NewListener()
+	hs := httptest.NewServer(ln)
+	defer hs.Close()
+	defer ln.Close()
+	resp, err := http.Get(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET got %s", resp.Status)
+	}
+	ctx := context.Background()
+	if conn, err := Dial(ctx, "ws://"+strings.TrimPrefix(hs.URL, "http://"), nil); err != nil {
+		t.Errorf("Dial: %v", err)
+	} else {
+		conn.Close()
+	}
+	if _, err := Dial(ctx, "http://"+strings.TrimPrefix(hs.URL, "http://"), nil); err == nil {
+		t.Error("Dial accepted http URL")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	ln := NewListener()
+	hs := httptest.NewServer(ln)
+	defer hs.Close()
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	handshake := func(origin string) int {
+		req, err := http.NewRequest("GET", hs.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tt := range []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{hs.URL, http.StatusSwitchingProtocols},
+		{"http://evil.example", http.StatusForbidden},
+	} {
+		if got := handshake(tt.origin); got != tt.want {
+			t.Errorf("handshake with Origin %q got status %d, want %d", tt.origin, got, tt.want)
+		}
+	}
+	ln.CheckOrigin = func(r *http.Request) bool { return true }
+	if got := handshake("http://evil.example"); got != http.StatusSwitchingProtocols {
+		t.Errorf("CheckOrigin did not allow handshake, got status %d", got)
+	}
+}
@@ -0,0 +1,179 @@
+package styx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+	"aqwari.net/net/styx/styxtrace"
+)
+
+// A TraceEvent describes a 9P message received or sent by a Server.
+type TraceEvent struct {
+	// The message. It is only valid until the TraceFunc returns.
+	Msg styxproto.Msg
+
+	// True for requests received from the client, false for
+	// responses sent to it.
+	Received bool
+
+	// The size of the message, in bytes.
+	Bytes int64
+
+	// For responses, the time since the request with the same tag
+	// was received. Zero for requests.
+	Latency time.Duration
+
+	// The user and file tree of the session the message belongs
+	// to, if any.
+	User, Access string
+
+	// The address of the client, if known.
+	RemoteAddr net.Addr
+}
+
+// A TraceFunc receives a TraceEvent for every message received or
+// sent by a Server. It is called from the goroutines reading and
+// writing the connection, and should not block.
+type TraceFunc func(TraceEvent)
+
+// A connTracer observes the messages on a connection, correlating
+// responses with their requests by tag, and reports them to the
+// server's TraceLog, Trace, and Metrics hooks.
+type connTracer struct {
+	srv  *Server
+	conn *conn
+
+	mu      sync.Mutex
+	pending map[uint16]tracedRequest
+	flushes map[uint16]uint16 // Tflush tags to old tags
+}
+
+type tracedRequest struct {
+	msgType      string
+	start        time.Time
+	user, access string
+}
+
+func newConnTracer(srv *Server, c *conn) *connTracer {
+	return &connTracer{
+		srv:     srv,
+		conn:    c,
+		pending: make(map[uint16]tracedRequest),
+		flushes: make(map[uint16]uint16),
+	}
+}
+
+// session returns the user and file tree of the session that m
+// belongs to.
+func (tr *connTracer) session(m styxproto.Msg) (user, access string) {
+	switch m := m.(type) {
+	case styxproto.Tauth:
+		return string(m.Uname()), tr.conn.access(string(m.Aname()))
+	case styxproto.Tattach:
+		return string(m.Uname()), tr.conn.access(string(m.Aname()))
+	case fcall:
+		if s, ok := tr.conn.sessionByFid(m.Fid()); ok {
+			return s.User, s.Access
+		}
+	}
+	return "", ""
+}
+
+// received is called for each message received from the client.
+func (tr *connTracer) received(ev styxtrace.Event) {
+	m := ev.Msg
+	req := tracedRequest{msgType: msgType(m), start: ev.Time}
+	req.user, req.access = tr.session(m)
+	tr.mu.Lock()
+	tr.pending[m.Tag()] = req
+	if m, ok := m.(styxproto.Tflush); ok {
+		tr.flushes[m.Tag()] = m.Oldtag()
+	}
+	tr.mu.Unlock()
+
+	if tr.srv.TraceLog != nil {
+		tr.srv.TraceLog.Printf("→ %03d %s", m.Tag(), m)
+	}
+	if tr.srv.Trace != nil {
+		tr.srv.Trace(TraceEvent{
+			Msg:        m,
+			Received:   true,
+			Bytes:      ev.Bytes,
+			User:       req.user,
+			Access:     req.access,
+			RemoteAddr: tr.conn.remoteAddr(),
+		})
+	}
+	if metrics := tr.srv.Metrics; metrics != nil {
+		metrics.BytesIn(ev.Bytes)
+		metrics.RequestStarted(req.msgType)
+	}
+}
+
+// sent is called for each message sent to the client.
+func (tr *connTracer) sent(ev styxtrace.Event) {
+	m := ev.Msg
+	req, ok := tr.finish(m.Tag())
+	var latency time.Duration
+	if ok {
+		latency = ev.Time.Sub(req.start)
+	}
+	if tr.srv.TraceLog != nil {
+		tr.srv.TraceLog.Printf("← %03d %s (%s)", m.Tag(), m, latency)
+	}
+	if tr.srv.Trace != nil {
+		tr.srv.Trace(TraceEvent{
+			Msg:        m,
+			Bytes:      ev.Bytes,
+			Latency:    latency,
+			User:       req.user,
+			Access:     req.access,
+			RemoteAddr: tr.conn.remoteAddr(),
+		})
+	}
+	if metrics := tr.srv.Metrics; metrics != nil {
+		metrics.BytesOut(ev.Bytes)
+		if ok {
+			metrics.RequestFinished(req.msgType, latency, responseError(m))
+		}
+	}
+
+	// From flush(5), the server does not respond to a flushed
+	// request once it sends the Rflush.
+	if _, ok := m.(styxproto.Rflush); ok {
+		tr.mu.Lock()
+		oldtag, ok := tr.flushes[m.Tag()]
+		delete(tr.flushes, m.Tag())
+		tr.mu.Unlock()
+		if !ok {
+			return
+		}
+		if req, ok := tr.finish(oldtag); ok && tr.srv.Metrics != nil {
+			tr.srv.Metrics.RequestFinished(req.msgType, time.Since(req.start), context.Canceled)
+		}
+	}
+}
+
+func (tr *connTracer) finish(tag uint16) (tracedRequest, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	req, ok := tr.pending[tag]
+	delete(tr.pending, tag)
+	return req, ok
+}
+
+// responseError returns the error carried by an error response,
+// or nil for any other message.
+func responseError(m styxproto.Msg) error {
+	switch m := m.(type) {
+	case styxproto.Rerror:
+		return Error{Msg: string(m.Ename()), Errno: m.Errno()}
+	case styxproto.Rlerror:
+		return Error{Msg: fmt.Sprintf("error %d", m.Ecode()), Errno: m.Ecode()}
+	}
+	return nil
+}
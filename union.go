@@ -0,0 +1,211 @@
+package styx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// Union overlays several handlers on the same file tree, much like
+// binding directories on top of each other in Plan 9. Each request
+// is tried on the handlers from left to right, until one of them
+// answers it successfully:
+//
+//   - A file is looked up in each handler in turn, so files in
+//     earlier handlers hide files of the same name in later ones.
+//   - Reading a directory lists the files in that directory from
+//     every handler that has it, leaving out hidden files.
+//   - Requests that modify the tree, such as Tcreate, Tremove or
+//     Twstat, are carried out by the first handler that accepts
+//     them, so new files are created in the first writable handler.
+//
+// If every handler fails a request, the client receives the error
+// from the first handler that failed it. If no handler answers the
+// request at all, the documented default response is sent.
+//
+// As with Stack, a handler that returns before its session ends is
+// removed from the union.
+func Union(handlers ...Handler) Handler {
+	h := make([]Handler, len(handlers))
+	copy(h, handlers)
+	return union(h)
+}
+
+type union []Handler
+
+func (layers union) Serve9P(s *Session) {
+	running := s.startHandlers(layers)
+	for s.Next() {
+		req := s.Request()
+		if t, ok := req.(Topen); ok && isDir(t) {
+			openUnionDir(running, t)
+			continue
+		}
+		var first error
+		for i, sub := range running {
+			if sub == nil {
+				continue
+			}
+			a := new(attempt)
+			next, ok := sub.pass(req.WithContext(context.WithValue(req.Context(), attemptKey{}, a)))
+			if !ok {
+				running[i] = nil
+				if sub.req != nil && sub.req.handled() {
+					break
+				}
+			} else if next == nil {
+				break
+			}
+			if first == nil {
+				first = a.err
+			}
+		}
+		if !req.handled() && first != nil {
+			req.Rerror("%s", first)
+		}
+	}
+	stopHandlers(running)
+}
+
+// openUnionDir opens the directory named in t in every layer of a
+// union, and answers t with the merged directory.
+func openUnionDir(running []*Session, t Topen) {
+	var (
+		dir   unionDir
+		first error
+	)
+	for i, sub := range running {
+		if sub == nil {
+			continue
+		}
+		a := new(attempt)
+		c := new(openCapture)
+		ctx := context.WithValue(t.Context(), attemptKey{}, a)
+		ctx = context.WithValue(ctx, captureKey{}, c)
+		if _, ok := sub.pass(t.WithContext(ctx)); !ok {
+			running[i] = nil
+		}
+		if c.rwc == nil {
+			if first == nil {
+				first = a.err
+			}
+			continue
+		}
+		dir.files = append(dir.files, c.rwc)
+		if d, ok := styxfile.AsDirectory(c.rwc); ok {
+			dir.dirs = append(dir.dirs, d)
+		}
+	}
+	if len(dir.files) > 0 {
+		dir.seen = make(map[string]bool)
+		t.Ropen(&dir, nil)
+	} else if first != nil {
+		t.Rerror("%s", first)
+	}
+}
+
+func isDir(t Topen) bool {
+	qid := t.Qid()
+	return qid != nil && qid.Type()&styxproto.QTDIR != 0
+}
+
+// A unionDir lists the contents of the same directory in each
+// layer of a union, leaving out names already listed by an
+// earlier layer.
+type unionDir struct {
+	files []interface{}
+	dirs  []styxfile.Directory
+	seen  map[string]bool
+}
+
+func (d *unionDir) Readdir(n int) ([]os.FileInfo, error) {
+	var list []os.FileInfo
+	for len(d.dirs) > 0 && (n <= 0 || len(list) < n) {
+		want := n - len(list)
+		if n <= 0 {
+			want = -1
+		}
+		files, err := d.dirs[0].Readdir(want)
+		for _, fi := range files {
+			if !d.seen[fi.Name()] {
+				d.seen[fi.Name()] = true
+				list = append(list, fi)
+			}
+		}
+		if err != nil && err != io.EOF {
+			return list, err
+		}
+		if n <= 0 || err != nil || len(files) == 0 {
+			d.dirs = d.dirs[1:]
+		}
+	}
+	if n > 0 && len(list) == 0 {
+		return nil, io.EOF
+	}
+	return list, nil
+}
+
+func (d *unionDir) Close() error {
+	var first error
+	for _, f := range d.files {
+		if c, ok := f.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// An attempt holds the error from a request that is being tried
+// on one layer of a union. While a request is being tried, errors
+// are kept in its attempt instead of being sent to the client, so
+// that the request can be tried on the next layer.
+type attempt struct {
+	err error
+}
+
+type attemptKey struct{}
+
+// failAttempt records err as the result of an attempt, and reports
+// whether ctx belongs to a request that is being tried.
+func failAttempt(ctx context.Context, err error) bool {
+	a, ok := ctx.Value(attemptKey{}).(*attempt)
+	if ok {
+		a.err = err
+	}
+	return ok
+}
+
+// An openCapture holds a directory opened by one layer of a union,
+// so that it can be merged with the same directory in other layers.
+type openCapture struct {
+	rwc interface{}
+}
+
+type captureKey struct{}
+
+// captureOpen keeps rwc in the openCapture of ctx, if there is one.
+func captureOpen(ctx context.Context, rwc interface{}) bool {
+	c, ok := ctx.Value(captureKey{}).(*openCapture)
+	if ok {
+		c.rwc = rwc
+	}
+	return ok
+}
+
+// rerror builds the error described by the arguments of an Rerror
+// call. A lone error argument is kept as is, so that its error number
+// survives being passed on with Rerror("%s", err).
+func rerror(format string, args []interface{}) error {
+	if format == "%s" && len(args) == 1 {
+		if err, ok := args[0].(error); ok {
+			return err
+		}
+	}
+	return fmt.Errorf(format, args...)
+}
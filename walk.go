@@ -1,7 +1,6 @@
 package styx
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -111,6 +110,8 @@ Loop:
 			for i := len(w.found); i < cap(w.found); i++ {
 				if w.qids[i] != nil {
 					w.found = w.found[:i+1]
+				} else {
+					break
 				}
 			}
 			if w.count == len(w.qids) {
@@ -129,9 +130,13 @@ Loop:
 			w.session.conn.Rerror(w.tag, "No such file or directory")
 		}
 	} else {
-		w.session.files.Put(w.newfid, file{name: w.path})
-		w.session.conn.sessionFid.Put(w.newfid, w.session)
-		w.session.IncRef()
+		// From walk(5): if the walk does not succeed in full,
+		// newfid is unaffected.
+		if len(w.found) == len(w.qids) {
+			w.session.putFile(w.newfid, file{name: w.path})
+			w.session.conn.sessionFid.Put(w.newfid, w.session)
+			w.session.IncRef()
+		}
 		if err := w.session.conn.Rwalk(w.tag, w.found...); err != nil {
 			panic(err) // should never happen
 		}
@@ -154,9 +159,19 @@ Loop:
 // 	- Consecutive, related Twalk requests will differ by at
 // 	  most 1 path element.
 //
+// A ".." element walks to the parent directory. Walks never leave the
+// file tree of the session; walking to the parent of the root directory
+// leaves the client at the root, as in Plan 9. Handlers that want to
+// treat walks to a parent differently can check the Name field.
+//
 // The default response to a Twalk request is an Rerror message saying
 // "No such file or directory".
 type Twalk struct {
+	// Name is the path element being walked, as sent by the
+	// client. It is ".." when walking to the parent directory.
+	Name string
+
+	from  string // directory walked from
 	index int
 	walk  *walker
 	reqInfo
@@ -167,6 +182,12 @@ func (t Twalk) WithContext(ctx context.Context) Request {
 	return t
 }
 
+// dir returns the path of the directory walked from. It differs
+// from the parent of Path for walks to a parent.
+func (t Twalk) dir() string {
+	return t.view(t.from)
+}
+
 func (t Twalk) handled() bool {
 	return t.walk.filled[t.index] == 1
 }
@@ -177,17 +198,27 @@ func (t Twalk) handled() bool {
 // are sent to the client. If err is non-nil, an error response is sent to the
 // client instead.
 func (t Twalk) Rwalk(info os.FileInfo, err error) {
-	var qid styxproto.Qid
 	var mode os.FileMode
 	if err == nil {
 		mode = info.Mode()
-		fqid, found := t.session.conn.getQid(t.Path(), styxfile.QidType(styxfile.Mode9P(mode)))
-		if !found {
-			err = errors.New("rwalk did not find file")
-		} else {
-			qid = fqid
-		}
 	}
+	t.RwalkMode(mode, err)
+}
+
+// RwalkMode is like Rwalk, but only needs the mode of the file, for
+// handlers that know what type of file is at a path but have no
+// other information about it. Only the type bits of mode are used,
+// so os.ModeDir is enough to walk to a directory, and 0 to a regular
+// file.
+func (t Twalk) RwalkMode(mode os.FileMode, err error) {
+	if err != nil && failAttempt(t.ctx, err) {
+		return
+	}
+	var qid styxproto.Qid
+	if err == nil {
+		qid = t.session.conn.qid(t.path, styxfile.QidType(styxfile.Mode9P(mode)))
+	}
+	recordResult(t.ctx, err)
 	t.walk.filled[t.index] = 1
 	elem := walkElem{qid: qid, index: t.index, err: err}
 	select {
@@ -199,7 +230,7 @@ func (t Twalk) Rwalk(info os.FileInfo, err error) {
 // Rerror signals to the client that the file named by the Twalk's
 // Path method does not exist.
 func (t Twalk) Rerror(format string, args ...interface{}) {
-	t.Rwalk(nil, fmt.Errorf(format, args...))
+	t.RwalkMode(0, fmt.Errorf(format, args...))
 }
 
 func (t Twalk) defaultResponse() {
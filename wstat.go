@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -30,7 +32,8 @@ import (
 // complexity of the walk transaction; by generating multiple fake
 // requests for each attribute to be changed, and assembling the
 // responses. If any one of the responses are succesful, an Rwstat
-// is returned.
+// is returned, unless the StrictWstat option requires all of them
+// to be.
 //
 // Note that for certain synthetic messages, there will be some overlap
 // with certain 9P2000.u or 9P2000.L extensions (such as Trename).
@@ -49,8 +52,12 @@ func (t twstat) Rerror(format string, args ...interface{}) {
 }
 
 func (t twstat) respond(err error) {
+	if err != nil && failAttempt(t.ctx, err) {
+		return
+	}
 	p := &t.filled[t.index]
 	if atomic.CompareAndSwapInt32(p, 0, 1) {
+		recordResult(t.ctx, err)
 		t.status <- err
 	}
 }
@@ -59,10 +66,31 @@ func (t twstat) handled() bool {
 	return atomic.LoadInt32(&t.filled[t.index]) == 1
 }
 
+// The default response must go through respond, so that the
+// pending Twstat is answered.
+func (t twstat) defaultResponse() {
+	t.Rerror("permission denied")
+}
+
 func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file file) bool {
-	// mode, atime+mtime, length, name, uid+gid, sync
-	// we will ignore muid
-	const numMutable = 6
+	// A Twstat can only rename a file within its directory; see
+	// stat(5). Moving files elsewhere takes a 9P2000.L Trename.
+	if name := string(msg.Stat().Name()); strings.Contains(name, "/") || name == "." || name == ".." {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "invalid file name %q", name)
+		s.conn.Flush()
+		return true
+	}
+	if s.conn.srv.RawWstat {
+		s.requests <- Twstat{
+			Stat:    append(styxproto.Stat(nil), msg.Stat()...),
+			reqInfo: newReqInfo(ctx, s, msg, file.name),
+		}
+		return true
+	}
+
+	// mode, atime+mtime, length, name, uid+gid, muid, sync
+	const numMutable = 7
 
 	// By convention, sending a Twstat message with a stat structure consisting
 	// entirely of "don't touch" values indicates that the client wants the server
@@ -82,26 +110,31 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 	if atime != math.MaxUint32 || mtime != math.MaxUint32 {
 		haveChanges = true
 		s.requests <- Tutimes{
-			Atime:  time.Unix(int64(atime), 0),
-			Mtime:  time.Unix(int64(mtime), 0),
+			Atime:  wstatTime(atime),
+			Mtime:  wstatTime(mtime),
 			twstat: twstat{status, filled, messages, info},
 		}
 		messages++
 	}
-	if uid, gid := string(stat.Uid()), string(stat.Gid()); uid != "" || gid != "" {
+	uid, gid := string(stat.Uid()), string(stat.Gid())
+	nuid, ngid := stat.NUid(), stat.NGid()
+	if uid != "" || gid != "" || nuid != styxproto.NoUid || ngid != styxproto.NoUid {
 		haveChanges = true
 		s.requests <- Tchown{
 			User:   uid,
 			Group:  gid,
+			Uid:    numericID(nuid),
+			Gid:    numericID(ngid),
 			twstat: twstat{status, filled, messages, info},
 		}
 		messages++
 	}
-	if name := string(stat.Name()); name != "" && name != file.name {
+	if name := string(stat.Name()); name != "" && name != path.Base(file.name) {
 		haveChanges = true
 		s.requests <- Trename{
 			OldPath: file.name,
-			NewPath: name,
+			NewPath: path.Join(path.Dir(file.name), name),
+			newpath: path.Join(path.Dir(file.name), name),
 			twstat:  twstat{status, filled, messages, info},
 		}
 		messages++
@@ -110,6 +143,7 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 		haveChanges = true
 		s.requests <- Ttruncate{
 			Size:   length,
+			file:   file.rwc,
 			twstat: twstat{status, filled, messages, info},
 		}
 		messages++
@@ -122,10 +156,13 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 		}
 		messages++
 	}
-	if len(stat.Muid()) != 0 {
-		// even though we won't respond to this field, we don't
-		// want to needlessly stimulate a sync request
+	if muid := string(stat.Muid()); muid != "" {
 		haveChanges = true
+		s.requests <- Tmuid{
+			Muid:   muid,
+			twstat: twstat{status, filled, messages, info},
+		}
+		messages++
 	}
 	if !haveChanges {
 		s.requests <- Tsync{
@@ -134,41 +171,82 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 		messages++
 	}
 
-	go func() {
-		var (
-			success bool
-			err     error
-		)
-		for i := 0; i < messages; i++ {
-			if e, ok := <-status; !ok {
-				panic("closed Twstat channel prematurely")
-			} else if e != nil {
-				err = e
-			} else {
-				success = true
-			}
-		}
-		if !s.conn.clearTag(msg.Tag()) {
-			return
-		}
-		if success {
-			s.conn.Rwstat(msg.Tag())
+	go s.collectWstat(msg, msg.Tag(), status, messages)
+	return true
+}
+
+// collectWstat waits for the responses to the requests synthesized
+// from msg, and answers msg once all of them are in. Unless the
+// StrictWstat option of the Server is set, one successful response
+// is enough for msg to succeed. In addition to
+// Twstat, it is used for the 9P2000.L messages that are translated
+// into the same requests. The contents of msg may be overwritten
+// by the time the responses are in, so its tag is passed separately,
+// and msg is only consulted for its type.
+func (s *Session) collectWstat(msg styxproto.Msg, tag uint16, status chan error, messages int) {
+	var (
+		success bool
+		err     error
+	)
+	for i := 0; i < messages; i++ {
+		if e, ok := <-status; !ok {
+			panic("closed Twstat channel prematurely")
+		} else if e != nil {
+			err = e
 		} else {
-			s.conn.Rerror(msg.Tag(), "%s", err)
+			success = true
 		}
+	}
+	if !s.conn.clearTag(tag) {
+		return
+	}
+	if (!success && messages > 0) || (err != nil && s.conn.srv.StrictWstat) {
+		s.conn.Rerror(tag, "%s", err)
 		s.conn.Flush()
-	}()
+		return
+	}
+	switch msg.(type) {
+	case styxproto.Tsetattr:
+		s.conn.Rsetattr(tag)
+	case styxproto.Trename:
+		s.conn.Rrename(tag)
+	case styxproto.Trenameat:
+		s.conn.Rrenameat(tag)
+	case styxproto.Tfsync:
+		s.conn.Rfsync(tag)
+	default:
+		s.conn.Rwstat(tag)
+	}
+	s.conn.Flush()
+}
 
-	return true
+// Numeric ids are only present in 9P2000.u stat structures.
+func numericID(id uint32) int {
+	if id == styxproto.NoUid {
+		return -1
+	}
+	return int(id)
+}
+
+// The maximum value of a time field means "don't touch", and
+// is translated to the zero time.
+func wstatTime(t uint32) time.Time {
+	if t == math.MaxUint32 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t), 0)
 }
 
 // A Trename message is sent by the client to change the name of
-// an existing file. Use the Rrename method to indicate success.
+// an existing file. Both OldPath and NewPath are absolute paths; a
+// client using the 9P2000.L extension may move a file to another
+// directory. Use the Rrename method to indicate success.
 //
 // The default response for a Trename request is an Rerror message
 // saying "permission denied"
 type Trename struct {
 	OldPath, NewPath string
+	newpath          string // NewPath as the client sees it
 	twstat
 }
 
@@ -187,15 +265,8 @@ func (t Trename) Path() string {
 // Rrename is called with a nil error, future stat requests should
 // reflect the updated name.
 func (t Trename) Rrename(err error) {
-	// BUG(droyo) renaming a file with one fid will break Twalk
-	// requests that attempt to clone another fid pointing to the
-	// same file.
 	if err == nil {
-		t.session.qidpool.Do(func(m map[interface{}]interface{}) {
-			if qid, ok := m[t.OldPath]; ok {
-				m[t.NewPath] = qid
-			}
-		})
+		t.session.renamed(t.path, t.newpath)
 	}
 	t.respond(err)
 }
@@ -221,8 +292,10 @@ func (t Tchmod) WithContext(ctx context.Context) Request {
 // file mode.
 func (t Tchmod) Rchmod(err error) { t.respond(err) }
 
-// A Tutimes message is sent by the client to change the modification
-// time of a file. Use the Rutime method to indicate success.
+// A Tutimes message is sent by the client to change the access and
+// modification times of a file. A zero time.Time value indicates that
+// the corresponding time should not be changed. Use the Rutimes method
+// to indicate success.
 //
 // The default response to a Tutimes message is an Rerror message
 // saying "permission denied"
@@ -239,7 +312,22 @@ func (t Tutimes) WithContext(ctx context.Context) Request {
 // Rutimes, when called with a nil error, indicates that the file
 // times were succesfully updated. Future stat requests should reflect
 // the new access and modification times.
-func (t Tutimes) Rutimes(err error) { t.respond(err) }
+func (t Tutimes) Rutimes(err error) {
+	if err == nil && !t.Atime.IsZero() {
+		t.session.setAtime(t.path, t.Atime)
+	}
+	t.respond(err)
+}
+
+// If the server tracks access times, requests that only change the
+// access time are recorded by the server.
+func (t Tutimes) defaultResponse() {
+	if t.session.conn.srv.TrackAtime && t.Mtime.IsZero() && !t.Atime.IsZero() {
+		t.Rutimes(nil)
+	} else {
+		t.Rerror("permission denied")
+	}
+}
 
 // A Tchown message is sent by the client to change the user and group
 // associated with a file. Use the Rchown method to indicate success.
@@ -265,13 +353,37 @@ func (t Tchown) WithContext(ctx context.Context) Request {
 // requests for the same file should reflect the changes.
 func (t Tchown) Rchown(err error) { t.respond(err) }
 
+// A Tmuid message is sent by the client to change the name of the
+// user who last modified a file. Use the Rmuid method to indicate
+// success.
+//
+// The default response to a Tmuid message is an Rerror message
+// saying "permission denied".
+type Tmuid struct {
+	Muid string
+	twstat
+}
+
+func (t Tmuid) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// Rmuid, when called with a nil error, indicates that the muid of the
+// file was changed to Muid. Future stat requests for the same file
+// should reflect the change.
+func (t Tmuid) Rmuid(err error) { t.respond(err) }
+
 // A Ttruncate requests for the size of a file to be changed. Use the Rtruncate
 // method to indicate success.
 //
-// The default response to a Ttruncate message is an Rerror message
-// saying "permission denied".
+// If the fid in the request refers to an open file that implements
+// the Truncate method of os.File, the default response to a
+// Ttruncate message is to call it. Otherwise, the default response
+// is an Rerror message saying "permission denied".
 type Ttruncate struct {
 	Size int64
+	file styxfile.Interface // nil if the fid is not open
 	twstat
 }
 
@@ -285,6 +397,16 @@ func (t Ttruncate) WithContext(ctx context.Context) Request {
 // the new file length.
 func (t Ttruncate) Rtruncate(err error) { t.respond(err) }
 
+func (t Ttruncate) defaultResponse() {
+	if t.file != nil {
+		if err := styxfile.Truncate(t.file, t.Size); err != styxfile.ErrNotSupported {
+			t.Rtruncate(err)
+			return
+		}
+	}
+	t.Rerror("permission denied")
+}
+
 // A Tsync request is made by the client to indicate that the client would
 // like any changes made to the file to be flushed to durable storage. Use
 // the Rsync method to indicate success.
@@ -307,3 +429,75 @@ func (t Tsync) WithContext(ctx context.Context) Request {
 func (t Tsync) Rsync(err error) { t.respond(err) }
 
 func (t Tsync) defaultResponse() { t.Rerror("not supported") }
+
+// renamed updates the server's records of the file at oldpath, and
+// of the fids of the session that refer to it, once it is renamed
+// to newpath.
+func (s *Session) renamed(oldpath, newpath string) {
+	s.qidpool.Do(func(m map[interface{}]interface{}) {
+		if qid, ok := m[oldpath]; ok {
+			m[newpath] = qid
+		}
+	})
+	if atime, ok := s.conn.srv.atimes.Load(s.atimeKey(oldpath)); ok {
+		s.conn.srv.atimes.Delete(s.atimeKey(oldpath))
+		s.conn.srv.atimes.Store(s.atimeKey(newpath), atime)
+	}
+	// Other fids in any session on the connection may point to
+	// the renamed file or its children, if they are in the same
+	// file tree.
+	for _, other := range s.conn.sessions() {
+		if other.Access != s.Access {
+			continue
+		}
+		other.files.Do(func(m map[interface{}]interface{}) {
+			for fid, v := range m {
+				f := v.(file)
+				if f.name == oldpath || strings.HasPrefix(f.name, oldpath+"/") {
+					newname := newpath + strings.TrimPrefix(f.name, oldpath)
+					s.conn.refs.move(f.name, newname)
+					f.name = newname
+					m[fid] = f
+				}
+			}
+		})
+	}
+}
+
+// A Twstat request asks for any of the attributes of a file in Stat
+// to be changed. Twstat requests are only passed to handlers when
+// the RawWstat option of the Server is set; otherwise they are split
+// into Tutimes, Tchown, Tmuid, Trename, Ttruncate, Tchmod and Tsync
+// requests. Fields of Stat that are not to be changed hold the
+// "don't touch" values described in stat(5), and a Stat in which
+// every field holds them asks for the file to be synced to durable
+// storage. All changes must succeed or fail together. Use the Rwstat
+// method to indicate success.
+//
+// The default response to a Twstat message is an Rerror message
+// saying "permission denied".
+type Twstat struct {
+	Stat styxproto.Stat
+	reqInfo
+}
+
+func (t Twstat) WithContext(ctx context.Context) Request {
+	t.ctx = ctx
+	return t
+}
+
+// Rwstat, when called with a nil error, indicates that every change
+// in Stat was made. If the name of the file was changed, future
+// requests refer to it by its new name.
+func (t Twstat) Rwstat(err error) {
+	if err != nil {
+		t.Rerror("%s", err)
+		return
+	}
+	if name := string(t.Stat.Name()); name != "" && name != path.Base(t.path) {
+		t.session.renamed(t.path, path.Join(path.Dir(t.path), name))
+	}
+	if t.respond(nil) {
+		t.session.conn.Rwstat(t.tag)
+	}
+}